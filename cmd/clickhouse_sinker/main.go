@@ -55,12 +55,18 @@ type CmdOptions struct {
 	ConsulRegister                       bool
 	ConsulAddr                           string
 	ConsulDeregisterCriticalServiceAfter string
+	ConsulKVKey                          string
 	NacosRegister                        bool
 	NacosAddr                            string
 	NacosNamespaceID                     string
 	NacosGroup                           string
 	NacosUsername                        string
 	NacosPassword                        string
+	EtcdRegister                         bool
+	EtcdEndpoints                        string
+	EtcdPrefix                           string
+	EtcdUsername                         string
+	EtcdPassword                         string
 }
 
 var (
@@ -83,12 +89,18 @@ func initCmdOptions() {
 		ConsulRegister:                       false,
 		ConsulAddr:                           "http://127.0.0.1:8500",
 		ConsulDeregisterCriticalServiceAfter: "30m",
+		ConsulKVKey:                          config.ConsulKVKey,
 		NacosRegister:                        false,
 		NacosAddr:                            "127.0.0.1:8848",
 		NacosNamespaceID:                     "",
 		NacosGroup:                           "DEFAULT_GROUP",
 		NacosUsername:                        "nacos",
 		NacosPassword:                        "nacos",
+		EtcdRegister:                         false,
+		EtcdEndpoints:                        "127.0.0.1:2379",
+		EtcdPrefix:                           config.EtcdPrefix,
+		EtcdUsername:                         "",
+		EtcdPassword:                         "",
 	}
 
 	// 2. Replace options with the corresponding env variable if present.
@@ -101,6 +113,7 @@ func initCmdOptions() {
 	util.EnvBoolVar(&cmdOps.ConsulRegister, "consul-register-enable")
 	util.EnvStringVar(&cmdOps.ConsulAddr, "consul-addr")
 	util.EnvStringVar(&cmdOps.ConsulDeregisterCriticalServiceAfter, "consul-deregister-critical-services-after")
+	util.EnvStringVar(&cmdOps.ConsulKVKey, "consul-kv-key")
 
 	util.EnvBoolVar(&cmdOps.NacosRegister, "nacos-register-enable")
 	util.EnvStringVar(&cmdOps.NacosAddr, "nacos-addr")
@@ -109,6 +122,12 @@ func initCmdOptions() {
 	util.EnvStringVar(&cmdOps.NacosUsername, "nacos-username")
 	util.EnvStringVar(&cmdOps.NacosPassword, "nacos-password")
 
+	util.EnvBoolVar(&cmdOps.EtcdRegister, "etcd-register-enable")
+	util.EnvStringVar(&cmdOps.EtcdEndpoints, "etcd-endpoints")
+	util.EnvStringVar(&cmdOps.EtcdPrefix, "etcd-prefix")
+	util.EnvStringVar(&cmdOps.EtcdUsername, "etcd-username")
+	util.EnvStringVar(&cmdOps.EtcdPassword, "etcd-password")
+
 	// 3. Replace options with the corresponding CLI parameter if present.
 	flag.BoolVar(&cmdOps.ShowVer, "v", cmdOps.ShowVer, "show build version and quit")
 	flag.IntVar(&cmdOps.HTTPPort, "http-port", cmdOps.HTTPPort, "http listen port")
@@ -121,6 +140,7 @@ func initCmdOptions() {
 	flag.StringVar(&cmdOps.ConsulAddr, "consul-addr", cmdOps.ConsulAddr, "consul api interface address")
 	flag.StringVar(&cmdOps.ConsulDeregisterCriticalServiceAfter, "consul-deregister-critical-services-after", cmdOps.ConsulDeregisterCriticalServiceAfter,
 		"configure service check DeregisterCriticalServiceAfter")
+	flag.StringVar(&cmdOps.ConsulKVKey, "consul-kv-key", cmdOps.ConsulKVKey, "consul KV key under which the config is stored")
 
 	flag.BoolVar(&cmdOps.NacosRegister, "nacos-register-enable", cmdOps.NacosRegister, "register current instance in nacos")
 	flag.StringVar(&cmdOps.NacosAddr, "nacos-addr", cmdOps.NacosAddr, "a list of comma-separated nacos server addresses")
@@ -129,6 +149,12 @@ func initCmdOptions() {
 	flag.StringVar(&cmdOps.NacosGroup, "nacos-group", cmdOps.NacosGroup, `nacos group name. Empty string doesn't work!`)
 	flag.StringVar(&cmdOps.NacosUsername, "nacos-username", cmdOps.NacosUsername, "nacos username")
 	flag.StringVar(&cmdOps.NacosPassword, "nacos-password", cmdOps.NacosPassword, "nacos password")
+
+	flag.BoolVar(&cmdOps.EtcdRegister, "etcd-register-enable", cmdOps.EtcdRegister, "register current instance in etcd")
+	flag.StringVar(&cmdOps.EtcdEndpoints, "etcd-endpoints", cmdOps.EtcdEndpoints, "a list of comma-separated etcd endpoints")
+	flag.StringVar(&cmdOps.EtcdPrefix, "etcd-prefix", cmdOps.EtcdPrefix, "etcd key prefix under which the config and instances are stored")
+	flag.StringVar(&cmdOps.EtcdUsername, "etcd-username", cmdOps.EtcdUsername, "etcd username")
+	flag.StringVar(&cmdOps.EtcdPassword, "etcd-password", cmdOps.EtcdPassword, "etcd password")
 	flag.Parse()
 }
 
@@ -149,7 +175,11 @@ func GenTask(cfg *config.Config, taskName string) (taskImpl *task.Service) {
 	ck := output.NewClickHouse(cfg, taskName)
 	pp := parser.NewParserPool(taskCfg.Parser, taskCfg.CsvFormat, taskCfg.Delimiter, []string{taskCfg.LayoutDate, taskCfg.LayoutDateTime, taskCfg.LayoutDateTime64})
 	var inputer input.Inputer
-	if taskCfg.Kafka != "" {
+	if taskCfg.RemoteWrite {
+		inputer = input.NewInputer(input.TypeRemoteWrite)
+	} else if taskCfg.Pulsar != "" {
+		inputer = input.NewInputer(input.TypePulsar)
+	} else if taskCfg.Kafka != "" {
 		inputer = input.NewInputer(taskCfg.KafkaClient)
 	}
 	taskImpl = task.NewTaskService(inputer, ck, pp, cfg, taskName)
@@ -172,6 +202,7 @@ func main() {
 			properties = make(map[string]interface{})
 			properties["consulAddr"] = cmdOps.ConsulAddr
 			properties["deregisterCriticalServiceAfter"] = cmdOps.ConsulDeregisterCriticalServiceAfter
+			properties["kvKey"] = cmdOps.ConsulKVKey
 		} else if cmdOps.NacosRegister {
 			rcm = &config.NacosConfManager{}
 			properties = make(map[string]interface{})
@@ -180,6 +211,13 @@ func main() {
 			properties["password"] = cmdOps.NacosPassword
 			properties["namespaceId"] = cmdOps.NacosNamespaceID
 			properties["group"] = cmdOps.NacosGroup
+		} else if cmdOps.EtcdRegister {
+			rcm = &config.EtcdConfManager{}
+			properties = make(map[string]interface{})
+			properties["endpoints"] = cmdOps.EtcdEndpoints
+			properties["prefix"] = cmdOps.EtcdPrefix
+			properties["username"] = cmdOps.EtcdUsername
+			properties["password"] = cmdOps.EtcdPassword
 		}
 		if rcm != nil {
 			if err := rcm.Init(properties); err != nil {
@@ -211,6 +249,8 @@ func main() {
 			mux.HandleFunc("/ready", health.Health.ReadyEndpoint) // GET /ready?full=1
 			mux.HandleFunc("/live", health.Health.LiveEndpoint)   // GET /live?full=1
 
+			mux.HandleFunc(input.RemoteWritePath, input.RemoteWriteHandler) // POST /api/v1/write?task=<name>
+
 			mux.HandleFunc("/debug/pprof/", pprof.Index)
 			mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
 			mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
@@ -229,6 +269,12 @@ func main() {
 	})
 }
 
+const (
+	// A paused task is restarted after a backoff inside [pauseInitialInterval/2, pauseMaxInterval).
+	pauseInitialInterval = 10 * time.Second
+	pauseMaxInterval     = 5 * time.Minute
+)
+
 // Sinker object maintains number of task for each partition
 type Sinker struct {
 	curCfg *config.Config
@@ -237,13 +283,29 @@ type Sinker struct {
 	rcm    config.RemoteConfManager
 	ctx    context.Context
 	cancel context.CancelFunc
+
+	pausedCh chan *task.Service    //tasks which paused themselves
+	resumeCh chan *task.Service    //paused tasks which are due to restart
+	pauses   map[string]*taskPause //task name => backoff of restarting
+}
+
+type taskPause struct {
+	backoff   *util.Backoff
+	resumedAt time.Time
 }
 
 // NewSinker get an instance of sinker with the task list
 func NewSinker(rcm config.RemoteConfManager) *Sinker {
 	parent := context.Background()
 	ctx, cancel := context.WithCancel(parent)
-	s := &Sinker{rcm: rcm, ctx: ctx, cancel: cancel}
+	s := &Sinker{
+		rcm:      rcm,
+		ctx:      ctx,
+		cancel:   cancel,
+		pausedCh: make(chan *task.Service),
+		resumeCh: make(chan *task.Service),
+		pauses:   make(map[string]*taskPause),
+	}
 	return s
 }
 
@@ -265,52 +327,162 @@ func (s *Sinker) Run() {
 		go s.pusher.Run(s.ctx)
 	}
 	if s.rcm == nil {
+		var cfgPath string
+		var isDir bool
 		if _, err = os.Stat(cmdOps.LocalCfgFile); err == nil {
-			if newCfg, err = config.ParseLocalCfgFile(cmdOps.LocalCfgFile); err != nil {
-				log.Fatalf("%+v", err)
-				return
-			}
-		} else if _, err = os.Stat(cmdOps.LocalCfgFile); err == nil {
-			if newCfg, err = config.ParseLocalCfgDir(cmdOps.LocalCfgDir); err != nil {
-				log.Fatalf("%+v", err)
-				return
-			}
+			cfgPath = cmdOps.LocalCfgFile
+		} else if _, err = os.Stat(cmdOps.LocalCfgDir); err == nil {
+			cfgPath, isDir = cmdOps.LocalCfgDir, true
 		} else {
 			log.Fatalf("expect --local-cfg-file or --local-cfg-dir")
 			return
 		}
-		if err = newCfg.Normallize(); err != nil {
+		if newCfg, err = loadLocalConfig(cfgPath, isDir); err != nil {
 			log.Fatalf("%+v", err)
 			return
 		}
-		// Assign all tasks to myself.
-		newCfg.AssignTasks([]config.Instance{{Addr: selfAddr, Weight: 1}})
 		if err = s.applyConfig(newCfg); err != nil {
 			log.Fatalf("%+v", err)
 			return
 		}
-		<-s.ctx.Done()
+		// Reload on changes of the local config. A broken config is reported and skipped, the running tasks are kept.
+		var watcher *config.LocalConfWatcher
+		if watcher, err = config.NewLocalConfWatcher(cfgPath, isDir); err != nil {
+			log.Errorf("failed to watch %s, hot reload is disabled. %+v", cfgPath, err)
+			for s.waitForChange(nil, 0) {
+			}
+			return
+		}
+		notify := watcher.Watch(s.ctx)
+		for s.waitForChange(notify, 0) {
+			log.Infof("detected changes of %s, reloading", cfgPath)
+			if newCfg, err = loadLocalConfig(cfgPath, isDir); err != nil {
+				log.Errorf("failed to reload %s, keep the current config. %+v", cfgPath, err)
+				continue
+			}
+			if err = s.applyConfig(newCfg); err != nil {
+				log.Errorf("failed to apply the reloaded %s, the running tasks are kept. %+v", cfgPath, err)
+				continue
+			}
+		}
 	} else {
-		for {
+		// Reload as soon as the backend notifies a change if it supports watching, and poll periodically anyway.
+		var notify <-chan struct{}
+		if watcher, ok := s.rcm.(config.ConfWatcher); ok {
+			notify = watcher.Watch(s.ctx)
+		}
+		for s.waitForChange(notify, 5*time.Second) {
+			if newCfg, err = s.rcm.GetConfig(); err != nil {
+				log.Fatalf("%+v", err)
+				return
+			}
+			if err = newCfg.Normallize(); err != nil {
+				log.Fatalf("%+v", err)
+				return
+			}
+			if err = s.applyConfig(newCfg); err != nil {
+				log.Errorf("failed to apply the config, the running tasks are kept. %+v", err)
+				continue
+			}
+		}
+	}
+}
+
+// waitForChange restarts paused tasks until either notify fires or interval(if positive) elapses, i.e. the config may
+// have changed. It returns false once the sinker is closed.
+func (s *Sinker) waitForChange(notify <-chan struct{}, interval time.Duration) bool {
+	var timeout <-chan time.Time
+	if interval > 0 {
+		timeout = time.After(interval)
+	}
+	for {
+		select {
+		case <-s.ctx.Done():
+			return false
+		case <-notify:
+			return true
+		case <-timeout:
+			return true
+		case t := <-s.pausedCh:
+			s.scheduleResume(t)
+		case t := <-s.resumeCh:
+			s.resumeTask(t)
+		}
+	}
+}
+
+// runTask runs the task, and reports it to pausedCh if it pauses itself.
+func (s *Sinker) runTask(t *task.Service) {
+	go t.Run(s.ctx)
+	go func() {
+		select {
+		case <-t.Paused():
 			select {
+			case s.pausedCh <- t:
 			case <-s.ctx.Done():
-				return
-			case <-time.After(5 * time.Second):
-				if newCfg, err = s.rcm.GetConfig(); err != nil {
-					log.Fatalf("%+v", err)
-					return
-				}
-				if err = newCfg.Normallize(); err != nil {
-					log.Fatalf("%+v", err)
-					return
-				}
-				if err = s.applyConfig(newCfg); err != nil {
-					log.Fatalf("%+v", err)
-					return
-				}
 			}
+		case <-t.Exited():
+		case <-s.ctx.Done():
+		}
+	}()
+}
+
+// scheduleResume restarts the paused task after a backoff, which grows as long as the task pauses again soon after restart.
+func (s *Sinker) scheduleResume(t *task.Service) {
+	p := s.pauses[t.Name()]
+	if p == nil {
+		p = &taskPause{backoff: util.NewBackoff(pauseInitialInterval, pauseMaxInterval)}
+		s.pauses[t.Name()] = p
+	} else if time.Since(p.resumedAt) > pauseMaxInterval {
+		p.backoff.Reset()
+	}
+	delay := p.backoff.Next()
+	log.Warnf("%s: the task paused, going to restart it after %v", t.Name(), delay)
+	time.AfterFunc(delay, func() {
+		select {
+		case s.resumeCh <- t:
+		case <-s.ctx.Done():
 		}
+	})
+}
+
+// resumeTask restarts the paused task with the current config, unless the task has been replaced by a config change.
+// The restarted task consumes from the committed offsets, so the failed batch is written again.
+func (s *Sinker) resumeTask(t *task.Service) {
+	taskName := t.Name()
+	if s.tasks[taskName] != t {
+		return
+	}
+	log.Infof("%s: restarting the paused task", taskName)
+	s.pauses[taskName].resumedAt = time.Now()
+	// Stop the paused one first, so that the new one doesn't join the consumer group before the old member leaves.
+	t.Stop()
+	nt := GenTask(s.curCfg, taskName)
+	if err := nt.Init(); err != nil {
+		// Keep the stopped one in place, and retry later with a longer backoff.
+		log.Errorf("%s: failed to restart the paused task, got error %+v", taskName, err)
+		s.scheduleResume(t)
+		return
+	}
+	s.tasks[taskName] = nt
+	s.runTask(nt)
+}
+
+// loadLocalConfig parses and normalizes the local config, and assigns all tasks to myself.
+func loadLocalConfig(cfgPath string, isDir bool) (cfg *config.Config, err error) {
+	if isDir {
+		cfg, err = config.ParseLocalCfgDir(cfgPath)
+	} else {
+		cfg, err = config.ParseLocalCfgFile(cfgPath)
+	}
+	if err != nil {
+		return
+	}
+	if err = cfg.Normallize(); err != nil {
+		return
 	}
+	cfg.AssignTasks([]config.Instance{{Addr: selfAddr, Weight: 1}})
+	return
 }
 
 // Close shutdown tasks
@@ -377,7 +549,7 @@ func (s *Sinker) applyFirstConfig(newCfg *config.Config) (err error) {
 	util.InitGlobalWritingPool(totalConn)
 
 	for _, t := range s.tasks {
-		go t.Run(s.ctx)
+		s.runTask(t)
 	}
 	s.curCfg = newCfg
 	return
@@ -396,6 +568,7 @@ func (s *Sinker) applyAnotherConfig(newCfg *config.Config) (err error) {
 	// - task config differ
 	// - task clickhouse config differ
 	// - task kafka config differ
+	// - task pulsar config differ
 	var tasksToStop []string
 	if taskNames, ok := s.curCfg.Assignment[selfAddr]; ok {
 		for _, taskName := range taskNames {
@@ -417,6 +590,12 @@ func (s *Sinker) applyAnotherConfig(newCfg *config.Config) (err error) {
 					if !reflect.DeepEqual(newKfkCfg, curKfkCfg) {
 						needStop = true
 					}
+					pulsarName := curTaskCfg.Pulsar
+					curPulsarCfg := s.curCfg.Pulsar[pulsarName]
+					newPulsarCfg := newCfg.Pulsar[pulsarName]
+					if !reflect.DeepEqual(newPulsarCfg, curPulsarCfg) {
+						needStop = true
+					}
 				}
 			} else {
 				needStop = true
@@ -441,13 +620,16 @@ func (s *Sinker) applyAnotherConfig(newCfg *config.Config) (err error) {
 		}
 	}
 	// 3. Initailize all tasks which are new or their config differ.
+	// A task which fails to initialize is skipped, and retried at the next config change. Other tasks go on.
 	var newTasks []*task.Service
 	if taskNames, ok := newCfg.Assignment[selfAddr]; ok {
 		for _, taskName := range taskNames {
 			if _, ok2 := s.tasks[taskName]; !ok2 {
 				t := GenTask(newCfg, taskName)
-				if err = t.Init(); err != nil {
-					return
+				if initErr := t.Init(); initErr != nil {
+					err = errors.Wrapf(initErr, "task %s", taskName)
+					log.Errorf("%s: failed to initialize task, got error %+v", taskName, initErr)
+					continue
 				}
 				s.tasks[taskName] = t
 				newTasks = append(newTasks, t)
@@ -465,7 +647,7 @@ func (s *Sinker) applyAnotherConfig(newCfg *config.Config) (err error) {
 
 	// 5. Start new tasks. We don't do it at step 3 in order to avoid goroutine leak due to errors raised by later steps.
 	for _, t := range newTasks {
-		go t.Run(s.ctx)
+		s.runTask(t)
 	}
 
 	// 6. Record the new config.
@@ -16,10 +16,12 @@ limitations under the License.
 package config
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
 	"time"
@@ -45,6 +47,12 @@ type RemoteConfManager interface {
 	PublishConfig(conf *Config) (err error)
 }
 
+// ConfWatcher can be implemented by a RemoteConfManager whose backend supports change notification.
+type ConfWatcher interface {
+	// Watch returns a channel which receives a notification whenever the config or instances changes.
+	Watch(ctx context.Context) <-chan struct{}
+}
+
 type Instance struct {
 	Addr   string
 	Weight int
@@ -53,6 +61,7 @@ type Instance struct {
 // Config struct used for different configurations use
 type Config struct {
 	Kafka      map[string]*KafkaConfig
+	Pulsar     map[string]*PulsarConfig
 	Clickhouse map[string]*ClickHouseConfig
 	Tasks      map[string]*TaskConfig
 	Common     struct {
@@ -106,6 +115,22 @@ type KafkaConfig struct {
 	}
 }
 
+// PulsarConfig configuration parameters
+type PulsarConfig struct {
+	URL               string // pulsar://host1:6650,host2:6650 or pulsar+ssl://host1:6651
+	OperationTimeout  int    // in seconds, 0 means the client default
+	ConnectionTimeout int    // in seconds, 0 means the client default
+	TLS               struct {
+		Enable             bool
+		TrustCertsFile     string // It's the CA certificate with which Pulsar brokers certs be signed.
+		ClientCertFile     string // Required if Pulsar brokers require TLS authentication.
+		ClientKeyFile      string // Required if and only if ClientCertFile is present.
+		InsecureSkipVerify bool   // Whether disable broker FQDN verification.
+	}
+	// AuthToken is the JWT for token authentication. It takes precedence over TLS authentication.
+	AuthToken string
+}
+
 // ClickHouseConfig configuration parameters
 type ClickHouseConfig struct {
 	DB    string
@@ -116,6 +141,56 @@ type ClickHouseConfig struct {
 	Password   string
 	DsnParams  string
 	RetryTimes int //<=0 means retry infinitely
+
+	// InsertMode is how rows are inserted, `block`(default) appends rows into native column blocks directly,
+	// `stmt` executes the prepared statement row by row.
+	InsertMode string `json:"insertMode,omitempty"`
+
+	// Protocol is `native`(default) or `http`. For the latter, Port is the HTTP port, DsnParams and InsertMode are ignored,
+	// and batches are inserted in HTTPFormat, compressed with HTTPCompression. Settings are passed along with every query.
+	Protocol        string            `json:"protocol,omitempty"`
+	HTTPFormat      string            `json:"httpFormat,omitempty"`
+	HTTPCompression string            `json:"httpCompression,omitempty"`
+	Settings        map[string]string `json:"settings,omitempty"`
+
+	// TLS secures connections of both protocols. Port defaults to the secure port(9440 for native, 8443 for http) if it's absent.
+	TLS struct {
+		Enable             bool
+		CaCertFiles        string // Required. It's the CA certificate with which ClickHouse servers certs be signed.
+		ClientCertFile     string // Required if ClickHouse servers require client authentication.
+		ClientKeyFile      string // Required if and only if ClientCertFile is present.
+		InsecureSkipVerify bool   // Whether disable server FQDN verification.
+	} `json:"tls"`
+}
+
+// Values of ClickHouseConfig.InsertMode
+const (
+	InsertModeBlock = "block"
+	InsertModeStmt  = "stmt"
+)
+
+// Values of ClickHouseConfig.Protocol, HTTPFormat and HTTPCompression
+const (
+	ProtocolNative        = "native"
+	ProtocolHTTP          = "http"
+	HTTPFormatRowBinary   = "RowBinary"
+	HTTPFormatJSONEachRow = "JSONEachRow"
+	HTTPCompressionGzip   = "gzip"
+	HTTPCompressionNone   = "none"
+)
+
+// RouteConfig is a table other than the task's one. Rows of messages whose RouteField value is one of Values go to it.
+type RouteConfig struct {
+	Values         []string `json:"values"`
+	TableName      string   `json:"tableName"`
+	AutoSchema     bool     `json:"autoSchema,omitempty"`
+	ExcludeColumns []string `json:"excludeColumns,omitempty"`
+	Dims           []struct {
+		Name       string
+		Type       string
+		SourceName string
+		Expr       string
+	} `json:"dims,omitempty"`
 }
 
 // Task configuration parameters
@@ -127,12 +202,44 @@ type TaskConfig struct {
 	Topic         string
 	ConsumerGroup string
 
+	// Topics are consumed in addition to Topic. Topic is merged into Topics by Normallize.
+	Topics []string `json:"topics,omitempty"`
+	// TopicPattern is a regular expression, all topics matching it are consumed. It's exclusive with Topic and Topics.
+	TopicPattern string `json:"topicPattern,omitempty"`
+	// TopicRefreshInterval is how often(in seconds) topics matching TopicPattern are listed again, defaults to 60.
+	TopicRefreshInterval int `json:"topicRefreshInterval,omitempty"`
+
+	// Pulsar is the name of pulsar config. A task consumes from either Kafka or Pulsar.
+	Pulsar string `json:"pulsar,omitempty"`
+	// RemoteWrite makes the task receive Prometheus remote write requests at /api/v1/write?task=<name> of the http port,
+	// instead of consuming Kafka or Pulsar. It requires parser prometheus.
+	RemoteWrite bool `json:"remoteWrite,omitempty"`
+	// SubscriptionName is the pulsar subscription, defaults to ConsumerGroup
+	SubscriptionName string `json:"subscriptionName,omitempty"`
+	// SubscriptionType is one of exclusive, shared, failover(default) and key_shared
+	SubscriptionType string `json:"subscriptionType,omitempty"`
+
 	// Earliest set to true to consume the message from oldest position
 	Earliest bool
 	Parser   string
 	// the csv cloum title if Parser is csv
 	CsvFormat []string
 	Delimiter string
+	// ProtoDescriptor is a FileDescriptorSet file and ProtoMessage is the full name of the message type in it, for parser protobuf.
+	ProtoDescriptor string `json:"protoDescriptor,omitempty"`
+	ProtoMessage    string `json:"protoMessage,omitempty"`
+	// SchemaRegistry is the Schema Registry URL for messages in the Confluent wire format, or AvroSchemaFile is the schema file of
+	// plain messages, for parser avro.
+	SchemaRegistry string `json:"schemaRegistry,omitempty"`
+	AvroSchemaFile string `json:"avroSchemaFile,omitempty"`
+	// Pattern is the regular expression for parser regex, or the grok expression for parser grok. GrokPatterns is a file of
+	// extra grok patterns.
+	Pattern      string `json:"pattern,omitempty"`
+	GrokPatterns string `json:"grokPatterns,omitempty"`
+	// InfluxPrecision is the precision(ns, us, ms or s) of timestamps for parser influx. Defaults to ns.
+	InfluxPrecision string `json:"influxPrecision,omitempty"`
+	// Explode is the path of an array(dot separated, "$" for a message which is an array itself), each element of which becomes a row.
+	Explode string `json:"explode,omitempty"`
 
 	Clickhouse string
 	TableName  string
@@ -144,8 +251,39 @@ type TaskConfig struct {
 		Name       string
 		Type       string
 		SourceName string
+		// Expr computes the column from message fields instead of copying SourceName, see util.CompileExpr.
+		Expr string
 	} `json:"dims"`
 
+	// Filter is an expression evaluated against each parsed message, messages not matching it are committed without being written.
+	Filter string `json:"filter,omitempty"`
+
+	// RouteField decides which table rows of a message go to. Messages whose RouteField matches none of Routes go to TableName.
+	RouteField string         `json:"routeField,omitempty"`
+	Routes     []*RouteConfig `json:"routes,omitempty"`
+
+	// SchemaRefreshInterval is how often(in seconds) the schema is fetched again if AutoSchema is enabled. Defaults to 60, negative disables it.
+	SchemaRefreshInterval int `json:"schemaRefreshInterval,omitempty"`
+
+	// DynamicSchema adds a column for each new top-level field of messages. Requires AutoSchema and parser fastjson or gjson.
+	DynamicSchema struct {
+		Enable             bool
+		Cluster            string // cluster name for `ON CLUSTER`, empty means the table is not distributed among a cluster
+		DistTblName        string // the Distributed table on top of TableName, which is altered as well
+		MaxNewColumns      int    // at most how many columns are added per NewColumnsInterval
+		NewColumnsInterval int    // in seconds
+	} `json:"dynamicSchema,omitempty"`
+
+	// CreateTable creates the table(and the distributed one) from Dims if it doesn't exist.
+	CreateTable *CreateTableConfig `json:"createTable,omitempty"`
+
+	// ExactlyOnce inserts each batch with insert_deduplication_token derived from its offsets,
+	// so that a batch consumed again after a crash is deduplicated by ClickHouse. Kafka only.
+	ExactlyOnce struct {
+		Enable       bool
+		OffsetsTable string // optional, where offsets are stored before committing to Kafka, partitions resume from them on startup
+	} `json:"exactlyOnce,omitempty"`
+
 	// ShardingKey is the column name to which sharding against
 	ShardingKey string `json:"shardingKey,omitempty"`
 	// ShardingPolicy is `stripe,<interval>`(requires ShardingKey be numerical) or `hash`(requires ShardingKey be string)
@@ -159,6 +297,54 @@ type TaskConfig struct {
 	LayoutDateTime   string `json:"layoutDateTime,omitempty"`
 	LayoutDateTime64 string `json:"layoutDateTime64,omitempty"`
 	Replicas         int    //on how many sinker instances this task runs
+
+	// DeadLetter is where messages failed to parse go. Such messages are dropped if it's absent.
+	DeadLetter *DeadLetterConfig `json:"deadLetter,omitempty"`
+	// FailedBatchPolicy is how to handle a batch which failed to write due to data errors, or retries being exhausted.
+	// One of exit(default), pause-task, dead-letter-batch(requires DeadLetter) and skip.
+	FailedBatchPolicy string `json:"failedBatchPolicy,omitempty"`
+}
+
+// CreateTableConfig configuration parameters
+type CreateTableConfig struct {
+	Engine      string `json:"engine,omitempty"`  //defaults to MergeTree()
+	OrderBy     string `json:"orderBy,omitempty"` //defaults to tuple()
+	PartitionBy string `json:"partitionBy,omitempty"`
+	TTL         string `json:"ttl,omitempty"`
+	// Cluster is the cluster name for `ON CLUSTER`. The table is created on every shard if it's empty.
+	Cluster string `json:"cluster,omitempty"`
+	// DistTblName is the Distributed table to create on top of TableName, requires Cluster.
+	DistTblName string `json:"distTblName,omitempty"`
+	// DistShardingKey is the sharding key of the Distributed table, defaults to rand().
+	DistShardingKey string `json:"distShardingKey,omitempty"`
+}
+
+// Values of TaskConfig.FailedBatchPolicy
+const (
+	FailedBatchExit       = "exit"
+	FailedBatchPause      = "pause-task"
+	FailedBatchDeadLetter = "dead-letter-batch"
+	FailedBatchSkip       = "skip"
+)
+
+// DeadLetterConfig configuration parameters
+// Each record carries topic, partition, offset, key, raw value and the error text of the failed message.
+type DeadLetterConfig struct {
+	// Type is one of kafka, file and clickhouse
+	Type string `json:"type"`
+
+	// Kafka is the name of kafka config, defaults to the task's.
+	Kafka string `json:"kafka,omitempty"`
+	Topic string `json:"topic,omitempty"`
+
+	// File is the path of the local file. It's rotated once its size exceeds MaxFileSize(in MB).
+	File        string `json:"file,omitempty"`
+	MaxFileSize int    `json:"maxFileSize,omitempty"`
+	MaxBackups  int    `json:"maxBackups,omitempty"` //how many rotated files are kept
+
+	// Clickhouse is the name of clickhouse config, defaults to the task's.
+	Clickhouse string `json:"clickhouse,omitempty"`
+	TableName  string `json:"tableName,omitempty"`
 }
 
 const (
@@ -170,6 +356,14 @@ const (
 	defaultLayoutDateTime   = time.RFC3339
 	defaultLayoutDateTime64 = time.RFC3339
 	defaultTaskReplicas     = 1
+	defaultDeadLetterSize   = 100 //in MB
+	defaultDeadLetterBackup = 10
+	defaultMaxNewColumns    = 10
+	defaultNewColumnsIntv   = 60 //in seconds
+	defaultSchemaRefresh    = 60 //in seconds
+	defaultTopicRefresh     = 60 //in seconds
+	defaultSecurePortNative = 9440
+	defaultSecurePortHTTP   = 8443
 )
 
 func ParseLocalCfgDir(cfgPath string) (cfg *Config, err error) {
@@ -299,10 +493,68 @@ func (cfg *Config) Normallize() (err error) {
 			}
 		}
 	}
-	for _, chConfig := range cfg.Clickhouse {
+	for pulsarName, pulsarConfig := range cfg.Pulsar {
+		if pulsarConfig.URL == "" {
+			err = errors.Errorf("pulsar %s url is required", pulsarName)
+			return
+		}
+	}
+	for chName, chConfig := range cfg.Clickhouse {
 		if chConfig.RetryTimes < 0 {
 			chConfig.RetryTimes = 0
 		}
+		chConfig.InsertMode = strings.ToLower(chConfig.InsertMode)
+		switch chConfig.InsertMode {
+		case "":
+			chConfig.InsertMode = InsertModeBlock
+		case InsertModeBlock, InsertModeStmt:
+		default:
+			err = errors.Errorf("clickhouse %s insertMode %s is unsupported", chName, chConfig.InsertMode)
+			return
+		}
+		chConfig.Protocol = strings.ToLower(chConfig.Protocol)
+		switch chConfig.Protocol {
+		case "":
+			chConfig.Protocol = ProtocolNative
+		case ProtocolNative, ProtocolHTTP:
+		default:
+			err = errors.Errorf("clickhouse %s protocol %s is unsupported", chName, chConfig.Protocol)
+			return
+		}
+		switch strings.ToLower(chConfig.HTTPFormat) {
+		case "", strings.ToLower(HTTPFormatRowBinary):
+			chConfig.HTTPFormat = HTTPFormatRowBinary
+		case strings.ToLower(HTTPFormatJSONEachRow):
+			chConfig.HTTPFormat = HTTPFormatJSONEachRow
+		default:
+			err = errors.Errorf("clickhouse %s httpFormat %s is unsupported", chName, chConfig.HTTPFormat)
+			return
+		}
+		chConfig.HTTPCompression = strings.ToLower(chConfig.HTTPCompression)
+		switch chConfig.HTTPCompression {
+		case "":
+			chConfig.HTTPCompression = HTTPCompressionGzip
+		case HTTPCompressionGzip, HTTPCompressionNone:
+		default:
+			err = errors.Errorf("clickhouse %s httpCompression %s is unsupported", chName, chConfig.HTTPCompression)
+			return
+		}
+		if chConfig.TLS.Enable {
+			if chConfig.TLS.CaCertFiles == "" {
+				err = errors.Errorf("clickhouse %s tls caCertFiles is required", chName)
+				return
+			}
+			if (chConfig.TLS.ClientCertFile == "") != (chConfig.TLS.ClientKeyFile == "") {
+				err = errors.Errorf("clickhouse %s tls clientCertFile and clientKeyFile shall be present together", chName)
+				return
+			}
+			if chConfig.Port == 0 {
+				chConfig.Port = defaultSecurePortNative
+				if chConfig.Protocol == ProtocolHTTP {
+					chConfig.Port = defaultSecurePortHTTP
+				}
+			}
+		}
 	}
 	for instAddr, taskNames := range cfg.Assignment {
 		sort.Strings(taskNames)
@@ -318,7 +570,17 @@ func (cfg *Config) Normallize() (err error) {
 
 func (cfg *Config) normallizeTasks() (err error) {
 	for taskName, taskConfig := range cfg.Tasks {
-		if _, ok := cfg.Kafka[taskConfig.Kafka]; !ok {
+		if taskConfig.RemoteWrite {
+			if taskConfig.Kafka != "" || taskConfig.Pulsar != "" {
+				err = errors.Errorf("task %s config is invalid, remoteWrite is exclusive with kafka and pulsar", taskConfig.Name)
+				return
+			}
+		} else if taskConfig.Pulsar != "" {
+			if _, ok := cfg.Pulsar[taskConfig.Pulsar]; !ok {
+				err = errors.Errorf("task %s config is invalid, pulsar %s doesn't exist.", taskConfig.Name, taskConfig.Pulsar)
+				return
+			}
+		} else if _, ok := cfg.Kafka[taskConfig.Kafka]; !ok {
 			err = errors.Errorf("task %s config is invalid, kafka %s doesn't exist.", taskConfig.Name, taskConfig.Kafka)
 			return
 		}
@@ -329,12 +591,46 @@ func (cfg *Config) normallizeTasks() (err error) {
 		if taskConfig.Name != taskName {
 			taskConfig.Name = taskName
 		}
-		kfkCfg := cfg.Kafka[taskConfig.Kafka]
-		if kfkCfg.Sasl.Enable && kfkCfg.Sasl.Username == "" {
-			//kafka-go doesn't support SASL/GSSAPI(Kerberos). https://github.com/segmentio/kafka-go/issues/539
-			taskConfig.KafkaClient = "sarama"
-		} else if taskConfig.KafkaClient == "" {
-			taskConfig.KafkaClient = "kafka-go"
+		if taskConfig.RemoteWrite {
+			if taskConfig.Parser == "" {
+				taskConfig.Parser = "prometheus"
+			} else if taskConfig.Parser != "prometheus" {
+				err = errors.Errorf("task %s config is invalid, remoteWrite requires parser prometheus", taskConfig.Name)
+				return
+			}
+			if taskConfig.ExactlyOnce.Enable {
+				// Offsets of requests are assigned by the process, they're not stable across restarts.
+				err = errors.Errorf("task %s config is invalid, exactlyOnce is unsupported by remoteWrite", taskConfig.Name)
+				return
+			}
+		} else if err = normallizeTopics(taskConfig); err != nil {
+			return
+		}
+		if taskConfig.Pulsar != "" {
+			if taskConfig.SubscriptionName == "" {
+				taskConfig.SubscriptionName = taskConfig.ConsumerGroup
+			}
+			if taskConfig.SubscriptionName == "" {
+				err = errors.Errorf("task %s config is invalid, subscriptionName is required", taskConfig.Name)
+				return
+			}
+			taskConfig.SubscriptionType = strings.ToLower(taskConfig.SubscriptionType)
+			switch taskConfig.SubscriptionType {
+			case "":
+				taskConfig.SubscriptionType = "failover"
+			case "exclusive", "shared", "failover", "key_shared":
+			default:
+				err = errors.Errorf("task %s config is invalid, subscriptionType %s is unsupported", taskConfig.Name, taskConfig.SubscriptionType)
+				return
+			}
+		} else if !taskConfig.RemoteWrite {
+			kfkCfg := cfg.Kafka[taskConfig.Kafka]
+			if kfkCfg.Sasl.Enable && kfkCfg.Sasl.Username == "" {
+				//kafka-go doesn't support SASL/GSSAPI(Kerberos). https://github.com/segmentio/kafka-go/issues/539
+				taskConfig.KafkaClient = "sarama"
+			} else if taskConfig.KafkaClient == "" {
+				taskConfig.KafkaClient = "kafka-go"
+			}
 		}
 		if taskConfig.Parser == "" {
 			taskConfig.Parser = "fastjson"
@@ -371,7 +667,275 @@ func (cfg *Config) normallizeTasks() (err error) {
 			if taskConfig.Dims[i].SourceName == "" {
 				taskConfig.Dims[i].SourceName = util.GetSourceName(taskConfig.Dims[i].Name)
 			}
+			if taskConfig.Dims[i].Expr != "" {
+				if _, err = util.CompileExpr(taskConfig.Dims[i].Expr, taskConfig.Dims[i].Type); err != nil {
+					return errors.Wrapf(err, "task %s config is invalid, column %s", taskConfig.Name, taskConfig.Dims[i].Name)
+				}
+			}
+		}
+		if taskConfig.Filter != "" {
+			if _, err = util.NewFilter(taskConfig.Filter); err != nil {
+				return errors.Wrapf(err, "task %s config is invalid", taskConfig.Name)
+			}
+		}
+		if len(taskConfig.Routes) != 0 {
+			if err = normallizeRoutes(taskConfig); err != nil {
+				return
+			}
+		}
+		if taskConfig.DeadLetter != nil {
+			if err = cfg.normallizeDeadLetter(taskConfig); err != nil {
+				return
+			}
+		}
+		if taskConfig.CreateTable != nil {
+			if err = normallizeCreateTable(taskConfig); err != nil {
+				return
+			}
+		}
+		if taskConfig.SchemaRefreshInterval == 0 {
+			taskConfig.SchemaRefreshInterval = defaultSchemaRefresh
+		}
+		if taskConfig.DynamicSchema.Enable {
+			if !taskConfig.AutoSchema {
+				err = errors.Errorf("task %s config is invalid, dynamicSchema requires autoSchema", taskConfig.Name)
+				return
+			}
+			switch taskConfig.Parser {
+			case "fastjson", "json", "gjson":
+			case "protobuf":
+				// Fields are fixed by protoMessage, update the descriptor and the table instead.
+				err = errors.Errorf("task %s config is invalid, dynamicSchema is unsupported by parser protobuf whose fields are fixed by protoMessage", taskConfig.Name)
+				return
+			default:
+				err = errors.Errorf("task %s config is invalid, dynamicSchema is unsupported by parser %s", taskConfig.Name, taskConfig.Parser)
+				return
+			}
+			if taskConfig.DynamicSchema.MaxNewColumns <= 0 {
+				taskConfig.DynamicSchema.MaxNewColumns = defaultMaxNewColumns
+			}
+			if taskConfig.DynamicSchema.NewColumnsInterval <= 0 {
+				taskConfig.DynamicSchema.NewColumnsInterval = defaultNewColumnsIntv
+			}
+		}
+		if taskConfig.Parser == "protobuf" && (taskConfig.ProtoDescriptor == "" || taskConfig.ProtoMessage == "") {
+			err = errors.Errorf("task %s config is invalid, parser protobuf requires protoDescriptor and protoMessage", taskConfig.Name)
+			return
+		}
+		if taskConfig.Parser == "avro" && (taskConfig.SchemaRegistry == "") == (taskConfig.AvroSchemaFile == "") {
+			err = errors.Errorf("task %s config is invalid, parser avro requires either schemaRegistry or avroSchemaFile", taskConfig.Name)
+			return
+		}
+		if (taskConfig.Parser == "regex" || taskConfig.Parser == "grok") && taskConfig.Pattern == "" {
+			err = errors.Errorf("task %s config is invalid, parser %s requires pattern", taskConfig.Name, taskConfig.Parser)
+			return
+		}
+		if taskConfig.Parser == "influx" {
+			switch taskConfig.InfluxPrecision {
+			case "":
+				taskConfig.InfluxPrecision = "ns"
+			case "ns", "us", "ms", "s":
+			default:
+				err = errors.Errorf("task %s config is invalid, unknown influxPrecision %s", taskConfig.Name, taskConfig.InfluxPrecision)
+				return
+			}
+		}
+		if taskConfig.Explode != "" {
+			switch taskConfig.Parser {
+			case "fastjson", "json", "gjson":
+			default:
+				err = errors.Errorf("task %s config is invalid, explode is unsupported by parser %s", taskConfig.Name, taskConfig.Parser)
+				return
+			}
+		}
+		if taskConfig.ExactlyOnce.Enable && taskConfig.Pulsar != "" {
+			// Offsets of pulsar messages are assigned by the process, they're not stable across restarts.
+			err = errors.Errorf("task %s config is invalid, exactlyOnce is unsupported by pulsar", taskConfig.Name)
+			return
 		}
+		if taskConfig.ExactlyOnce.OffsetsTable != "" && !taskConfig.ExactlyOnce.Enable {
+			err = errors.Errorf("task %s config is invalid, exactlyOnce offsetsTable requires exactlyOnce enabled", taskConfig.Name)
+			return
+		}
+		taskConfig.FailedBatchPolicy = strings.ToLower(taskConfig.FailedBatchPolicy)
+		switch taskConfig.FailedBatchPolicy {
+		case "":
+			taskConfig.FailedBatchPolicy = FailedBatchExit
+		case FailedBatchExit, FailedBatchPause, FailedBatchSkip:
+		case FailedBatchDeadLetter:
+			if taskConfig.DeadLetter == nil {
+				err = errors.Errorf("task %s config is invalid, failedBatchPolicy %s requires deadLetter", taskConfig.Name, taskConfig.FailedBatchPolicy)
+				return
+			}
+		default:
+			err = errors.Errorf("task %s config is invalid, failedBatchPolicy %s is unsupported", taskConfig.Name, taskConfig.FailedBatchPolicy)
+			return
+		}
+	}
+	return
+}
+
+func normallizeTopics(taskConfig *TaskConfig) (err error) {
+	if taskConfig.Topic != "" {
+		found := false
+		for _, topic := range taskConfig.Topics {
+			if topic == taskConfig.Topic {
+				found = true
+				break
+			}
+		}
+		if !found {
+			taskConfig.Topics = append([]string{taskConfig.Topic}, taskConfig.Topics...)
+		}
+	}
+	if taskConfig.TopicPattern != "" {
+		if len(taskConfig.Topics) != 0 {
+			return errors.Errorf("task %s config is invalid, topicPattern is exclusive with topic and topics", taskConfig.Name)
+		}
+		if _, err = regexp.Compile(taskConfig.TopicPattern); err != nil {
+			return errors.Wrapf(err, "task %s config is invalid, topicPattern %s", taskConfig.Name, taskConfig.TopicPattern)
+		}
+		if taskConfig.TopicRefreshInterval <= 0 {
+			taskConfig.TopicRefreshInterval = defaultTopicRefresh
+		}
+	} else if len(taskConfig.Topics) == 0 {
+		return errors.Errorf("task %s config is invalid, one of topic, topics and topicPattern is required", taskConfig.Name)
+	}
+	return
+}
+
+func normallizeRoutes(taskConfig *TaskConfig) (err error) {
+	if taskConfig.RouteField == "" {
+		return errors.Errorf("task %s config is invalid, routes requires routeField", taskConfig.Name)
+	}
+	if taskConfig.ShardingKey != "" || taskConfig.DynamicSchema.Enable {
+		return errors.Errorf("task %s config is invalid, routes is exclusive with shardingKey and dynamicSchema", taskConfig.Name)
+	}
+	values := make(map[string]bool)
+	for i, route := range taskConfig.Routes {
+		if route.TableName == "" || route.TableName == taskConfig.TableName {
+			return errors.Errorf("task %s config is invalid, tableName of route %d is empty or the same as the task's", taskConfig.Name, i)
+		}
+		if !route.AutoSchema && len(route.Dims) == 0 {
+			return errors.Errorf("task %s config is invalid, route %d requires autoSchema or dims", taskConfig.Name, i)
+		}
+		if len(route.Values) == 0 {
+			return errors.Errorf("task %s config is invalid, values of route %d is empty", taskConfig.Name, i)
+		}
+		for _, value := range route.Values {
+			if values[value] {
+				return errors.Errorf("task %s config is invalid, value %s belongs to multiple routes", taskConfig.Name, value)
+			}
+			values[value] = true
+		}
+		for j := range route.Dims {
+			if route.Dims[j].SourceName == "" {
+				route.Dims[j].SourceName = util.GetSourceName(route.Dims[j].Name)
+			}
+			if route.Dims[j].Expr != "" {
+				if _, err = util.CompileExpr(route.Dims[j].Expr, route.Dims[j].Type); err != nil {
+					return errors.Wrapf(err, "task %s config is invalid, column %s of route %d", taskConfig.Name, route.Dims[j].Name, i)
+				}
+			}
+		}
+	}
+	return
+}
+
+// RouteTask returns a copy of the task config, which writes to the table of the i-th route instead.
+// Other settings(clickhouse cluster, failed batch policy etc.) are the same as the task's.
+func (taskConfig *TaskConfig) RouteTask(i int) *TaskConfig {
+	route := taskConfig.Routes[i]
+	routeCfg := *taskConfig
+	routeCfg.TableName = route.TableName
+	routeCfg.AutoSchema = route.AutoSchema
+	routeCfg.ExcludeColumns = route.ExcludeColumns
+	routeCfg.Dims = route.Dims
+	routeCfg.CreateTable = nil
+	routeCfg.Routes = nil
+	return &routeCfg
+}
+
+// TopicsDesc describes topics consumed by the task.
+func (taskConfig *TaskConfig) TopicsDesc() string {
+	if taskConfig.RemoteWrite {
+		return "remote_write"
+	}
+	if taskConfig.TopicPattern != "" {
+		return "/" + taskConfig.TopicPattern + "/"
+	}
+	return strings.Join(taskConfig.Topics, ",")
+}
+
+func normallizeCreateTable(taskConfig *TaskConfig) (err error) {
+	ctCfg := taskConfig.CreateTable
+	if len(taskConfig.Dims) == 0 {
+		err = errors.Errorf("task %s config is invalid, createTable requires dims", taskConfig.Name)
+		return
+	}
+	if ctCfg.DistTblName != "" && ctCfg.Cluster == "" {
+		err = errors.Errorf("task %s config is invalid, createTable distTblName requires cluster", taskConfig.Name)
+		return
+	}
+	if ctCfg.Engine == "" {
+		ctCfg.Engine = "MergeTree()"
+	}
+	if ctCfg.OrderBy == "" {
+		ctCfg.OrderBy = "tuple()"
+	}
+	if ctCfg.DistShardingKey == "" {
+		ctCfg.DistShardingKey = "rand()"
+	}
+	return
+}
+
+func (cfg *Config) normallizeDeadLetter(taskConfig *TaskConfig) (err error) {
+	dlCfg := taskConfig.DeadLetter
+	dlCfg.Type = strings.ToLower(dlCfg.Type)
+	switch dlCfg.Type {
+	case "kafka":
+		if dlCfg.Kafka == "" {
+			dlCfg.Kafka = taskConfig.Kafka
+		}
+		if _, ok := cfg.Kafka[dlCfg.Kafka]; !ok {
+			err = errors.Errorf("task %s config is invalid, deadLetter kafka %s doesn't exist.", taskConfig.Name, dlCfg.Kafka)
+			return
+		}
+		if dlCfg.Topic == "" {
+			err = errors.Errorf("task %s config is invalid, deadLetter topic is required", taskConfig.Name)
+			return
+		}
+	case "file":
+		if dlCfg.File == "" {
+			err = errors.Errorf("task %s config is invalid, deadLetter file is required", taskConfig.Name)
+			return
+		}
+		if dlCfg.MaxFileSize <= 0 {
+			dlCfg.MaxFileSize = defaultDeadLetterSize
+		}
+		if dlCfg.MaxBackups <= 0 {
+			dlCfg.MaxBackups = defaultDeadLetterBackup
+		}
+	case "clickhouse":
+		if dlCfg.Clickhouse == "" {
+			dlCfg.Clickhouse = taskConfig.Clickhouse
+		}
+		chCfg, ok := cfg.Clickhouse[dlCfg.Clickhouse]
+		if !ok {
+			err = errors.Errorf("task %s config is invalid, deadLetter clickhouse %s doesn't exist.", taskConfig.Name, dlCfg.Clickhouse)
+			return
+		}
+		if strings.ToLower(chCfg.Protocol) == ProtocolHTTP {
+			err = errors.Errorf("task %s config is invalid, deadLetter clickhouse %s uses the http protocol, which is unsupported", taskConfig.Name, dlCfg.Clickhouse)
+			return
+		}
+		if dlCfg.TableName == "" {
+			err = errors.Errorf("task %s config is invalid, deadLetter tableName is required", taskConfig.Name)
+			return
+		}
+	default:
+		err = errors.Errorf("task %s config is invalid, deadLetter type %s is unsupported", taskConfig.Name, dlCfg.Type)
+		return
 	}
 	return
 }
@@ -1,8 +1,10 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
 	"runtime"
+	"sort"
 
 	"github.com/hashicorp/consul/api"
 	"github.com/pkg/errors"
@@ -11,17 +13,37 @@ import (
 
 var _ RemoteConfManager = (*ConsulConfManager)(nil)
 
+const (
+	// ConsulKVKey is the default KV key under which the config is stored.
+	ConsulKVKey = "clickhouse_sinker/config.json"
+)
+
 type ConsulConfManager struct {
 	consulAgent                    *api.Agent
+	consulHealth                   *api.Health
+	consulKV                       *api.KV
 	deregisterCriticalServiceAfter string
+	kvKey                          string
 }
 
 func (ccm *ConsulConfManager) Init(properties map[string]interface{}) (err error) {
 	consulConfig := api.DefaultConfig()
 	consulConfig.Address = properties["consulAddr"].(string)
-	consulClient, _ := api.NewClient(consulConfig)
+	var consulClient *api.Client
+	if consulClient, err = api.NewClient(consulConfig); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
 	ccm.consulAgent = consulClient.Agent()
-	ccm.deregisterCriticalServiceAfter = properties["deregisterCriticalServiceAfter"].(string)
+	ccm.consulHealth = consulClient.Health()
+	ccm.consulKV = consulClient.KV()
+	if v, ok := properties["deregisterCriticalServiceAfter"]; ok {
+		ccm.deregisterCriticalServiceAfter = v.(string)
+	}
+	ccm.kvKey = ConsulKVKey
+	if v, ok := properties["kvKey"]; ok && v.(string) != "" {
+		ccm.kvKey = v.(string)
+	}
 	return
 }
 
@@ -29,7 +51,7 @@ func (ccm *ConsulConfManager) Register(ip string, port int) (err error) {
 	log.Infof("Consul: register service")
 	appID := fmt.Sprintf("clickhouse_sinker-%s-%d", ip, port)
 	err = ccm.consulAgent.ServiceRegister(&api.AgentServiceRegistration{
-		Name:    "clickhouse_sinker",
+		Name:    ServiceName,
 		ID:      appID,
 		Port:    port,
 		Address: ip,
@@ -60,16 +82,67 @@ func (ccm *ConsulConfManager) Deregister(ip string, port int) (err error) {
 }
 
 func (ccm *ConsulConfManager) GetInstances() (instances []Instance, err error) {
-	//FIXME: implement it!
+	var entries []*api.ServiceEntry
+	if entries, _, err = ccm.consulHealth.Service(ServiceName, "", true, nil); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	for _, entry := range entries {
+		svc := entry.Service
+		addr := svc.Address
+		if addr == "" && entry.Node != nil {
+			// Consul falls back to the node address if the service doesn't specify one.
+			addr = entry.Node.Address
+		}
+		instances = append(instances, Instance{Addr: fmt.Sprintf("%s:%d", addr, svc.Port), Weight: svc.Weights.Passing})
+	}
+	sort.Slice(instances, func(i, j int) bool { return (instances[i].Addr < instances[j].Addr) })
 	return
 }
 
 func (ccm *ConsulConfManager) GetConfig() (conf *Config, err error) {
-	//FIXME: implement it!
+	var pair *api.KVPair
+	if pair, _, err = ccm.consulKV.Get(ccm.kvKey, nil); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if pair == nil {
+		err = errors.Errorf("consul key %s doesn't exist", ccm.kvKey)
+		return
+	}
+	conf = &Config{}
+	if err = json.Unmarshal(pair.Value, conf); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
 	return
 }
 
+// PublishConfig publishs the config via check-and-set, so that concurrent publishers don't overwrite each other silently.
 func (ccm *ConsulConfManager) PublishConfig(conf *Config) (err error) {
-	//FIXME: implement it!
+	var bs []byte
+	if bs, err = json.Marshal(*conf); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	var pair *api.KVPair
+	if pair, _, err = ccm.consulKV.Get(ccm.kvKey, nil); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	// ModifyIndex 0 means the key must not exist.
+	var modifyIndex uint64
+	if pair != nil {
+		modifyIndex = pair.ModifyIndex
+	}
+	var ok bool
+	if ok, _, err = ccm.consulKV.CAS(&api.KVPair{Key: ccm.kvKey, Value: bs, ModifyIndex: modifyIndex}, nil); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if !ok {
+		err = errors.Errorf("consul key %s has been modified by someone else, please retry", ccm.kvKey)
+		return
+	}
 	return
 }
@@ -0,0 +1,109 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeConsul is a stand-in for the Consul HTTP API, which serves the health and KV endpoints only.
+type fakeConsul struct {
+	mux         sync.Mutex
+	value       []byte
+	modifyIndex uint64
+	services    []*api.ServiceEntry
+	racing      bool //simulate another publisher writing right after every read
+}
+
+func (fc *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fc.mux.Lock()
+	defer fc.mux.Unlock()
+	switch {
+	case r.URL.Path == "/v1/health/service/"+ServiceName:
+		if r.URL.Query().Get("passing") != "1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(fc.services)
+	case r.URL.Path == "/v1/kv/"+ConsulKVKey && r.Method == http.MethodGet:
+		if fc.value == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode([]*api.KVPair{{Key: ConsulKVKey, Value: fc.value, ModifyIndex: fc.modifyIndex}})
+		if fc.racing {
+			fc.modifyIndex++
+		}
+	case r.URL.Path == "/v1/kv/"+ConsulKVKey && r.Method == http.MethodPut:
+		cas, _ := strconv.ParseUint(r.URL.Query().Get("cas"), 10, 64)
+		if cas != fc.modifyIndex {
+			_, _ = w.Write([]byte("false"))
+			return
+		}
+		fc.value, _ = ioutil.ReadAll(r.Body)
+		fc.modifyIndex++
+		_, _ = w.Write([]byte("true"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestConsulConfManager(t *testing.T) {
+	fc := &fakeConsul{
+		services: []*api.ServiceEntry{
+			{Node: &api.Node{Address: "10.0.0.2"}, Service: &api.AgentService{Address: "10.0.0.2", Port: 2112, Weights: api.AgentWeights{Passing: 8}}},
+			{Node: &api.Node{Address: "10.0.0.1"}, Service: &api.AgentService{Port: 2113, Weights: api.AgentWeights{Passing: 4}}},
+		},
+	}
+	ts := httptest.NewServer(fc)
+	defer ts.Close()
+
+	ccm := &ConsulConfManager{}
+	require.Nil(t, ccm.Init(map[string]interface{}{"consulAddr": ts.URL, "deregisterCriticalServiceAfter": "30m"}))
+
+	insts, err := ccm.GetInstances()
+	require.Nil(t, err)
+	require.Equal(t, []Instance{{Addr: "10.0.0.1:2113", Weight: 4}, {Addr: "10.0.0.2:2112", Weight: 8}}, insts)
+
+	_, err = ccm.GetConfig()
+	require.NotNil(t, err)
+
+	cfg := &Config{
+		Kafka:      map[string]*KafkaConfig{"kfk1": {Brokers: "127.0.0.1:9092"}},
+		Clickhouse: map[string]*ClickHouseConfig{"ch1": {DB: "default", Hosts: [][]string{{"127.0.0.1"}}, Port: 9000}},
+		Tasks:      map[string]*TaskConfig{"task1": {Name: "task1", Kafka: "kfk1", Topic: "topic1", Clickhouse: "ch1", TableName: "t1"}},
+	}
+	cfg.AssignTasks(insts)
+	require.Nil(t, ccm.PublishConfig(cfg))
+	newCfg, err := ccm.GetConfig()
+	require.Nil(t, err)
+	require.Equal(t, cfg, newCfg)
+
+	// Another publisher modifies the key between our read and write.
+	fc.mux.Lock()
+	fc.racing = true
+	fc.mux.Unlock()
+	require.NotNil(t, ccm.PublishConfig(cfg))
+}
@@ -0,0 +1,276 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+var _ RemoteConfManager = (*EtcdConfManager)(nil)
+var _ ConfWatcher = (*EtcdConfManager)(nil)
+
+const (
+	// EtcdPrefix is the default key prefix. The config is stored at <prefix>/config,
+	// and each instance registers itself at <prefix>/instances/<ip>:<port>.
+	EtcdPrefix      = "/clickhouse_sinker"
+	etcdLeaseTTL    = 10 //in seconds
+	etcdOpTimeout   = 5 * time.Second
+	etcdDialTimeout = 5 * time.Second
+)
+
+// etcdRewatchDelay is a variable so that tests can shorten it.
+var etcdRewatchDelay = time.Second
+
+type EtcdConfManager struct {
+	client  *clientv3.Client
+	kv      clientv3.KV
+	lease   clientv3.Lease
+	watcher clientv3.Watcher
+	prefix  string
+
+	mux     sync.Mutex //protect leases
+	leases  map[string]clientv3.LeaseID
+	cancels map[string]context.CancelFunc
+}
+
+func (ecm *EtcdConfManager) Init(properties map[string]interface{}) (err error) {
+	etcdConfig := clientv3.Config{
+		Endpoints:   strings.Split(properties["endpoints"].(string), ","),
+		DialTimeout: etcdDialTimeout,
+	}
+	if v, ok := properties["username"]; ok {
+		etcdConfig.Username = v.(string)
+	}
+	if v, ok := properties["password"]; ok {
+		etcdConfig.Password = v.(string)
+	}
+	if ecm.client, err = clientv3.New(etcdConfig); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	prefix := EtcdPrefix
+	if v, ok := properties["prefix"]; ok && v.(string) != "" {
+		prefix = strings.TrimSuffix(v.(string), "/")
+	}
+	ecm.init(ecm.client, ecm.client, ecm.client, prefix)
+	return
+}
+
+func (ecm *EtcdConfManager) init(kv clientv3.KV, lease clientv3.Lease, watcher clientv3.Watcher, prefix string) {
+	ecm.kv, ecm.lease, ecm.watcher = kv, lease, watcher
+	ecm.prefix = prefix
+	ecm.leases = make(map[string]clientv3.LeaseID)
+	ecm.cancels = make(map[string]context.CancelFunc)
+}
+
+func (ecm *EtcdConfManager) configKey() string {
+	return ecm.prefix + "/config"
+}
+
+func (ecm *EtcdConfManager) instancesPrefix() string {
+	return ecm.prefix + "/instances/"
+}
+
+// Register puts the instance as a leased key, and keep-alive the lease.
+// The key disappears once the instance stops heartbeat for etcdLeaseTTL seconds.
+func (ecm *EtcdConfManager) Register(ip string, port int) (err error) {
+	addr := fmt.Sprintf("%s:%d", ip, port)
+	var bs []byte
+	if bs, err = json.Marshal(Instance{Addr: addr, Weight: runtime.NumCPU()}); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdOpTimeout)
+	defer cancel()
+	var lease *clientv3.LeaseGrantResponse
+	if lease, err = ecm.lease.Grant(ctx, etcdLeaseTTL); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if _, err = ecm.kv.Put(ctx, ecm.instancesPrefix()+addr, string(bs), clientv3.WithLease(lease.ID)); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	kaCtx, kaCancel := context.WithCancel(context.Background())
+	var kaChan <-chan *clientv3.LeaseKeepAliveResponse
+	if kaChan, err = ecm.lease.KeepAlive(kaCtx, lease.ID); err != nil {
+		kaCancel()
+		err = errors.Wrapf(err, "")
+		return
+	}
+	go func() {
+		// The channel must be drained, otherwise the client logs warnings.
+		for range kaChan {
+		}
+		log.Infof("etcd: keep-alive of %s quit", addr)
+	}()
+	ecm.mux.Lock()
+	ecm.leases[addr] = lease.ID
+	ecm.cancels[addr] = kaCancel
+	ecm.mux.Unlock()
+	return
+}
+
+func (ecm *EtcdConfManager) Deregister(ip string, port int) (err error) {
+	addr := fmt.Sprintf("%s:%d", ip, port)
+	ecm.mux.Lock()
+	leaseID, ok := ecm.leases[addr]
+	kaCancel := ecm.cancels[addr]
+	delete(ecm.leases, addr)
+	delete(ecm.cancels, addr)
+	ecm.mux.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), etcdOpTimeout)
+	defer cancel()
+	if ok {
+		kaCancel()
+		if _, err = ecm.lease.Revoke(ctx, leaseID); err != nil {
+			err = errors.Wrapf(err, "")
+		}
+		return
+	}
+	// Registered by another process.
+	if _, err = ecm.kv.Delete(ctx, ecm.instancesPrefix()+addr); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+func (ecm *EtcdConfManager) GetInstances() (instances []Instance, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdOpTimeout)
+	defer cancel()
+	var resp *clientv3.GetResponse
+	if resp, err = ecm.kv.Get(ctx, ecm.instancesPrefix(), clientv3.WithPrefix()); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	for _, kv := range resp.Kvs {
+		var inst Instance
+		if err = json.Unmarshal(kv.Value, &inst); err != nil {
+			err = errors.Wrapf(err, "key %s", string(kv.Key))
+			return
+		}
+		instances = append(instances, inst)
+	}
+	sort.Slice(instances, func(i, j int) bool { return (instances[i].Addr < instances[j].Addr) })
+	return
+}
+
+func (ecm *EtcdConfManager) GetConfig() (conf *Config, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdOpTimeout)
+	defer cancel()
+	var resp *clientv3.GetResponse
+	if resp, err = ecm.kv.Get(ctx, ecm.configKey()); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if len(resp.Kvs) == 0 {
+		err = errors.Errorf("etcd key %s doesn't exist", ecm.configKey())
+		return
+	}
+	conf = &Config{}
+	if err = json.Unmarshal(resp.Kvs[0].Value, conf); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	return
+}
+
+func (ecm *EtcdConfManager) PublishConfig(conf *Config) (err error) {
+	var bs []byte
+	if bs, err = json.Marshal(*conf); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdOpTimeout)
+	defer cancel()
+	if _, err = ecm.kv.Put(ctx, ecm.configKey(), string(bs)); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	return
+}
+
+// Watch notifies on every change of the config and instances under the prefix.
+// Notifications are coalesced, so a slow receiver sees at most one pending notification.
+func (ecm *EtcdConfManager) Watch(ctx context.Context) <-chan struct{} {
+	notify := make(chan struct{}, 1)
+	go func() {
+		var lastRev int64 //the latest revision which has been seen
+		for {
+			// Created and progress notifications tell the current revision even if there's no event, so that the watch
+			// resumes from there rather than from the revision of the next watch.
+			opts := []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithCreatedNotify(), clientv3.WithProgressNotify()}
+			if lastRev > 0 {
+				// Resume right after the last seen revision, so that changes made meanwhile are not missed.
+				opts = append(opts, clientv3.WithRev(lastRev+1))
+			}
+			wch := ecm.watcher.Watch(clientv3.WithRequireLeader(ctx), ecm.prefix+"/", opts...)
+			for wresp := range wch {
+				if wresp.CompactRevision != 0 {
+					// Some changes have been compacted, resume from the oldest available revision and let the receiver reload.
+					log.Warnf("etcd: watch revision %d has been compacted, resume from %d", lastRev+1, wresp.CompactRevision)
+					lastRev = wresp.CompactRevision - 1
+					select {
+					case notify <- struct{}{}:
+					default:
+					}
+					continue
+				}
+				if err := wresp.Err(); err != nil {
+					log.Errorf("etcd: watch got error %+v", err)
+					continue
+				}
+				for _, ev := range wresp.Events {
+					if ev.Kv.ModRevision > lastRev {
+						lastRev = ev.Kv.ModRevision
+					}
+				}
+				if len(wresp.Events) == 0 {
+					// The header revision of a fresh watch, or of a progress notification, has been seen entirely.
+					if (wresp.Created && lastRev == 0) || wresp.IsProgressNotify() {
+						if wresp.Header.Revision > lastRev {
+							lastRev = wresp.Header.Revision
+						}
+					}
+					continue
+				}
+				select {
+				case notify <- struct{}{}:
+				default:
+				}
+			}
+			// The watch channel is closed due to either ctx is done, or the watch is canceled by server(leader lost, compaction etc.).
+			select {
+			case <-ctx.Done():
+				log.Infof("etcd: watch quit due to the context has been canceled")
+				return
+			case <-time.After(etcdRewatchDelay):
+			}
+		}
+	}()
+	return notify
+}
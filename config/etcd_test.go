@@ -0,0 +1,258 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// fakeEtcd is an in-memory stand-in for the KV, Lease and Watcher of an etcd client, which supports what EtcdConfManager uses only.
+// Unused methods are left to the embedded nil interfaces.
+type fakeEtcd struct {
+	mux       sync.Mutex
+	rev       int64
+	kvs       map[string]*mvccpb.KeyValue
+	leaseKeys map[clientv3.LeaseID][]string
+	lastLease clientv3.LeaseID
+	watches   chan fakeWatch //each Watch call
+}
+
+type fakeWatch struct {
+	rev      int64 //the requested start revision, 0 means the current one
+	created  bool  //whether WithCreatedNotify is given
+	progress bool  //whether WithProgressNotify is given
+	ch       chan clientv3.WatchResponse
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{
+		kvs:       make(map[string]*mvccpb.KeyValue),
+		leaseKeys: make(map[clientv3.LeaseID][]string),
+		watches:   make(chan fakeWatch, 10),
+	}
+}
+
+type fakeKV struct {
+	clientv3.KV
+	*fakeEtcd
+}
+
+func (fe fakeKV) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	fe.mux.Lock()
+	defer fe.mux.Unlock()
+	fe.rev++
+	fe.kvs[key] = &mvccpb.KeyValue{Key: []byte(key), Value: []byte(val), ModRevision: fe.rev}
+	// The only option given by EtcdConfManager is WithLease of the latest granted lease.
+	if len(opts) != 0 {
+		fe.leaseKeys[fe.lastLease] = append(fe.leaseKeys[fe.lastLease], key)
+	}
+	return &clientv3.PutResponse{Header: &pb.ResponseHeader{Revision: fe.rev}}, nil
+}
+
+func (fe fakeKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	fe.mux.Lock()
+	defer fe.mux.Unlock()
+	withPrefix := len(clientv3.OpGet(key, opts...).RangeBytes()) != 0
+	resp := &clientv3.GetResponse{Header: &pb.ResponseHeader{Revision: fe.rev}}
+	for k, kv := range fe.kvs {
+		if k == key || (withPrefix && strings.HasPrefix(k, key)) {
+			resp.Kvs = append(resp.Kvs, kv)
+		}
+	}
+	sort.Slice(resp.Kvs, func(i, j int) bool { return string(resp.Kvs[i].Key) < string(resp.Kvs[j].Key) })
+	resp.Count = int64(len(resp.Kvs))
+	return resp, nil
+}
+
+func (fe fakeKV) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	fe.mux.Lock()
+	defer fe.mux.Unlock()
+	fe.rev++
+	delete(fe.kvs, key)
+	return &clientv3.DeleteResponse{Header: &pb.ResponseHeader{Revision: fe.rev}}, nil
+}
+
+type fakeLease struct {
+	clientv3.Lease
+	*fakeEtcd
+}
+
+func (fe fakeLease) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	fe.mux.Lock()
+	defer fe.mux.Unlock()
+	fe.lastLease++
+	return &clientv3.LeaseGrantResponse{ID: fe.lastLease, TTL: ttl}, nil
+}
+
+func (fe fakeLease) KeepAlive(ctx context.Context, id clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	ch := make(chan *clientv3.LeaseKeepAliveResponse)
+	go func() {
+		<-ctx.Done()
+		close(ch)
+	}()
+	return ch, nil
+}
+
+func (fe fakeLease) Revoke(ctx context.Context, id clientv3.LeaseID) (*clientv3.LeaseRevokeResponse, error) {
+	fe.mux.Lock()
+	defer fe.mux.Unlock()
+	fe.rev++
+	for _, key := range fe.leaseKeys[id] {
+		delete(fe.kvs, key)
+	}
+	delete(fe.leaseKeys, id)
+	return &clientv3.LeaseRevokeResponse{}, nil
+}
+
+type fakeWatcher struct {
+	clientv3.Watcher
+	*fakeEtcd
+}
+
+func (fe fakeWatcher) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	op := clientv3.OpGet(key, opts...)
+	// Op has no getters for the notify options.
+	v := reflect.ValueOf(op)
+	w := fakeWatch{
+		rev:      op.Rev(),
+		created:  v.FieldByName("createdNotify").Bool(),
+		progress: v.FieldByName("progressNotify").Bool(),
+		ch:       make(chan clientv3.WatchResponse, 10),
+	}
+	fe.watches <- w
+	return w.ch
+}
+
+func newFakeEtcdConfManager(fe *fakeEtcd) *EtcdConfManager {
+	ecm := &EtcdConfManager{}
+	ecm.init(fakeKV{fakeEtcd: fe}, fakeLease{fakeEtcd: fe}, fakeWatcher{fakeEtcd: fe}, EtcdPrefix)
+	return ecm
+}
+
+func TestEtcdConfManager(t *testing.T) {
+	fe := newFakeEtcd()
+	ecm := newFakeEtcdConfManager(fe)
+
+	_, err := ecm.GetConfig()
+	require.NotNil(t, err)
+	conf := &Config{Tasks: map[string]*TaskConfig{"logs": {Name: "logs", Topic: "logs"}}}
+	require.Nil(t, ecm.PublishConfig(conf))
+	got, err := ecm.GetConfig()
+	require.Nil(t, err)
+	require.Equal(t, "logs", got.Tasks["logs"].Topic)
+
+	require.Nil(t, ecm.Register("10.0.0.2", 2112))
+	require.Nil(t, ecm.Register("10.0.0.1", 2112))
+	instances, err := ecm.GetInstances()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(instances))
+	require.Equal(t, "10.0.0.1:2112", instances[0].Addr)
+	require.Equal(t, "10.0.0.2:2112", instances[1].Addr)
+
+	require.Nil(t, ecm.Deregister("10.0.0.1", 2112))
+	// Registered by another process.
+	require.Nil(t, ecm.Deregister("10.0.0.2", 2112))
+	instances, err = ecm.GetInstances()
+	require.Nil(t, err)
+	require.Equal(t, 0, len(instances))
+}
+
+func TestEtcdWatch(t *testing.T) {
+	etcdRewatchDelay = 10 * time.Millisecond
+	fe := newFakeEtcd()
+	ecm := newFakeEtcdConfManager(fe)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	notify := ecm.Watch(ctx)
+	event := func(rev int64) *clientv3.Event {
+		return &clientv3.Event{Type: mvccpb.PUT, Kv: &mvccpb.KeyValue{Key: []byte(ecm.configKey()), ModRevision: rev}}
+	}
+	noNotify := func() {
+		select {
+		case <-notify:
+			t.Fatal("unexpected notification")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	w := <-fe.watches
+	require.Equal(t, int64(0), w.rev)
+	w.ch <- clientv3.WatchResponse{Header: pb.ResponseHeader{Revision: 5}, Created: true}
+	noNotify()
+	w.ch <- clientv3.WatchResponse{Header: pb.ResponseHeader{Revision: 7}, Events: []*clientv3.Event{event(6), event(7)}}
+	<-notify
+
+	// The watch is canceled by server, it resumes right after the last seen revision.
+	close(w.ch)
+	w = <-fe.watches
+	require.Equal(t, int64(8), w.rev)
+	w.ch <- clientv3.WatchResponse{Header: pb.ResponseHeader{Revision: 9}, Events: []*clientv3.Event{event(9)}}
+	<-notify
+
+	// Changes since the last seen revision have been compacted, the receiver is told to reload.
+	w.ch <- clientv3.WatchResponse{Header: pb.ResponseHeader{Revision: 20}, CompactRevision: 15, Canceled: true}
+	<-notify
+	close(w.ch)
+	w = <-fe.watches
+	require.Equal(t, int64(15), w.rev)
+
+	cancel()
+	close(w.ch)
+	select {
+	case <-fe.watches:
+		t.Fatal("the watch is resumed after the context has been canceled")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestEtcdWatchBreakBeforeEvents(t *testing.T) {
+	etcdRewatchDelay = 10 * time.Millisecond
+	fe := newFakeEtcd()
+	ecm := newFakeEtcdConfManager(fe)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ecm.Watch(ctx)
+
+	w := <-fe.watches
+	require.True(t, w.created)
+	require.True(t, w.progress)
+	w.ch <- clientv3.WatchResponse{Header: pb.ResponseHeader{Revision: 5}, Created: true}
+	// The watch breaks before any event, it resumes right after the revision it was created at.
+	close(w.ch)
+	w = <-fe.watches
+	require.Equal(t, int64(6), w.rev)
+	require.True(t, w.created)
+	require.True(t, w.progress)
+
+	// A progress notification also tells the revision which has been seen entirely.
+	w.ch <- clientv3.WatchResponse{Header: pb.ResponseHeader{Revision: 8}}
+	close(w.ch)
+	w = <-fe.watches
+	require.Equal(t, int64(9), w.rev)
+	cancel()
+	close(w.ch)
+}
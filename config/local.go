@@ -0,0 +1,171 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/housepower/clickhouse_sinker/util"
+)
+
+var _ ConfWatcher = (*LocalConfWatcher)(nil)
+
+// Editors usually save a file via several operations(truncate+write, or write a temp file and rename).
+// Wait for a while to let them finish before notifying.
+const localWatchDebounce = 500 * time.Millisecond
+
+// LocalConfWatcher watches the local config file or dir, including files referenced via `@extend:`.
+// It watches the parent directories instead of the files so that rename and re-creation are not missed.
+type LocalConfWatcher struct {
+	cfgPath string
+	isDir   bool
+	watcher *fsnotify.Watcher
+	dirs    map[string]bool
+	files   map[string]bool
+}
+
+// NewLocalConfWatcher creates a watcher of the config file(isDir is false), or the config dir(isDir is true).
+func NewLocalConfWatcher(cfgPath string, isDir bool) (w *LocalConfWatcher, err error) {
+	if cfgPath, err = filepath.Abs(cfgPath); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	w = &LocalConfWatcher{
+		cfgPath: cfgPath,
+		isDir:   isDir,
+		dirs:    make(map[string]bool),
+		files:   make(map[string]bool),
+	}
+	if w.watcher, err = fsnotify.NewWatcher(); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if err = w.refresh(); err != nil {
+		w.watcher.Close()
+		return
+	}
+	return
+}
+
+func (w *LocalConfWatcher) tasksDir() string {
+	return filepath.Join(w.cfgPath, "tasks")
+}
+
+// refresh re-computes the set of interested files since `@extend:` references and task files may have changed.
+func (w *LocalConfWatcher) refresh() (err error) {
+	var cfgFiles []string
+	if !w.isDir {
+		// ParseLocalCfgFile doesn't resolve `@extend:`.
+		cfgFiles = []string{w.cfgPath}
+	} else {
+		mainFile := filepath.Join(w.cfgPath, "config.json")
+		if cfgFiles, err = util.ExtendedFiles(mainFile); err != nil {
+			// Tolerate broken references during editing, the main file itself is still interested.
+			log.Warnf("failed to resolve files referenced by %s, %+v", mainFile, err)
+			cfgFiles = []string{mainFile}
+		}
+		var taskFiles []string
+		if taskFiles, err = filepath.Glob(filepath.Join(w.tasksDir(), "*.json")); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		for _, taskFile := range taskFiles {
+			var files []string
+			if files, err = util.ExtendedFiles(taskFile); err != nil {
+				log.Warnf("failed to resolve files referenced by %s, %+v", taskFile, err)
+				files = []string{taskFile}
+			}
+			cfgFiles = append(cfgFiles, files...)
+		}
+		err = nil
+	}
+	files := make(map[string]bool)
+	dirs := []string{}
+	if w.isDir {
+		dirs = append(dirs, w.tasksDir())
+	}
+	for _, f := range cfgFiles {
+		f = filepath.Clean(f)
+		files[f] = true
+		dirs = append(dirs, filepath.Dir(f))
+	}
+	for _, dir := range dirs {
+		if w.dirs[dir] {
+			continue
+		}
+		if err = w.watcher.Add(dir); err != nil {
+			err = errors.Wrapf(err, "dir %s", dir)
+			return
+		}
+		w.dirs[dir] = true
+	}
+	w.files = files
+	return
+}
+
+func (w *LocalConfWatcher) interested(name string) bool {
+	name = filepath.Clean(name)
+	if w.files[name] {
+		return true
+	}
+	return w.isDir && filepath.Dir(name) == w.tasksDir() && filepath.Ext(name) == ".json"
+}
+
+// Watch notifies on every change of interested files. Notifications are debounced and coalesced.
+// The underlying watcher is closed once ctx is done.
+func (w *LocalConfWatcher) Watch(ctx context.Context) <-chan struct{} {
+	notify := make(chan struct{}, 1)
+	go func() {
+		defer w.watcher.Close()
+		var debounce <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				log.Infof("local config watcher quit due to the context has been canceled")
+				return
+			case event, ok := <-w.watcher.Events:
+				if !ok {
+					return
+				}
+				if w.interested(event.Name) {
+					log.Debugf("local config watcher got event %s", event.String())
+					debounce = time.After(localWatchDebounce)
+				}
+			case err, ok := <-w.watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Errorf("local config watcher got error %+v", err)
+			case <-debounce:
+				debounce = nil
+				if err := w.refresh(); err != nil {
+					log.Errorf("local config watcher failed to refresh, %+v", err)
+				}
+				select {
+				case notify <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return notify
+}
@@ -0,0 +1,77 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func expectNotify(t *testing.T, notify <-chan struct{}, expected bool) {
+	select {
+	case <-notify:
+		require.True(t, expected, "got unexpected notification")
+	case <-time.After(3 * localWatchDebounce):
+		require.False(t, expected, "expect notification")
+	}
+}
+
+func TestLocalConfWatcher(t *testing.T) {
+	cfgDir, err := ioutil.TempDir("", "clickhouse_sinker")
+	require.Nil(t, err)
+	defer os.RemoveAll(cfgDir)
+	extDir := filepath.Join(cfgDir, "ext")
+	require.Nil(t, os.MkdirAll(filepath.Join(cfgDir, "tasks"), 0755))
+	require.Nil(t, os.MkdirAll(extDir, 0755))
+	write := func(name, content string) {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(cfgDir, name), []byte(content), 0644))
+	}
+	write("config.json", `{"clickhouse": "@extend:ext/clickhouse.json"}`)
+	write("ext/clickhouse.json", `{"db": "default"}`)
+	write("ext/unrelated.json", `{}`)
+	write("tasks/task1.json", `{"name": "task1"}`)
+
+	w, err := NewLocalConfWatcher(cfgDir, true)
+	require.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	notify := w.Watch(ctx)
+
+	// A new task.
+	write("tasks/task2.json", `{"name": "task2"}`)
+	expectNotify(t, notify, true)
+	// A file referenced via `@extend:`.
+	write("ext/clickhouse.json", `{"db": "test"}`)
+	expectNotify(t, notify, true)
+	// Not referenced by any config.
+	write("ext/unrelated.json", `{"db": "test"}`)
+	write("tasks/README.md", `task files`)
+	expectNotify(t, notify, false)
+	// The config starts to reference another file, which shall be watched thereafter.
+	write("config.json", `{"clickhouse": "@extend:ext/unrelated.json"}`)
+	expectNotify(t, notify, true)
+	write("ext/unrelated.json", `{"db": "test2"}`)
+	expectNotify(t, notify, true)
+	// Removing a task.
+	require.Nil(t, os.Remove(filepath.Join(cfgDir, "tasks", "task1.json")))
+	expectNotify(t, notify, true)
+}
@@ -12,6 +12,7 @@ const (
 	TypeKafkaGo     = "kafka-go"
 	TypeKafkaSarama = "sarama"
 	TypePulsar      = "pulsar"
+	TypeRemoteWrite = "remote-write"
 )
 
 type Inputer interface {
@@ -21,12 +22,30 @@ type Inputer interface {
 	CommitMessages(ctx context.Context, message *model.InputMessage) error
 }
 
+// Seeker is implemented by inputers which are able to resume partitions from offsets given by the task.
+type Seeker interface {
+	// SetOffsetLoader must be called before Run. Once a partition is assigned, loadOffset is called for it,
+	// and consuming resumes right after the returned offset if it's ahead of the committed one. -1 means unknown.
+	SetOffsetLoader(loadOffset func(topic string, partition int) (int64, error))
+}
+
+// TopicsWatcher is implemented by inputers which are able to consume topics matching a pattern.
+type TopicsWatcher interface {
+	// SetTopicsRemovedFn must be called before Run. fn is called with topics which are no longer consumed,
+	// after their messages have stopped being put.
+	SetTopicsRemovedFn(fn func(topics []string))
+}
+
 func NewInputer(typ string) Inputer {
 	switch typ {
 	case TypeKafkaGo:
 		return NewKafkaGo()
 	case TypeKafkaSarama:
 		return NewKafkaSarama()
+	case TypePulsar:
+		return NewPulsar()
+	case TypeRemoteWrite:
+		return NewRemoteWrite()
 	default:
 		log.Fatalf("%s is not a supported input type", typ)
 		return nil
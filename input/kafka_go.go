@@ -18,8 +18,9 @@ package input
 import (
 	"context"
 	"crypto/tls"
-	"io"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -35,13 +36,25 @@ import (
 )
 
 var _ Inputer = (*KafkaGo)(nil)
+var _ Seeker = (*KafkaGo)(nil)
+var _ TopicsWatcher = (*KafkaGo)(nil)
 
 // KafkaGo implements input.Inputer
+// A single member of the consumer group consumes all topics, and runs a kafka.Reader per partition assigned to it.
 type KafkaGo struct {
-	taskCfg *config.TaskConfig
-	r       *kafka.Reader
-	stopped chan struct{}
-	putFn   func(msg model.InputMessage)
+	taskCfg         *config.TaskConfig
+	groupCfg        kafka.ConsumerGroupConfig
+	readerCfg       kafka.ReaderConfig //config of partition readers
+	putFn           func(msg model.InputMessage)
+	pattern         *regexp.Regexp
+	loadOffset      func(topic string, partition int) (int64, error)
+	topicsRemovedFn func(topics []string)
+
+	mux         sync.Mutex //protect topics, gen, cancelGroup, stopped
+	topics      []string
+	gen         *kafka.Generation
+	cancelGroup context.CancelFunc
+	stopped     bool
 }
 
 // NewKafkaGo get instance of kafka reader
@@ -53,22 +66,24 @@ func NewKafkaGo() *KafkaGo {
 func (k *KafkaGo) Init(cfg *config.Config, taskName string, putFn func(msg model.InputMessage)) (err error) {
 	k.taskCfg = cfg.Tasks[taskName]
 	kfkCfg := cfg.Kafka[k.taskCfg.Kafka]
-	k.stopped = make(chan struct{})
 	k.putFn = putFn
 	offset := kafka.LastOffset
 	if k.taskCfg.Earliest {
 		offset = kafka.FirstOffset
 	}
+	k.groupCfg = kafka.ConsumerGroupConfig{
+		ID:                    k.taskCfg.ConsumerGroup,
+		Brokers:               strings.Split(kfkCfg.Brokers, ","),
+		StartOffset:           offset,
+		WatchPartitionChanges: true,
+		ErrorLogger:           log.StandardLogger(), //kafka-go INFO log is too verbose
+	}
 	readerCfg := &kafka.ReaderConfig{
-		Brokers:        strings.Split(kfkCfg.Brokers, ","),
-		GroupID:        k.taskCfg.ConsumerGroup,
-		Topic:          k.taskCfg.Topic,
-		StartOffset:    offset,
-		MinBytes:       k.taskCfg.MinBufferSize * k.taskCfg.MsgSizeHint,
-		MaxBytes:       k.taskCfg.BufferSize * k.taskCfg.MsgSizeHint,
-		MaxWait:        time.Duration(k.taskCfg.FlushInterval) * time.Second,
-		CommitInterval: time.Second,          // flushes commits to Kafka every second
-		ErrorLogger:    log.StandardLogger(), //kafka-go INFO log is too verbose
+		Brokers:     k.groupCfg.Brokers,
+		MinBytes:    k.taskCfg.MinBufferSize * k.taskCfg.MsgSizeHint,
+		MaxBytes:    k.taskCfg.BufferSize * k.taskCfg.MsgSizeHint,
+		MaxWait:     time.Duration(k.taskCfg.FlushInterval) * time.Second,
+		ErrorLogger: log.StandardLogger(),
 	}
 	var dialer *kafka.Dialer
 	if kfkCfg.TLS.Enable {
@@ -107,30 +122,175 @@ func (k *KafkaGo) Init(cfg *config.Config, taskName string, putFn func(msg model
 	}
 	if dialer != nil {
 		readerCfg.Dialer = dialer
+		k.groupCfg.Dialer = dialer
+	}
+	k.readerCfg = *readerCfg
+	if k.topics, k.pattern, err = initTopics(k.taskCfg, k.listTopics); err != nil {
+		return
 	}
-	k.r = kafka.NewReader(*readerCfg)
 	return nil
 }
 
+// SetOffsetLoader implements input.Seeker
+func (k *KafkaGo) SetOffsetLoader(loadOffset func(topic string, partition int) (int64, error)) {
+	k.loadOffset = loadOffset
+}
+
+// SetTopicsRemovedFn implements input.TopicsWatcher
+func (k *KafkaGo) SetTopicsRemovedFn(fn func(topics []string)) {
+	k.topicsRemovedFn = fn
+}
+
+func (k *KafkaGo) listTopics() (topics []string, err error) {
+	dialer := k.readerCfg.Dialer
+	if dialer == nil {
+		dialer = kafka.DefaultDialer
+	}
+	var conn *kafka.Conn
+	for _, broker := range k.readerCfg.Brokers {
+		if conn, err = dialer.Dial("tcp", broker); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer conn.Close()
+	var partitions []kafka.Partition
+	if partitions, err = conn.ReadPartitions(); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	seen := make(map[string]bool)
+	for _, p := range partitions {
+		if !seen[p.Topic] {
+			seen[p.Topic] = true
+			topics = append(topics, p.Topic)
+		}
+	}
+	return
+}
+
 // kafka main loop
 func (k *KafkaGo) Run(ctx context.Context) {
+	if k.pattern != nil {
+		go watchTopics(ctx, k.taskCfg, k.pattern, k.topics, k.listTopics, k.setTopics)
+	}
+	var consumed []string
 LOOP_KAFKA_GO:
 	for {
-		var err error
-		var msg kafka.Message
-		if msg, err = k.r.FetchMessage(ctx); err != nil {
-			if errors.Is(err, context.Canceled) {
-				log.Infof("%s: Kafka.Run quit due to context has been canceled", k.taskCfg.Name)
-				break LOOP_KAFKA_GO
-			} else if errors.Is(err, io.EOF) {
-				log.Infof("%s: Kafka.Run quit due to reader has been closed", k.taskCfg.Name)
-				break LOOP_KAFKA_GO
-			} else {
-				statistics.ConsumeMsgsErrorTotal.WithLabelValues(k.taskCfg.Name).Inc()
-				err = errors.Wrap(err, "")
-				log.Errorf("%s: Kafka.Run got error %+v", k.taskCfg.Name, err)
-				continue
+		k.mux.Lock()
+		if k.stopped {
+			k.mux.Unlock()
+			log.Infof("%s: Kafka.Run quit due to consumer has been stopped", k.taskCfg.Name)
+			break LOOP_KAFKA_GO
+		}
+		topics := k.topics
+		groupCtx, cancelGroup := context.WithCancel(ctx)
+		k.cancelGroup = cancelGroup
+		k.mux.Unlock()
+		// Readers of the previous group have quit, nothing of removed topics is put any longer.
+		if removed := removedTopics(consumed, topics); removed != nil && k.topicsRemovedFn != nil {
+			k.topicsRemovedFn(removed)
+		}
+		consumed = topics
+		if len(topics) == 0 {
+			// No topic matches the pattern yet.
+			<-groupCtx.Done()
+		} else if err := k.consumeGroup(groupCtx, topics); err != nil {
+			statistics.ConsumeMsgsErrorTotal.WithLabelValues(k.taskCfg.Name).Inc()
+			log.Errorf("%s: Kafka.Run got error %+v", k.taskCfg.Name, err)
+			select {
+			case <-groupCtx.Done():
+			case <-time.After(5 * time.Second):
+			}
+		}
+		cancelGroup()
+		if ctx.Err() != nil {
+			log.Infof("%s: Kafka.Run quit due to context has been canceled", k.taskCfg.Name)
+			break LOOP_KAFKA_GO
+		}
+	}
+}
+
+// setTopics ends the current consumer group, so that the next one consumes the new topics.
+func (k *KafkaGo) setTopics(topics []string) {
+	k.mux.Lock()
+	k.topics = topics
+	if k.cancelGroup != nil {
+		k.cancelGroup()
+	}
+	k.mux.Unlock()
+}
+
+// consumeGroup joins the consumer group with the topics, and consumes partitions assigned by each generation until ctx is done.
+// The group leaves once all readers of the current generation have quit.
+func (k *KafkaGo) consumeGroup(ctx context.Context, topics []string) (err error) {
+	groupCfg := k.groupCfg
+	groupCfg.Topics = topics
+	var group *kafka.ConsumerGroup
+	if group, err = kafka.NewConsumerGroup(groupCfg); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer group.Close()
+	for {
+		var gen *kafka.Generation
+		if gen, err = group.Next(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			// The group rejoins after a backoff.
+			statistics.ConsumeMsgsErrorTotal.WithLabelValues(k.taskCfg.Name).Inc()
+			log.Errorf("%s: consumer group %s got error %+v", k.taskCfg.Name, groupCfg.ID, errors.Wrap(err, ""))
+			continue
+		}
+		k.mux.Lock()
+		k.gen = gen
+		k.mux.Unlock()
+		for topic, assignments := range gen.Assignments {
+			for _, assignment := range assignments {
+				topic, partition, offset := topic, assignment.ID, assignment.Offset
+				gen.Start(func(genCtx context.Context) {
+					k.consumePartition(genCtx, topic, partition, offset)
+				})
+			}
+		}
+	}
+}
+
+// consumePartition reads the partition from the offset until the generation ends.
+func (k *KafkaGo) consumePartition(ctx context.Context, topic string, partition int, offset int64) {
+	if k.loadOffset != nil {
+		stored, err := k.loadOffset(topic, partition)
+		if err != nil {
+			// The generation ends, and the partition is assigned again by the next one.
+			log.Errorf("%s: failed to load the offset of topic %s partition %d, got error %+v", k.taskCfg.Name, topic, partition, err)
+			return
+		}
+		// The committed offset wins if it's ahead. A negative one is either FirstOffset or LastOffset.
+		if stored >= 0 && stored+1 > offset {
+			offset = stored + 1
+		}
+	}
+	readerCfg := k.readerCfg
+	readerCfg.Topic, readerCfg.Partition = topic, partition
+	r := kafka.NewReader(readerCfg)
+	defer r.Close()
+	if err := r.SetOffset(offset); err != nil {
+		log.Errorf("%s: failed to seek topic %s partition %d to offset %d, got error %+v", k.taskCfg.Name, topic, partition, offset, errors.Wrap(err, ""))
+		return
+	}
+	for {
+		msg, err := r.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
 			}
+			statistics.ConsumeMsgsErrorTotal.WithLabelValues(k.taskCfg.Name).Inc()
+			log.Errorf("%s: Kafka.Run got error %+v", k.taskCfg.Name, errors.Wrap(err, ""))
+			continue
 		}
 		k.putFn(model.InputMessage{
 			Topic:     msg.Topic,
@@ -139,16 +299,31 @@ LOOP_KAFKA_GO:
 			Value:     msg.Value,
 			Offset:    msg.Offset,
 			Timestamp: &msg.Time,
+			Headers:   kafkaGoHeaders(msg.Headers),
 		})
 	}
 }
 
+func kafkaGoHeaders(headers []kafka.Header) (msgHeaders []model.MsgHeader) {
+	if len(headers) == 0 {
+		return
+	}
+	msgHeaders = make([]model.MsgHeader, len(headers))
+	for i, h := range headers {
+		msgHeaders[i] = model.MsgHeader{Key: h.Key, Value: h.Value}
+	}
+	return
+}
+
+// CommitMessages commits the offset via the current generation. It fails if the partition has been assigned to another member.
 func (k *KafkaGo) CommitMessages(ctx context.Context, msg *model.InputMessage) (err error) {
-	if err = k.r.CommitMessages(ctx, kafka.Message{
-		Topic:     msg.Topic,
-		Partition: msg.Partition,
-		Offset:    msg.Offset,
-	}); err != nil {
+	k.mux.Lock()
+	gen := k.gen
+	k.mux.Unlock()
+	if gen == nil {
+		return errors.Errorf("no partition has been assigned")
+	}
+	if err = gen.CommitOffsets(map[string]map[int]int64{msg.Topic: {msg.Partition: msg.Offset + 1}}); err != nil {
 		err = errors.Wrapf(err, "")
 		return
 	}
@@ -157,13 +332,16 @@ func (k *KafkaGo) CommitMessages(ctx context.Context, msg *model.InputMessage) (
 
 // Stop kafka consumer and close all connections
 func (k *KafkaGo) Stop() error {
-	if k.r != nil {
-		k.r.Close()
+	k.mux.Lock()
+	k.stopped = true
+	if k.cancelGroup != nil {
+		k.cancelGroup()
 	}
+	k.mux.Unlock()
 	return nil
 }
 
 // Description of this kafka consumer, which topic it reads from
 func (k *KafkaGo) Description() string {
-	return "kafka consumer of topic " + k.taskCfg.Topic
+	return "kafka consumer of topic " + k.taskCfg.TopicsDesc()
 }
@@ -20,7 +20,9 @@ import (
 	"crypto/sha256"
 	"crypto/sha512"
 	"hash"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Shopify/sarama"
@@ -35,14 +37,25 @@ import (
 )
 
 var _ Inputer = (*KafkaSarama)(nil)
+var _ Seeker = (*KafkaSarama)(nil)
+var _ TopicsWatcher = (*KafkaSarama)(nil)
 
 // KafkaSarama implements input.Inputer
 type KafkaSarama struct {
 	taskCfg *config.TaskConfig
+	client  sarama.Client
 	cg      sarama.ConsumerGroup
 	sess    sarama.ConsumerGroupSession
 	stopped chan struct{}
 	putFn   func(msg model.InputMessage)
+	pattern *regexp.Regexp
+
+	loadOffset      func(topic string, partition int) (int64, error)
+	topicsRemovedFn func(topics []string)
+
+	mux        sync.Mutex //protect topics, cancelSess
+	topics     []string
+	cancelSess context.CancelFunc
 }
 
 // NewKafkaSarama get instance of kafka reader
@@ -56,6 +69,22 @@ type MyConsumerGroupHandler struct {
 
 func (h MyConsumerGroupHandler) Setup(sess sarama.ConsumerGroupSession) error {
 	h.k.sess = sess
+	if h.k.loadOffset == nil {
+		return nil
+	}
+	// Claims start from offsets of the session, which are settled after Setup.
+	for topic, partitions := range sess.Claims() {
+		for _, partition := range partitions {
+			offset, err := h.k.loadOffset(topic, int(partition))
+			if err != nil {
+				return err
+			}
+			if offset >= 0 {
+				// MarkOffset only moves forward, the committed offset wins if it's ahead.
+				sess.MarkOffset(topic, partition, offset+1, "")
+			}
+		}
+	}
 	return nil
 }
 func (h MyConsumerGroupHandler) Cleanup(_ sarama.ConsumerGroupSession) error {
@@ -73,18 +102,86 @@ func (h MyConsumerGroupHandler) ConsumeClaim(sess sarama.ConsumerGroupSession, c
 			Value:     msg.Value,
 			Offset:    msg.Offset,
 			Timestamp: &msg.Timestamp,
+			Headers:   saramaHeaders(msg.Headers),
 		})
 	}
 	return nil
 }
 
+// saramaHeaders requires Kafka version 0.11+, headers are absent otherwise.
+func saramaHeaders(headers []*sarama.RecordHeader) (msgHeaders []model.MsgHeader) {
+	if len(headers) == 0 {
+		return
+	}
+	msgHeaders = make([]model.MsgHeader, len(headers))
+	for i, h := range headers {
+		msgHeaders[i] = model.MsgHeader{Key: string(h.Key), Value: h.Value}
+	}
+	return
+}
+
 // Init Initialise the kafka instance with configuration
 func (k *KafkaSarama) Init(cfg *config.Config, taskName string, putFn func(msg model.InputMessage)) (err error) {
 	k.taskCfg = cfg.Tasks[taskName]
 	kfkCfg := cfg.Kafka[k.taskCfg.Kafka]
 	k.stopped = make(chan struct{})
 	k.putFn = putFn
-	config := sarama.NewConfig()
+	var config *sarama.Config
+	if config, err = NewSaramaConfig(kfkCfg); err != nil {
+		return
+	}
+	if k.taskCfg.Earliest {
+		config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	}
+	config.ChannelBufferSize = k.taskCfg.MinBufferSize
+	if k.client, err = sarama.NewClient(strings.Split(kfkCfg.Brokers, ","), config); err != nil {
+		return errors.Wrapf(err, "")
+	}
+	if k.topics, k.pattern, err = initTopics(k.taskCfg, k.listTopics); err != nil {
+		k.client.Close()
+		return
+	}
+	if k.cg, err = sarama.NewConsumerGroupFromClient(k.taskCfg.ConsumerGroup, k.client); err != nil {
+		k.client.Close()
+		return errors.Wrapf(err, "")
+	}
+	return nil
+}
+
+// SetOffsetLoader implements input.Seeker
+func (k *KafkaSarama) SetOffsetLoader(loadOffset func(topic string, partition int) (int64, error)) {
+	k.loadOffset = loadOffset
+}
+
+// SetTopicsRemovedFn implements input.TopicsWatcher
+func (k *KafkaSarama) SetTopicsRemovedFn(fn func(topics []string)) {
+	k.topicsRemovedFn = fn
+}
+
+func (k *KafkaSarama) listTopics() (topics []string, err error) {
+	if err = k.client.RefreshMetadata(); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if topics, err = k.client.Topics(); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+// setTopics ends the current session, so that the next one consumes the new topics.
+func (k *KafkaSarama) setTopics(topics []string) {
+	k.mux.Lock()
+	k.topics = topics
+	if k.cancelSess != nil {
+		k.cancelSess()
+	}
+	k.mux.Unlock()
+}
+
+// NewSaramaConfig creates a sarama config with version, TLS and SASL settings of the given kafka config.
+func NewSaramaConfig(kfkCfg *config.KafkaConfig) (config *sarama.Config, err error) {
+	config = sarama.NewConfig()
 	if config.Version, err = sarama.ParseKafkaVersion(kfkCfg.Version); err != nil {
 		err = errors.Wrapf(err, "")
 		return
@@ -114,38 +211,52 @@ func (k *KafkaSarama) Init(cfg *config.Config, taskName string, putFn func(msg m
 		config.Net.SASL.Password = kfkCfg.Sasl.Password
 		config.Net.SASL.GSSAPI = kfkCfg.Sasl.GSSAPI
 	}
-	if k.taskCfg.Earliest {
-		config.Consumer.Offsets.Initial = sarama.OffsetOldest
-	}
-	config.ChannelBufferSize = k.taskCfg.MinBufferSize
-	cg, err := sarama.NewConsumerGroup(strings.Split(kfkCfg.Brokers, ","), k.taskCfg.ConsumerGroup, config)
-	if err != nil {
-		return err
-	}
-	k.cg = cg
-	return nil
+	return
 }
 
 // kafka main loop
 func (k *KafkaSarama) Run(ctx context.Context) {
+	if k.pattern != nil {
+		go watchTopics(ctx, k.taskCfg, k.pattern, k.topics, k.listTopics, k.setTopics)
+	}
+	var consumed []string
 LOOP_SARAMA:
 	for {
 		handler := MyConsumerGroupHandler{k}
-		// `Consume` should be called inside an infinite loop, when a
-		// server-side rebalance happens, the consumer session will need to be
-		// recreated to get the new claims
-		if err := k.cg.Consume(ctx, []string{k.taskCfg.Topic}, handler); err != nil {
-			if errors.Is(err, context.Canceled) {
-				log.Infof("%s: Kafka.Run quit due to context has been canceled", k.taskCfg.Name)
-				break LOOP_SARAMA
-			} else if errors.Is(err, sarama.ErrClosedConsumerGroup) {
+		k.mux.Lock()
+		topics := k.topics
+		sessCtx, cancelSess := context.WithCancel(ctx)
+		k.cancelSess = cancelSess
+		k.mux.Unlock()
+		// Claims of the previous session have quit, nothing of removed topics is put any longer.
+		if removed := removedTopics(consumed, topics); removed != nil && k.topicsRemovedFn != nil {
+			k.topicsRemovedFn(removed)
+		}
+		consumed = topics
+		var err error
+		if len(topics) == 0 {
+			// No topic matches the pattern yet.
+			<-sessCtx.Done()
+		} else {
+			// `Consume` should be called inside an infinite loop, when a
+			// server-side rebalance happens, the consumer session will need to be
+			// recreated to get the new claims
+			err = k.cg.Consume(sessCtx, topics, handler)
+		}
+		cancelSess()
+		if ctx.Err() != nil {
+			log.Infof("%s: Kafka.Run quit due to context has been canceled", k.taskCfg.Name)
+			break LOOP_SARAMA
+		}
+		if err != nil {
+			if errors.Is(err, sarama.ErrClosedConsumerGroup) {
 				log.Infof("%s: Kafka.Run quit due to consumer group has been closed", k.taskCfg.Name)
 				break LOOP_SARAMA
-			} else {
+			} else if !errors.Is(err, context.Canceled) {
+				// context.Canceled means the session was ended due to topics change.
 				statistics.ConsumeMsgsErrorTotal.WithLabelValues(k.taskCfg.Name).Inc()
 				err = errors.Wrap(err, "")
 				log.Errorf("%s: Kafka.Run got error %+v", k.taskCfg.Name, err)
-				continue
 			}
 		}
 	}
@@ -159,12 +270,13 @@ func (k *KafkaSarama) CommitMessages(ctx context.Context, msg *model.InputMessag
 // Stop kafka consumer and close all connections
 func (k *KafkaSarama) Stop() error {
 	k.cg.Close()
+	k.client.Close()
 	return nil
 }
 
 // Description of this kafka consumer, which topic it reads from
 func (k *KafkaSarama) Description() string {
-	return "kafka consumer of topic " + k.taskCfg.Topic
+	return "kafka consumer of topic " + k.taskCfg.TopicsDesc()
 }
 
 // Predefined SCRAMClientGeneratorFunc, copied from https://github.com/Shopify/sarama/blob/master/examples/sasl_scram_client/scram_client.go
@@ -0,0 +1,208 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package input
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/statistics"
+)
+
+var _ Inputer = (*Pulsar)(nil)
+
+// pulsarSubscribe creates the consumer. It's a variable so that tests can replace it with a fake broker.
+var pulsarSubscribe = func(pulsarCfg *config.PulsarConfig, opts pulsar.ConsumerOptions) (client pulsar.Client, consumer pulsar.Consumer, err error) {
+	clientOpts := pulsar.ClientOptions{
+		URL:               pulsarCfg.URL,
+		OperationTimeout:  time.Duration(pulsarCfg.OperationTimeout) * time.Second,
+		ConnectionTimeout: time.Duration(pulsarCfg.ConnectionTimeout) * time.Second,
+	}
+	if pulsarCfg.TLS.Enable {
+		clientOpts.TLSTrustCertsFilePath = pulsarCfg.TLS.TrustCertsFile
+		clientOpts.TLSAllowInsecureConnection = pulsarCfg.TLS.InsecureSkipVerify
+		clientOpts.TLSValidateHostname = !pulsarCfg.TLS.InsecureSkipVerify
+		if pulsarCfg.TLS.ClientCertFile != "" {
+			clientOpts.Authentication = pulsar.NewAuthenticationTLS(pulsarCfg.TLS.ClientCertFile, pulsarCfg.TLS.ClientKeyFile)
+		}
+	}
+	if pulsarCfg.AuthToken != "" {
+		clientOpts.Authentication = pulsar.NewAuthenticationToken(pulsarCfg.AuthToken)
+	}
+	if client, err = pulsar.NewClient(clientOpts); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if consumer, err = client.Subscribe(opts); err != nil {
+		client.Close()
+		client = nil
+		err = errors.Wrapf(err, "")
+		return
+	}
+	return
+}
+
+// Pulsar implements input.Inputer
+// Pulsar message ids are not consecutive, however the ring requires consecutive offsets.
+// So Pulsar assigns each message a consecutive offset per partition, and remembers the message ids
+// not acknowledged yet in order to map a committed offset back to them.
+type Pulsar struct {
+	taskCfg  *config.TaskConfig
+	client   pulsar.Client
+	consumer pulsar.Consumer
+	stopped  chan struct{}
+	putFn    func(msg model.InputMessage)
+
+	mux      sync.Mutex //protect nextOffs, pending
+	nextOffs map[model.TopicPartition]int64
+	pending  map[model.TopicPartition][]pulsar.MessageID //message ids pending to ack, pending[p][i] is of offset nextOffs[p]-len(pending[p])+i
+}
+
+// NewPulsar get instance of pulsar consumer
+func NewPulsar() *Pulsar {
+	return &Pulsar{}
+}
+
+// Init Initialise the pulsar instance with configuration
+func (p *Pulsar) Init(cfg *config.Config, taskName string, putFn func(msg model.InputMessage)) (err error) {
+	p.taskCfg = cfg.Tasks[taskName]
+	pulsarCfg := cfg.Pulsar[p.taskCfg.Pulsar]
+	p.stopped = make(chan struct{})
+	p.putFn = putFn
+	p.nextOffs = make(map[model.TopicPartition]int64)
+	p.pending = make(map[model.TopicPartition][]pulsar.MessageID)
+	opts := pulsar.ConsumerOptions{
+		Topics:                      p.taskCfg.Topics,
+		TopicsPattern:               p.taskCfg.TopicPattern,
+		AutoDiscoveryPeriod:         time.Duration(p.taskCfg.TopicRefreshInterval) * time.Second,
+		SubscriptionName:            p.taskCfg.SubscriptionName,
+		SubscriptionInitialPosition: pulsar.SubscriptionPositionLatest,
+		ReceiverQueueSize:           p.taskCfg.MinBufferSize,
+	}
+	if p.taskCfg.Earliest {
+		opts.SubscriptionInitialPosition = pulsar.SubscriptionPositionEarliest
+	}
+	switch p.taskCfg.SubscriptionType {
+	case "exclusive":
+		opts.Type = pulsar.Exclusive
+	case "shared":
+		opts.Type = pulsar.Shared
+	case "key_shared":
+		opts.Type = pulsar.KeyShared
+	default:
+		opts.Type = pulsar.Failover
+	}
+	if p.client, p.consumer, err = pulsarSubscribe(pulsarCfg, opts); err != nil {
+		return
+	}
+	return nil
+}
+
+// pulsar main loop
+func (p *Pulsar) Run(ctx context.Context) {
+LOOP_PULSAR:
+	for {
+		msg, err := p.consumer.Receive(ctx)
+		if err != nil {
+			if errors.Is(err, context.Canceled) || ctx.Err() != nil {
+				log.Infof("%s: Pulsar.Run quit due to context has been canceled", p.taskCfg.Name)
+				break LOOP_PULSAR
+			}
+			select {
+			case <-p.stopped:
+				log.Infof("%s: Pulsar.Run quit due to consumer has been closed", p.taskCfg.Name)
+				break LOOP_PULSAR
+			default:
+			}
+			statistics.ConsumeMsgsErrorTotal.WithLabelValues(p.taskCfg.Name).Inc()
+			err = errors.Wrap(err, "")
+			log.Errorf("%s: Pulsar.Run got error %+v", p.taskCfg.Name, err)
+			continue
+		}
+		partition := int(msg.ID().PartitionIdx())
+		if partition < 0 {
+			// non-partitioned topic
+			partition = 0
+		}
+		tp := model.TopicPartition{Topic: msg.Topic(), Partition: partition}
+		p.mux.Lock()
+		offset := p.nextOffs[tp]
+		p.nextOffs[tp] = offset + 1
+		p.pending[tp] = append(p.pending[tp], msg.ID())
+		p.mux.Unlock()
+		ts := msg.PublishTime()
+		p.putFn(model.InputMessage{
+			Topic:     msg.Topic(),
+			Partition: partition,
+			Key:       []byte(msg.Key()),
+			Value:     msg.Payload(),
+			Offset:    offset,
+			Timestamp: &ts,
+		})
+	}
+}
+
+// CommitMessages acknowledges all messages of the partition up to and including the given offset.
+// pulsar-client-go has no cumulative ack API, so ack every pending message id individually.
+// This also works for Shared and KeyShared subscriptions since only ids received by this consumer are pending.
+func (p *Pulsar) CommitMessages(ctx context.Context, msg *model.InputMessage) error {
+	tp := model.TopicPartition{Topic: msg.Topic, Partition: msg.Partition}
+	p.mux.Lock()
+	pending := p.pending[tp]
+	begOff := p.nextOffs[tp] - int64(len(pending))
+	cnt := int(msg.Offset - begOff + 1)
+	if cnt <= 0 {
+		p.mux.Unlock()
+		return nil
+	}
+	if cnt > len(pending) {
+		p.mux.Unlock()
+		return errors.Errorf("%s: offset %d of topic %s partition %d is out of range [%d, %d)", p.taskCfg.Name, msg.Offset, msg.Topic, msg.Partition, begOff, begOff+int64(len(pending)))
+	}
+	toAck := pending[:cnt]
+	p.pending[tp] = pending[cnt:]
+	p.mux.Unlock()
+	for _, id := range toAck {
+		p.consumer.AckID(id)
+	}
+	return nil
+}
+
+// Stop pulsar consumer and close all connections
+func (p *Pulsar) Stop() error {
+	if p.stopped != nil {
+		close(p.stopped)
+	}
+	if p.consumer != nil {
+		p.consumer.Close()
+	}
+	if p.client != nil {
+		p.client.Close()
+	}
+	return nil
+}
+
+// Description of this pulsar consumer, which topic it reads from
+func (p *Pulsar) Description() string {
+	return "pulsar consumer of topic " + p.taskCfg.TopicsDesc()
+}
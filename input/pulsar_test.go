@@ -0,0 +1,154 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package input
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/stretchr/testify/require"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/model"
+)
+
+type fakeMessageID struct {
+	ledger    int64
+	entry     int64
+	partition int32
+}
+
+func (id fakeMessageID) Serialize() []byte   { return nil }
+func (id fakeMessageID) LedgerID() int64     { return id.ledger }
+func (id fakeMessageID) EntryID() int64      { return id.entry }
+func (id fakeMessageID) BatchIdx() int32     { return -1 }
+func (id fakeMessageID) PartitionIdx() int32 { return id.partition }
+
+type fakeMessage struct {
+	pulsar.Message
+	topic   string
+	id      fakeMessageID
+	key     string
+	payload []byte
+}
+
+func (m *fakeMessage) Topic() string                 { return m.topic }
+func (m *fakeMessage) ID() pulsar.MessageID          { return m.id }
+func (m *fakeMessage) Key() string                   { return m.key }
+func (m *fakeMessage) Payload() []byte               { return m.payload }
+func (m *fakeMessage) PublishTime() time.Time        { return time.Unix(1600000000, 0) }
+func (m *fakeMessage) Properties() map[string]string { return nil }
+
+// fakeBroker delivers queued messages to its consumer and records acknowledgements.
+type fakeBroker struct {
+	pulsar.Consumer
+	opts   pulsar.ConsumerOptions
+	msgs   chan pulsar.Message
+	mux    sync.Mutex
+	acked  []pulsar.MessageID
+	closed bool
+}
+
+func (b *fakeBroker) Receive(ctx context.Context) (pulsar.Message, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case msg := <-b.msgs:
+		return msg, nil
+	}
+}
+
+func (b *fakeBroker) AckID(id pulsar.MessageID) {
+	b.mux.Lock()
+	b.acked = append(b.acked, id)
+	b.mux.Unlock()
+}
+
+func (b *fakeBroker) Close() {
+	b.closed = true
+}
+
+func TestPulsar(t *testing.T) {
+	broker := &fakeBroker{msgs: make(chan pulsar.Message, 10)}
+	pulsarSubscribe = func(pulsarCfg *config.PulsarConfig, opts pulsar.ConsumerOptions) (pulsar.Client, pulsar.Consumer, error) {
+		broker.opts = opts
+		return nil, broker, nil
+	}
+	cfg := &config.Config{
+		Pulsar: map[string]*config.PulsarConfig{"pulsar1": {URL: "pulsar://127.0.0.1:6650"}},
+		Tasks: map[string]*config.TaskConfig{"test1": {
+			Name:             "test1",
+			Pulsar:           "pulsar1",
+			Topics:           []string{"topic1"},
+			SubscriptionName: "sub1",
+			SubscriptionType: "key_shared",
+			Earliest:         true,
+		}},
+	}
+	got := make(chan model.InputMessage, 10)
+	p := NewPulsar()
+	require.Nil(t, p.Init(cfg, "test1", func(msg model.InputMessage) { got <- msg }))
+	require.Equal(t, []string{"topic1"}, broker.opts.Topics)
+	require.Equal(t, "sub1", broker.opts.SubscriptionName)
+	require.Equal(t, pulsar.KeyShared, broker.opts.Type)
+	require.Equal(t, pulsar.SubscriptionPositionEarliest, broker.opts.SubscriptionInitialPosition)
+
+	// Message ids are sparse, partition 1 interleaves with partition 0.
+	ids := []fakeMessageID{{7, 10, 0}, {7, 13, 0}, {9, 2, 1}, {7, 20, 0}}
+	for i, id := range ids {
+		broker.msgs <- &fakeMessage{topic: "topic1", id: id, key: "k", payload: []byte{byte(i)}}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx)
+		close(done)
+	}()
+	var msgs []model.InputMessage
+	for range ids {
+		msgs = append(msgs, <-got)
+	}
+	expOffsets := []struct {
+		partition int
+		offset    int64
+	}{{0, 0}, {0, 1}, {1, 0}, {0, 2}}
+	for i, exp := range expOffsets {
+		require.Equal(t, exp.partition, msgs[i].Partition)
+		require.Equal(t, exp.offset, msgs[i].Offset)
+		require.Equal(t, []byte{byte(i)}, msgs[i].Value)
+		require.Equal(t, []byte("k"), msgs[i].Key)
+	}
+
+	// Commit offset 1 of partition 0, expect the first two messages be acked.
+	require.Nil(t, p.CommitMessages(ctx, &model.InputMessage{Topic: "topic1", Partition: 0, Offset: 1}))
+	require.Equal(t, []pulsar.MessageID{ids[0], ids[1]}, broker.acked)
+	// Committing an acked offset again is harmless.
+	require.Nil(t, p.CommitMessages(ctx, &model.InputMessage{Topic: "topic1", Partition: 0, Offset: 0}))
+	require.Equal(t, 2, len(broker.acked))
+	require.Nil(t, p.CommitMessages(ctx, &model.InputMessage{Topic: "topic1", Partition: 1, Offset: 0}))
+	require.Nil(t, p.CommitMessages(ctx, &model.InputMessage{Topic: "topic1", Partition: 0, Offset: 2}))
+	require.Equal(t, []pulsar.MessageID{ids[0], ids[1], ids[2], ids[3]}, broker.acked)
+	// Offset beyond what has been received.
+	require.NotNil(t, p.CommitMessages(ctx, &model.InputMessage{Topic: "topic1", Partition: 0, Offset: 5}))
+
+	cancel()
+	<-done
+	require.Nil(t, p.Stop())
+	require.True(t, broker.closed)
+}
@@ -0,0 +1,190 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package input
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/parser"
+)
+
+const (
+	// RemoteWritePath is where Prometheus remote write requests are received, the task is given by the query parameter "task".
+	RemoteWritePath = "/api/v1/write"
+	// RemoteWriteTopic is the topic of messages received by RemoteWrite, all of them are in partition 0.
+	RemoteWriteTopic   = "remote_write"
+	maxRemoteWriteSize = 32 << 20
+)
+
+var _ Inputer = (*RemoteWrite)(nil)
+
+var (
+	remoteWritesMux sync.Mutex
+	remoteWrites    = make(map[string]*RemoteWrite) //task name => running RemoteWrite
+)
+
+// RemoteWrite implements input.Inputer
+// Each request body becomes a message with a consecutive offset. The request is answered once its offset has been
+// committed, which happens after its rows have been written. So Prometheus retries requests which fail to be written.
+type RemoteWrite struct {
+	taskCfg *config.TaskConfig
+	putFn   func(msg model.InputMessage)
+	ctx     context.Context
+	stopped chan struct{}
+
+	putMux  sync.Mutex //serialize putFn so that messages arrive in the order of offsets, protect nextOff
+	nextOff int64
+
+	mux       sync.Mutex //protect committed, commitCh
+	committed int64
+	commitCh  chan struct{} //closed and replaced on each commit
+}
+
+// NewRemoteWrite get instance of the remote write receiver
+func NewRemoteWrite() *RemoteWrite {
+	return &RemoteWrite{}
+}
+
+// Init Initialise the remote write receiver with configuration
+func (r *RemoteWrite) Init(cfg *config.Config, taskName string, putFn func(msg model.InputMessage)) error {
+	r.taskCfg = cfg.Tasks[taskName]
+	r.putFn = putFn
+	r.stopped = make(chan struct{})
+	r.committed = -1
+	r.commitCh = make(chan struct{})
+	return nil
+}
+
+// Run accepts requests of the task until ctx is canceled or the receiver is stopped.
+func (r *RemoteWrite) Run(ctx context.Context) {
+	r.ctx = ctx
+	remoteWritesMux.Lock()
+	remoteWrites[r.taskCfg.Name] = r
+	remoteWritesMux.Unlock()
+	log.Infof("%s: RemoteWrite.Run accepting requests at %s?task=%s", r.taskCfg.Name, RemoteWritePath, r.taskCfg.Name)
+	select {
+	case <-ctx.Done():
+		log.Infof("%s: RemoteWrite.Run quit due to context has been canceled", r.taskCfg.Name)
+	case <-r.stopped:
+		log.Infof("%s: RemoteWrite.Run quit due to receiver has been stopped", r.taskCfg.Name)
+	}
+	remoteWritesMux.Lock()
+	if remoteWrites[r.taskCfg.Name] == r {
+		delete(remoteWrites, r.taskCfg.Name)
+	}
+	remoteWritesMux.Unlock()
+}
+
+// CommitMessages answers requests up to and including the given offset.
+func (r *RemoteWrite) CommitMessages(ctx context.Context, msg *model.InputMessage) error {
+	r.mux.Lock()
+	if msg.Offset > r.committed {
+		r.committed = msg.Offset
+		close(r.commitCh)
+		r.commitCh = make(chan struct{})
+	}
+	r.mux.Unlock()
+	return nil
+}
+
+// Stop the receiver, pending requests are answered with 503 so that Prometheus retries them.
+func (r *RemoteWrite) Stop() error {
+	if r.stopped != nil {
+		close(r.stopped)
+	}
+	return nil
+}
+
+// Description of this receiver
+func (r *RemoteWrite) Description() string {
+	return "prometheus remote write receiver of task " + r.taskCfg.Name
+}
+
+func (r *RemoteWrite) serve(w http.ResponseWriter, req *http.Request) {
+	if enc := req.Header.Get("Content-Encoding"); enc != "" && enc != "snappy" {
+		http.Error(w, fmt.Sprintf("unsupported Content-Encoding %s", enc), http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxRemoteWriteSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Reject malformed requests, otherwise they'd be acknowledged as parse errors, and Prometheus would never know.
+	if err = parser.ValidateWriteRequest(body); err != nil {
+		http.Error(w, fmt.Sprintf("invalid remote write request: %v", err), http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	r.putMux.Lock()
+	offset := r.nextOff
+	r.nextOff++
+	r.putFn(model.InputMessage{
+		Topic:     RemoteWriteTopic,
+		Partition: 0,
+		Value:     body,
+		Offset:    offset,
+		Timestamp: &now,
+	})
+	r.putMux.Unlock()
+	for {
+		r.mux.Lock()
+		done, commitCh := r.committed >= offset, r.commitCh
+		r.mux.Unlock()
+		if done {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		select {
+		case <-commitCh:
+		case <-req.Context().Done():
+			return
+		case <-r.stopped:
+			http.Error(w, "the task has been stopped", http.StatusServiceUnavailable)
+			return
+		case <-r.ctx.Done():
+			http.Error(w, "the task has been stopped", http.StatusServiceUnavailable)
+			return
+		}
+	}
+}
+
+// RemoteWriteHandler dispatches Prometheus remote write requests to the RemoteWrite of the task.
+// It answers 503 if the task isn't running on this instance, so that Prometheus retries, e.g. while the task is restarting.
+func RemoteWriteHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	taskName := req.URL.Query().Get("task")
+	remoteWritesMux.Lock()
+	r := remoteWrites[taskName]
+	remoteWritesMux.Unlock()
+	if r == nil {
+		http.Error(w, fmt.Sprintf("task %s is not running on this instance", taskName), http.StatusServiceUnavailable)
+		return
+	}
+	r.serve(w, req)
+}
@@ -0,0 +1,100 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package input
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/model"
+)
+
+func TestRemoteWrite(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(RemoteWriteHandler))
+	defer server.Close()
+	// A WriteRequest of a series with label job="node".
+	var label, series, req []byte
+	label = protowire.AppendTag(label, 1, protowire.BytesType)
+	label = protowire.AppendString(label, "job")
+	label = protowire.AppendTag(label, 2, protowire.BytesType)
+	label = protowire.AppendString(label, "node")
+	series = protowire.AppendTag(series, 1, protowire.BytesType)
+	series = protowire.AppendBytes(series, label)
+	req = protowire.AppendTag(req, 1, protowire.BytesType)
+	req = protowire.AppendBytes(req, series)
+	payload := snappy.Encode(nil, req)
+	postBody := func(task string, body []byte) int {
+		resp, err := http.Post(server.URL+RemoteWritePath+"?task="+task, "application/x-protobuf", bytes.NewReader(body))
+		require.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	post := func(task string) int {
+		return postBody(task, payload)
+	}
+	require.Equal(t, http.StatusServiceUnavailable, post("prom"))
+
+	cfg := &config.Config{Tasks: map[string]*config.TaskConfig{"prom": {Name: "prom"}}}
+	msgs := make(chan model.InputMessage, 10)
+	r := NewRemoteWrite()
+	require.Nil(t, r.Init(cfg, "prom", func(msg model.InputMessage) { msgs <- msg }))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+	require.Eventually(t, func() bool {
+		remoteWritesMux.Lock()
+		defer remoteWritesMux.Unlock()
+		return remoteWrites["prom"] == r
+	}, time.Second, 10*time.Millisecond)
+
+	// Malformed requests are rejected without becoming messages.
+	require.Equal(t, http.StatusBadRequest, postBody("prom", []byte("payload")))
+	require.Equal(t, http.StatusBadRequest, postBody("prom", snappy.Encode(nil, []byte{0x0a, 0x05, 0x0a})))
+	require.Equal(t, 0, len(msgs))
+
+	// Requests are answered after their offsets have been committed.
+	codes := make(chan int, 2)
+	go func() { codes <- post("prom") }()
+	go func() { codes <- post("prom") }()
+	msg1, msg2 := <-msgs, <-msgs
+	require.Equal(t, payload, msg1.Value)
+	require.Equal(t, RemoteWriteTopic, msg1.Topic)
+	require.Equal(t, int64(1), msg1.Offset+msg2.Offset)
+	select {
+	case <-codes:
+		t.Fatal("the request was answered before commit")
+	case <-time.After(100 * time.Millisecond):
+	}
+	require.Nil(t, r.CommitMessages(ctx, &model.InputMessage{Topic: RemoteWriteTopic, Offset: 1}))
+	require.Equal(t, http.StatusNoContent, <-codes)
+	require.Equal(t, http.StatusNoContent, <-codes)
+
+	// Pending requests fail once the task stops.
+	go func() { codes <- post("prom") }()
+	<-msgs
+	require.Nil(t, r.Stop())
+	require.Equal(t, http.StatusServiceUnavailable, <-codes)
+	require.Eventually(t, func() bool { return post("prom") == http.StatusServiceUnavailable }, time.Second, 10*time.Millisecond)
+}
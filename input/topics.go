@@ -0,0 +1,111 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package input
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/housepower/clickhouse_sinker/config"
+)
+
+// matchTopics returns sorted topics matching the pattern. Kafka internal topics(__consumer_offsets etc.) are excluded.
+func matchTopics(topics []string, pattern *regexp.Regexp) (matched []string) {
+	for _, topic := range topics {
+		if !strings.HasPrefix(topic, "__") && pattern.MatchString(topic) {
+			matched = append(matched, topic)
+		}
+	}
+	sort.Strings(matched)
+	return
+}
+
+func equalTopics(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// removedTopics returns topics of old which are absent in topics.
+func removedTopics(old, topics []string) (removed []string) {
+	kept := make(map[string]bool, len(topics))
+	for _, topic := range topics {
+		kept[topic] = true
+	}
+	for _, topic := range old {
+		if !kept[topic] {
+			removed = append(removed, topic)
+		}
+	}
+	return
+}
+
+// initTopics returns the topics to consume at startup, and the compiled TopicPattern if it's specified.
+func initTopics(taskCfg *config.TaskConfig, listTopics func() ([]string, error)) (topics []string, pattern *regexp.Regexp, err error) {
+	if taskCfg.TopicPattern == "" {
+		topics = taskCfg.Topics
+		return
+	}
+	if pattern, err = regexp.Compile(taskCfg.TopicPattern); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	var all []string
+	if all, err = listTopics(); err != nil {
+		return
+	}
+	topics = matchTopics(all, pattern)
+	log.Infof("%s: topics matching %s: %v", taskCfg.Name, taskCfg.TopicPattern, topics)
+	return
+}
+
+// watchTopics lists topics every TopicRefreshInterval until ctx is done, and calls onChange with the matching ones once they change.
+func watchTopics(ctx context.Context, taskCfg *config.TaskConfig, pattern *regexp.Regexp, topics []string,
+	listTopics func() ([]string, error), onChange func(topics []string)) {
+	ticker := time.NewTicker(time.Duration(taskCfg.TopicRefreshInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		all, err := listTopics()
+		if err != nil {
+			log.Errorf("%s: failed to list topics, got error %+v", taskCfg.Name, err)
+			continue
+		}
+		newTopics := matchTopics(all, pattern)
+		if equalTopics(topics, newTopics) {
+			continue
+		}
+		log.Infof("%s: topics matching %s changed from %v to %v", taskCfg.Name, taskCfg.TopicPattern, topics, newTopics)
+		topics = newTopics
+		onChange(topics)
+	}
+}
@@ -0,0 +1,55 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package input
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/housepower/clickhouse_sinker/config"
+)
+
+func TestWatchTopics(t *testing.T) {
+	taskCfg := &config.TaskConfig{Name: "test1", TopicPattern: `^tenant\d+$`, TopicRefreshInterval: 1}
+	all := []string{"tenant2", "__consumer_offsets", "tenant1", "tenant_x"}
+	listTopics := func() ([]string, error) { return all, nil }
+	topics, pattern, err := initTopics(taskCfg, listTopics)
+	require.Nil(t, err)
+	require.Equal(t, []string{"tenant1", "tenant2"}, topics)
+
+	all = []string{"tenant3", "tenant1"}
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := make(chan []string, 1)
+	done := make(chan struct{})
+	go func() {
+		watchTopics(ctx, taskCfg, pattern, topics, listTopics, func(topics []string) { changes <- topics })
+		close(done)
+	}()
+	require.Equal(t, []string{"tenant1", "tenant3"}, <-changes)
+	cancel()
+	<-done
+
+	require.Equal(t, []string{"tenant2"}, removedTopics([]string{"tenant1", "tenant2"}, []string{"tenant1", "tenant3"}))
+	require.Nil(t, removedTopics([]string{"tenant1"}, []string{"tenant1", "tenant3"}))
+
+	// Topics are taken as is without pattern.
+	topics, pattern, err = initTopics(&config.TaskConfig{Topics: []string{"a", "b"}}, nil)
+	require.Nil(t, err)
+	require.Nil(t, pattern)
+	require.Equal(t, []string{"a", "b"}, topics)
+}
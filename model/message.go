@@ -25,6 +25,18 @@ type InputMessage struct {
 	Value     []byte
 	Offset    int64
 	Timestamp *time.Time
+	Headers   []MsgHeader
+}
+
+// TopicPartition identifies a partition among all topics consumed by a task.
+type TopicPartition struct {
+	Topic     string
+	Partition int
+}
+
+type MsgHeader struct {
+	Key   string
+	Value []byte
 }
 
 type Row []interface{}
@@ -34,13 +46,22 @@ type MsgRow struct {
 	Msg   *InputMessage
 	Row   *Row
 	Shard int
+	Route int      //index of the table which Row goes to, 0 is the task's table
+	Extra []MsgRow //rows following Row if the message is exploded into multiple ones, their Msg is nil
+	// Filtered tells Row is nil since all rows of the message have been filtered out, rather than it failed to parse.
+	Filtered bool
 }
 
 type Batch struct {
 	Rows     *Rows
+	Dims     []*ColumnWithType //columns of Rows, it changes once the table schema changes
 	BatchIdx int64
 	RealSize int
 	Group    *BatchGroup
+	Route    int //index of the table to write to, 0 is the task's table
+
+	// DedupToken identifies messages of the batch by their offsets. It's empty unless ExactlyOnce is enabled.
+	DedupToken string
 }
 
 //BatchGroup consists of multiple batches.
@@ -48,7 +69,7 @@ type Batch struct {
 //So those batches need to be committed after ALL of them have been written to clickhouse.
 type BatchGroup struct {
 	Batchs    []*Batch
-	Offsets   []int64
+	Offsets   map[string][]int64 //topic => offsets indexed by partition, -1 means the partition is absent
 	Sys       *BatchSys
 	PendWrite int32 //how many batches in this group are pending to wirte to ClickHouse
 }
@@ -57,10 +78,10 @@ type BatchSys struct {
 	taskCfg  *config.TaskConfig
 	mux      sync.Mutex
 	groups   list.List
-	fnCommit func(partition int, offset int64) error
+	fnCommit func(topic string, partition int, offset int64) error
 }
 
-func NewBatchSys(taskCfg *config.TaskConfig, fnCommit func(partition int, offset int64) error) *BatchSys {
+func NewBatchSys(taskCfg *config.TaskConfig, fnCommit func(topic string, partition int, offset int64) error) *BatchSys {
 	return &BatchSys{taskCfg: taskCfg, fnCommit: fnCommit}
 }
 
@@ -75,12 +96,14 @@ LOOP:
 			break LOOP
 		}
 		// commit the whole group
-		for j, off := range grp.Offsets {
-			if off >= 0 {
-				if err := bs.fnCommit(j, off); err != nil {
-					return err
+		for topic, offsets := range grp.Offsets {
+			for j, off := range offsets {
+				if off >= 0 {
+					if err := bs.fnCommit(topic, j, off); err != nil {
+						return err
+					}
+					statistics.ConsumeOffsets.WithLabelValues(bs.taskCfg.Name, topic, strconv.Itoa(j)).Set(float64(off))
 				}
-				statistics.ConsumeOffsets.WithLabelValues(bs.taskCfg.Name, bs.taskCfg.Topic, strconv.Itoa(j)).Set(float64(off))
 			}
 		}
 		eNext := e.Next()
@@ -90,27 +113,28 @@ LOOP:
 	return nil
 }
 
-func (bs *BatchSys) CreateBatchGroupSingle(batch *Batch, partition int, offset int64) {
+func (bs *BatchSys) CreateBatchGroupSingle(batch *Batch, topic string, partition int, offset int64) {
+	offsets := make([]int64, partition+1)
 	bg := &BatchGroup{
 		Sys:       bs,
 		Batchs:    []*Batch{batch},
-		Offsets:   make([]int64, partition+1),
+		Offsets:   map[string][]int64{topic: offsets},
 		PendWrite: 1,
 	}
 	bg.Batchs[0].Group = bg
 	for i := 0; i < partition; i++ {
-		bg.Offsets[i] = -1
+		offsets[i] = -1
 	}
-	bg.Offsets[partition] = offset
+	offsets[partition] = offset
 	bs.mux.Lock()
 	bs.groups.PushBack(bg)
 	bs.mux.Unlock()
 }
 
-func (bs *BatchSys) CreateBatchGroupMulti(batches []*Batch, offsets []int64) {
-	bg := &BatchGroup{Sys: bs, PendWrite: int32(len(batches))}
+// CreateBatchGroupMulti takes the ownership of offsets.
+func (bs *BatchSys) CreateBatchGroupMulti(batches []*Batch, offsets map[string][]int64) {
+	bg := &BatchGroup{Sys: bs, PendWrite: int32(len(batches)), Offsets: offsets}
 	bg.Batchs = append(bg.Batchs, batches...)
-	bg.Offsets = append(bg.Offsets, offsets...)
 	for _, batch := range bg.Batchs {
 		batch.Group = bg
 	}
@@ -129,13 +153,17 @@ func (b *Batch) Size() int {
 	return len(*b.Rows)
 }
 
+// Commit releases rows of the batch, and commits the group if all of its batches are written.
+// It's safe to retry Commit on failure.
 func (b *Batch) Commit() error {
-	for _, row := range *b.Rows {
-		PutRow(row)
+	if b.Rows != nil {
+		for _, row := range *b.Rows {
+			PutRow(row)
+		}
+		PutRows(b.Rows)
+		b.Rows = nil
+		atomic.AddInt32(&b.Group.PendWrite, -1)
 	}
-	PutRows(b.Rows)
-	b.Rows = nil
-	atomic.AddInt32(&b.Group.PendWrite, -1)
 	return b.Group.Sys.TryCommit()
 }
 
@@ -172,11 +200,19 @@ func PutRow(r *Row) {
 func MetricToRow(metric Metric, msg InputMessage, dims []*ColumnWithType) (row *Row) {
 	row = GetRow()
 	for _, dim := range dims {
-		if strings.HasPrefix(dim.Name, "__kafka") {
+		if dim.Expr != nil {
+			*row = append(*row, getExprValue(metric, dim))
+		} else if strings.HasPrefix(dim.Name, "__kafka_header.") {
+			*row = append(*row, getHeaderValue(&msg, strings.TrimPrefix(dim.Name, "__kafka_header."), dim))
+		} else if strings.HasPrefix(dim.Name, "__kafka") {
 			if strings.HasSuffix(dim.Name, "_topic") {
 				*row = append(*row, msg.Topic)
 			} else if strings.HasSuffix(dim.Name, "_partition") {
 				*row = append(*row, msg.Partition)
+			} else if strings.HasSuffix(dim.Name, "_key") {
+				*row = append(*row, getKeyValue(&msg, dim))
+			} else if strings.HasSuffix(dim.Name, "_timestamp") {
+				*row = append(*row, getTimestampValue(&msg, dim))
 			} else {
 				*row = append(*row, msg.Offset)
 			}
@@ -186,3 +222,51 @@ func MetricToRow(metric Metric, msg InputMessage, dims []*ColumnWithType) (row *
 	}
 	return
 }
+
+// getExprValue evaluates the column expression, whose result is converted to what the column type requires.
+func getExprValue(metric Metric, dim *ColumnWithType) interface{} {
+	v := dim.Expr.Eval(metric)
+	if v == nil {
+		return GetDefaultValue(dim)
+	}
+	if t, ok := v.(time.Time); ok {
+		if swType, _ := switchType(dim.Type); swType == "ElasticDateTime" {
+			return t.Unix()
+		}
+	}
+	return v
+}
+
+// getKeyValue returns the message key as a string, or nil if the key is absent and the column is Nullable.
+func getKeyValue(msg *InputMessage, dim *ColumnWithType) interface{} {
+	if msg.Key == nil {
+		return GetDefaultValue(dim)
+	}
+	return string(msg.Key)
+}
+
+// getTimestampValue returns the message timestamp as the column type(Date, DateTime, DateTime64 or ElasticDateTime) requires.
+func getTimestampValue(msg *InputMessage, dim *ColumnWithType) interface{} {
+	if msg.Timestamp == nil {
+		return GetDefaultValue(dim)
+	}
+	swType, _ := switchType(dim.Type)
+	switch swType {
+	case "Date", "DateTime", "DateTime64":
+		return *msg.Timestamp
+	case "ElasticDateTime":
+		return msg.Timestamp.Unix()
+	default:
+		return GetDefaultValue(dim)
+	}
+}
+
+// getHeaderValue returns value of the first header with the key as a string. Header keys are case sensitive.
+func getHeaderValue(msg *InputMessage, key string, dim *ColumnWithType) interface{} {
+	for _, h := range msg.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return GetDefaultValue(dim)
+}
@@ -0,0 +1,79 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/housepower/clickhouse_sinker/config"
+)
+
+func TestMetricToRowKafkaColumns(t *testing.T) {
+	ts := time.Unix(1600000000, 5000000)
+	msg := InputMessage{
+		Topic:     "topic1",
+		Partition: 3,
+		Key:       []byte("k1"),
+		Offset:    100,
+		Timestamp: &ts,
+		Headers:   []MsgHeader{{Key: "h1", Value: []byte("v1")}, {Key: "h1", Value: []byte("v2")}},
+	}
+	dims := []*ColumnWithType{
+		{Name: "__kafka_topic", Type: "String"},
+		{Name: "__kafka_partition", Type: "Int32"},
+		{Name: "__kafka_offset", Type: "Int64"},
+		{Name: "__kafka_key", Type: "Nullable(String)"},
+		{Name: "__kafka_timestamp", Type: "DateTime64(3)"},
+		{Name: "__kafka_header.h1", Type: "String"},
+		{Name: "__kafka_header.h2", Type: "Nullable(String)"},
+		{Name: "__kafka_header.h3", Type: "String"},
+	}
+	row := MetricToRow(nil, msg, dims)
+	require.Equal(t, Row{"topic1", 3, int64(100), "k1", ts, "v1", nil, ""}, *row)
+
+	msg.Key = nil
+	msg.Timestamp = nil
+	dims[4].Type = "DateTime"
+	row = MetricToRow(nil, msg, dims)
+	require.Equal(t, Row{"topic1", 3, int64(100), nil, time.Unix(0, 0), "v1", nil, ""}, *row)
+
+	msg.Timestamp = &ts
+	dims[4].Type = "ElasticDateTime"
+	row = MetricToRow(nil, msg, dims)
+	require.Equal(t, int64(1600000000), (*row)[4])
+}
+
+func TestBatchGroupCommitTopics(t *testing.T) {
+	committed := make(map[TopicPartition]int64)
+	bs := NewBatchSys(&config.TaskConfig{Name: "test1"}, func(topic string, partition int, offset int64) error {
+		committed[TopicPartition{Topic: topic, Partition: partition}] = offset
+		return nil
+	})
+	batch1 := NewBatch()
+	bs.CreateBatchGroupSingle(batch1, "topic1", 2, 100)
+	batch2, batch3 := NewBatch(), NewBatch()
+	bs.CreateBatchGroupMulti([]*Batch{batch2, batch3}, map[string][]int64{"topic1": {-1, 5}, "topic2": {7}})
+
+	require.Nil(t, batch2.Commit())
+	require.Empty(t, committed)
+	require.Nil(t, batch1.Commit())
+	require.Equal(t, map[TopicPartition]int64{{"topic1", 2}: 100}, committed)
+	require.Nil(t, batch3.Commit())
+	require.Equal(t, map[TopicPartition]int64{{"topic1", 2}: 100, {"topic1", 1}: 5, {"topic2", 0}: 7}, committed)
+}
@@ -15,6 +15,13 @@ limitations under the License.
 
 package model
 
+import (
+	"regexp"
+	"sync"
+
+	"github.com/housepower/clickhouse_sinker/util"
+)
+
 // Metric interface for metric collection
 type Metric interface {
 	Get(key string) interface{}
@@ -26,6 +33,20 @@ type Metric interface {
 	GetDateTime(key string, nullable bool) interface{}
 	GetDateTime64(key string, nullable bool) interface{}
 	GetElasticDateTime(key string, nullable bool) interface{}
+	// GetNewKeys reports top-level fields which are absent in knownKeys, along with the inferred ClickHouse type.
+	// Parsers not supporting dynamic schema always return false.
+	GetNewKeys(knownKeys *sync.Map, newKeys map[string]string) bool
+}
+
+// Only fields with such names are added as columns by dynamic schema, others are ignored.
+var newKeyRegexp = regexp.MustCompile(`^[a-zA-Z_][0-9a-zA-Z_]*$`)
+
+// IsNewKey tells whether key is a valid column name and absent in knownKeys.
+func IsNewKey(key string, knownKeys *sync.Map) bool {
+	if _, ok := knownKeys.Load(key); ok {
+		return false
+	}
+	return newKeyRegexp.MatchString(key)
 }
 
 // DimMetrics
@@ -39,4 +60,5 @@ type ColumnWithType struct {
 	Name       string
 	Type       string
 	SourceName string
+	Expr       *util.Expr //computes the value instead of SourceName if it's not nil
 }
@@ -16,6 +16,7 @@ package model
 
 import (
 	"strings"
+	"time"
 
 	"github.com/ClickHouse/clickhouse-go"
 )
@@ -52,6 +53,68 @@ func GetValueByType(metric Metric, cwt *ColumnWithType) interface{} {
 	}
 }
 
+// GetDefaultValue returns the value of a column for rows built without it.
+func GetDefaultValue(cwt *ColumnWithType) interface{} {
+	swType, nullable := switchType(cwt.Type)
+	if nullable {
+		return nil
+	}
+	switch swType {
+	case "int":
+		return int64(0)
+	case "float":
+		return float64(0)
+	case "string":
+		return ""
+	case "stringArray":
+		return clickhouse.Array([]string{})
+	case "intArray":
+		return clickhouse.Array([]int64{})
+	case "floatArray":
+		return clickhouse.Array([]float64{})
+	case "Date", "DateTime", "DateTime64":
+		return time.Unix(0, 0)
+	case "ElasticDateTime":
+		return int64(0)
+	default:
+		return ""
+	}
+}
+
+// RowsRemapper converts rows built with a column list to another one.
+// Values of columns existing in both lists(same name and type) are kept, others get the default value.
+type RowsRemapper struct {
+	newDims []*ColumnWithType
+	idxs    []int //idxs[i] is the index of newDims[i] in the old list, -1 means absent
+}
+
+func NewRowsRemapper(oldDims, newDims []*ColumnWithType) *RowsRemapper {
+	rm := &RowsRemapper{newDims: newDims, idxs: make([]int, len(newDims))}
+	for i, newDim := range newDims {
+		rm.idxs[i] = -1
+		for j, oldDim := range oldDims {
+			if oldDim.Name == newDim.Name && oldDim.Type == newDim.Type {
+				rm.idxs[i] = j
+				break
+			}
+		}
+	}
+	return rm
+}
+
+// Remap converts the row in place.
+func (rm *RowsRemapper) Remap(row *Row) {
+	newRow := make(Row, len(rm.newDims))
+	for i, idx := range rm.idxs {
+		if idx >= 0 && idx < len(*row) {
+			newRow[i] = (*row)[idx]
+		} else {
+			newRow[i] = GetDefaultValue(rm.newDims[i])
+		}
+	}
+	*row = newRow
+}
+
 func switchType(typ string) (dataType string, nullable bool) {
 	nullable = strings.HasPrefix(typ, "Nullable")
 
@@ -0,0 +1,238 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package output
+
+import (
+	"database/sql/driver"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/ClickHouse/clickhouse-go/lib/data"
+	"github.com/pkg/errors"
+
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/pool"
+	"github.com/housepower/clickhouse_sinker/statistics"
+)
+
+// columnWriter appends a value to the c-th column of the block, encoded in the column's native type.
+type columnWriter func(block *data.Block, c int, v interface{}) error
+
+// writeRowsBlock inserts rows via a direct connection, which bypasses database/sql and the per-row stmt.Exec.
+func (c *ClickHouse) writeRowsBlock(rows model.Rows, prepareSQL string, batchIdx int64) (err error) {
+	if len(rows) == 0 {
+		return nil
+	}
+	conn := pool.GetConn(c.taskCfg.Clickhouse, batchIdx)
+	var dc clickhouse.Clickhouse
+	if dc, err = conn.GetDirect(); err != nil {
+		return
+	}
+	if err = writeBlocks(dc, rows, prepareSQL); err != nil {
+		// The connection may be in the middle of an insert, never reuse it.
+		_ = dc.Rollback()
+		_ = dc.Close()
+		return
+	}
+	conn.PutDirect(dc)
+	statistics.FlushMsgsTotal.WithLabelValues(c.taskCfg.Name).Add(float64(len(rows)))
+	return
+}
+
+// writeBlocks sends rows as blocks of at most pool.BlockSize rows, the same as the prepared statement does.
+func writeBlocks(dc clickhouse.Clickhouse, rows model.Rows, prepareSQL string) (err error) {
+	if _, err = dc.Begin(); err != nil {
+		return
+	}
+	if _, err = dc.Prepare(prepareSQL); err != nil {
+		return
+	}
+	var block *data.Block
+	if block, err = dc.Block(); err != nil {
+		return
+	}
+	for begin := 0; begin < len(rows); begin += pool.BlockSize {
+		end := begin + pool.BlockSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		if err = appendRows(block, rows[begin:end]); err != nil {
+			return
+		}
+		// Commit sends the last block.
+		if end < len(rows) {
+			if err = dc.WriteBlock(block); err != nil {
+				return
+			}
+		}
+	}
+	return dc.Commit()
+}
+
+// appendRows appends rows to the block column by column, if every column has a typed writer.
+// Otherwise(Nullable, Decimal, DateTime64 etc.) it falls back to append them row by row.
+func appendRows(block *data.Block, rows model.Rows) (err error) {
+	writers := make([]columnWriter, len(block.Columns))
+	for i, col := range block.Columns {
+		if writers[i] = newColumnWriter(col.CHType()); writers[i] == nil {
+			return appendRowsSlow(block, rows)
+		}
+	}
+	for _, row := range rows {
+		if len(*row) != len(block.Columns) {
+			return errors.Errorf("block: expected %d columns, got %d", len(block.Columns), len(*row))
+		}
+	}
+	block.Reserve()
+	for i, fn := range writers {
+		for _, row := range rows {
+			if err = fn(block, i, (*row)[i]); err != nil {
+				return errors.Wrapf(err, "column %s", block.Columns[i].Name())
+			}
+		}
+	}
+	block.NumRows += uint64(len(rows))
+	return
+}
+
+func appendRowsSlow(block *data.Block, rows model.Rows) (err error) {
+	args := make([]driver.Value, len(block.Columns))
+	for _, row := range rows {
+		if len(*row) != len(args) {
+			return errors.Errorf("block: expected %d columns, got %d", len(args), len(*row))
+		}
+		for i, v := range *row {
+			args[i] = v
+		}
+		if err = block.AppendRow(args); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// newColumnWriter returns nil if the column type has no typed writer.
+func newColumnWriter(chType string) columnWriter {
+	switch chType {
+	case "Int8":
+		return intWriter(func(block *data.Block, c int, v int64) error { return block.WriteInt8(c, int8(v)) })
+	case "Int16":
+		return intWriter(func(block *data.Block, c int, v int64) error { return block.WriteInt16(c, int16(v)) })
+	case "Int32":
+		return intWriter(func(block *data.Block, c int, v int64) error { return block.WriteInt32(c, int32(v)) })
+	case "Int64":
+		return intWriter(func(block *data.Block, c int, v int64) error { return block.WriteInt64(c, v) })
+	case "UInt8":
+		return intWriter(func(block *data.Block, c int, v int64) error { return block.WriteUInt8(c, uint8(v)) })
+	case "UInt16":
+		return intWriter(func(block *data.Block, c int, v int64) error { return block.WriteUInt16(c, uint16(v)) })
+	case "UInt32":
+		return intWriter(func(block *data.Block, c int, v int64) error { return block.WriteUInt32(c, uint32(v)) })
+	case "UInt64":
+		return intWriter(func(block *data.Block, c int, v int64) error { return block.WriteUInt64(c, uint64(v)) })
+	case "Float32":
+		return floatWriter(func(block *data.Block, c int, v float64) error { return block.WriteFloat32(c, float32(v)) })
+	case "Float64":
+		return floatWriter(func(block *data.Block, c int, v float64) error { return block.WriteFloat64(c, v) })
+	case "String":
+		return writeString
+	case "Date":
+		return timeWriter(func(block *data.Block, c int, v time.Time) error { return block.WriteDate(c, v) })
+	case "DateTime":
+		return timeWriter(func(block *data.Block, c int, v time.Time) error {
+			if v.IsZero() {
+				return block.WriteUInt32(c, 0)
+			}
+			return block.WriteDateTime(c, v)
+		})
+	}
+	if strings.HasPrefix(chType, "Array(") && !strings.Contains(chType, "Nullable") {
+		return func(block *data.Block, c int, v interface{}) error { return block.WriteArray(c, v) }
+	}
+	return nil
+}
+
+func intWriter(fn func(block *data.Block, c int, v int64) error) columnWriter {
+	return func(block *data.Block, c int, v interface{}) error {
+		if val, ok := asInt64(v); ok {
+			return fn(block, c, val)
+		}
+		return errors.Errorf("unexpected type %T of value %v for an integer column", v, v)
+	}
+}
+
+func floatWriter(fn func(block *data.Block, c int, v float64) error) columnWriter {
+	return func(block *data.Block, c int, v interface{}) error {
+		if val, ok := asFloat64(v); ok {
+			return fn(block, c, val)
+		}
+		return errors.Errorf("unexpected type %T of value %v for a float column", v, v)
+	}
+}
+
+func timeWriter(fn func(block *data.Block, c int, v time.Time) error) columnWriter {
+	return func(block *data.Block, c int, v interface{}) error {
+		if val, ok := v.(time.Time); ok {
+			return fn(block, c, val)
+		}
+		return errors.Errorf("unexpected type %T of value %v for a date column", v, v)
+	}
+}
+
+func writeString(block *data.Block, c int, v interface{}) error {
+	switch val := v.(type) {
+	case string:
+		return block.WriteString(c, val)
+	case []byte:
+		return block.WriteBytes(c, val)
+	}
+	return errors.Errorf("unexpected type %T of value %v for a string column", v, v)
+}
+
+func asInt64(v interface{}) (int64, bool) {
+	switch val := v.(type) {
+	case int64:
+		return val, true
+	case int:
+		return int64(val), true
+	case int32:
+		return int64(val), true
+	case int16:
+		return int64(val), true
+	case int8:
+		return int64(val), true
+	case uint64:
+		return int64(val), true
+	case uint32:
+		return int64(val), true
+	case uint16:
+		return int64(val), true
+	case uint8:
+		return int64(val), true
+	}
+	return 0, false
+}
+
+func asFloat64(v interface{}) (float64, bool) {
+	switch val := v.(type) {
+	case float64:
+		return val, true
+	case float32:
+		return float64(val), true
+	}
+	return 0, false
+}
@@ -0,0 +1,155 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package output
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/lib/binary"
+	"github.com/ClickHouse/clickhouse-go/lib/column"
+	"github.com/ClickHouse/clickhouse-go/lib/data"
+	"github.com/stretchr/testify/require"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/pool"
+)
+
+var blockTestDims = []*model.ColumnWithType{
+	{Name: "i8", Type: "Int8"},
+	{Name: "i32", Type: "Int32"},
+	{Name: "i64", Type: "Int64"},
+	{Name: "u16", Type: "UInt16"},
+	{Name: "f32", Type: "Float32"},
+	{Name: "f64", Type: "Float64"},
+	{Name: "s", Type: "String"},
+	{Name: "d", Type: "Date"},
+	{Name: "dt", Type: "DateTime"},
+	{Name: "as", Type: "Array(String)"},
+	{Name: "ai", Type: "Array(Int64)"},
+}
+
+func genBlockTestRows(num int) (rows model.Rows) {
+	ts := time.Date(2020, 11, 11, 8, 30, 0, 0, time.UTC)
+	for i := 0; i < num; i++ {
+		row := model.Row{int64(i % 100), int64(i), int64(i) << 20, int64(i % 60000), float64(i) / 3, float64(i) / 7,
+			fmt.Sprintf("name%d", i), ts, ts.Add(time.Duration(i) * time.Second), []string{"a", "b"}, []int{i, i + 1}}
+		rows = append(rows, &row)
+	}
+	return
+}
+
+func newTestBlock(t testing.TB, dims []*model.ColumnWithType) *data.Block {
+	block := &data.Block{NumColumns: uint64(len(dims))}
+	for _, dim := range dims {
+		col, err := column.Factory(dim.Name, dim.Type, time.UTC)
+		require.Nil(t, err)
+		block.Columns = append(block.Columns, col)
+	}
+	return block
+}
+
+func encodeBlock(t testing.TB, block *data.Block) []byte {
+	var buf bytes.Buffer
+	require.Nil(t, block.Write(&data.ServerInfo{}, binary.NewEncoder(&buf)))
+	return buf.Bytes()
+}
+
+func TestAppendRows(t *testing.T) {
+	rows := genBlockTestRows(100)
+	typed := newTestBlock(t, blockTestDims)
+	require.Nil(t, appendRows(typed, rows))
+	require.Equal(t, uint64(len(rows)), typed.NumRows)
+	slow := newTestBlock(t, blockTestDims)
+	require.Nil(t, appendRowsSlow(slow, rows))
+	require.Equal(t, encodeBlock(t, slow), encodeBlock(t, typed))
+
+	// Nullable columns fall back to Block.AppendRow.
+	dims := []*model.ColumnWithType{{Name: "i64", Type: "Int64"}, {Name: "ns", Type: "Nullable(String)"}}
+	rows = model.Rows{&model.Row{int64(1), nil}, &model.Row{int64(2), "x"}}
+	block := newTestBlock(t, dims)
+	require.Nil(t, appendRows(block, rows))
+	require.Equal(t, uint64(2), block.NumRows)
+
+	block = newTestBlock(t, blockTestDims[:1])
+	require.NotNil(t, appendRows(block, model.Rows{&model.Row{"not a number"}}))
+	require.NotNil(t, appendRows(block, model.Rows{&model.Row{int64(1), int64(2)}}))
+}
+
+func BenchmarkAppendRowsTyped(b *testing.B) {
+	rows := genBlockTestRows(10000)
+	block := newTestBlock(b, blockTestDims)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = appendRows(block, rows)
+		block.Reset()
+	}
+}
+
+func BenchmarkAppendRowsSlow(b *testing.B) {
+	rows := genBlockTestRows(10000)
+	block := newTestBlock(b, blockTestDims)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = appendRowsSlow(block, rows)
+		block.Reset()
+	}
+}
+
+// benchmarkWriteRows compares insert paths end to end. It requires a ClickHouse server listening at 127.0.0.1:9000.
+func benchmarkWriteRows(b *testing.B, insertMode string) {
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:9000", time.Second)
+	if err != nil {
+		b.Skipf("ClickHouse is unavailable: %v", err)
+	}
+	conn.Close()
+	cfg := &config.Config{
+		Clickhouse: map[string]*config.ClickHouseConfig{"ch1": {DB: "default", Hosts: [][]string{{"127.0.0.1"}}, Port: 9000, InsertMode: insertMode}},
+		Tasks:      map[string]*config.TaskConfig{"bench": {Name: "bench", Clickhouse: "ch1", TableName: "bench_write_rows"}},
+	}
+	c := NewClickHouse(cfg, "bench")
+	require.Nil(b, pool.InitConn("ch1", c.chCfg.Hosts, c.chCfg.Port, c.chCfg.DB, "default", "", "", nil))
+	defer pool.FreeConn("ch1")
+	cols := make([]string, 0, len(blockTestDims))
+	for _, dim := range blockTestDims {
+		cols = append(cols, fmt.Sprintf("`%s` %s", dim.Name, dim.Type))
+	}
+	db := pool.GetConn("ch1", 0).DB
+	_, err = db.Exec("DROP TABLE IF EXISTS default.bench_write_rows")
+	require.Nil(b, err)
+	_, err = db.Exec(fmt.Sprintf("CREATE TABLE default.bench_write_rows (%s) ENGINE = Null", strings.Join(cols, ", ")))
+	require.Nil(b, err)
+
+	rows := genBlockTestRows(100000)
+	prepareSQL := genPrepareSQL("default", "bench_write_rows", blockTestDims)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		require.Nil(b, c.writeRows(rows, blockTestDims, prepareSQL, "", 0))
+	}
+}
+
+func BenchmarkWriteRowsStmt(b *testing.B) {
+	benchmarkWriteRows(b, config.InsertModeStmt)
+}
+
+func BenchmarkWriteRowsBlock(b *testing.B) {
+	benchmarkWriteRows(b, config.InsertModeBlock)
+}
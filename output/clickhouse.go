@@ -17,14 +17,23 @@ package output
 
 import (
 	"context"
+	"crypto/tls"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	std_errors "errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/ClickHouse/clickhouse-go"
 	"github.com/housepower/clickhouse_sinker/config"
 	"github.com/housepower/clickhouse_sinker/model"
 	"github.com/housepower/clickhouse_sinker/pool"
@@ -35,68 +44,168 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	retryInitialInterval = time.Second
+	retryMaxInterval     = time.Minute
+)
+
 var (
+	// dataErrorCodes are ClickHouse exception codes caused by the inserted data.
+	// https://github.com/ClickHouse/ClickHouse/blob/master/src/Common/ErrorCodes.cpp
+	dataErrorCodes = map[int32]bool{
+		6:   true, //CANNOT_PARSE_TEXT
+		16:  true, //NO_SUCH_COLUMN_IN_TABLE
+		26:  true, //CANNOT_PARSE_QUOTED_STRING
+		27:  true, //CANNOT_PARSE_INPUT_ASSERTION_FAILED
+		38:  true, //CANNOT_PARSE_DATE
+		41:  true, //CANNOT_PARSE_DATETIME
+		53:  true, //TYPE_MISMATCH
+		69:  true, //ARGUMENT_OUT_OF_BOUND
+		70:  true, //CANNOT_CONVERT_TYPE
+		72:  true, //CANNOT_PARSE_NUMBER
+		117: true, //INCORRECT_DATA
+		131: true, //TOO_LARGE_STRING_SIZE
+		190: true, //SIZES_OF_ARRAYS_DOESNT_MATCH
+		321: true, //VALUE_IS_OUT_OF_RANGE_OF_DATA_TYPE
+		349: true, //CANNOT_INSERT_NULL_IN_ORDINARY_COLUMN
+		407: true, //DECIMAL_OVERFLOW
+	}
+	// schemaErrorCodes are data errors caused by columns of the batch rather than values of some rows.
+	// So bisecting the batch doesn't help, the batch is either rebuilt with the current schema or rejected as a whole.
+	schemaErrorCodes = map[int32]bool{
+		16: true, //NO_SUCH_COLUMN_IN_TABLE
+	}
 	selectSQLTemplate    = `select name, type, default_kind from system.columns where database = '%s' and table = '%s'`
 	lowCardinalityRegexp = regexp.MustCompile(`LowCardinality\((.+)\)`)
 )
 
 // ClickHouse is an output service consumers from kafka messages
 type ClickHouse struct {
+	mux  sync.RWMutex //protect Dims, Dms and prepareSQL, which change once the table schema changes
 	Dims []*model.ColumnWithType
 	Dms  []string
 	// Table Configs
+	cfg     *config.Config
 	taskCfg *config.TaskConfig
 	chCfg   *config.ClickHouseConfig
 
 	prepareSQL string
+	fnPause    func()
+
+	// DeadLetter is where messages failed to parse, and batches failed to write go. It's nil if not configured.
+	DeadLetter DeadLetter
+	// main is the task's table if this is a route, which owns the dead letter sink.
+	main *ClickHouse
 }
 
 // NewClickHouse new a clickhouse instance
 func NewClickHouse(cfg *config.Config, taskName string) *ClickHouse {
 	taskCfg := cfg.Tasks[taskName]
 	chCfg := cfg.Clickhouse[taskCfg.Clickhouse]
-	return &ClickHouse{taskCfg: taskCfg, chCfg: chCfg}
+	return &ClickHouse{cfg: cfg, taskCfg: taskCfg, chCfg: chCfg}
+}
+
+// NewRouteClickHouse creates a clickhouse instance for the i-th route of the task. It shares the dead letter sink of main,
+// so main shall be initialized before it.
+func NewRouteClickHouse(main *ClickHouse, i int) *ClickHouse {
+	return &ClickHouse{cfg: main.cfg, taskCfg: main.taskCfg.RouteTask(i), chCfg: main.chCfg, main: main}
 }
 
-// Init the clickhouse intance
-func (c *ClickHouse) Init() (err error) {
-	if err = pool.InitConn(c.taskCfg.Clickhouse, c.chCfg.Hosts, c.chCfg.Port, c.chCfg.DB, c.chCfg.Username, c.chCfg.Password, c.chCfg.DsnParams); err != nil {
+// Init the clickhouse intance. fnPause is invoked if the task shall be paused due to a batch failed to write.
+func (c *ClickHouse) Init(fnPause func()) (err error) {
+	c.fnPause = fnPause
+	var tlsConfig *tls.Config
+	if tlsConfig, err = newTLSConfig(c.chCfg); err != nil {
 		return
 	}
-	if err = c.initSchema(); err != nil {
+	if c.chCfg.Protocol == config.ProtocolHTTP {
+		opts := pool.HTTPOptions{Username: c.chCfg.Username, Password: c.chCfg.Password, Settings: c.chCfg.Settings, Compression: c.chCfg.HTTPCompression, TLSConfig: tlsConfig}
+		if err = pool.InitHTTPConn(c.taskCfg.Clickhouse, c.chCfg.Hosts, c.chCfg.Port, c.chCfg.DB, opts); err != nil {
+			return
+		}
+	} else if err = pool.InitConn(c.taskCfg.Clickhouse, c.chCfg.Hosts, c.chCfg.Port, c.chCfg.DB, c.chCfg.Username, c.chCfg.Password, c.chCfg.DsnParams, tlsConfig); err != nil {
+		return
+	}
+	if c.taskCfg.CreateTable != nil {
+		if err = c.createTable(); err != nil {
+			return
+		}
+	}
+	var dims []*model.ColumnWithType
+	if dims, _, err = c.FetchSchema(); err != nil {
 		return err
 	}
+	c.SetDims(dims)
+	if c.main != nil {
+		c.DeadLetter = c.main.DeadLetter
+	} else if c.DeadLetter, err = NewDeadLetter(c.cfg, c.taskCfg.Name); err != nil {
+		return
+	}
 	return nil
 }
 
-// Send a batch to clickhouse
-func (c *ClickHouse) Send(batch *model.Batch, callback func(batch *model.Batch) error) {
+// Send a batch to clickhouse. Retries give up once ctx is done, and the batch is left uncommitted.
+func (c *ClickHouse) Send(ctx context.Context, batch *model.Batch, callback func(batch *model.Batch) error) {
 	statistics.WritingPoolBacklog.WithLabelValues(c.taskCfg.Name).Inc()
 	_ = util.GlobalWritingPool.Submit(func() {
-		c.loopWrite(batch, callback)
+		c.loopWrite(ctx, batch, callback)
 		statistics.WritingPoolBacklog.WithLabelValues(c.taskCfg.Name).Dec()
 	})
 }
 
 // Write kvs to clickhouse
 func (c *ClickHouse) write(batch *model.Batch) error {
+	dims, prepareSQL := c.batchSchema(batch)
+	return c.writeRows(*batch.Rows, dims, prepareSQL, batch.DedupToken, batch.BatchIdx)
+}
+
+// batchSchema returns columns of the batch and the insert statement.
+// Batches generated before a schema change keep the old columns.
+func (c *ClickHouse) batchSchema(batch *model.Batch) ([]*model.ColumnWithType, string) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	if batch.Dims == nil || (len(batch.Dims) == len(c.Dims) && (len(c.Dims) == 0 || &batch.Dims[0] == &c.Dims[0])) {
+		return c.Dims, c.prepareSQL
+	}
+	return batch.Dims, genPrepareSQL(c.chCfg.DB, c.taskCfg.TableName, batch.Dims)
+}
+
+// writeRows inserts rows with insert_deduplication_token if dedupToken is not empty.
+func (c *ClickHouse) writeRows(rows model.Rows, dims []*model.ColumnWithType, prepareSQL, dedupToken string, batchIdx int64) error {
+	if c.chCfg.Protocol == config.ProtocolHTTP {
+		return c.writeRowsHTTP(rows, dims, dedupToken, batchIdx)
+	}
+	if dedupToken != "" {
+		var err error
+		if prepareSQL, err = withDedupToken(prepareSQL, dedupToken); err != nil {
+			return err
+		}
+	}
+	if c.chCfg.InsertMode == config.InsertModeStmt {
+		return c.writeRowsStmt(rows, prepareSQL, batchIdx)
+	}
+	return c.writeRowsBlock(rows, prepareSQL, batchIdx)
+}
+
+// writeRowsStmt inserts rows via executing the prepared statement row by row.
+func (c *ClickHouse) writeRowsStmt(rows model.Rows, prepareSQL string, batchIdx int64) error {
 	var numErr int
 	var err, tmpErr error
 	var stmt *sql.Stmt
 	var tx *sql.Tx
-	if len(*batch.Rows) == 0 {
+	if len(rows) == 0 {
 		return nil
 	}
 
-	conn := pool.GetConn(c.taskCfg.Clickhouse, batch.BatchIdx)
+	conn := pool.GetConn(c.taskCfg.Clickhouse, batchIdx)
 	if tx, err = conn.Begin(); err != nil {
 		goto ERR
 	}
-	if stmt, err = tx.Prepare(c.prepareSQL); err != nil {
+	if stmt, err = tx.Prepare(prepareSQL); err != nil {
 		goto ERR
 	}
 	defer stmt.Close()
-	for _, row := range *batch.Rows {
+	for _, row := range rows {
 		if _, tmpErr = stmt.Exec(*row...); tmpErr != nil {
 			numErr++
 			err = tmpErr
@@ -110,9 +219,13 @@ func (c *ClickHouse) write(batch *model.Batch) error {
 	if err = tx.Commit(); err != nil {
 		goto ERR
 	}
-	statistics.FlushMsgsTotal.WithLabelValues(c.taskCfg.Name).Add(float64(batch.RealSize))
+	statistics.FlushMsgsTotal.WithLabelValues(c.taskCfg.Name).Add(float64(len(rows)))
 	return err
 ERR:
+	if tx != nil {
+		// Release the underlying connection, the transaction may have been finished by a failed Commit.
+		_ = tx.Rollback()
+	}
 	if shouldReconnect(err) {
 		_ = conn.ReConnect()
 		statistics.ClickhouseReconnectTotal.WithLabelValues(c.taskCfg.Name).Inc()
@@ -120,6 +233,53 @@ ERR:
 	return err
 }
 
+// writeRowsWithRetry retries retryable errors with backoff, until success or ctx is done. RetryTimes doesn't apply, since
+// rows failing due to transient errors shall never be rejected. So it returns either nil, a data error or ctx.Err().
+func (c *ClickHouse) writeRowsWithRetry(ctx context.Context, rows model.Rows, dims []*model.ColumnWithType, prepareSQL, dedupToken string, batchIdx int64) (err error) {
+	var times int
+	backoff := util.NewBackoff(retryInitialInterval, retryMaxInterval)
+	for {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		if err = c.writeRows(rows, dims, prepareSQL, dedupToken, batchIdx); err == nil || !isRetryable(err) {
+			return
+		}
+		times++
+		log.Errorf("%s: flush %d rows(try #%d) failed with error %+v", c.taskCfg.Name, len(rows), times, err)
+		if !backoff.Wait(ctx) {
+			return ctx.Err()
+		}
+	}
+}
+
+// isolateBadRows splits rows which failed to write with a data error into halves and writes them recursively,
+// until the offending rows are isolated. Rows not returned have been written via fnWrite.
+// fnWrite is expected to retry transient errors by itself. If it fails with a non-data error anyway(e.g. canceled),
+// isolating stops and the error is returned, so that rows are never rejected for transient reasons.
+func isolateBadRows(rows model.Rows, rowsErr error, fnWrite func(rows model.Rows) error) (badRows model.Rows, badErrs []error, err error) {
+	if !isDataError(rowsErr) {
+		err = rowsErr
+		return
+	}
+	if len(rows) == 1 {
+		return rows, []error{rowsErr}, nil
+	}
+	mid := len(rows) / 2
+	for _, half := range []model.Rows{rows[:mid], rows[mid:]} {
+		if halfErr := fnWrite(half); halfErr != nil {
+			rs, errs, e := isolateBadRows(half, halfErr, fnWrite)
+			badRows = append(badRows, rs...)
+			badErrs = append(badErrs, errs...)
+			if e != nil {
+				err = e
+				return
+			}
+		}
+	}
+	return
+}
+
 func shouldReconnect(err error) bool {
 	if err == nil {
 		return false
@@ -131,96 +291,536 @@ func shouldReconnect(err error) bool {
 	return false
 }
 
-// LoopWrite will dead loop to write the records
-func (c *ClickHouse) loopWrite(batch *model.Batch, callback func(batch *model.Batch) error) {
+// isRetryable tells whether a failed batch is worth retrying.
+// Errors caused by the data itself(bad values, type mismatch etc.) fail again and again, so they are not.
+// All other errors are considered transient(network, overload, ZooKeeper, readonly replica etc.).
+func isRetryable(err error) bool {
+	var exp *clickhouse.Exception
+	if std_errors.As(err, &exp) {
+		return !dataErrorCodes[exp.Code]
+	}
+	var netErr net.Error
+	if std_errors.As(err, &netErr) || std_errors.Is(err, driver.ErrBadConn) || std_errors.Is(err, io.EOF) || std_errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	errMsg := err.Error()
+	for _, s := range []string{"connection refused", "bad connection", "broken pipe", "connection reset", "i/o timeout"} {
+		if strings.Contains(errMsg, s) {
+			return true
+		}
+	}
+	// clickhouse-go fails to encode a value into the column.
+	return false
+}
+
+// isSchemaError tells whether the batch failed since its columns mismatch the table, e.g. a column has been dropped.
+func isSchemaError(err error) bool {
+	var exp *clickhouse.Exception
+	return std_errors.As(err, &exp) && schemaErrorCodes[exp.Code]
+}
+
+// isDataError tells whether the error is caused by the inserted data, i.e. it's neither transient nor a cancellation.
+func isDataError(err error) bool {
+	return !isRetryable(err) && !std_errors.Is(err, context.Canceled)
+}
+
+// loopWrite writes the batch and commits it, retrying with backoff. It quits without committing once ctx is done.
+func (c *ClickHouse) loopWrite(ctx context.Context, batch *model.Batch, callback func(batch *model.Batch) error) {
 	var err error
 	var times int
+	backoff := util.NewBackoff(retryInitialInterval, retryMaxInterval)
 	for {
 		if err = c.write(batch); err == nil {
-			for {
-				if err = callback(batch); err == nil {
-					return
-				}
-				if std_errors.Is(err, context.Canceled) {
-					log.Infof("%s: ClickHouse.loopWrite quit due to the context has been cancelled", c.taskCfg.Name)
-					return
-				}
-				log.Errorf("%s: committing offset(try #%d) failed with error %+v", c.taskCfg.Name, times, err)
-				times++
-				if c.chCfg.RetryTimes <= 0 || times < c.chCfg.RetryTimes {
-					time.Sleep(10 * time.Second)
-				} else {
-					os.Exit(-1)
+			break
+		}
+		if std_errors.Is(err, context.Canceled) {
+			log.Infof("%s: ClickHouse.loopWrite quit due to the context has been cancelled", c.taskCfg.Name)
+			return
+		}
+		statistics.FlushMsgsErrorTotal.WithLabelValues(c.taskCfg.Name).Add(float64(batch.RealSize))
+		times++
+		retryable := isRetryable(err)
+		log.Errorf("%s: flush batch(try #%d, retryable %v) failed with error %+v", c.taskCfg.Name, times, retryable, err)
+		if isSchemaError(err) && c.taskCfg.AutoSchema {
+			// The table has changed since the batch was generated, write it again with the current columns.
+			// Otherwise the table mismatches the configured dims, it's rejected as a whole below.
+			if rebuilt, rebuildErr := c.rebuildBatch(batch); rebuildErr != nil {
+				log.Errorf("%s: failed to rebuild the batch with the current schema, got error %+v", c.taskCfg.Name, rebuildErr)
+				retryable = true
+			} else if rebuilt {
+				continue
+			}
+		}
+		if !retryable && !isSchemaError(err) && (c.taskCfg.FailedBatchPolicy == config.FailedBatchDeadLetter || c.taskCfg.FailedBatchPolicy == config.FailedBatchSkip) {
+			// Write good rows, and reject bad ones. Not for other policies, since the batch will be consumed again.
+			dims, prepareSQL := c.batchSchema(batch)
+			allRows := *batch.Rows
+			badRows, badErrs, isoErr := isolateBadRows(allRows, err, func(rows model.Rows) error {
+				var dedupToken string
+				if batch.DedupToken != "" {
+					// Each part of the batch needs its own token. rows shares the backing array with allRows,
+					// so the difference of capacities is the index of its first row.
+					dedupToken = fmt.Sprintf("%s/%d+%d", batch.DedupToken, cap(allRows)-cap(rows), len(rows))
 				}
+				return c.writeRowsWithRetry(ctx, rows, dims, prepareSQL, dedupToken, batch.BatchIdx)
+			})
+			if isoErr != nil {
+				// Only a cancellation stops isolating, the batch will be consumed again.
+				log.Infof("%s: ClickHouse.loopWrite quit isolating bad rows due to %v", c.taskCfg.Name, isoErr)
+				return
+			}
+			records := make([]DeadLetterRecord, 0, len(badRows))
+			for i, row := range badRows {
+				records = append(records, newRowDeadLetterRecord(c.taskCfg.TopicsDesc(), row, dims, badErrs[i]))
+			}
+			log.Errorf("%s: isolated %d bad rows out of a batch of %d rows", c.taskCfg.Name, len(badRows), batch.RealSize)
+			if !c.rejectRows(ctx, records) {
+				return
+			}
+			break
+		}
+		// skip would lose rows which failed for transient reasons, so they're retried regardless of RetryTimes.
+		if !retryable || (c.chCfg.RetryTimes > 0 && times >= c.chCfg.RetryTimes && c.taskCfg.FailedBatchPolicy != config.FailedBatchSkip) {
+			if !c.handleFailedBatch(ctx, batch, err) {
+				return
 			}
+			break
+		}
+		if !backoff.Wait(ctx) {
+			log.Infof("%s: ClickHouse.loopWrite quit due to the context has been cancelled", c.taskCfg.Name)
+			return
+		}
+	}
+	times = 0
+	backoff.Reset()
+	for {
+		if err = callback(batch); err == nil {
+			return
 		}
 		if std_errors.Is(err, context.Canceled) {
 			log.Infof("%s: ClickHouse.loopWrite quit due to the context has been cancelled", c.taskCfg.Name)
 			return
 		}
-		log.Errorf("%s: flush batch(try #%d) failed with error %+v", c.taskCfg.Name, c.chCfg.RetryTimes-times, err)
-		statistics.FlushMsgsErrorTotal.WithLabelValues(c.taskCfg.Name).Add(float64(batch.RealSize))
 		times++
-		if shouldReconnect(err) && (c.chCfg.RetryTimes <= 0 || times < c.chCfg.RetryTimes) {
-			time.Sleep(10 * time.Second)
-		} else {
-			os.Exit(-1)
+		log.Errorf("%s: committing offset(try #%d) failed with error %+v", c.taskCfg.Name, times, err)
+		if c.chCfg.RetryTimes > 0 && times >= c.chCfg.RetryTimes {
+			if c.taskCfg.FailedBatchPolicy == config.FailedBatchExit {
+				os.Exit(-1)
+			}
+			// Offsets are committed cumulatively, the next batch will commit them.
+			log.Errorf("%s: gave up committing offset, leave it to the next batch", c.taskCfg.Name)
+			return
+		}
+		if !backoff.Wait(ctx) {
+			log.Infof("%s: ClickHouse.loopWrite quit due to the context has been cancelled", c.taskCfg.Name)
+			return
+		}
+	}
+}
+
+// rebuildBatch converts rows of the batch to the current columns of the table. Values of dropped columns are discarded,
+// and new columns get default values. It returns false if the batch has the current columns already.
+// Rings and the sharder catch up with the schema change at the next schema refresh.
+func (c *ClickHouse) rebuildBatch(batch *model.Batch) (rebuilt bool, err error) {
+	var dims []*model.ColumnWithType
+	if dims, _, err = c.FetchSchema(); err != nil {
+		return
+	}
+	oldDims, _ := c.batchSchema(batch)
+	if sameColumns(oldDims, dims) {
+		return
+	}
+	rm := model.NewRowsRemapper(oldDims, dims)
+	for _, row := range *batch.Rows {
+		rm.Remap(row)
+	}
+	batch.Dims = dims
+	log.Warnf("%s: rebuilt the batch of %d rows with %d columns instead of %d", c.taskCfg.Name, len(*batch.Rows), len(dims), len(oldDims))
+	return true, nil
+}
+
+func sameColumns(a, b []*model.ColumnWithType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].Type != b[i].Type {
+			return false
 		}
 	}
+	return true
+}
+
+// handleFailedBatch applies the task's FailedBatchPolicy to a batch which cannot be written.
+// It returns whether the batch shall be committed.
+func (c *ClickHouse) handleFailedBatch(ctx context.Context, batch *model.Batch, err error) (commit bool) {
+	statistics.FailedBatchsTotal.WithLabelValues(c.taskCfg.Name, c.taskCfg.FailedBatchPolicy).Inc()
+	switch c.taskCfg.FailedBatchPolicy {
+	case config.FailedBatchSkip, config.FailedBatchDeadLetter:
+		dims, _ := c.batchSchema(batch)
+		records := make([]DeadLetterRecord, 0, len(*batch.Rows))
+		for _, row := range *batch.Rows {
+			records = append(records, newRowDeadLetterRecord(c.taskCfg.TopicsDesc(), row, dims, err))
+		}
+		return c.rejectRows(ctx, records)
+	case config.FailedBatchPause:
+		log.Errorf("%s: pause the task due to a batch failed to write", c.taskCfg.Name)
+		if c.fnPause != nil {
+			c.fnPause()
+		}
+		return false
+	default:
+		log.Errorf("%s: exit the process due to a batch failed to write", c.taskCfg.Name)
+		os.Exit(-1)
+	}
+	return false
+}
+
+// rejectRows writes rows to the dead letter sink if the policy is dead-letter-batch, otherwise drops them.
+// The sink is retried with backoff. It returns false if ctx is done before rows are rejected, so that the batch isn't committed.
+func (c *ClickHouse) rejectRows(ctx context.Context, records []DeadLetterRecord) bool {
+	if len(records) == 0 {
+		return true
+	}
+	if c.taskCfg.FailedBatchPolicy != config.FailedBatchDeadLetter {
+		statistics.RejectedRowsTotal.WithLabelValues(c.taskCfg.Name).Add(float64(len(records)))
+		log.Errorf("%s: skipped %d rows, the first one %s got error %s", c.taskCfg.Name, len(records), records[0].Value, records[0].Error)
+		return true
+	}
+	backoff := util.NewBackoff(retryInitialInterval, retryMaxInterval)
+	for {
+		var dlErr error
+		if dlErr = c.DeadLetter.Write(records); dlErr == nil {
+			statistics.RejectedRowsTotal.WithLabelValues(c.taskCfg.Name).Add(float64(len(records)))
+			statistics.DeadLetterMsgsTotal.WithLabelValues(c.taskCfg.Name).Add(float64(len(records)))
+			log.Errorf("%s: wrote %d rows to the dead letter sink", c.taskCfg.Name, len(records))
+			return true
+		}
+		statistics.DeadLetterErrorTotal.WithLabelValues(c.taskCfg.Name).Inc()
+		log.Errorf("%s: failed to write %d rows to the dead letter sink, got error %+v", c.taskCfg.Name, len(records), dlErr)
+		if !backoff.Wait(ctx) {
+			log.Infof("%s: gave up writing %d rows to the dead letter sink due to the context has been cancelled", c.taskCfg.Name, len(records))
+			return false
+		}
+	}
+}
+
+// newRowDeadLetterRecord encodes the row as a JSON object of column names to values.
+// Rows don't remember the message they come from, so partition and offset are -1.
+func newRowDeadLetterRecord(topic string, row *model.Row, dims []*model.ColumnWithType, err error) DeadLetterRecord {
+	obj := make(map[string]interface{}, len(dims))
+	for i, val := range *row {
+		if i < len(dims) {
+			obj[dims[i].Name] = val
+		}
+	}
+	value, jsonErr := json.Marshal(obj)
+	if jsonErr != nil {
+		value = []byte(fmt.Sprintf("%+v", *row))
+	}
+	return DeadLetterRecord{
+		Topic:     topic,
+		Partition: -1,
+		Offset:    -1,
+		Value:     string(value),
+		Error:     err.Error(),
+	}
 }
 
 // Stop free clickhouse connections
 func (c *ClickHouse) Stop() error {
 	pool.FreeConn(c.taskCfg.Clickhouse)
+	if c.DeadLetter != nil && c.main == nil {
+		if err := c.DeadLetter.Close(); err != nil {
+			log.Errorf("%s: failed to close the dead letter sink, got error %+v", c.taskCfg.Name, err)
+		}
+	}
 	return nil
 }
 
-func (c *ClickHouse) initSchema() (err error) {
+// FetchSchema returns columns to insert into, and names of all columns of the table.
+// The latter includes excluded and MATERIALIZED columns, and is empty if AutoSchema is disabled.
+// For the http protocol, it fails if some column is unsupported by both RowBinary and JSONEachRow.
+func (c *ClickHouse) FetchSchema() (dims []*model.ColumnWithType, allCols []string, err error) {
 	if c.taskCfg.AutoSchema {
-		conn := pool.GetConn(c.taskCfg.Clickhouse, 0)
-		var rs *sql.Rows
-		if rs, err = conn.Query(fmt.Sprintf(selectSQLTemplate, c.chCfg.DB, c.taskCfg.TableName)); err != nil {
-			err = errors.Wrapf(err, "")
-			return err
+		var rows [][]string
+		if rows, err = c.query(0, fmt.Sprintf(selectSQLTemplate, c.chCfg.DB, c.taskCfg.TableName)); err != nil {
+			return
 		}
-		defer rs.Close()
-
-		c.Dims = make([]*model.ColumnWithType, 0, 10)
-		var name, typ, defaultKind string
-		for rs.Next() {
-			if err = rs.Scan(&name, &typ, &defaultKind); err != nil {
-				err = errors.Wrapf(err, "")
-				return err
-			}
+		dims = make([]*model.ColumnWithType, 0, 10)
+		for _, row := range rows {
+			name, typ, defaultKind := row[0], row[1], row[2]
+			allCols = append(allCols, name)
 			typ = lowCardinalityRegexp.ReplaceAllString(typ, "$1")
 			if !util.StringContains(c.taskCfg.ExcludeColumns, name) && defaultKind != "MATERIALIZED" {
-				c.Dims = append(c.Dims, &model.ColumnWithType{Name: name, Type: typ, SourceName: util.GetSourceName(name)})
+				dims = append(dims, &model.ColumnWithType{Name: name, Type: typ, SourceName: util.GetSourceName(name)})
 			}
 		}
 	} else {
-		c.Dims = make([]*model.ColumnWithType, 0)
+		dims = make([]*model.ColumnWithType, 0)
 		for _, dim := range c.taskCfg.Dims {
-			c.Dims = append(c.Dims, &model.ColumnWithType{
+			col := &model.ColumnWithType{
 				Name:       dim.Name,
 				Type:       dim.Type,
 				SourceName: dim.SourceName,
-			})
+			}
+			if dim.Expr != "" {
+				if col.Expr, err = util.CompileExpr(dim.Expr, dim.Type); err != nil {
+					return
+				}
+			}
+			dims = append(dims, col)
+		}
+	}
+	if c.chCfg.Protocol == config.ProtocolHTTP {
+		// Refuse unsupported column types upfront, rather than failing every batch.
+		var format string
+		if format, err = httpFormatOf(dims, c.chCfg.HTTPFormat); err != nil {
+			err = errors.Wrapf(err, "%s: table %s is unsupported by the http protocol, exclude the column or use the native protocol",
+				c.taskCfg.Name, c.taskCfg.TableName)
+			return
+		}
+		if format != c.chCfg.HTTPFormat {
+			log.Warnf("%s: some columns of table %s are unsupported by %s, insert in %s instead", c.taskCfg.Name, c.taskCfg.TableName, c.chCfg.HTTPFormat, format)
+		}
+	}
+	return
+}
+
+// SetDims sets columns to insert into, and rebuilds the insert statement.
+func (c *ClickHouse) SetDims(dims []*model.ColumnWithType) {
+	dms := make([]string, 0, len(dims))
+	for _, d := range dims {
+		dms = append(dms, d.Name)
+	}
+	prepareSQL := genPrepareSQL(c.chCfg.DB, c.taskCfg.TableName, dims)
+	c.mux.Lock()
+	c.Dims, c.Dms, c.prepareSQL = dims, dms, prepareSQL
+	c.mux.Unlock()
+	log.Infof("%s: Prepare sql=> %s", c.taskCfg.Name, prepareSQL)
+}
+
+// AddColumns adds columns(name to type) to the table, and the distributed table if any.
+func (c *ClickHouse) AddColumns(newKeys map[string]string) (err error) {
+	names := make([]string, 0, len(newKeys))
+	for name := range newKeys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	adds := make([]string, 0, len(names))
+	for _, name := range names {
+		adds = append(adds, fmt.Sprintf("ADD COLUMN IF NOT EXISTS `%s` %s", name, newKeys[name]))
+	}
+	tables := []string{c.taskCfg.TableName}
+	if c.taskCfg.DynamicSchema.DistTblName != "" {
+		tables = append(tables, c.taskCfg.DynamicSchema.DistTblName)
+	}
+	cluster := c.taskCfg.DynamicSchema.Cluster
+	for _, table := range tables {
+		query := fmt.Sprintf("ALTER TABLE %s.%s%s %s", c.chCfg.DB, table, onCluster(cluster), strings.Join(adds, ", "))
+		for _, shard := range c.ddlShards(cluster) {
+			if err = c.execDDL(shard, query); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// createTable creates the table and the distributed one from Dims, if they don't exist.
+func (c *ClickHouse) createTable() (err error) {
+	ctCfg := c.taskCfg.CreateTable
+	dims := make([]*model.ColumnWithType, 0, len(c.taskCfg.Dims))
+	for _, dim := range c.taskCfg.Dims {
+		dims = append(dims, &model.ColumnWithType{Name: dim.Name, Type: dim.Type})
+	}
+	queries := map[string]string{c.taskCfg.TableName: genCreateTableSQL(c.chCfg.DB, c.taskCfg.TableName, dims, ctCfg)}
+	tables := []string{c.taskCfg.TableName}
+	if ctCfg.DistTblName != "" {
+		queries[ctCfg.DistTblName] = genCreateDistTableSQL(c.chCfg.DB, c.taskCfg.TableName, ctCfg)
+		tables = append(tables, ctCfg.DistTblName)
+	}
+	for _, table := range tables {
+		for _, shard := range c.ddlShards(ctCfg.Cluster) {
+			var exists bool
+			if exists, err = c.tableExists(shard, table); err != nil {
+				return
+			}
+			if exists {
+				continue
+			}
+			if err = c.execDDL(shard, queries[table]); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (c *ClickHouse) tableExists(shard int, table string) (exists bool, err error) {
+	var rows [][]string
+	query := fmt.Sprintf("SELECT count() FROM system.tables WHERE database = '%s' AND name = '%s'", c.chCfg.DB, table)
+	if rows, err = c.query(shard, query); err != nil {
+		return
+	}
+	exists = len(rows) > 0 && rows[0][0] != "0"
+	return
+}
+
+// ddlShards returns shards to execute a DDL. A DDL with `ON CLUSTER` is executed once, otherwise on every shard.
+func (c *ClickHouse) ddlShards(cluster string) (shards []int) {
+	numShards := c.NumShards()
+	if cluster != "" {
+		numShards = 1
+	}
+	for i := 0; i < numShards; i++ {
+		shards = append(shards, i)
+	}
+	return
+}
+
+func (c *ClickHouse) execDDL(shard int, query string) (err error) {
+	log.Infof("%s: executing sql=> %s", c.taskCfg.Name, query)
+	return c.exec(shard, query)
+}
+
+// newTLSConfig returns nil if TLS is disabled.
+func newTLSConfig(chCfg *config.ClickHouseConfig) (*tls.Config, error) {
+	if !chCfg.TLS.Enable {
+		return nil, nil
+	}
+	return util.NewTLSConfig(chCfg.TLS.CaCertFiles, chCfg.TLS.ClientCertFile, chCfg.TLS.ClientKeyFile, chCfg.TLS.InsecureSkipVerify)
+}
+
+// NumShards returns the number of shards of the ClickHouse cluster.
+func (c *ClickHouse) NumShards() int {
+	return len(c.chCfg.Hosts)
+}
+
+// query executes the query on the shard, and returns all rows with values converted to strings.
+func (c *ClickHouse) query(shard int, query string) (rows [][]string, err error) {
+	if c.chCfg.Protocol == config.ProtocolHTTP {
+		return pool.GetHTTPConn(c.taskCfg.Clickhouse, int64(shard)).Query(query)
+	}
+	var rs *sql.Rows
+	if rs, err = pool.GetConn(c.taskCfg.Clickhouse, int64(shard)).Query(query); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer rs.Close()
+	var cols []string
+	if cols, err = rs.Columns(); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	for rs.Next() {
+		row := make([]string, len(cols))
+		dests := make([]interface{}, len(cols))
+		for i := range row {
+			dests[i] = &row[i]
+		}
+		if err = rs.Scan(dests...); err != nil {
+			err = errors.Wrapf(err, "")
+			return
 		}
+		rows = append(rows, row)
+	}
+	if err = rs.Err(); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+// exec executes the statement on the shard.
+func (c *ClickHouse) exec(shard int, query string) (err error) {
+	if c.chCfg.Protocol == config.ProtocolHTTP {
+		return pool.GetHTTPConn(c.taskCfg.Clickhouse, int64(shard)).Exec(query)
+	}
+	if _, err = pool.GetConn(c.taskCfg.Clickhouse, int64(shard)).Exec(query); err != nil {
+		err = errors.Wrapf(err, "")
 	}
-	//根据 Dms 生成prepare的sql语句
-	c.Dms = make([]string, 0, len(c.Dims))
-	quotedDms := make([]string, 0, len(c.Dims))
-	for _, d := range c.Dims {
-		c.Dms = append(c.Dms, d.Name)
+	return
+}
+
+func onCluster(cluster string) string {
+	if cluster == "" {
+		return ""
+	}
+	return fmt.Sprintf(" ON CLUSTER `%s`", cluster)
+}
+
+func genCreateTableSQL(db, table string, dims []*model.ColumnWithType, ctCfg *config.CreateTableConfig) string {
+	cols := make([]string, 0, len(dims))
+	for _, d := range dims {
+		cols = append(cols, fmt.Sprintf("`%s` %s", d.Name, d.Type))
+	}
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s.%s%s (%s) ENGINE = %s", db, table, onCluster(ctCfg.Cluster), strings.Join(cols, ", "), ctCfg.Engine)
+	if ctCfg.PartitionBy != "" {
+		query += " PARTITION BY " + ctCfg.PartitionBy
+	}
+	query += " ORDER BY " + ctCfg.OrderBy
+	if ctCfg.TTL != "" {
+		query += " TTL " + ctCfg.TTL
+	}
+	return query
+}
+
+func genCreateDistTableSQL(db, table string, ctCfg *config.CreateTableConfig) string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s.%s%s AS %s.%s ENGINE = Distributed('%s', '%s', '%s', %s)",
+		db, ctCfg.DistTblName, onCluster(ctCfg.Cluster), db, table, ctCfg.Cluster, db, table, ctCfg.DistShardingKey)
+}
+
+// withDedupToken adds the setting insert_deduplication_token to the INSERT query, just before its VALUES or FORMAT clause.
+func withDedupToken(query, dedupToken string) (string, error) {
+	idx := strings.LastIndex(query, " VALUES (")
+	if idx < 0 {
+		idx = strings.LastIndex(query, " FORMAT ")
+	}
+	if idx < 0 {
+		return "", errors.Errorf("failed to add insert_deduplication_token, neither VALUES nor FORMAT is found in %s", query)
+	}
+	return query[:idx] + " SETTINGS insert_deduplication_token=" + quoteString(dedupToken) + query[idx:], nil
+}
+
+// quoteString returns s as a string literal of SQL.
+func quoteString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// LoadOffset returns the offset of the partition stored in ExactlyOnce.OffsetsTable, or -1 if there's none.
+func (c *ClickHouse) LoadOffset(topic string, partition int) (offset int64, err error) {
+	var rows [][]string
+	query := fmt.Sprintf("SELECT offset FROM %s.%s WHERE task = %s AND topic = %s AND partition = %d ORDER BY offset DESC LIMIT 1",
+		c.chCfg.DB, c.taskCfg.ExactlyOnce.OffsetsTable, quoteString(c.taskCfg.Name), quoteString(topic), partition)
+	if rows, err = c.query(0, query); err != nil {
+		return
+	}
+	if len(rows) == 0 {
+		return -1, nil
+	}
+	if offset, err = strconv.ParseInt(rows[0][0], 10, 64); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+// SaveOffset stores the committed offset of the partition into ExactlyOnce.OffsetsTable.
+// `INSERT ... SELECT` works with both protocols, while `INSERT ... VALUES` requires a prepared statement of the native one.
+func (c *ClickHouse) SaveOffset(topic string, partition int, offset int64) error {
+	query := fmt.Sprintf("INSERT INTO %s.%s (task, topic, partition, offset, timestamp) SELECT %s, %s, %d, %d, now()",
+		c.chCfg.DB, c.taskCfg.ExactlyOnce.OffsetsTable, quoteString(c.taskCfg.Name), quoteString(topic), partition, offset)
+	return c.exec(0, query)
+}
+
+func genPrepareSQL(db, table string, dims []*model.ColumnWithType) string {
+	quotedDms := make([]string, 0, len(dims))
+	for _, d := range dims {
 		quotedDms = append(quotedDms, fmt.Sprintf("`%s`", d.Name))
 	}
-	var params = make([]string, len(c.Dims))
+	var params = make([]string, len(dims))
 	for i := range params {
 		params[i] = "?"
 	}
-	c.prepareSQL = "INSERT INTO " + c.chCfg.DB + "." + c.taskCfg.TableName + " (" + strings.Join(quotedDms, ",") + ") " +
+	return "INSERT INTO " + db + "." + table + " (" + strings.Join(quotedDms, ",") + ") " +
 		"VALUES (" + strings.Join(params, ",") + ")"
-
-	log.Infof("%s: Prepare sql=> %s", c.taskCfg.Name, c.prepareSQL)
-	return nil
 }
@@ -0,0 +1,176 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package output
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/ClickHouse/clickhouse-go/lib/column"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/model"
+)
+
+func TestIsRetryable(t *testing.T) {
+	col, err := column.Factory("c1", "Int32", nil)
+	require.Nil(t, err)
+	testCases := []struct {
+		err       error
+		retryable bool
+	}{
+		{&clickhouse.Exception{Code: 252, Message: "Too many parts"}, true},
+		{&clickhouse.Exception{Code: 242, Message: "Table is in readonly mode"}, true},
+		{errors.Wrap(&clickhouse.Exception{Code: 60, Message: "Table default.t1 doesn't exist"}, ""), true},
+		{&clickhouse.Exception{Code: 53, Message: "Type mismatch"}, false},
+		{&clickhouse.Exception{Code: 16, Message: "No such column c1 in table default.t1"}, false},
+		{errors.Wrap(&clickhouse.Exception{Code: 321, Message: "Value is out of range"}, ""), false},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true},
+		{driver.ErrBadConn, true},
+		{io.EOF, true},
+		{errors.New("write tcp 127.0.0.1:9000: broken pipe"), true},
+		{&column.ErrUnexpectedType{Column: col, T: "abc"}, false},
+	}
+	for i, tc := range testCases {
+		require.Equal(t, tc.retryable, isRetryable(tc.err), "case #%d: %v", i, tc.err)
+	}
+}
+
+func TestIsolateBadRows(t *testing.T) {
+	var rows model.Rows
+	for i := 0; i < 50; i++ {
+		rows = append(rows, &model.Row{i})
+	}
+	written := make(map[int]int)
+	var writes int
+	// Rows of multiples of 17 have bad values, and the replica is down when writing row 40 if readonly is set.
+	var readonly bool
+	fnWrite := func(rows model.Rows) error {
+		writes++
+		for _, row := range rows {
+			if v := (*row)[0].(int); v%17 == 0 {
+				return &clickhouse.Exception{Code: 53, Message: "Type mismatch"}
+			} else if v == 40 && readonly {
+				return &clickhouse.Exception{Code: 242, Message: "Table is in readonly mode"}
+			}
+		}
+		for _, row := range rows {
+			written[(*row)[0].(int)]++
+		}
+		return nil
+	}
+	err := fnWrite(rows)
+	require.NotNil(t, err)
+	badRows, badErrs, err := isolateBadRows(rows, err, fnWrite)
+	require.Nil(t, err)
+	require.Equal(t, len(badRows), len(badErrs))
+
+	var bad []int
+	for i, row := range badRows {
+		bad = append(bad, (*row)[0].(int))
+		require.True(t, isDataError(badErrs[i]))
+	}
+	for i := 0; i < 50; i++ {
+		if i%17 == 0 {
+			require.Contains(t, bad, i)
+			require.Equal(t, 0, written[i])
+		} else {
+			require.Equal(t, 1, written[i], "row %d shall be written exactly once", i)
+		}
+	}
+	require.True(t, writes < 50, "bisecting shall take fewer writes than one row at a time, got %d", writes)
+
+	// A transient error stops isolating, rows are never rejected because of it.
+	readonly = true
+	written = make(map[int]int)
+	err = fnWrite(rows)
+	badRows, _, err = isolateBadRows(rows, err, fnWrite)
+	require.NotNil(t, err)
+	require.False(t, isDataError(err))
+	for _, row := range badRows {
+		require.Equal(t, 0, (*row)[0].(int)%17)
+	}
+	require.Equal(t, 0, written[40])
+
+	_, _, err = isolateBadRows(rows, errors.Wrap(context.Canceled, ""), fnWrite)
+	require.True(t, errors.Is(err, context.Canceled))
+}
+
+func contains(vals []int, v int) bool {
+	for _, val := range vals {
+		if val == v {
+			return true
+		}
+	}
+	return false
+}
+
+// brokenDeadLetter fails every write.
+type brokenDeadLetter struct{}
+
+func (brokenDeadLetter) Write(records []DeadLetterRecord) error { return errors.New("disk full") }
+func (brokenDeadLetter) Close() error                           { return nil }
+
+func TestRejectRowsCanceled(t *testing.T) {
+	c := &ClickHouse{
+		taskCfg:    &config.TaskConfig{Name: "t1", FailedBatchPolicy: config.FailedBatchDeadLetter},
+		DeadLetter: brokenDeadLetter{},
+	}
+	records := []DeadLetterRecord{{Value: "{}", Error: "bad"}}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() { done <- c.rejectRows(ctx, records) }()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case ok := <-done:
+		require.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("rejectRows shall quit once the context is canceled")
+	}
+
+	c.taskCfg.FailedBatchPolicy = config.FailedBatchSkip
+	require.True(t, c.rejectRows(ctx, records))
+}
+
+func TestGenCreateTableSQL(t *testing.T) {
+	dims := []*model.ColumnWithType{{Name: "day", Type: "Date"}, {Name: "name", Type: "LowCardinality(String)"}, {Name: "value", Type: "Nullable(Float64)"}}
+	ctCfg := &config.CreateTableConfig{Engine: "MergeTree()", OrderBy: "tuple()"}
+	require.Equal(t, "CREATE TABLE IF NOT EXISTS default.t1 (`day` Date, `name` LowCardinality(String), `value` Nullable(Float64)) ENGINE = MergeTree() ORDER BY tuple()",
+		genCreateTableSQL("default", "t1", dims, ctCfg))
+
+	ctCfg = &config.CreateTableConfig{
+		Engine:          "ReplicatedMergeTree('/clickhouse/tables/{shard}/default/t1', '{replica}')",
+		OrderBy:         "(day, name)",
+		PartitionBy:     "toYYYYMM(day)",
+		TTL:             "day + INTERVAL 1 MONTH",
+		Cluster:         "abc",
+		DistTblName:     "dist_t1",
+		DistShardingKey: "rand()",
+	}
+	require.Equal(t, "CREATE TABLE IF NOT EXISTS default.t1 ON CLUSTER `abc` (`day` Date, `name` LowCardinality(String), `value` Nullable(Float64)) "+
+		"ENGINE = ReplicatedMergeTree('/clickhouse/tables/{shard}/default/t1', '{replica}') PARTITION BY toYYYYMM(day) ORDER BY (day, name) TTL day + INTERVAL 1 MONTH",
+		genCreateTableSQL("default", "t1", dims, ctCfg))
+	require.Equal(t, "CREATE TABLE IF NOT EXISTS default.dist_t1 ON CLUSTER `abc` AS default.t1 ENGINE = Distributed('abc', 'default', 't1', rand())",
+		genCreateDistTableSQL("default", "t1", ctCfg))
+}
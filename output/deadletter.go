@@ -0,0 +1,310 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package output
+
+import (
+	"bufio"
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/input"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/pool"
+)
+
+// DeadLetterRecord is a message which failed to sink, along with the reason.
+type DeadLetterRecord struct {
+	Topic     string     `json:"topic"`
+	Partition int        `json:"partition"`
+	Offset    int64      `json:"offset"`
+	Key       string     `json:"key"`
+	Value     string     `json:"value"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	Error     string     `json:"error"`
+}
+
+// NewDeadLetterRecord creates a record from the original message and the error.
+func NewDeadLetterRecord(msg *model.InputMessage, err error) DeadLetterRecord {
+	return DeadLetterRecord{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Key:       string(msg.Key),
+		Value:     string(msg.Value),
+		Timestamp: msg.Timestamp,
+		Error:     err.Error(),
+	}
+}
+
+// DeadLetter persists messages which are unable to sink, so that they can be examined and replayed later.
+// Write shall not return until records are durable, since the caller commits offsets of them thereafter.
+type DeadLetter interface {
+	Write(records []DeadLetterRecord) error
+	Close() error
+}
+
+// NewDeadLetter creates the dead letter sink of the task. Returns nil if it's not configured.
+func NewDeadLetter(cfg *config.Config, taskName string) (dl DeadLetter, err error) {
+	dlCfg := cfg.Tasks[taskName].DeadLetter
+	if dlCfg == nil {
+		return
+	}
+	switch dlCfg.Type {
+	case "kafka":
+		dl, err = newDeadLetterKafka(cfg.Kafka[dlCfg.Kafka], dlCfg.Topic)
+	case "file":
+		dl, err = newDeadLetterFile(dlCfg.File, int64(dlCfg.MaxFileSize)<<20, dlCfg.MaxBackups)
+	case "clickhouse":
+		dl, err = newDeadLetterClickHouse(cfg.Clickhouse[dlCfg.Clickhouse], dlCfg.Clickhouse, dlCfg.TableName)
+	default:
+		err = errors.Errorf("%s: deadLetter type %s is unsupported", taskName, dlCfg.Type)
+	}
+	return
+}
+
+// deadLetterKafka produces each record to the topic with the original key, value and timestamp.
+// The other fields are put into message headers.
+type deadLetterKafka struct {
+	topic    string
+	producer sarama.SyncProducer
+}
+
+func newDeadLetterKafka(kfkCfg *config.KafkaConfig, topic string) (dl *deadLetterKafka, err error) {
+	var saramaCfg *sarama.Config
+	if saramaCfg, err = input.NewSaramaConfig(kfkCfg); err != nil {
+		return
+	}
+	saramaCfg.Producer.RequiredAcks = sarama.WaitForAll
+	saramaCfg.Producer.Return.Successes = true
+	dl = &deadLetterKafka{topic: topic}
+	if dl.producer, err = sarama.NewSyncProducer(strings.Split(kfkCfg.Brokers, ","), saramaCfg); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	return
+}
+
+func (dl *deadLetterKafka) Write(records []DeadLetterRecord) (err error) {
+	msgs := make([]*sarama.ProducerMessage, 0, len(records))
+	for _, rec := range records {
+		msg := &sarama.ProducerMessage{
+			Topic: dl.topic,
+			Value: sarama.StringEncoder(rec.Value),
+			Headers: []sarama.RecordHeader{
+				{Key: []byte("topic"), Value: []byte(rec.Topic)},
+				{Key: []byte("partition"), Value: []byte(strconv.Itoa(rec.Partition))},
+				{Key: []byte("offset"), Value: []byte(strconv.FormatInt(rec.Offset, 10))},
+				{Key: []byte("error"), Value: []byte(rec.Error)},
+			},
+		}
+		if rec.Key != "" {
+			msg.Key = sarama.StringEncoder(rec.Key)
+		}
+		// Keep the original timestamp, so that the dead letter topic is ordered and retained the same way.
+		if rec.Timestamp != nil {
+			msg.Timestamp = *rec.Timestamp
+		}
+		msgs = append(msgs, msg)
+	}
+	if err = dl.producer.SendMessages(msgs); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+func (dl *deadLetterKafka) Close() error {
+	return dl.producer.Close()
+}
+
+// deadLetterFile appends each record as a JSON line to a local file.
+// The file is renamed to <file>.<timestamp> once its size exceeds maxSize, and at most maxBackups renamed files are kept.
+type deadLetterFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mux  sync.Mutex //protect fp, size
+	fp   *os.File
+	size int64
+}
+
+func newDeadLetterFile(path string, maxSize int64, maxBackups int) (dl *deadLetterFile, err error) {
+	dl = &deadLetterFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if err = dl.open(); err != nil {
+		return
+	}
+	return
+}
+
+func (dl *deadLetterFile) open() (err error) {
+	if dl.fp, err = os.OpenFile(dl.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	var fi os.FileInfo
+	if fi, err = dl.fp.Stat(); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	dl.size = fi.Size()
+	return
+}
+
+func (dl *deadLetterFile) rotate() (err error) {
+	if err = dl.fp.Close(); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	backup := dl.path + "." + time.Now().Format("20060102T150405.000000000")
+	if err = os.Rename(dl.path, backup); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	var backups []string
+	if backups, err = filepath.Glob(dl.path + ".*"); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	sort.Strings(backups)
+	for i := 0; i < len(backups)-dl.maxBackups; i++ {
+		if err = os.Remove(backups[i]); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+	}
+	return dl.open()
+}
+
+func (dl *deadLetterFile) Write(records []DeadLetterRecord) (err error) {
+	dl.mux.Lock()
+	defer dl.mux.Unlock()
+	if dl.size >= dl.maxSize {
+		if err = dl.rotate(); err != nil {
+			return
+		}
+	}
+	w := bufio.NewWriter(dl.fp)
+	var bs []byte
+	for _, rec := range records {
+		if bs, err = json.Marshal(rec); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		bs = append(bs, '\n')
+		if _, err = w.Write(bs); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		dl.size += int64(len(bs))
+	}
+	if err = w.Flush(); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if err = dl.fp.Sync(); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	return
+}
+
+func (dl *deadLetterFile) Close() error {
+	dl.mux.Lock()
+	defer dl.mux.Unlock()
+	return dl.fp.Close()
+}
+
+// deadLetterClickHouse inserts records into a table, which is expected to be:
+// CREATE TABLE <table> (topic String, partition Int64, offset Int64, key String, value String, error String, timestamp DateTime) ENGINE=MergeTree() ORDER BY (topic, partition, offset)
+type deadLetterClickHouse struct {
+	chName     string
+	prepareSQL string
+}
+
+func newDeadLetterClickHouse(chCfg *config.ClickHouseConfig, chName, tableName string) (dl *deadLetterClickHouse, err error) {
+	var tlsConfig *tls.Config
+	if tlsConfig, err = newTLSConfig(chCfg); err != nil {
+		return
+	}
+	if err = pool.InitConn(chName, chCfg.Hosts, chCfg.Port, chCfg.DB, chCfg.Username, chCfg.Password, chCfg.DsnParams, tlsConfig); err != nil {
+		return
+	}
+	dl = &deadLetterClickHouse{
+		chName: chName,
+		prepareSQL: fmt.Sprintf("INSERT INTO %s.%s (`topic`,`partition`,`offset`,`key`,`value`,`error`,`timestamp`) VALUES (?,?,?,?,?,?,?)",
+			chCfg.DB, tableName),
+	}
+	return
+}
+
+func (dl *deadLetterClickHouse) Write(records []DeadLetterRecord) (err error) {
+	var tx *sql.Tx
+	var stmt *sql.Stmt
+	conn := pool.GetConn(dl.chName, 0)
+	defer func() {
+		if shouldReconnect(err) {
+			_ = conn.ReConnect()
+		}
+	}()
+	if tx, err = conn.Begin(); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if stmt, err = tx.Prepare(dl.prepareSQL); err != nil {
+		_ = tx.Rollback()
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer stmt.Close()
+	for _, rec := range records {
+		ts := time.Now()
+		if rec.Timestamp != nil {
+			ts = *rec.Timestamp
+		}
+		if _, err = stmt.Exec(rec.Topic, int64(rec.Partition), rec.Offset, rec.Key, rec.Value, rec.Error, ts); err != nil {
+			_ = tx.Rollback()
+			err = errors.Wrapf(err, "")
+			return
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	return
+}
+
+func (dl *deadLetterClickHouse) Close() error {
+	pool.FreeConn(dl.chName)
+	return nil
+}
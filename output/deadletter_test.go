@@ -0,0 +1,125 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package output
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/housepower/clickhouse_sinker/model"
+)
+
+func readDeadLetterFile(t *testing.T, path string) (records []DeadLetterRecord) {
+	fp, err := os.Open(path)
+	require.Nil(t, err)
+	defer fp.Close()
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		var rec DeadLetterRecord
+		require.Nil(t, json.Unmarshal(scanner.Bytes(), &rec))
+		records = append(records, rec)
+	}
+	require.Nil(t, scanner.Err())
+	return
+}
+
+func TestDeadLetterFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clickhouse_sinker")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dlq", "task1.json")
+
+	rec := NewDeadLetterRecord(&model.InputMessage{Topic: "topic1", Partition: 3, Offset: 100, Key: []byte("k"), Value: []byte(`{"a":`)}, errors.New("unexpected EOF"))
+	bs, err := json.Marshal(rec)
+	require.Nil(t, err)
+	recSize := int64(len(bs) + 1)
+
+	// Rotate once the file holds 2 records, keep at most 2 rotated files.
+	dl, err := newDeadLetterFile(path, 2*recSize, 2)
+	require.Nil(t, err)
+	require.Nil(t, dl.Write([]DeadLetterRecord{rec}))
+	require.Equal(t, []DeadLetterRecord{rec}, readDeadLetterFile(t, path))
+	for i := 1; i < 8; i++ {
+		rec.Offset = 100 + int64(i)
+		require.Nil(t, dl.Write([]DeadLetterRecord{rec}))
+	}
+	require.Nil(t, dl.Close())
+
+	backups, err := filepath.Glob(path + ".*")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(backups))
+	records := readDeadLetterFile(t, backups[0])
+	require.Equal(t, 2, len(records))
+	require.Equal(t, int64(102), records[0].Offset)
+	records = readDeadLetterFile(t, path)
+	require.Equal(t, 2, len(records))
+	require.Equal(t, "topic1", records[1].Topic)
+	require.Equal(t, 3, records[1].Partition)
+	require.Equal(t, int64(107), records[1].Offset)
+	require.Equal(t, `{"a":`, records[1].Value)
+	require.Equal(t, "unexpected EOF", records[1].Error)
+
+	// Reopen appends to the existing file.
+	dl, err = newDeadLetterFile(path, 2*recSize, 2)
+	require.Nil(t, err)
+	require.Equal(t, 2*recSize, dl.size)
+	require.Nil(t, dl.Close())
+}
+
+// recordingProducer is a sarama.SyncProducer which remembers sent messages.
+type recordingProducer struct {
+	sarama.SyncProducer
+	msgs []*sarama.ProducerMessage
+}
+
+func (p *recordingProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	p.msgs = append(p.msgs, msgs...)
+	return nil
+}
+
+func TestDeadLetterKafka(t *testing.T) {
+	producer := &recordingProducer{}
+	dl := &deadLetterKafka{topic: "dlq", producer: producer}
+	ts := time.Unix(1600000000, 0)
+	require.Nil(t, dl.Write([]DeadLetterRecord{
+		NewDeadLetterRecord(&model.InputMessage{Topic: "topic1", Partition: 3, Offset: 100, Key: []byte("k"), Value: []byte("v"), Timestamp: &ts}, errors.New("bad")),
+		newRowDeadLetterRecord("topic1", &model.Row{int64(1)}, []*model.ColumnWithType{{Name: "a"}}, errors.New("bad")),
+	}))
+	require.Equal(t, 2, len(producer.msgs))
+	msg := producer.msgs[0]
+	require.Equal(t, "dlq", msg.Topic)
+	require.Equal(t, sarama.StringEncoder("k"), msg.Key)
+	require.Equal(t, sarama.StringEncoder("v"), msg.Value)
+	require.Equal(t, ts, msg.Timestamp)
+	require.Equal(t, []sarama.RecordHeader{
+		{Key: []byte("topic"), Value: []byte("topic1")},
+		{Key: []byte("partition"), Value: []byte("3")},
+		{Key: []byte("offset"), Value: []byte("100")},
+		{Key: []byte("error"), Value: []byte("bad")},
+	}, msg.Headers)
+	// Rows have no original timestamp, the producer stamps them.
+	require.Nil(t, producer.msgs[1].Key)
+	require.True(t, producer.msgs[1].Timestamp.IsZero())
+}
@@ -0,0 +1,418 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package output
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/pool"
+	"github.com/housepower/clickhouse_sinker/statistics"
+)
+
+// valueEncoder appends a value of the column to buf.
+type valueEncoder func(buf []byte, v interface{}) ([]byte, error)
+
+// writeRowsHTTP inserts rows via the HTTP interface, the whole batch is sent as one request.
+func (c *ClickHouse) writeRowsHTTP(rows model.Rows, dims []*model.ColumnWithType, dedupToken string, batchIdx int64) (err error) {
+	if len(rows) == 0 {
+		return nil
+	}
+	var format string
+	if format, err = httpFormatOf(dims, c.chCfg.HTTPFormat); err != nil {
+		return
+	}
+	var body []byte
+	if body, err = encodeRows(rows, dims, format); err != nil {
+		return
+	}
+	query := genInsertSQL(c.chCfg.DB, c.taskCfg.TableName, dims, format)
+	if dedupToken != "" {
+		if query, err = withDedupToken(query, dedupToken); err != nil {
+			return
+		}
+	}
+	if err = pool.GetHTTPConn(c.taskCfg.Clickhouse, batchIdx).Insert(query, body); err != nil {
+		return
+	}
+	statistics.FlushMsgsTotal.WithLabelValues(c.taskCfg.Name).Add(float64(len(rows)))
+	return
+}
+
+func genInsertSQL(db, table string, dims []*model.ColumnWithType, format string) string {
+	quotedDms := make([]string, 0, len(dims))
+	for _, d := range dims {
+		quotedDms = append(quotedDms, fmt.Sprintf("`%s`", d.Name))
+	}
+	return "INSERT INTO " + db + "." + table + " (" + strings.Join(quotedDms, ",") + ") FORMAT " + format
+}
+
+// httpFormatOf returns the format to insert the columns in. It's the configured one if all columns are supported by it,
+// otherwise JSONEachRow if RowBinary is configured and JSONEachRow supports all columns.
+func httpFormatOf(dims []*model.ColumnWithType, format string) (string, error) {
+	err := checkColumnTypes(dims, format)
+	if err == nil {
+		return format, nil
+	}
+	if format == config.HTTPFormatRowBinary && checkColumnTypes(dims, config.HTTPFormatJSONEachRow) == nil {
+		return config.HTTPFormatJSONEachRow, nil
+	}
+	return "", err
+}
+
+// checkColumnTypes returns an error if any column type is unsupported by the format.
+func checkColumnTypes(dims []*model.ColumnWithType, format string) (err error) {
+	for _, dim := range dims {
+		if format == config.HTTPFormatJSONEachRow {
+			_, err = newJSONEncoder(dim.Type)
+		} else {
+			_, err = newRowBinaryEncoder(dim.Type)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "column %s", dim.Name)
+		}
+	}
+	return
+}
+
+// encodeRows encodes rows in RowBinary or JSONEachRow format.
+func encodeRows(rows model.Rows, dims []*model.ColumnWithType, format string) (buf []byte, err error) {
+	encoders := make([]valueEncoder, len(dims))
+	for i, dim := range dims {
+		if format == config.HTTPFormatJSONEachRow {
+			encoders[i], err = newJSONEncoder(dim.Type)
+		} else {
+			encoders[i], err = newRowBinaryEncoder(dim.Type)
+		}
+		if err != nil {
+			return
+		}
+	}
+	var names [][]byte
+	if format == config.HTTPFormatJSONEachRow {
+		for _, dim := range dims {
+			name, _ := json.Marshal(dim.Name)
+			names = append(names, append(name, ':'))
+		}
+	}
+	for _, row := range rows {
+		if len(*row) != len(dims) {
+			return nil, errors.Errorf("expected %d columns, got %d", len(dims), len(*row))
+		}
+		for i, v := range *row {
+			if names != nil {
+				if i == 0 {
+					buf = append(buf, '{')
+				} else {
+					buf = append(buf, ',')
+				}
+				buf = append(buf, names[i]...)
+			}
+			if buf, err = encoders[i](buf, v); err != nil {
+				return nil, errors.Wrapf(err, "column %s", dims[i].Name)
+			}
+		}
+		if names != nil {
+			buf = append(buf, '}', '\n')
+		}
+	}
+	return
+}
+
+// newRowBinaryEncoder returns the encoder of the column type in RowBinary format.
+func newRowBinaryEncoder(chType string) (enc valueEncoder, err error) {
+	if inner, ok := unwrapType(chType, "LowCardinality("); ok {
+		// It's the same as the inner type in RowBinary.
+		return newRowBinaryEncoder(inner)
+	}
+	if inner, ok := unwrapType(chType, "Nullable("); ok {
+		var elem valueEncoder
+		if elem, err = newRowBinaryEncoder(inner); err != nil {
+			return
+		}
+		return func(buf []byte, v interface{}) ([]byte, error) {
+			if v == nil {
+				return append(buf, 1), nil
+			}
+			return elem(append(buf, 0), v)
+		}, nil
+	}
+	if inner, ok := unwrapType(chType, "Array("); ok {
+		var elem valueEncoder
+		if elem, err = newRowBinaryEncoder(inner); err != nil {
+			return
+		}
+		return func(buf []byte, v interface{}) ([]byte, error) {
+			return encodeArray(buf, v, elem, func(buf []byte, n int) []byte {
+				return appendUvarint(buf, uint64(n))
+			}, nil)
+		}, nil
+	}
+	switch chType {
+	case "Int8", "UInt8":
+		return intEncoder(func(buf []byte, v int64) []byte { return append(buf, byte(v)) }), nil
+	case "Int16", "UInt16":
+		return intEncoder(func(buf []byte, v int64) []byte { return appendUint16(buf, uint16(v)) }), nil
+	case "Int32", "UInt32":
+		return intEncoder(func(buf []byte, v int64) []byte { return appendUint32(buf, uint32(v)) }), nil
+	case "Int64", "UInt64":
+		return intEncoder(func(buf []byte, v int64) []byte { return appendUint64(buf, uint64(v)) }), nil
+	case "Float32":
+		return floatEncoder(func(buf []byte, v float64) []byte {
+			return appendUint32(buf, math.Float32bits(float32(v)))
+		}), nil
+	case "Float64":
+		return floatEncoder(func(buf []byte, v float64) []byte { return appendUint64(buf, math.Float64bits(v)) }), nil
+	case "String":
+		return stringEncoder(func(buf []byte, v string) []byte {
+			return append(appendUvarint(buf, uint64(len(v))), v...)
+		}), nil
+	case "Date":
+		return timeEncoder(func(buf []byte, v time.Time) []byte {
+			return appendUint16(buf, uint16(daysSinceEpoch(v)))
+		}), nil
+	}
+	if strings.HasPrefix(chType, "FixedString(") {
+		var size int
+		if size, err = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(chType, "FixedString("), ")")); err != nil {
+			return nil, errors.Wrapf(err, "type %s", chType)
+		}
+		return stringEncoder(func(buf []byte, v string) []byte {
+			if len(v) > size {
+				v = v[:size]
+			}
+			buf = append(buf, v...)
+			for i := len(v); i < size; i++ {
+				buf = append(buf, 0)
+			}
+			return buf
+		}), nil
+	}
+	if chType == "ElasticDateTime" || strings.HasPrefix(chType, "DateTime(") || chType == "DateTime" {
+		return secondsEncoder(func(buf []byte, v int64) []byte { return appendUint32(buf, uint32(v)) }), nil
+	}
+	if strings.HasPrefix(chType, "DateTime64") {
+		scale := dateTime64Scale(chType)
+		return timeEncoder(func(buf []byte, v time.Time) []byte {
+			var ts int64
+			if !v.IsZero() {
+				ts = v.UnixNano() / scale
+			}
+			return appendUint64(buf, uint64(ts))
+		}), nil
+	}
+	return nil, errors.Errorf("type %s is unsupported by RowBinary", chType)
+}
+
+// newJSONEncoder returns the encoder of the column type in JSONEachRow format.
+func newJSONEncoder(chType string) (enc valueEncoder, err error) {
+	if inner, ok := unwrapType(chType, "LowCardinality("); ok {
+		return newJSONEncoder(inner)
+	}
+	if inner, ok := unwrapType(chType, "Nullable("); ok {
+		var elem valueEncoder
+		if elem, err = newJSONEncoder(inner); err != nil {
+			return
+		}
+		return func(buf []byte, v interface{}) ([]byte, error) {
+			if v == nil {
+				return append(buf, "null"...), nil
+			}
+			return elem(buf, v)
+		}, nil
+	}
+	if inner, ok := unwrapType(chType, "Array("); ok {
+		var elem valueEncoder
+		if elem, err = newJSONEncoder(inner); err != nil {
+			return
+		}
+		return func(buf []byte, v interface{}) ([]byte, error) {
+			buf, err := encodeArray(buf, v, elem, func(buf []byte, n int) []byte { return append(buf, '[') }, []byte(","))
+			if err != nil {
+				return buf, err
+			}
+			return append(buf, ']'), nil
+		}, nil
+	}
+	switch {
+	case strings.HasPrefix(chType, "UInt"):
+		return intEncoder(func(buf []byte, v int64) []byte { return strconv.AppendUint(buf, uint64(v), 10) }), nil
+	case strings.HasPrefix(chType, "Int"):
+		return intEncoder(func(buf []byte, v int64) []byte { return strconv.AppendInt(buf, v, 10) }), nil
+	case strings.HasPrefix(chType, "Float"):
+		return floatEncoder(func(buf []byte, v float64) []byte {
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				// JSON has no literal for them, ClickHouse parses them from strings.
+				return strconv.AppendQuote(buf, strconv.FormatFloat(v, 'g', -1, 64))
+			}
+			return strconv.AppendFloat(buf, v, 'g', -1, 64)
+		}), nil
+	case chType == "String", strings.HasPrefix(chType, "FixedString("):
+		return stringEncoder(func(buf []byte, v string) []byte {
+			bs, _ := json.Marshal(v)
+			return append(buf, bs...)
+		}), nil
+	case chType == "Date":
+		return timeEncoder(func(buf []byte, v time.Time) []byte {
+			return append(append(append(buf, '"'), v.Format("2006-01-02")...), '"')
+		}), nil
+	case chType == "ElasticDateTime", chType == "DateTime", strings.HasPrefix(chType, "DateTime("):
+		return secondsEncoder(func(buf []byte, v int64) []byte { return strconv.AppendInt(buf, v, 10) }), nil
+	case strings.HasPrefix(chType, "DateTime64"):
+		return timeEncoder(func(buf []byte, v time.Time) []byte {
+			if v.IsZero() {
+				return append(buf, '0')
+			}
+			return append(buf, fmt.Sprintf("%d.%09d", v.Unix(), v.Nanosecond())...)
+		}), nil
+	}
+	return nil, errors.Errorf("type %s is unsupported by JSONEachRow", chType)
+}
+
+// unwrapType returns the inner type of a wrapper type such as Nullable(T), Array(T).
+func unwrapType(chType, prefix string) (inner string, ok bool) {
+	if strings.HasPrefix(chType, prefix) && strings.HasSuffix(chType, ")") {
+		return chType[len(prefix) : len(chType)-1], true
+	}
+	return
+}
+
+// encodeArray encodes v, which is a slice or nil, with begin, separator and the element encoder.
+func encodeArray(buf []byte, v interface{}, enc valueEncoder, begin func(buf []byte, n int) []byte, sep []byte) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	if v != nil && rv.Kind() != reflect.Slice {
+		return buf, errors.Errorf("unexpected type %T of value %v for an array column", v, v)
+	}
+	n := 0
+	if v != nil {
+		n = rv.Len()
+	}
+	buf = begin(buf, n)
+	var err error
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			buf = append(buf, sep...)
+		}
+		if buf, err = enc(buf, rv.Index(i).Interface()); err != nil {
+			return buf, err
+		}
+	}
+	return buf, nil
+}
+
+func intEncoder(fn func(buf []byte, v int64) []byte) valueEncoder {
+	return func(buf []byte, v interface{}) ([]byte, error) {
+		if val, ok := asInt64(v); ok {
+			return fn(buf, val), nil
+		}
+		return buf, errors.Errorf("unexpected type %T of value %v for an integer column", v, v)
+	}
+}
+
+func floatEncoder(fn func(buf []byte, v float64) []byte) valueEncoder {
+	return func(buf []byte, v interface{}) ([]byte, error) {
+		if val, ok := asFloat64(v); ok {
+			return fn(buf, val), nil
+		}
+		return buf, errors.Errorf("unexpected type %T of value %v for a float column", v, v)
+	}
+}
+
+func stringEncoder(fn func(buf []byte, v string) []byte) valueEncoder {
+	return func(buf []byte, v interface{}) ([]byte, error) {
+		switch val := v.(type) {
+		case string:
+			return fn(buf, val), nil
+		case []byte:
+			return fn(buf, string(val)), nil
+		}
+		return buf, errors.Errorf("unexpected type %T of value %v for a string column", v, v)
+	}
+}
+
+func timeEncoder(fn func(buf []byte, v time.Time) []byte) valueEncoder {
+	return func(buf []byte, v interface{}) ([]byte, error) {
+		if val, ok := v.(time.Time); ok {
+			return fn(buf, val), nil
+		}
+		return buf, errors.Errorf("unexpected type %T of value %v for a date column", v, v)
+	}
+}
+
+// secondsEncoder accepts either time.Time or unix seconds(ElasticDateTime).
+func secondsEncoder(fn func(buf []byte, v int64) []byte) valueEncoder {
+	return func(buf []byte, v interface{}) ([]byte, error) {
+		if val, ok := v.(time.Time); ok {
+			if val.IsZero() {
+				return fn(buf, 0), nil
+			}
+			return fn(buf, val.Unix()), nil
+		}
+		if val, ok := asInt64(v); ok {
+			return fn(buf, val), nil
+		}
+		return buf, errors.Errorf("unexpected type %T of value %v for a datetime column", v, v)
+	}
+}
+
+// daysSinceEpoch is the same as how clickhouse-go writes a Date, the date is the one in the time's location.
+func daysSinceEpoch(t time.Time) int64 {
+	_, offset := t.Zone()
+	return (t.Unix() + int64(offset)) / 86400
+}
+
+// dateTime64Scale returns nanoseconds per tick of DateTime64(precision[, timezone]), precision defaults to 3.
+func dateTime64Scale(chType string) int64 {
+	precision := 3
+	if args, ok := unwrapType(chType, "DateTime64("); ok {
+		if p, err := strconv.Atoi(strings.TrimSpace(strings.Split(args, ",")[0])); err == nil {
+			precision = p
+		}
+	}
+	scale := int64(1)
+	for i := precision; i < 9; i++ {
+		scale *= 10
+	}
+	return scale
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v), byte(v>>8))
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	return appendUint32(appendUint32(buf, uint32(v)), uint32(v>>32))
+}
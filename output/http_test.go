@@ -0,0 +1,486 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package output
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/lib/binary"
+	"github.com/ClickHouse/clickhouse-go/lib/column"
+	"github.com/stretchr/testify/require"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/pool"
+)
+
+// Each RowBinary value is the same as a native column of one row, except that arrays are prefixed with a varint length.
+func TestEncodeRowBinary(t *testing.T) {
+	rows := genBlockTestRows(10)
+	body, err := encodeRows(rows, blockTestDims, config.HTTPFormatRowBinary)
+	require.Nil(t, err)
+	var exp bytes.Buffer
+	enc := binary.NewEncoder(&exp)
+	for _, row := range rows {
+		for i, dim := range blockTestDims {
+			typ, v := dim.Type, (*row)[i]
+			if inner, ok := unwrapType(typ, "Array("); ok {
+				rv := reflect.ValueOf(v)
+				require.Nil(t, enc.Uvarint(uint64(rv.Len())))
+				col, err := column.Factory(dim.Name, inner, time.UTC)
+				require.Nil(t, err)
+				for j := 0; j < rv.Len(); j++ {
+					require.Nil(t, col.Write(enc, rv.Index(j).Interface()))
+				}
+				continue
+			}
+			col, err := column.Factory(dim.Name, typ, time.UTC)
+			require.Nil(t, err)
+			require.Nil(t, col.Write(enc, v))
+		}
+	}
+	require.Equal(t, exp.Bytes(), body)
+
+	dims := []*model.ColumnWithType{{Name: "ni", Type: "Nullable(Int32)"}, {Name: "fs", Type: "FixedString(3)"}, {Name: "dt64", Type: "DateTime64(3)"}}
+	ts := time.Unix(1600000000, 123456789)
+	body, err = encodeRows(model.Rows{&model.Row{nil, "ab", ts}, &model.Row{int64(-2), "abcd", time.Time{}}}, dims, config.HTTPFormatRowBinary)
+	require.Nil(t, err)
+	require.Equal(t, []byte{1, 'a', 'b', 0, 0x7b, 0x80, 0x6e, 0x87, 0x74, 0x01, 0, 0,
+		0, 0xfe, 0xff, 0xff, 0xff, 'a', 'b', 'c', 0, 0, 0, 0, 0, 0, 0, 0}, body)
+
+	_, err = encodeRows(rows, []*model.ColumnWithType{{Name: "d", Type: "Decimal(9,2)"}}, config.HTTPFormatRowBinary)
+	require.NotNil(t, err)
+	_, err = encodeRows(model.Rows{&model.Row{"x"}}, blockTestDims[:1], config.HTTPFormatRowBinary)
+	require.NotNil(t, err)
+}
+
+func TestEncodeJSONEachRow(t *testing.T) {
+	dims := []*model.ColumnWithType{
+		{Name: "i", Type: "Int64"},
+		{Name: "u", Type: "UInt64"},
+		{Name: "f", Type: "Float64"},
+		{Name: "s", Type: "Nullable(String)"},
+		{Name: "d", Type: "Date"},
+		{Name: "dt", Type: "DateTime"},
+		{Name: "dt64", Type: "DateTime64(3)"},
+		{Name: "as", Type: "Array(String)"},
+		{Name: "af", Type: "Array(Float32)"},
+	}
+	ts := time.Date(2020, 11, 11, 8, 30, 0, 5000000, time.UTC)
+	rows := model.Rows{
+		&model.Row{int64(-1), int64(1), 1.5, "a\"b", ts, ts, ts, []string{"x", "y"}, []float64{0.5}},
+		&model.Row{int64(0), int64(0), 0.0, nil, ts, int64(1600000000), time.Time{}, nil, []float64{}},
+	}
+	body, err := encodeRows(rows, dims, config.HTTPFormatJSONEachRow)
+	require.Nil(t, err)
+	require.Equal(t, `{"i":-1,"u":1,"f":1.5,"s":"a\"b","d":"2020-11-11","dt":1605083400,"dt64":1605083400.005000000,"as":["x","y"],"af":[0.5]}
+{"i":0,"u":0,"f":0,"s":null,"d":"2020-11-11","dt":1600000000,"dt64":0,"as":[],"af":[]}
+`, string(body))
+}
+
+func TestHTTPFormatOf(t *testing.T) {
+	dims := []*model.ColumnWithType{{Name: "s", Type: "LowCardinality(String)"}, {Name: "n", Type: "Nullable(Int64)"}}
+	format, err := httpFormatOf(dims, config.HTTPFormatRowBinary)
+	require.Nil(t, err)
+	require.Equal(t, config.HTTPFormatRowBinary, format)
+
+	// JSONEachRow is used instead if only it supports all columns.
+	dims = append(dims, &model.ColumnWithType{Name: "big", Type: "Int128"})
+	format, err = httpFormatOf(dims, config.HTTPFormatRowBinary)
+	require.Nil(t, err)
+	require.Equal(t, config.HTTPFormatJSONEachRow, format)
+
+	for _, typ := range []string{"Decimal(9,2)", "UUID", "IPv4", "IPv6", "Nullable(UUID)", "LowCardinality(Nullable(IPv6))"} {
+		_, err = httpFormatOf([]*model.ColumnWithType{{Name: "c", Type: typ}}, config.HTTPFormatRowBinary)
+		require.NotNil(t, err, typ)
+	}
+}
+
+type fakeHTTPServer struct {
+	mux        sync.Mutex
+	inserts    []string
+	bodies     [][]byte
+	errCode    string //reply inserts with an exception if it's not empty
+	badGateway bool   //reply inserts as a proxy which failed to reach ClickHouse
+	execs      []string
+	offset     string //reply queries of the offsets table
+	columns    string //reply queries of system.columns if it's not empty
+	dropped    string //reply inserts into the column with NO_SUCH_COLUMN_IN_TABLE
+}
+
+func (s *fakeHTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/ping" {
+		_, _ = w.Write([]byte("Ok.\n"))
+		return
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok || user != "u1" || password != "p1" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	params := r.URL.Query()
+	if params.Get("database") != "db1" || params.Get("insert_quorum") != "2" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var body []byte
+	var err error
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(r.Body); err == nil {
+			body, err = ioutil.ReadAll(zr)
+		}
+	} else {
+		body, err = ioutil.ReadAll(r.Body)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	query := params.Get("query")
+	if query == "" {
+		query = string(body)
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	switch {
+	case strings.HasPrefix(query, "select name, type, default_kind from system.columns"):
+		if s.columns != "" {
+			_, _ = w.Write([]byte(s.columns))
+			return
+		}
+		_, _ = w.Write([]byte("id\tInt64\t\nname\tNullable(String)\t\ntags\tArray(String)\t\nts\tDateTime\t\nday\tDate\tMATERIALIZED\n"))
+	case strings.HasPrefix(query, "SELECT offset FROM db1.offsets"):
+		_, _ = w.Write([]byte(s.offset))
+	case strings.HasPrefix(query, "INSERT INTO db1.offsets"):
+		s.execs = append(s.execs, query)
+	case strings.HasPrefix(query, "INSERT INTO"):
+		if s.errCode != "" {
+			w.Header().Set("X-ClickHouse-Exception-Code", s.errCode)
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte("Code: " + s.errCode + ". DB::Exception: something wrong"))
+			return
+		}
+		if s.badGateway {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if s.dropped != "" && strings.Contains(query, "`"+s.dropped+"`") {
+			w.Header().Set("X-ClickHouse-Exception-Code", "16")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("Code: 16. DB::Exception: No such column " + s.dropped + " in table db1.t1"))
+			return
+		}
+		s.inserts = append(s.inserts, query)
+		s.bodies = append(s.bodies, body)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func TestHTTPWriteRows(t *testing.T) {
+	srv := &fakeHTTPServer{}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.Nil(t, err)
+
+	cfg := &config.Config{
+		Clickhouse: map[string]*config.ClickHouseConfig{"ch_http": {
+			DB:              "db1",
+			Hosts:           [][]string{{"127.0.0.1"}},
+			Port:            port,
+			Username:        "u1",
+			Password:        "p1",
+			Protocol:        config.ProtocolHTTP,
+			HTTPFormat:      config.HTTPFormatRowBinary,
+			HTTPCompression: config.HTTPCompressionGzip,
+			Settings:        map[string]string{"insert_quorum": "2"},
+		}},
+		Tasks: map[string]*config.TaskConfig{"test_http": {Name: "test_http", Clickhouse: "ch_http", TableName: "t1", AutoSchema: true}},
+	}
+	// Tables with columns unsupported by the http protocol are refused.
+	srv.columns = "id\tInt64\t\nuid\tUUID\t\n"
+	require.NotNil(t, NewClickHouse(cfg, "test_http").Init(nil))
+	pool.FreeConn("ch_http")
+	srv.columns = ""
+
+	c := NewClickHouse(cfg, "test_http")
+	require.Nil(t, c.Init(nil))
+	defer c.Stop()
+	require.Equal(t, 1, c.NumShards())
+	require.Equal(t, []string{"id", "name", "tags", "ts"}, c.Dms)
+
+	rows := model.Rows{&model.Row{int64(1), nil, []string{"a"}, time.Unix(1600000000, 0)}}
+	dims, prepareSQL := c.batchSchema(&model.Batch{})
+	require.Nil(t, c.writeRows(rows, dims, prepareSQL, "", 0))
+	expBody, err := encodeRows(rows, dims, config.HTTPFormatRowBinary)
+	require.Nil(t, err)
+	require.Equal(t, []string{"INSERT INTO db1.t1 (`id`,`name`,`tags`,`ts`) FORMAT RowBinary"}, srv.inserts)
+	require.Equal(t, [][]byte{expBody}, srv.bodies)
+
+	c.chCfg.HTTPFormat = config.HTTPFormatJSONEachRow
+	require.Nil(t, c.writeRows(rows, dims, prepareSQL, "", 0))
+	require.Equal(t, "INSERT INTO db1.t1 (`id`,`name`,`tags`,`ts`) FORMAT JSONEachRow", srv.inserts[1])
+	require.Equal(t, `{"id":1,"name":null,"tags":["a"],"ts":1600000000}`+"\n", string(srv.bodies[1]))
+
+	require.Nil(t, c.writeRows(rows, dims, prepareSQL, "topic1/0/10-20", 0))
+	require.Equal(t, "INSERT INTO db1.t1 (`id`,`name`,`tags`,`ts`) SETTINGS insert_deduplication_token='topic1/0/10-20' FORMAT JSONEachRow", srv.inserts[2])
+
+	// Exceptions are classified the same as the native protocol.
+	srv.errCode = "53"
+	err = c.writeRows(rows, dims, prepareSQL, "", 0)
+	require.NotNil(t, err)
+	require.False(t, isRetryable(err))
+	srv.errCode = ""
+	srv.badGateway = true
+	err = c.writeRows(rows, dims, prepareSQL, "", 0)
+	require.NotNil(t, err)
+	require.True(t, isRetryable(err))
+}
+
+func TestHTTPWriteRowsTLS(t *testing.T) {
+	srv := &fakeHTTPServer{}
+	ts := httptest.NewTLSServer(srv)
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.Nil(t, err)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.Nil(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0644))
+
+	chCfg := &config.ClickHouseConfig{
+		DB:              "db1",
+		Hosts:           [][]string{{"127.0.0.1"}},
+		Port:            port,
+		Username:        "u1",
+		Password:        "p1",
+		Protocol:        config.ProtocolHTTP,
+		HTTPFormat:      config.HTTPFormatJSONEachRow,
+		HTTPCompression: config.HTTPCompressionNone,
+		Settings:        map[string]string{"insert_quorum": "2"},
+	}
+	chCfg.TLS.Enable = true
+	chCfg.TLS.CaCertFiles = caFile
+	cfg := &config.Config{
+		Clickhouse: map[string]*config.ClickHouseConfig{"ch_https": chCfg},
+		Tasks:      map[string]*config.TaskConfig{"test_https": {Name: "test_https", Clickhouse: "ch_https", TableName: "t1", AutoSchema: true}},
+	}
+	c := NewClickHouse(cfg, "test_https")
+	require.Nil(t, c.Init(nil))
+	defer c.Stop()
+	require.Nil(t, pool.GetHTTPConn("ch_https", 0).Ping())
+	rows := model.Rows{&model.Row{int64(1), "x", []string{}, time.Unix(1600000000, 0)}}
+	dims, prepareSQL := c.batchSchema(&model.Batch{})
+	require.Nil(t, c.writeRows(rows, dims, prepareSQL, "", 0))
+	require.Equal(t, `{"id":1,"name":"x","tags":[],"ts":1600000000}`+"\n", string(srv.bodies[0]))
+
+	// The server cert isn't signed by the system CAs.
+	require.Nil(t, pool.InitHTTPConn("ch_https_untrusted", chCfg.Hosts, port, chCfg.DB, pool.HTTPOptions{TLSConfig: &tls.Config{}}))
+	defer pool.FreeConn("ch_https_untrusted")
+	require.NotNil(t, pool.GetHTTPConn("ch_https_untrusted", 0).Ping())
+}
+
+func TestWithDedupToken(t *testing.T) {
+	query, err := withDedupToken("INSERT INTO db.t (`a`,`b`) VALUES (?,?)", "t'1/0/1-2")
+	require.Nil(t, err)
+	require.Equal(t, "INSERT INTO db.t (`a`,`b`) SETTINGS insert_deduplication_token='t\\'1/0/1-2' VALUES (?,?)", query)
+	query, err = withDedupToken("INSERT INTO db.t (`a`,`b`) FORMAT RowBinary", "t1/0:1-2,3:5-9/shard1")
+	require.Nil(t, err)
+	require.Equal(t, "INSERT INTO db.t (`a`,`b`) SETTINGS insert_deduplication_token='t1/0:1-2,3:5-9/shard1' FORMAT RowBinary", query)
+	_, err = withDedupToken("INSERT INTO db.t SELECT 1", "t1/0/1-2")
+	require.NotNil(t, err)
+}
+
+func TestHTTPOffsetsTable(t *testing.T) {
+	srv := &fakeHTTPServer{}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.Nil(t, err)
+
+	taskCfg := &config.TaskConfig{Name: "test_offsets", Clickhouse: "ch_offsets", TableName: "t1", AutoSchema: true}
+	taskCfg.ExactlyOnce.Enable = true
+	taskCfg.ExactlyOnce.OffsetsTable = "offsets"
+	cfg := &config.Config{
+		Clickhouse: map[string]*config.ClickHouseConfig{"ch_offsets": {
+			DB:       "db1",
+			Hosts:    [][]string{{"127.0.0.1"}},
+			Port:     port,
+			Username: "u1",
+			Password: "p1",
+			Protocol: config.ProtocolHTTP,
+			Settings: map[string]string{"insert_quorum": "2"},
+		}},
+		Tasks: map[string]*config.TaskConfig{"test_offsets": taskCfg},
+	}
+	c := NewClickHouse(cfg, "test_offsets")
+	require.Nil(t, c.Init(nil))
+	defer c.Stop()
+
+	offset, err := c.LoadOffset("topic1", 3)
+	require.Nil(t, err)
+	require.Equal(t, int64(-1), offset)
+	srv.offset = "12345\n"
+	offset, err = c.LoadOffset("topic1", 3)
+	require.Nil(t, err)
+	require.Equal(t, int64(12345), offset)
+
+	require.Nil(t, c.SaveOffset("topic1", 3, 23456))
+	require.Equal(t, []string{"INSERT INTO db1.offsets (task, topic, partition, offset, timestamp) SELECT 'test_offsets', 'topic1', 3, 23456, now()"}, srv.execs)
+}
+
+func TestRebuildBatchOnDroppedColumn(t *testing.T) {
+	srv := &fakeHTTPServer{}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(u.Port())
+	require.Nil(t, err)
+
+	taskCfg := &config.TaskConfig{Name: "test_rebuild", Clickhouse: "ch_rebuild", TableName: "t1", AutoSchema: true, FailedBatchPolicy: config.FailedBatchSkip}
+	cfg := &config.Config{
+		Clickhouse: map[string]*config.ClickHouseConfig{"ch_rebuild": {
+			DB:         "db1",
+			Hosts:      [][]string{{"127.0.0.1"}},
+			Port:       port,
+			Username:   "u1",
+			Password:   "p1",
+			Protocol:   config.ProtocolHTTP,
+			HTTPFormat: config.HTTPFormatJSONEachRow,
+			Settings:   map[string]string{"insert_quorum": "2"},
+		}},
+		Tasks: map[string]*config.TaskConfig{"test_rebuild": taskCfg},
+	}
+	c := NewClickHouse(cfg, "test_rebuild")
+	require.Nil(t, c.Init(nil))
+	defer c.Stop()
+
+	// The column tags is dropped after the batch has been generated.
+	batch := &model.Batch{Rows: &model.Rows{&model.Row{int64(1), "x", []string{"a"}, time.Unix(1600000000, 0)}}, Dims: c.Dims, RealSize: 1}
+	srv.columns = "id\tInt64\t\nname\tNullable(String)\t\nts\tDateTime\t\n"
+	srv.dropped = "tags"
+	var committed bool
+	c.loopWrite(context.Background(), batch, func(batch *model.Batch) error {
+		committed = true
+		return nil
+	})
+	require.True(t, committed)
+	require.Equal(t, []string{"INSERT INTO db1.t1 (`id`,`name`,`ts`) FORMAT JSONEachRow"}, srv.inserts)
+	require.Equal(t, `{"id":1,"name":"x","ts":1600000000}`+"\n", string(srv.bodies[0]))
+
+	// The batch has the current columns already, the table mismatches them for good.
+	require.True(t, isSchemaError(c.writeRows(model.Rows{&model.Row{[]string{"a"}}}, []*model.ColumnWithType{{Name: "tags", Type: "Array(String)"}}, "", "", 0)))
+	rebuilt, err := c.rebuildBatch(batch)
+	require.Nil(t, err)
+	require.False(t, rebuilt)
+}
+
+// genHostnameCert generates a self-signed certificate which is valid for the hostname only, not for any IP.
+func genHostnameCert(t *testing.T, hostname string) (cert tls.Certificate, certPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: hostname},
+		DNSNames:              []string{hostname},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	cert, err = tls.X509KeyPair(certPEM, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	require.Nil(t, err)
+	return
+}
+
+// Hosts are connected by name, so that certificates without IP SANs are verified.
+func TestTLSHostnameCert(t *testing.T) {
+	cert, certPEM := genHostnameCert(t, "localhost")
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.Nil(t, ioutil.WriteFile(caFile, certPEM, 0644))
+	chCfg := &config.ClickHouseConfig{Hosts: [][]string{{"localhost"}}}
+	chCfg.TLS.Enable = true
+	chCfg.TLS.CaCertFiles = caFile
+	tlsConfig, err := newTLSConfig(chCfg)
+	require.Nil(t, err)
+
+	srv := &fakeHTTPServer{}
+	ts := httptest.NewUnstartedServer(srv)
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	ts.StartTLS()
+	defer ts.Close()
+	port := ts.Listener.Addr().(*net.TCPAddr).Port
+	require.Nil(t, pool.InitHTTPConn("ch_https_hostname", chCfg.Hosts, port, "db1", pool.HTTPOptions{TLSConfig: tlsConfig}))
+	defer pool.FreeConn("ch_https_hostname")
+	require.Nil(t, pool.GetHTTPConn("ch_https_hostname", 0).Ping())
+
+	// The native protocol is checked by the handshake only.
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	require.Nil(t, err)
+	defer ln.Close()
+	handshakes := make(chan error, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			handshakes <- conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	port = ln.Addr().(*net.TCPAddr).Port
+	require.Nil(t, pool.InitConn("ch_tls_hostname", chCfg.Hosts, port, "db1", "", "", "", tlsConfig))
+	defer pool.FreeConn("ch_tls_hostname")
+	_ = pool.GetConn("ch_tls_hostname", 0).Ping()
+	require.Nil(t, <-handshakes)
+}
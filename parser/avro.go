@@ -0,0 +1,508 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package parser
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/pkg/errors"
+
+	"github.com/housepower/clickhouse_sinker/model"
+)
+
+var _ Parser = (*AvroParser)(nil)
+
+// avroCodec decodes messages of a schema.
+type avroCodec struct {
+	codec  *goavro.Codec
+	schema interface{}            //the schema as decoded JSON
+	named  map[string]interface{} //full name => definition of records, enums and fixed types
+}
+
+func newAvroCodec(schema string) (c *avroCodec, err error) {
+	c = &avroCodec{named: make(map[string]interface{})}
+	if c.codec, err = goavro.NewCodec(schema); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	if err = json.Unmarshal([]byte(schema), &c.schema); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	c.collectNamed(c.schema, "")
+	return
+}
+
+// avroFullName returns the full name of a named type and its namespace.
+func avroFullName(s map[string]interface{}, namespace string) (fullName, ns string) {
+	name, _ := s["name"].(string)
+	if idx := strings.LastIndexByte(name, '.'); idx >= 0 {
+		return name, name[:idx]
+	}
+	if v, ok := s["namespace"].(string); ok {
+		namespace = v
+	}
+	if namespace == "" {
+		return name, ""
+	}
+	return namespace + "." + name, namespace
+}
+
+func (c *avroCodec) collectNamed(schema interface{}, namespace string) {
+	switch s := schema.(type) {
+	case []interface{}:
+		for _, branch := range s {
+			c.collectNamed(branch, namespace)
+		}
+	case map[string]interface{}:
+		switch s["type"] {
+		case "record", "error", "enum", "fixed":
+			fullName, ns := avroFullName(s, namespace)
+			c.named[fullName] = s
+			fields, _ := s["fields"].([]interface{})
+			for _, field := range fields {
+				if f, ok := field.(map[string]interface{}); ok {
+					c.collectNamed(f["type"], ns)
+				}
+			}
+		case "array":
+			c.collectNamed(s["items"], namespace)
+		case "map":
+			c.collectNamed(s["values"], namespace)
+		default:
+			c.collectNamed(s["type"], namespace)
+		}
+	}
+}
+
+// lookup resolves a reference to a named type, it returns nil for primitive types.
+func (c *avroCodec) lookup(name, namespace string) interface{} {
+	if s, ok := c.named[name]; ok {
+		return s
+	}
+	if namespace != "" {
+		return c.named[namespace+"."+name]
+	}
+	return nil
+}
+
+// branchName is the name which goavro wraps a datum of the union branch with.
+func (c *avroCodec) branchName(branch interface{}, namespace string) string {
+	switch s := branch.(type) {
+	case string:
+		if named, ok := c.lookup(s, namespace).(map[string]interface{}); ok {
+			fullName, _ := avroFullName(named, namespace)
+			return fullName
+		}
+		return s
+	case map[string]interface{}:
+		switch typ := s["type"].(type) {
+		case string:
+			switch typ {
+			case "record", "error", "enum", "fixed":
+				fullName, _ := avroFullName(s, namespace)
+				return fullName
+			case "array", "map":
+				return typ
+			}
+			if lt, ok := s["logicalType"].(string); ok {
+				return typ + "." + lt
+			}
+			return typ
+		default:
+			return c.branchName(typ, namespace)
+		}
+	}
+	return ""
+}
+
+// avroDecimal is a decimal along with its scale.
+type avroDecimal struct {
+	rat   *big.Rat
+	scale int
+}
+
+// normalize strips union wrappers(map of the branch name to the datum) and attaches scales to decimals in place,
+// so that a datum is a plain value wherever it is.
+func (c *avroCodec) normalize(schema interface{}, namespace string, datum interface{}) interface{} {
+	if datum == nil {
+		return nil
+	}
+	switch s := schema.(type) {
+	case string:
+		if named := c.lookup(s, namespace); named != nil {
+			return c.normalize(named, namespace, datum)
+		}
+	case []interface{}:
+		m, ok := datum.(map[string]interface{})
+		if !ok || len(m) != 1 {
+			return datum
+		}
+		for key, v := range m {
+			for _, branch := range s {
+				if c.branchName(branch, namespace) == key {
+					return c.normalize(branch, namespace, v)
+				}
+			}
+			return v
+		}
+	case map[string]interface{}:
+		switch typ := s["type"].(type) {
+		case string:
+			switch typ {
+			case "record", "error":
+				_, ns := avroFullName(s, namespace)
+				rec, ok := datum.(map[string]interface{})
+				fields, _ := s["fields"].([]interface{})
+				for _, field := range fields {
+					f, _ := field.(map[string]interface{})
+					name, _ := f["name"].(string)
+					if v, found := rec[name]; ok && found {
+						rec[name] = c.normalize(f["type"], ns, v)
+					}
+				}
+			case "array":
+				if arr, ok := datum.([]interface{}); ok {
+					for i := range arr {
+						arr[i] = c.normalize(s["items"], namespace, arr[i])
+					}
+				}
+			case "map":
+				if m, ok := datum.(map[string]interface{}); ok {
+					for k, v := range m {
+						m[k] = c.normalize(s["values"], namespace, v)
+					}
+				}
+			default:
+				if r, ok := datum.(*big.Rat); ok {
+					scale, _ := s["scale"].(float64)
+					return avroDecimal{rat: r, scale: int(scale)}
+				}
+			}
+		default:
+			return c.normalize(typ, namespace, datum)
+		}
+	}
+	return datum
+}
+
+// avroSchemas resolves schemas of messages, by ids in the Confluent wire format, or the static one.
+type avroSchemas struct {
+	registry string
+	client   *http.Client
+	static   *avroCodec
+	mux      sync.RWMutex
+	byID     map[uint32]*avroCodec
+}
+
+func newAvroSchemas(registry, schemaFile string) (schemas *avroSchemas, err error) {
+	schemas = &avroSchemas{
+		registry: strings.TrimSuffix(registry, "/"),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		byID:     make(map[uint32]*avroCodec),
+	}
+	if schemaFile != "" {
+		var bs []byte
+		if bs, err = ioutil.ReadFile(schemaFile); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		if schemas.static, err = newAvroCodec(string(bs)); err != nil {
+			err = errors.Wrapf(err, "invalid schema in %s", schemaFile)
+			return
+		}
+	}
+	return
+}
+
+// resolve returns the codec and the payload of the message. Messages are in the Confluent wire format if and only if the
+// registry is configured, otherwise they're decoded with the static schema as a whole.
+func (schemas *avroSchemas) resolve(bs []byte) (codec *avroCodec, payload []byte, err error) {
+	if schemas.registry == "" {
+		return schemas.static, bs, nil
+	}
+	if len(bs) < 5 || bs[0] != 0 {
+		err = errors.Errorf("the message is not in the Confluent wire format")
+		return
+	}
+	payload = bs[5:]
+	id := binary.BigEndian.Uint32(bs[1:5])
+	schemas.mux.RLock()
+	codec = schemas.byID[id]
+	schemas.mux.RUnlock()
+	if codec != nil {
+		return
+	}
+	if codec, err = schemas.fetch(id); err != nil {
+		return
+	}
+	schemas.mux.Lock()
+	schemas.byID[id] = codec
+	schemas.mux.Unlock()
+	return
+}
+
+// fetch gets the schema from the registry. It returns a RetryableError if the registry failed to respond.
+func (schemas *avroSchemas) fetch(id uint32) (codec *avroCodec, err error) {
+	url := fmt.Sprintf("%s/schemas/ids/%d", schemas.registry, id)
+	resp, err := schemas.client.Get(url)
+	if err != nil {
+		return nil, &RetryableError{errors.Wrapf(err, "")}
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &RetryableError{errors.Wrapf(err, "")}
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = errors.Errorf("failed to get schema %d from %s, got status %d, response %s", id, url, resp.StatusCode, string(body))
+		if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests {
+			err = &RetryableError{err}
+		}
+		return nil, err
+	}
+	var result struct {
+		Schema string `json:"schema"`
+	}
+	if err = json.Unmarshal(body, &result); err != nil {
+		return nil, errors.Wrapf(err, "")
+	}
+	return newAvroCodec(result.Schema)
+}
+
+// AvroParser decodes Avro records, with the Confluent header(magic byte 0 and a 4-byte schema id) if the registry is
+// configured, or plain records of the static schema.
+type AvroParser struct {
+	schemas  *avroSchemas
+	tsLayout []string
+}
+
+func (p *AvroParser) Parse(bs []byte) (metric model.Metric, err error) {
+	codec, payload, err := p.schemas.resolve(bs)
+	if err != nil {
+		return
+	}
+	native, _, err := codec.codec.NativeFromBinary(payload)
+	if err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	rec, ok := codec.normalize(codec.schema, "", native).(map[string]interface{})
+	if !ok {
+		err = errors.Errorf("the message is not a record")
+		return
+	}
+	metric = &AvroMetric{value: rec, tsLayout: p.tsLayout}
+	return
+}
+
+// AvroMetric looks up fields by dot separated paths, like "header.host", across nested records and maps.
+// Nullable fields(unions with null) are absent if they're null.
+type AvroMetric struct {
+	value    map[string]interface{}
+	tsLayout []string
+}
+
+func (c *AvroMetric) Get(key string) interface{} {
+	var v interface{} = c.value
+	for _, part := range strings.Split(key, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[part]
+	}
+	return v
+}
+
+func (c *AvroMetric) GetString(key string, nullable bool) interface{} {
+	switch v := c.Get(key).(type) {
+	case nil:
+		if nullable {
+			return nil
+		}
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case int32:
+		return strconv.FormatInt(int64(v), 10)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case avroDecimal:
+		return v.rat.FloatString(v.scale)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	default:
+		bs, _ := json.Marshal(v)
+		return string(bs)
+	}
+}
+
+// avroFloat converts a numeric value to float64.
+func avroFloat(v interface{}) float64 {
+	switch v := v.(type) {
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case float64:
+		return v
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case avroDecimal:
+		f, _ := v.rat.Float64()
+		return f
+	case time.Time:
+		return float64(v.UnixNano()) / 1e9
+	case time.Duration:
+		return v.Seconds()
+	case string:
+		f, _ := strconv.ParseFloat(v, 64)
+		return f
+	default:
+		return 0
+	}
+}
+
+// avroInt is like avroFloat, but keeps precision of 64-bit integers.
+func avroInt(v interface{}) int64 {
+	switch v := v.(type) {
+	case int32:
+		return int64(v)
+	case int64:
+		return v
+	case time.Time:
+		return v.Unix()
+	case string:
+		i, _ := strconv.ParseInt(v, 10, 64)
+		return i
+	default:
+		return int64(avroFloat(v))
+	}
+}
+
+func (c *AvroMetric) GetFloat(key string, nullable bool) interface{} {
+	v := c.Get(key)
+	if v == nil && nullable {
+		return nil
+	}
+	return avroFloat(v)
+}
+
+func (c *AvroMetric) GetInt(key string, nullable bool) interface{} {
+	v := c.Get(key)
+	if v == nil && nullable {
+		return nil
+	}
+	return avroInt(v)
+}
+
+// GetArray returns elements of an array as []string, []int64 or []float64.
+func (c *AvroMetric) GetArray(key string, t string) interface{} {
+	arr, _ := c.Get(key).([]interface{})
+	switch t {
+	case "string":
+		results := make([]string, 0, len(arr))
+		for _, e := range arr {
+			m := AvroMetric{value: map[string]interface{}{"e": e}}
+			results = append(results, m.GetString("e", false).(string))
+		}
+		return results
+	case "float":
+		results := make([]float64, 0, len(arr))
+		for _, e := range arr {
+			results = append(results, avroFloat(e))
+		}
+		return results
+	case "int":
+		results := make([]int64, 0, len(arr))
+		for _, e := range arr {
+			results = append(results, avroInt(e))
+		}
+		return results
+	default:
+		panic("not supported array type " + t)
+	}
+}
+
+// getTime converts a time(logical types date and timestamp-*), seconds since epoch, or a string of the layout to time.
+func (c *AvroMetric) getTime(key string, nullable bool, layout string) interface{} {
+	switch v := c.Get(key).(type) {
+	case nil:
+		if nullable {
+			return nil
+		}
+		return Epoch
+	case time.Time:
+		return v
+	case string:
+		t, _ := time.Parse(layout, v)
+		return t
+	case float32, float64:
+		f := avroFloat(v)
+		return time.Unix(int64(f), int64(f*1e9)%1e9).UTC()
+	default:
+		return time.Unix(avroInt(v), 0).UTC()
+	}
+}
+
+func (c *AvroMetric) GetDate(key string, nullable bool) interface{} {
+	return c.getTime(key, nullable, c.tsLayout[0])
+}
+
+func (c *AvroMetric) GetDateTime(key string, nullable bool) interface{} {
+	return c.getTime(key, nullable, c.tsLayout[1])
+}
+
+func (c *AvroMetric) GetDateTime64(key string, nullable bool) interface{} {
+	return c.getTime(key, nullable, c.tsLayout[2])
+}
+
+func (c *AvroMetric) GetElasticDateTime(key string, nullable bool) interface{} {
+	t := c.getTime(key, nullable, time.RFC3339)
+	if t == nil {
+		return nil
+	}
+	return t.(time.Time).Unix()
+}
+
+// GetNewKeys is not supported by AvroMetric, the schema is fixed by the writer.
+func (c *AvroMetric) GetNewKeys(knownKeys *sync.Map, newKeys map[string]string) bool {
+	return false
+}
@@ -0,0 +1,143 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package parser
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/stretchr/testify/require"
+)
+
+const eventSchema = `{
+	"type": "record", "name": "Event", "namespace": "test",
+	"fields": [
+		{"name": "name", "type": "string"},
+		{"name": "id", "type": "long"},
+		{"name": "host", "type": ["null", "string"], "default": null},
+		{"name": "ts", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+		{"name": "day", "type": {"type": "int", "logicalType": "date"}},
+		{"name": "price", "type": {"type": "bytes", "logicalType": "decimal", "precision": 9, "scale": 2}},
+		{"name": "tags", "type": {"type": "array", "items": "string"}},
+		{"name": "header", "type": ["null", {"type": "record", "name": "Header", "fields": [
+			{"name": "latency", "type": ["null", "double"]}
+		]}]}
+	]
+}`
+
+func encodeEvent(t *testing.T, codec *goavro.Codec, host interface{}, header interface{}) []byte {
+	bs, err := codec.BinaryFromNative(nil, map[string]interface{}{
+		"name":   "click",
+		"id":     int64(1 << 60),
+		"host":   host,
+		"ts":     time.Unix(1600000000, 5e6).UTC(),
+		"day":    time.Date(2020, 9, 13, 0, 0, 0, 0, time.UTC),
+		"price":  big.NewRat(12345, 100),
+		"tags":   []interface{}{"t1", "t2"},
+		"header": header,
+	})
+	require.Nil(t, err)
+	return bs
+}
+
+func TestAvro(t *testing.T) {
+	var requests int32
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path == "/schemas/ids/3" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path != "/schemas/ids/1" {
+			http.Error(w, `{"error_code":40403,"message":"Schema not found"}`, http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"schema": eventSchema})
+	}))
+	defer registry.Close()
+
+	codec, err := goavro.NewCodec(eventSchema)
+	require.Nil(t, err)
+	header := goavro.Union("test.Header", map[string]interface{}{"latency": goavro.Union("double", 0.5)})
+	payload := encodeEvent(t, codec, goavro.Union("string", "a"), header)
+
+	pp := NewParserPool("avro", nil, "", DefaultTSLayout)
+	require.Nil(t, pp.InitAvro(registry.URL, ""))
+	parser := pp.Get()
+	defer pp.Put(parser)
+
+	for i := 0; i < 2; i++ {
+		metric, err := parser.Parse(append([]byte{0, 0, 0, 0, 1}, payload...))
+		require.Nil(t, err)
+		require.Equal(t, "click", metric.GetString("name", false))
+		require.Equal(t, int64(1<<60), metric.GetInt("id", false))
+		require.Equal(t, "a", metric.GetString("host", true))
+		require.Equal(t, 0.5, metric.GetFloat("header.latency", true))
+		require.Equal(t, time.Unix(1600000000, 5e6).UTC(), metric.GetDateTime64("ts", false))
+		require.Equal(t, int64(1600000000), metric.GetElasticDateTime("ts", false))
+		require.Equal(t, time.Date(2020, 9, 13, 0, 0, 0, 0, time.UTC), metric.GetDate("day", false))
+		require.Equal(t, "123.45", metric.GetString("price", false))
+		require.Equal(t, 123.45, metric.GetFloat("price", false))
+		require.Equal(t, []string{"t1", "t2"}, metric.GetArray("tags", "string"))
+		require.Equal(t, []int64{}, metric.GetArray("absent", "int"))
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	// Nulls are absent.
+	metric, err := parser.Parse(append([]byte{0, 0, 0, 0, 1}, encodeEvent(t, codec, nil, nil)...))
+	require.Nil(t, err)
+	require.Nil(t, metric.GetString("host", true))
+	require.Equal(t, "", metric.GetString("host", false))
+	require.Nil(t, metric.GetFloat("header.latency", true))
+
+	_, err = parser.Parse(append([]byte{0, 0, 0, 0, 2}, payload...))
+	require.NotNil(t, err)
+	require.False(t, IsRetryable(err))
+	_, err = parser.Parse(payload)
+	require.NotNil(t, err)
+	require.False(t, IsRetryable(err))
+
+	// Failures of the registry are retryable, and aren't cached.
+	for i := 0; i < 2; i++ {
+		_, err = parser.Parse(append([]byte{0, 0, 0, 0, 3}, payload...))
+		require.True(t, IsRetryable(err))
+	}
+	require.Equal(t, int32(4), atomic.LoadInt32(&requests))
+	registry.Close()
+	_, err = parser.Parse(append([]byte{0, 0, 0, 0, 4}, payload...))
+	require.True(t, IsRetryable(err))
+
+	// Without the registry, the static schema decodes messages as a whole.
+	dir, err := ioutil.TempDir("", "avro")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "event.avsc")
+	require.Nil(t, ioutil.WriteFile(file, []byte(eventSchema), 0644))
+	pp = NewParserPool("avro", nil, "", DefaultTSLayout)
+	require.Nil(t, pp.InitAvro("", file))
+	parser = pp.Get()
+	metric, err = parser.Parse(payload)
+	require.Nil(t, err)
+	require.Equal(t, "a", metric.GetString("host", true))
+}
@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"encoding/csv"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/housepower/clickhouse_sinker/model"
@@ -134,3 +135,8 @@ func (c *CsvMetric) GetElasticDateTime(key string, nullable bool) interface{} {
 
 	return t.Unix()
 }
+
+// GetNewKeys is not supported by CsvMetric
+func (c *CsvMetric) GetNewKeys(knownKeys *sync.Map, newKeys map[string]string) bool {
+	return false
+}
@@ -16,6 +16,9 @@ limitations under the License.
 package parser
 
 import (
+	"bytes"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/housepower/clickhouse_sinker/model"
@@ -29,6 +32,7 @@ var _ Parser = (*FastjsonParser)(nil)
 type FastjsonParser struct {
 	tsLayout []string
 	fjp      fastjson.Parser
+	arena    fastjson.Arena //for objects built by explode
 }
 
 func (p *FastjsonParser) Parse(bs []byte) (metric model.Metric, err error) {
@@ -41,13 +45,67 @@ func (p *FastjsonParser) Parse(bs []byte) (metric model.Metric, err error) {
 	return
 }
 
+func (p *FastjsonParser) explode(bs []byte, path string) (metrics []model.Metric, err error) {
+	var value *fastjson.Value
+	if value, err = p.fjp.ParseBytes(bs); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	var keys []string
+	arr := value
+	if path != "$" {
+		keys = strings.Split(path, ".")
+		if arr = value.Get(keys...); arr == nil || arr.Type() == fastjson.TypeNull {
+			return
+		}
+	}
+	var elems []*fastjson.Value
+	if elems, err = arr.Array(); err != nil {
+		err = errors.Wrapf(err, "%s", path)
+		return
+	}
+	parent, _ := value.Object()
+	p.arena.Reset()
+	for i, elem := range elems {
+		if keys == nil {
+			if elem.Type() != fastjson.TypeObject {
+				err = errors.Errorf("element %d of the message is not an object", i)
+				return
+			}
+			metrics = append(metrics, &FastjsonMetric{value: elem, tsLayout: p.tsLayout})
+			continue
+		}
+		obj := p.arena.NewObject()
+		parent.Visit(func(key []byte, v *fastjson.Value) {
+			if string(key) != keys[0] {
+				obj.Set(string(key), v)
+			}
+		})
+		if elem.Type() == fastjson.TypeObject {
+			elem.GetObject().Visit(func(key []byte, v *fastjson.Value) {
+				obj.Set(string(key), v)
+			})
+		} else {
+			obj.Set(keys[len(keys)-1], elem)
+		}
+		metrics = append(metrics, &FastjsonMetric{value: obj, tsLayout: p.tsLayout})
+	}
+	return
+}
+
 type FastjsonMetric struct {
 	value    *fastjson.Value
 	tsLayout []string
 }
 
+// Get returns nil if the field is absent or null, a *fastjson.Value otherwise.
 func (c *FastjsonMetric) Get(key string) interface{} {
-	return c.value.Get(key)
+	v := c.value.Get(key)
+	if v == nil || v.Type() == fastjson.TypeNull {
+		// A nil *fastjson.Value is not a nil interface.
+		return nil
+	}
+	return v
 }
 
 func (c *FastjsonMetric) GetString(key string, nullable bool) interface{} {
@@ -155,3 +213,56 @@ func (c *FastjsonMetric) GetElasticDateTime(key string, nullable bool) interface
 
 	return t.Unix()
 }
+
+func (c *FastjsonMetric) GetNewKeys(knownKeys *sync.Map, newKeys map[string]string) (foundNew bool) {
+	var obj *fastjson.Object
+	var err error
+	if obj, err = c.value.Object(); err != nil {
+		return
+	}
+	obj.Visit(func(key []byte, v *fastjson.Value) {
+		strKey := string(key)
+		if !model.IsNewKey(strKey, knownKeys) {
+			return
+		}
+		if typ := fastjsonType(v); typ != "" {
+			newKeys[strKey] = typ
+			foundNew = true
+		}
+	})
+	return
+}
+
+// fastjsonType infers the ClickHouse type of a value. Returns empty string if unable to.
+func fastjsonType(v *fastjson.Value) string {
+	switch v.Type() {
+	case fastjson.TypeString:
+		return "Nullable(String)"
+	case fastjson.TypeNumber:
+		if isIntNumber(v.MarshalTo(nil)) {
+			return "Nullable(Int64)"
+		}
+		return "Nullable(Float64)"
+	case fastjson.TypeArray:
+		array, _ := v.Array()
+		if len(array) == 0 {
+			return ""
+		}
+		switch array[0].Type() {
+		case fastjson.TypeString:
+			return "Array(String)"
+		case fastjson.TypeNumber:
+			for _, e := range array {
+				if !isIntNumber(e.MarshalTo(nil)) {
+					return "Array(Float64)"
+				}
+			}
+			return "Array(Int64)"
+		}
+	}
+	return ""
+}
+
+func isIntNumber(raw []byte) bool {
+	return !bytes.ContainsAny(raw, ".eE")
+}
@@ -16,8 +16,12 @@ limitations under the License.
 package parser
 
 import (
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/tidwall/gjson"
 
 	"github.com/housepower/clickhouse_sinker/model"
@@ -34,6 +38,75 @@ func (p *GjsonParser) Parse(bs []byte) (metric model.Metric, err error) {
 	return
 }
 
+func (p *GjsonParser) explode(bs []byte, path string) (metrics []model.Metric, err error) {
+	root := gjson.Parse(string(bs))
+	arr := root
+	var top, last string
+	if path != "$" {
+		if arr = root.Get(path); !arr.Exists() || arr.Type == gjson.Null {
+			return
+		}
+		keys := strings.Split(path, ".")
+		top, last = keys[0], keys[len(keys)-1]
+	}
+	if !arr.IsArray() {
+		err = errors.Errorf("%s is not an array", path)
+		return
+	}
+	var sb strings.Builder
+	arr.ForEach(func(idx, elem gjson.Result) bool {
+		if top == "" {
+			if !elem.IsObject() {
+				err = errors.Errorf("element %d of the message is not an object", idx.Int())
+				return false
+			}
+			metrics = append(metrics, &GjsonMetric{elem.Raw, p.tsLayout})
+			return true
+		}
+		// Fields are written once, since gjson returns the first one of duplicated keys.
+		overrides := map[string]bool{top: true}
+		if elem.IsObject() {
+			elem.ForEach(func(key, _ gjson.Result) bool {
+				overrides[key.String()] = true
+				return true
+			})
+		} else {
+			overrides[last] = true
+		}
+		sb.Reset()
+		sb.WriteByte('{')
+		writeField := func(key, rawValue string) {
+			if sb.Len() > 1 {
+				sb.WriteByte(',')
+			}
+			sb.WriteString(key)
+			sb.WriteByte(':')
+			sb.WriteString(rawValue)
+		}
+		root.ForEach(func(key, value gjson.Result) bool {
+			if !overrides[key.String()] {
+				writeField(key.Raw, value.Raw)
+			}
+			return true
+		})
+		if elem.IsObject() {
+			elem.ForEach(func(key, value gjson.Result) bool {
+				writeField(key.Raw, value.Raw)
+				return true
+			})
+		} else {
+			writeField(strconv.Quote(last), elem.Raw)
+		}
+		sb.WriteByte('}')
+		metrics = append(metrics, &GjsonMetric{sb.String(), p.tsLayout})
+		return true
+	})
+	if err != nil {
+		metrics = nil
+	}
+	return
+}
+
 type GjsonMetric struct {
 	raw      string
 	tsLayout []string
@@ -148,3 +221,51 @@ func (c *GjsonMetric) GetElasticDateTime(key string, nullable bool) interface{}
 	t, _ := time.Parse(time.RFC3339, r.String())
 	return t.Unix()
 }
+
+func (c *GjsonMetric) GetNewKeys(knownKeys *sync.Map, newKeys map[string]string) (foundNew bool) {
+	gjson.Parse(c.raw).ForEach(func(key, value gjson.Result) bool {
+		strKey := key.String()
+		if !model.IsNewKey(strKey, knownKeys) {
+			return true
+		}
+		if typ := gjsonType(value); typ != "" {
+			newKeys[strKey] = typ
+			foundNew = true
+		}
+		return true
+	})
+	return
+}
+
+// gjsonType infers the ClickHouse type of a value. Returns empty string if unable to.
+func gjsonType(v gjson.Result) string {
+	switch v.Type {
+	case gjson.String:
+		return "Nullable(String)"
+	case gjson.Number:
+		if !strings.ContainsAny(v.Raw, ".eE") {
+			return "Nullable(Int64)"
+		}
+		return "Nullable(Float64)"
+	case gjson.JSON:
+		if !v.IsArray() {
+			return ""
+		}
+		array := v.Array()
+		if len(array) == 0 {
+			return ""
+		}
+		switch array[0].Type {
+		case gjson.String:
+			return "Array(String)"
+		case gjson.Number:
+			for _, e := range array {
+				if strings.ContainsAny(e.Raw, ".eE") {
+					return "Array(Float64)"
+				}
+			}
+			return "Array(Int64)"
+		}
+	}
+	return ""
+}
@@ -17,6 +17,7 @@ package parser
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/tidwall/gjson"
@@ -240,3 +241,8 @@ func (c *GjsonExtendMetric) GetElasticDateTime(key string, nullable bool) interf
 	t, _ := time.Parse(time.RFC3339, val.(string))
 	return t.Unix()
 }
+
+// GetNewKeys is not supported by GjsonExtendMetric
+func (c *GjsonExtendMetric) GetNewKeys(knownKeys *sync.Map, newKeys map[string]string) bool {
+	return false
+}
@@ -0,0 +1,191 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package parser
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxGrokDepth limits nesting of patterns, which also catches recursive definitions.
+const maxGrokDepth = 32
+
+// grokPatterns is the bundled pattern library. It follows the Logstash one, with lookarounds and atomic groups
+// rewritten since they're unsupported by RE2.
+var grokPatterns = map[string]string{
+	"USERNAME":       `[a-zA-Z0-9._-]+`,
+	"USER":           `%{USERNAME}`,
+	"EMAILLOCALPART": `[a-zA-Z][a-zA-Z0-9_.+=:-]+`,
+	"EMAILADDRESS":   `%{EMAILLOCALPART}@%{HOSTNAME}`,
+	"HTTPDUSER":      `(?:%{EMAILADDRESS}|%{USER})`,
+	"INT":            `(?:[+-]?(?:[0-9]+))`,
+	"BASE10NUM":      `(?:[+-]?(?:[0-9]+(?:\.[0-9]+)?|\.[0-9]+))`,
+	"NUMBER":         `(?:%{BASE10NUM})`,
+	"BASE16NUM":      `(?:(?:0[xX])?[0-9A-Fa-f]+)`,
+	"POSINT":         `\b(?:[1-9][0-9]*)\b`,
+	"NONNEGINT":      `\b(?:[0-9]+)\b`,
+	"WORD":           `\b\w+\b`,
+	"NOTSPACE":       `\S+`,
+	"SPACE":          `\s*`,
+	"DATA":           `.*?`,
+	"GREEDYDATA":     `.*`,
+	"QUOTEDSTRING":   `(?:"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*')`,
+	"QS":             `%{QUOTEDSTRING}`,
+	"UUID":           `[A-Fa-f0-9]{8}-(?:[A-Fa-f0-9]{4}-){3}[A-Fa-f0-9]{12}`,
+	"MAC":            `(?:(?:[A-Fa-f0-9]{2}[:-]){5}[A-Fa-f0-9]{2}|(?:[A-Fa-f0-9]{4}\.){2}[A-Fa-f0-9]{4})`,
+
+	"IPV4": `(?:(?:25[0-5]|2[0-4][0-9]|1[0-9]{2}|[1-9]?[0-9])\.){3}(?:25[0-5]|2[0-4][0-9]|1[0-9]{2}|[1-9]?[0-9])`,
+	"IPV6": `(?:(?:[0-9A-Fa-f]{1,4}:){1,4}:%{IPV4}|::(?:[Ff]{4}:)?%{IPV4}|` +
+		`(?:[0-9A-Fa-f]{1,4}:){7}[0-9A-Fa-f]{1,4}|` +
+		`(?:[0-9A-Fa-f]{1,4}:){1,6}:[0-9A-Fa-f]{1,4}|` +
+		`(?:[0-9A-Fa-f]{1,4}:){1,5}(?::[0-9A-Fa-f]{1,4}){1,2}|` +
+		`(?:[0-9A-Fa-f]{1,4}:){1,4}(?::[0-9A-Fa-f]{1,4}){1,3}|` +
+		`(?:[0-9A-Fa-f]{1,4}:){1,3}(?::[0-9A-Fa-f]{1,4}){1,4}|` +
+		`(?:[0-9A-Fa-f]{1,4}:){1,2}(?::[0-9A-Fa-f]{1,4}){1,5}|` +
+		`[0-9A-Fa-f]{1,4}:(?::[0-9A-Fa-f]{1,4}){1,6}|` +
+		`:(?::[0-9A-Fa-f]{1,4}){1,7}|` +
+		`(?:[0-9A-Fa-f]{1,4}:){1,7}:|::)`,
+	"IP":       `(?:%{IPV6}|%{IPV4})`,
+	"HOSTNAME": `\b(?:[0-9A-Za-z][0-9A-Za-z-]{0,62})(?:\.(?:[0-9A-Za-z][0-9A-Za-z-]{0,62}))*\.?`,
+	"HOST":     `%{HOSTNAME}`,
+	"IPORHOST": `(?:%{IP}|%{HOSTNAME})`,
+	"HOSTPORT": `%{IPORHOST}:%{POSINT}`,
+
+	"URIPROTO":     `[A-Za-z][A-Za-z0-9+.-]*`,
+	"URIHOST":      `%{IPORHOST}(?::%{POSINT})?`,
+	"URIPATH":      `(?:/[A-Za-z0-9$.+!*'(){},~:;=@#%&_-]*)+`,
+	"URIPARAM":     `\?[A-Za-z0-9$.+!*'|(){},~@#%&/=:;_?\[\]<>-]*`,
+	"URIPATHPARAM": `%{URIPATH}(?:%{URIPARAM})?`,
+	"URI":          `%{URIPROTO}://(?:%{USER}(?::[^@]*)?@)?(?:%{URIHOST})?(?:%{URIPATHPARAM})?`,
+
+	"MONTH":             `\b(?:Jan(?:uary)?|Feb(?:ruary)?|Mar(?:ch)?|Apr(?:il)?|May|Jun(?:e)?|Jul(?:y)?|Aug(?:ust)?|Sep(?:tember)?|Oct(?:ober)?|Nov(?:ember)?|Dec(?:ember)?)\b`,
+	"MONTHNUM":          `(?:0?[1-9]|1[0-2])`,
+	"MONTHDAY":          `(?:(?:0[1-9])|(?:[12][0-9])|(?:3[01])|[1-9])`,
+	"DAY":               `(?:Mon(?:day)?|Tue(?:sday)?|Wed(?:nesday)?|Thu(?:rsday)?|Fri(?:day)?|Sat(?:urday)?|Sun(?:day)?)`,
+	"YEAR":              `(?:\d\d){1,2}`,
+	"HOUR":              `(?:2[0123]|[01]?[0-9])`,
+	"MINUTE":            `(?:[0-5][0-9])`,
+	"SECOND":            `(?:(?:[0-5]?[0-9]|60)(?:[:.,][0-9]+)?)`,
+	"TIME":              `%{HOUR}:%{MINUTE}(?::%{SECOND})`,
+	"ISO8601_TIMEZONE":  `(?:Z|[+-]%{HOUR}(?::?%{MINUTE}))`,
+	"TIMESTAMP_ISO8601": `%{YEAR}-%{MONTHNUM}-%{MONTHDAY}[T ]%{HOUR}:?%{MINUTE}(?::?%{SECOND})?%{ISO8601_TIMEZONE}?`,
+	"DATE_US":           `%{MONTHNUM}[/-]%{MONTHDAY}[/-]%{YEAR}`,
+	"DATE_EU":           `%{MONTHDAY}[./-]%{MONTHNUM}[./-]%{YEAR}`,
+	"DATE":              `(?:%{DATE_US}|%{DATE_EU})`,
+	"DATESTAMP":         `%{DATE}[- ]%{TIME}`,
+	"TZ":                `(?:[APMCE][SD]T|UTC)`,
+	"HTTPDATE":          `%{MONTHDAY}/%{MONTH}/%{YEAR}:%{TIME} %{INT}`,
+	"SYSLOGTIMESTAMP":   `%{MONTH} +%{MONTHDAY} %{TIME}`,
+
+	"LOGLEVEL":   `(?:[Aa]lert|ALERT|[Tt]race|TRACE|[Dd]ebug|DEBUG|[Nn]otice|NOTICE|[Ii]nfo|INFO|[Ww]arn?(?:ing)?|WARN?(?:ING)?|[Ee]rr?(?:or)?|ERR?(?:OR)?|[Cc]rit?(?:ical)?|CRIT?(?:ICAL)?|[Ff]atal|FATAL|[Ss]evere|SEVERE|EMERG(?:ENCY)?|[Ee]merg(?:ency)?)`,
+	"PROG":       `[\x21-\x5a\x5c\x5e-\x7e]+`,
+	"SYSLOGPROG": `%{PROG:program}(?:\[%{POSINT:pid}\])?`,
+	"SYSLOGHOST": `%{IPORHOST}`,
+	"SYSLOGBASE": `%{SYSLOGTIMESTAMP:timestamp} %{SYSLOGHOST:logsource} %{SYSLOGPROG}:`,
+	"SYSLOGLINE": `%{SYSLOGBASE} %{GREEDYDATA:message}`,
+
+	"COMMONAPACHELOG":   `%{IPORHOST:clientip} %{HTTPDUSER:ident} %{USER:auth} \[%{HTTPDATE:timestamp}\] "(?:%{WORD:verb} %{NOTSPACE:request}(?: HTTP/%{NUMBER:httpversion})?|%{DATA:rawrequest})" %{NUMBER:response} (?:%{NUMBER:bytes}|-)`,
+	"COMBINEDAPACHELOG": `%{COMMONAPACHELOG} %{QS:referrer} %{QS:agent}`,
+}
+
+// grokRef matches %{NAME}, %{NAME:field} and %{NAME:field:type}. The type is accepted for compatibility with
+// Logstash, but ignored since values are converted per column type.
+var grokRef = regexp.MustCompile(`%\{(\w+)(?::(\w+))?(?::\w+)?\}`)
+
+// loadGrokPatterns reads patterns in the Logstash format, a "NAME regex" per line, "#" starts a comment line.
+func loadGrokPatterns(file string) (patterns map[string]string, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	defer f.Close()
+	patterns = make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			err = errors.Errorf("invalid grok pattern %q in %s", line, file)
+			return
+		}
+		patterns[parts[0]] = strings.TrimSpace(parts[1])
+	}
+	if err = scanner.Err(); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+// CompileGrok expands the grok expression into a regular expression, patterns in patternsFile override bundled ones.
+func CompileGrok(expr, patternsFile string) (re *regexp.Regexp, err error) {
+	patterns := grokPatterns
+	if patternsFile != "" {
+		var extra map[string]string
+		if extra, err = loadGrokPatterns(patternsFile); err != nil {
+			return
+		}
+		patterns = make(map[string]string, len(grokPatterns)+len(extra))
+		for name, pattern := range grokPatterns {
+			patterns[name] = pattern
+		}
+		for name, pattern := range extra {
+			patterns[name] = pattern
+		}
+	}
+	expanded, err := expandGrok(expr, patterns, 0)
+	if err != nil {
+		return
+	}
+	if re, err = regexp.Compile(expanded); err != nil {
+		err = errors.Wrapf(err, "invalid grok expression %s", expr)
+	}
+	return
+}
+
+func expandGrok(expr string, patterns map[string]string, depth int) (expanded string, err error) {
+	if depth > maxGrokDepth {
+		err = errors.Errorf("grok patterns are nested too deep, there may be a recursive definition")
+		return
+	}
+	expanded = grokRef.ReplaceAllStringFunc(expr, func(ref string) string {
+		if err != nil {
+			return ""
+		}
+		m := grokRef.FindStringSubmatch(ref)
+		pattern, ok := patterns[m[1]]
+		if !ok {
+			err = errors.Errorf("unknown grok pattern %s", m[1])
+			return ""
+		}
+		var sub string
+		if sub, err = expandGrok(pattern, patterns, depth+1); err != nil {
+			return ""
+		}
+		if m[2] == "" {
+			return "(?:" + sub + ")"
+		}
+		return "(?P<" + m[2] + ">" + sub + ")"
+	})
+	return
+}
@@ -0,0 +1,348 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package parser
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/housepower/clickhouse_sinker/model"
+)
+
+const (
+	// InfluxMeasurement and InfluxTime are keys of the measurement and the timestamp of a line.
+	InfluxMeasurement = "_measurement"
+	InfluxTime        = "_time"
+)
+
+// InfluxPrecisions maps precisions of line protocol timestamps to units.
+var InfluxPrecisions = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+var _ Parser = (*InfluxParser)(nil)
+
+// InfluxParser parses the InfluxDB line protocol, a message may carry multiple lines.
+type InfluxParser struct {
+	precision time.Duration
+	tsLayout  []string
+}
+
+// Parse returns the metric of the first line, use ParseAll to get all of them.
+func (p *InfluxParser) Parse(bs []byte) (metric model.Metric, err error) {
+	metrics, err := p.parseAll(bs)
+	if err != nil {
+		return
+	}
+	if len(metrics) == 0 {
+		err = errors.Errorf("the message has no line")
+		return
+	}
+	metric = metrics[0]
+	return
+}
+
+func (p *InfluxParser) parseAll(bs []byte) (metrics []model.Metric, err error) {
+	for _, line := range bytes.Split(bs, []byte{'\n'}) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		var metric *InfluxMetric
+		if metric, err = p.parseLine(line); err != nil {
+			err = errors.Wrapf(err, "invalid line %q", line)
+			return
+		}
+		metrics = append(metrics, metric)
+	}
+	return
+}
+
+// readToken reads until an unescaped stop character, and unescapes backslash escaped characters of the line protocol.
+func readToken(line []byte, i int, stops string) (token string, next int) {
+	var sb strings.Builder
+	for ; i < len(line); i++ {
+		c := line[i]
+		if c == '\\' && i+1 < len(line) && strings.IndexByte(`,= "\`, line[i+1]) >= 0 {
+			i++
+			sb.WriteByte(line[i])
+			continue
+		}
+		if strings.IndexByte(stops, c) >= 0 {
+			break
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String(), i
+}
+
+// readQuoted reads a double quoted string starting at line[i].
+func readQuoted(line []byte, i int) (s string, next int, err error) {
+	var sb strings.Builder
+	for i++; i < len(line); i++ {
+		c := line[i]
+		if c == '\\' && i+1 < len(line) && (line[i+1] == '"' || line[i+1] == '\\') {
+			i++
+			sb.WriteByte(line[i])
+			continue
+		}
+		if c == '"' {
+			return sb.String(), i + 1, nil
+		}
+		sb.WriteByte(c)
+	}
+	return "", i, errors.Errorf("unterminated string")
+}
+
+// parseFieldValue parses a field value: float, integer(1i), unsigned integer(1u) or boolean.
+func parseFieldValue(s string) (v interface{}, err error) {
+	switch s {
+	case "t", "T", "true", "True", "TRUE":
+		return true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return false, nil
+	}
+	if s == "" {
+		return nil, errors.Errorf("empty field value")
+	}
+	switch s[len(s)-1] {
+	case 'i':
+		v, err = strconv.ParseInt(s[:len(s)-1], 10, 64)
+	case 'u':
+		v, err = strconv.ParseUint(s[:len(s)-1], 10, 64)
+	default:
+		v, err = strconv.ParseFloat(s, 64)
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+func (p *InfluxParser) parseLine(line []byte) (metric *InfluxMetric, err error) {
+	values := make(map[string]interface{})
+	measurement, i := readToken(line, 0, ", ")
+	if measurement == "" {
+		return nil, errors.Errorf("missing measurement")
+	}
+	values[InfluxMeasurement] = measurement
+	for i < len(line) && line[i] == ',' {
+		var key, value string
+		key, i = readToken(line, i+1, "=, ")
+		if i >= len(line) || line[i] != '=' || key == "" {
+			return nil, errors.Errorf("invalid tag")
+		}
+		value, i = readToken(line, i+1, ", ")
+		values[key] = value
+	}
+	for i < len(line) && line[i] == ' ' {
+		i++
+	}
+	var fields int
+	for i < len(line) && line[i] != ' ' {
+		if fields > 0 {
+			if line[i] != ',' {
+				return nil, errors.Errorf("invalid field set")
+			}
+			i++
+		}
+		var key string
+		key, i = readToken(line, i, "=, ")
+		if i >= len(line) || line[i] != '=' || key == "" {
+			return nil, errors.Errorf("invalid field")
+		}
+		i++
+		var value interface{}
+		if i < len(line) && line[i] == '"' {
+			if value, i, err = readQuoted(line, i); err != nil {
+				return
+			}
+		} else {
+			var s string
+			s, i = readToken(line, i, ", ")
+			if value, err = parseFieldValue(s); err != nil {
+				return nil, errors.Wrapf(err, "field %s", key)
+			}
+		}
+		values[key] = value
+		fields++
+	}
+	if fields == 0 {
+		return nil, errors.Errorf("missing fields")
+	}
+	ts := time.Now().UTC()
+	if s := strings.TrimSpace(string(line[i:])); s != "" {
+		var n int64
+		if n, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return nil, errors.Wrapf(err, "invalid timestamp")
+		}
+		ts = time.Unix(0, n*int64(p.precision)).UTC()
+	}
+	values[InfluxTime] = ts
+	metric = &InfluxMetric{values, p.tsLayout}
+	return
+}
+
+// InfluxMetric exposes tags and fields by their keys, the measurement by InfluxMeasurement and the timestamp by InfluxTime.
+// A field shadows a tag of the same key.
+type InfluxMetric struct {
+	values   map[string]interface{}
+	tsLayout []string
+}
+
+func (c *InfluxMetric) Get(key string) interface{} {
+	return c.values[key]
+}
+
+func (c *InfluxMetric) GetString(key string, nullable bool) interface{} {
+	switch v := c.values[key].(type) {
+	case nil:
+		if nullable {
+			return nil
+		}
+		return ""
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	default:
+		return ""
+	}
+}
+
+func (c *InfluxMetric) GetFloat(key string, nullable bool) interface{} {
+	switch v := c.values[key].(type) {
+	case nil:
+		if nullable {
+			return nil
+		}
+		return float64(0)
+	case float64:
+		return v
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case bool:
+		if v {
+			return float64(1)
+		}
+		return float64(0)
+	case string:
+		f, _ := strconv.ParseFloat(v, 64)
+		return f
+	case time.Time:
+		return float64(v.UnixNano()) / 1e9
+	default:
+		return float64(0)
+	}
+}
+
+func (c *InfluxMetric) GetInt(key string, nullable bool) interface{} {
+	switch v := c.values[key].(type) {
+	case nil:
+		if nullable {
+			return nil
+		}
+		return int64(0)
+	case int64:
+		return v
+	case uint64:
+		return int64(v)
+	case string:
+		n, _ := strconv.ParseInt(v, 10, 64)
+		return n
+	case time.Time:
+		return v.Unix()
+	default:
+		return int64(c.GetFloat(key, false).(float64))
+	}
+}
+
+// GetArray is Empty implemented for InfluxMetric, the line protocol has no array.
+func (c *InfluxMetric) GetArray(key string, t string) interface{} {
+	switch t {
+	case "string":
+		return []string{}
+	case "float":
+		return []float64{}
+	case "int":
+		return []int64{}
+	default:
+		panic("not supported array type " + t)
+	}
+}
+
+// getTime converts the timestamp, a number of seconds since epoch, or a string of the layout to time.
+func (c *InfluxMetric) getTime(key string, nullable bool, layout string) interface{} {
+	switch v := c.values[key].(type) {
+	case nil:
+		if nullable {
+			return nil
+		}
+		return Epoch
+	case time.Time:
+		return v
+	case string:
+		t, _ := time.Parse(layout, v)
+		return t
+	case float64:
+		return time.Unix(int64(v), int64(v*1e9)%1e9).UTC()
+	default:
+		return time.Unix(c.GetInt(key, false).(int64), 0).UTC()
+	}
+}
+
+func (c *InfluxMetric) GetDate(key string, nullable bool) interface{} {
+	return c.getTime(key, nullable, c.tsLayout[0])
+}
+
+func (c *InfluxMetric) GetDateTime(key string, nullable bool) interface{} {
+	return c.getTime(key, nullable, c.tsLayout[1])
+}
+
+func (c *InfluxMetric) GetDateTime64(key string, nullable bool) interface{} {
+	return c.getTime(key, nullable, c.tsLayout[2])
+}
+
+func (c *InfluxMetric) GetElasticDateTime(key string, nullable bool) interface{} {
+	t := c.getTime(key, nullable, time.RFC3339)
+	if t == nil {
+		return nil
+	}
+	return t.(time.Time).Unix()
+}
+
+// GetNewKeys is not supported by InfluxMetric
+func (c *InfluxMetric) GetNewKeys(knownKeys *sync.Map, newKeys map[string]string) bool {
+	return false
+}
@@ -0,0 +1,76 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package parser
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInflux(t *testing.T) {
+	pp := NewParserPool("influx", nil, "", DefaultTSLayout)
+	require.NotNil(t, pp.SetInfluxPrecision("h"))
+	require.Nil(t, pp.SetInfluxPrecision("ms"))
+	parser := pp.Get()
+	defer pp.Put(parser)
+
+	msg := "# telegraf\n" +
+		`cpu,host=web-01,region=us\ west usage_idle=98.5,usage_user=1i,online=t,note="say \"hi\", bye" 1600000000123` + "\n" +
+		"\n" +
+		`disk\,io,host=web-01 reads=42u 1600000001000` + "\r\n"
+	metrics, err := ParseAll(parser, []byte(msg))
+	require.Nil(t, err)
+	require.Equal(t, 2, len(metrics))
+
+	cpu := metrics[0]
+	require.Equal(t, "cpu", cpu.GetString(InfluxMeasurement, false))
+	require.Equal(t, "web-01", cpu.GetString("host", false))
+	require.Equal(t, "us west", cpu.GetString("region", false))
+	require.Equal(t, 98.5, cpu.GetFloat("usage_idle", false))
+	require.Equal(t, int64(1), cpu.GetInt("usage_user", false))
+	require.Equal(t, int64(1), cpu.GetInt("online", false))
+	require.Equal(t, `say "hi", bye`, cpu.GetString("note", false))
+	require.Equal(t, time.Unix(1600000000, 123e6).UTC(), cpu.GetDateTime64(InfluxTime, false))
+	require.Equal(t, int64(1600000000), cpu.GetElasticDateTime(InfluxTime, false))
+	require.Nil(t, cpu.GetFloat("absent", true))
+
+	disk := metrics[1]
+	require.Equal(t, "disk,io", disk.GetString(InfluxMeasurement, false))
+	require.Equal(t, "42", disk.GetString("reads", false))
+	require.Equal(t, int64(42), disk.GetInt("reads", false))
+
+	metric, err := parser.Parse([]byte(msg))
+	require.Nil(t, err)
+	require.Equal(t, "cpu", metric.GetString(InfluxMeasurement, false))
+
+	// A line without timestamp is stamped on arrival.
+	metric, err = parser.Parse([]byte("mem free=1"))
+	require.Nil(t, err)
+	require.WithinDuration(t, time.Now(), metric.GetDateTime(InfluxTime, false).(time.Time), time.Minute)
+
+	for _, line := range []string{
+		"cpu",
+		"cpu,host usage=1",
+		"cpu usage=",
+		"cpu usage=abc",
+		`cpu note="open`,
+		"cpu usage=1 abc",
+	} {
+		_, err = ParseAll(parser, []byte(line))
+		require.NotNil(t, err, line)
+	}
+}
@@ -16,9 +16,13 @@ package parser
 
 import (
 	"encoding/json"
+	"regexp"
 	"sync"
 	"time"
 
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
 	"github.com/housepower/clickhouse_sinker/model"
 )
 
@@ -32,12 +36,64 @@ type Parser interface {
 	Parse(bs []byte) (metric model.Metric, err error)
 }
 
+// RetryableError is returned by Parse if the message failed due to a transient failure of an external service, like the
+// Schema Registry being unreachable. The message shall be parsed again later rather than taken as malformed.
+type RetryableError struct {
+	error
+}
+
+// IsRetryable tells whether err is, or wraps, a RetryableError.
+func IsRetryable(err error) bool {
+	_, ok := errors.Cause(err).(*RetryableError)
+	return ok
+}
+
+// multiParser is implemented by parsers whose messages may carry multiple metrics.
+type multiParser interface {
+	parseAll(bs []byte) (metrics []model.Metric, err error)
+}
+
+// ParseAll parses the message into all metrics it carries, it's the same as Parse for most parsers.
+func ParseAll(p Parser, bs []byte) (metrics []model.Metric, err error) {
+	if mp, ok := p.(multiParser); ok {
+		return mp.parseAll(bs)
+	}
+	var metric model.Metric
+	if metric, err = p.Parse(bs); err != nil {
+		return
+	}
+	metrics = []model.Metric{metric}
+	return
+}
+
+// exploder is implemented by parsers which are able to split a message into multiple metrics.
+type exploder interface {
+	explode(bs []byte, path string) (metrics []model.Metric, err error)
+}
+
+// Explode parses the message, and returns a metric for each element of the array at path(dot separated, "$" for the message itself).
+// Each metric inherits top-level fields of the message except the one containing the array. An element which is an object
+// overrides inherited fields of the same names, other elements are put at the last key of path.
+// There's no metric if the array is absent, null or empty.
+func Explode(p Parser, bs []byte, path string) (metrics []model.Metric, err error) {
+	ep, ok := p.(exploder)
+	if !ok {
+		err = errors.Errorf("explode is unsupported by parser %T", p)
+		return
+	}
+	return ep.explode(bs, path)
+}
+
 // Pool may be used for pooling Parsers for similarly typed JSONs.
 type Pool struct {
 	name      string
 	csvFormat []string
 	delimiter string
 	tsLayout  []string
+	protoDesc protoreflect.MessageDescriptor
+	avro      *avroSchemas
+	regexp    *regexp.Regexp
+	precision time.Duration
 	pool      sync.Pool
 }
 
@@ -51,6 +107,39 @@ func NewParserPool(name string, csvFormat []string, delimiter string, tsLayout [
 	}
 }
 
+// LoadProtoDescriptor loads the message type for parser protobuf, it shall be called before Get.
+func (pp *Pool) LoadProtoDescriptor(file, message string) (err error) {
+	pp.protoDesc, err = LoadProtoDescriptor(file, message)
+	return
+}
+
+// InitAvro sets up schema resolving for parser avro, it shall be called before Get.
+func (pp *Pool) InitAvro(schemaRegistry, schemaFile string) (err error) {
+	pp.avro, err = newAvroSchemas(schemaRegistry, schemaFile)
+	return
+}
+
+// CompilePattern compiles the expression for parser regex or grok, it shall be called before Get.
+func (pp *Pool) CompilePattern(pattern, grokPatterns string) (err error) {
+	if pp.name == "grok" {
+		pp.regexp, err = CompileGrok(pattern, grokPatterns)
+		return
+	}
+	if pp.regexp, err = regexp.Compile(pattern); err != nil {
+		err = errors.Wrapf(err, "invalid pattern %s", pattern)
+	}
+	return
+}
+
+// SetInfluxPrecision sets the precision(ns, us, ms or s) of timestamps for parser influx, it shall be called before Get.
+func (pp *Pool) SetInfluxPrecision(precision string) (err error) {
+	var ok bool
+	if pp.precision, ok = InfluxPrecisions[precision]; !ok {
+		err = errors.Errorf("invalid influx precision %s", precision)
+	}
+	return
+}
+
 // Get returns a Parser from pp.
 //
 // The Parser must be Put to pp after use.
@@ -67,6 +156,16 @@ func (pp *Pool) Get() Parser {
 		//extend gjson that could extract the map
 		case "gjson_extend":
 			return &GjsonExtendParser{pp.tsLayout}
+		case "protobuf":
+			return &ProtobufParser{pp.protoDesc, pp.tsLayout}
+		case "avro":
+			return &AvroParser{pp.avro, pp.tsLayout}
+		case "regex", "grok":
+			return &RegexParser{pp.regexp, pp.tsLayout}
+		case "influx":
+			return &InfluxParser{pp.precision, pp.tsLayout}
+		case "prometheus":
+			return &PrometheusParser{pp.tsLayout}
 		default:
 			return &FastjsonParser{tsLayout: pp.tsLayout}
 		}
@@ -17,6 +17,7 @@ package parser
 import (
 	"encoding/json"
 	"log"
+	"sync"
 	"testing"
 	"time"
 
@@ -152,3 +153,92 @@ func TestFastJson(t *testing.T) {
 	exp4 := []int{123, 456}
 	require.Equal(t, exp4, arr2)
 }
+
+func TestGetNewKeys(t *testing.T) {
+	var knownKeys sync.Map
+	for _, key := range []string{"its", "_ip", "cgi", "channel", "platform", "experiment", "ip", "version", "mp", "mpf"} {
+		knownKeys.Store(key, nil)
+	}
+	sample := []byte(`{"its":1536813227,"success":0,"percent":0.11,"exp":1e3,"date":"2019-12-16T12:10:30Z",
+		"ints":[1,2],"floats":[1,2.5],"strs":["a"],"empty":[],"obj":{"a":1},"flag":true,"null":null,"a.b":"x"}`)
+	expected := map[string]string{
+		"success": "Nullable(Int64)",
+		"percent": "Nullable(Float64)",
+		"exp":     "Nullable(Float64)",
+		"date":    "Nullable(String)",
+		"ints":    "Array(Int64)",
+		"floats":  "Array(Float64)",
+		"strs":    "Array(String)",
+	}
+	for _, name := range []string{"fastjson", "gjson"} {
+		pp := NewParserPool(name, nil, "", DefaultTSLayout)
+		parser := pp.Get()
+		metric, err := parser.Parse(sample)
+		require.Nil(t, err)
+		newKeys := make(map[string]string)
+		require.True(t, metric.GetNewKeys(&knownKeys, newKeys), name)
+		require.Equal(t, expected, newKeys, name)
+
+		metric, err = parser.Parse(jsonSample)
+		require.Nil(t, err)
+		newKeys = make(map[string]string)
+		require.True(t, metric.GetNewKeys(&knownKeys, newKeys), name)
+		for _, key := range []string{"mp", "mpf", "mps", "its"} {
+			require.NotContains(t, newKeys, key, name)
+		}
+		require.Equal(t, "Nullable(String)", newKeys["date"], name)
+		pp.Put(parser)
+	}
+}
+
+func TestGetAbsent(t *testing.T) {
+	// Get returns nil for absent and null fields, which the filter function exists() relies on.
+	for _, name := range []string{"fastjson", "gjson", "gjson_extend"} {
+		pp := NewParserPool(name, nil, "", DefaultTSLayout)
+		parser := pp.Get()
+		metric, err := parser.Parse([]byte(`{"a":1,"b":null,"c":""}`))
+		require.Nil(t, err)
+		require.NotNil(t, metric.Get("a"), name)
+		require.Nil(t, metric.Get("b"), name)
+		require.NotNil(t, metric.Get("c"), name)
+		require.Nil(t, metric.Get("absent"), name)
+		pp.Put(parser)
+	}
+}
+
+func TestExplode(t *testing.T) {
+	cases := []struct {
+		sample   string
+		path     string
+		expected [][]string //host and name of each metric
+	}{
+		{`{"host":"a","name":"x","events":[{"name":"e1"},{"name":"e2","host":"b"}]}`, "events", [][]string{{"a", "e1"}, {"b", "e2"}}},
+		{`{"host":"a","data":{"name":["e1","e2"]}}`, "data.name", [][]string{{"a", "e1"}, {"a", "e2"}}},
+		{`[{"host":"a","name":"e1"},{"name":"e2"}]`, "$", [][]string{{"a", "e1"}, {"", "e2"}}},
+		{`{"host":"a","events":[]}`, "events", nil},
+		{`{"host":"a"}`, "events", nil},
+	}
+	for _, name := range []string{"fastjson", "gjson"} {
+		pp := NewParserPool(name, nil, "", DefaultTSLayout)
+		parser := pp.Get()
+		for _, c := range cases {
+			metrics, err := Explode(parser, []byte(c.sample), c.path)
+			require.Nil(t, err, "%s %s", name, c.sample)
+			var actual [][]string
+			for _, metric := range metrics {
+				actual = append(actual, []string{metric.GetString("host", false).(string), metric.GetString("name", false).(string)})
+				require.Nil(t, metric.GetString("events", true), "%s %s", name, c.sample)
+			}
+			require.Equal(t, c.expected, actual, "%s %s", name, c.sample)
+		}
+		for _, c := range []struct{ sample, path string }{{`{"events":"e1"}`, "events"}, {`[1,2]`, "$"}} {
+			_, err := Explode(parser, []byte(c.sample), c.path)
+			require.NotNil(t, err, "%s %s", name, c.sample)
+		}
+		pp.Put(parser)
+	}
+
+	pp := NewParserPool("csv", []string{"a"}, ",", DefaultTSLayout)
+	_, err := Explode(pp.Get(), []byte("1"), "$")
+	require.NotNil(t, err)
+}
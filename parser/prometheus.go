@@ -0,0 +1,381 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package parser
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/housepower/clickhouse_sinker/model"
+)
+
+// Keys of a sample other than its labels. A label is looked up by its name.
+const (
+	PromName        = "__name__"         // the metric name
+	PromValue       = "__value__"        // the sample value
+	PromTimestamp   = "__timestamp__"    // the sample timestamp
+	PromLabels      = "__labels__"       // labels except __name__ as a JSON object
+	PromLabelNames  = "__label_names__"  // names of labels except __name__
+	PromLabelValues = "__label_values__" // values of labels except __name__, in the same order as PromLabelNames
+	PromFingerprint = "__fingerprint__"  // a hash of all labels, which identifies the series
+)
+
+var _ Parser = (*PrometheusParser)(nil)
+
+type promLabel struct {
+	name, value string
+}
+
+// promSeries is a time series of a WriteRequest.
+type promSeries struct {
+	labels      []promLabel //sorted by name
+	samples     []promSample
+	fingerprint uint64
+}
+
+type promSample struct {
+	value     float64
+	timestamp int64 //milliseconds since epoch
+}
+
+// PrometheusParser decodes snappy-compressed Prometheus remote write requests, each sample of which is a metric.
+type PrometheusParser struct {
+	tsLayout []string
+}
+
+// Parse returns the metric of the first sample, use ParseAll to get all of them.
+func (p *PrometheusParser) Parse(bs []byte) (metric model.Metric, err error) {
+	metrics, err := p.parseAll(bs)
+	if err != nil {
+		return
+	}
+	if len(metrics) == 0 {
+		err = errors.Errorf("the request has no sample")
+		return
+	}
+	metric = metrics[0]
+	return
+}
+
+func (p *PrometheusParser) parseAll(bs []byte) (metrics []model.Metric, err error) {
+	series, err := decodeCompressedWriteRequest(bs)
+	if err != nil {
+		return
+	}
+	for _, s := range series {
+		for i := range s.samples {
+			metrics = append(metrics, &PrometheusMetric{s, s.samples[i], p.tsLayout})
+		}
+	}
+	return
+}
+
+// ValidateWriteRequest checks that bs is a snappy-compressed remote write request.
+func ValidateWriteRequest(bs []byte) (err error) {
+	_, err = decodeCompressedWriteRequest(bs)
+	return
+}
+
+func decodeCompressedWriteRequest(bs []byte) (series []*promSeries, err error) {
+	if bs, err = snappy.Decode(nil, bs); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	return decodeWriteRequest(bs)
+}
+
+// protoFields calls fn for each field of the protobuf message.
+func protoFields(bs []byte, fn func(num protowire.Number, typ protowire.Type, bs []byte) (n int)) (err error) {
+	for len(bs) > 0 {
+		num, typ, n := protowire.ConsumeTag(bs)
+		if n < 0 {
+			return errors.Wrapf(protowire.ParseError(n), "")
+		}
+		bs = bs[n:]
+		if n = fn(num, typ, bs); n < 0 {
+			return errors.Wrapf(protowire.ParseError(n), "")
+		}
+		bs = bs[n:]
+	}
+	return
+}
+
+// decodeWriteRequest decodes prometheus.WriteRequest, metadata and exemplars are skipped.
+func decodeWriteRequest(bs []byte) (series []*promSeries, err error) {
+	var seriesErr error
+	err = protoFields(bs, func(num protowire.Number, typ protowire.Type, bs []byte) int {
+		if num != 1 || typ != protowire.BytesType {
+			return protowire.ConsumeFieldValue(num, typ, bs)
+		}
+		v, n := protowire.ConsumeBytes(bs)
+		if n < 0 {
+			return n
+		}
+		var s *promSeries
+		if s, seriesErr = decodeTimeSeries(v); seriesErr != nil {
+			return -1
+		}
+		series = append(series, s)
+		return n
+	})
+	if seriesErr != nil {
+		err = seriesErr
+	}
+	return
+}
+
+func decodeTimeSeries(bs []byte) (s *promSeries, err error) {
+	s = &promSeries{}
+	var fieldErr error
+	err = protoFields(bs, func(num protowire.Number, typ protowire.Type, bs []byte) int {
+		if (num != 1 && num != 2) || typ != protowire.BytesType {
+			return protowire.ConsumeFieldValue(num, typ, bs)
+		}
+		v, n := protowire.ConsumeBytes(bs)
+		if n < 0 {
+			return n
+		}
+		if num == 1 {
+			var label promLabel
+			fieldErr = protoFields(v, func(num protowire.Number, typ protowire.Type, bs []byte) int {
+				if (num != 1 && num != 2) || typ != protowire.BytesType {
+					return protowire.ConsumeFieldValue(num, typ, bs)
+				}
+				str, n := protowire.ConsumeString(bs)
+				if num == 1 {
+					label.name = str
+				} else {
+					label.value = str
+				}
+				return n
+			})
+			s.labels = append(s.labels, label)
+		} else {
+			var sample promSample
+			fieldErr = protoFields(v, func(num protowire.Number, typ protowire.Type, bs []byte) int {
+				switch {
+				case num == 1 && typ == protowire.Fixed64Type:
+					bits, n := protowire.ConsumeFixed64(bs)
+					sample.value = math.Float64frombits(bits)
+					return n
+				case num == 2 && typ == protowire.VarintType:
+					ts, n := protowire.ConsumeVarint(bs)
+					sample.timestamp = int64(ts)
+					return n
+				default:
+					return protowire.ConsumeFieldValue(num, typ, bs)
+				}
+			})
+			s.samples = append(s.samples, sample)
+		}
+		if fieldErr != nil {
+			return -1
+		}
+		return n
+	})
+	if fieldErr != nil {
+		err = fieldErr
+	}
+	if err != nil {
+		return
+	}
+	sort.Slice(s.labels, func(i, j int) bool { return s.labels[i].name < s.labels[j].name })
+	h := fnv.New64a()
+	for _, label := range s.labels {
+		_, _ = h.Write([]byte(label.name))
+		_, _ = h.Write([]byte{0xff})
+		_, _ = h.Write([]byte(label.value))
+		_, _ = h.Write([]byte{0xff})
+	}
+	s.fingerprint = h.Sum64()
+	return
+}
+
+// PrometheusMetric is a sample along with labels of its series. Besides labels, it exposes PromValue, PromTimestamp,
+// PromLabels, PromLabelNames, PromLabelValues and PromFingerprint.
+type PrometheusMetric struct {
+	series   *promSeries
+	sample   promSample
+	tsLayout []string
+}
+
+func (c *PrometheusMetric) label(name string) (value string, ok bool) {
+	for _, label := range c.series.labels {
+		if label.name == name {
+			return label.value, true
+		}
+	}
+	return
+}
+
+func (c *PrometheusMetric) labelsJSON() string {
+	labels := make(map[string]string, len(c.series.labels))
+	for _, label := range c.series.labels {
+		if label.name != PromName {
+			labels[label.name] = label.value
+		}
+	}
+	bs, _ := json.Marshal(labels)
+	return string(bs)
+}
+
+func (c *PrometheusMetric) Get(key string) interface{} {
+	switch key {
+	case PromValue:
+		return c.sample.value
+	case PromTimestamp:
+		return time.Unix(0, c.sample.timestamp*int64(time.Millisecond)).UTC()
+	case PromFingerprint:
+		return c.series.fingerprint
+	case PromLabels:
+		return c.labelsJSON()
+	case PromLabelNames, PromLabelValues:
+		return c.GetArray(key, "string")
+	}
+	if v, ok := c.label(key); ok {
+		return v
+	}
+	return nil
+}
+
+func (c *PrometheusMetric) GetString(key string, nullable bool) interface{} {
+	switch key {
+	case PromValue:
+		return strconv.FormatFloat(c.sample.value, 'g', -1, 64)
+	case PromTimestamp:
+		return c.Get(key).(time.Time).Format(time.RFC3339Nano)
+	case PromFingerprint:
+		return strconv.FormatUint(c.series.fingerprint, 10)
+	case PromLabels:
+		return c.labelsJSON()
+	}
+	v, ok := c.label(key)
+	if !ok && nullable {
+		return nil
+	}
+	return v
+}
+
+func (c *PrometheusMetric) GetFloat(key string, nullable bool) interface{} {
+	switch key {
+	case PromValue:
+		return c.sample.value
+	case PromTimestamp:
+		return float64(c.sample.timestamp) / 1e3
+	case PromFingerprint:
+		return float64(c.series.fingerprint)
+	}
+	v, ok := c.label(key)
+	if !ok && nullable {
+		return nil
+	}
+	f, _ := strconv.ParseFloat(v, 64)
+	return f
+}
+
+// GetInt returns milliseconds for PromTimestamp.
+func (c *PrometheusMetric) GetInt(key string, nullable bool) interface{} {
+	switch key {
+	case PromValue:
+		return int64(c.sample.value)
+	case PromTimestamp:
+		return c.sample.timestamp
+	case PromFingerprint:
+		return int64(c.series.fingerprint)
+	}
+	v, ok := c.label(key)
+	if !ok && nullable {
+		return nil
+	}
+	n, _ := strconv.ParseInt(v, 10, 64)
+	return n
+}
+
+// GetArray returns PromLabelNames and PromLabelValues, other arrays are empty.
+func (c *PrometheusMetric) GetArray(key string, t string) interface{} {
+	switch t {
+	case "string":
+		results := []string{}
+		if key == PromLabelNames || key == PromLabelValues {
+			for _, label := range c.series.labels {
+				if label.name == PromName {
+					continue
+				}
+				if key == PromLabelNames {
+					results = append(results, label.name)
+				} else {
+					results = append(results, label.value)
+				}
+			}
+		}
+		return results
+	case "float":
+		return []float64{}
+	case "int":
+		return []int64{}
+	default:
+		panic("not supported array type " + t)
+	}
+}
+
+func (c *PrometheusMetric) getTime(key string, nullable bool, layout string) interface{} {
+	if key == PromTimestamp {
+		return c.Get(key)
+	}
+	v, ok := c.label(key)
+	if !ok {
+		if nullable {
+			return nil
+		}
+		return Epoch
+	}
+	t, _ := time.Parse(layout, v)
+	return t
+}
+
+func (c *PrometheusMetric) GetDate(key string, nullable bool) interface{} {
+	return c.getTime(key, nullable, c.tsLayout[0])
+}
+
+func (c *PrometheusMetric) GetDateTime(key string, nullable bool) interface{} {
+	return c.getTime(key, nullable, c.tsLayout[1])
+}
+
+func (c *PrometheusMetric) GetDateTime64(key string, nullable bool) interface{} {
+	return c.getTime(key, nullable, c.tsLayout[2])
+}
+
+func (c *PrometheusMetric) GetElasticDateTime(key string, nullable bool) interface{} {
+	t := c.getTime(key, nullable, time.RFC3339)
+	if t == nil {
+		return nil
+	}
+	return t.(time.Time).Unix()
+}
+
+// GetNewKeys is not supported by PrometheusMetric
+func (c *PrometheusMetric) GetNewKeys(knownKeys *sync.Map, newKeys map[string]string) bool {
+	return false
+}
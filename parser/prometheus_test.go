@@ -0,0 +1,98 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package parser
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// encodeWriteRequest encodes a prometheus.WriteRequest, each series is given by labels and samples(value, timestamp pairs).
+func encodeWriteRequest(series ...[]interface{}) []byte {
+	var req []byte
+	for _, s := range series {
+		var ts []byte
+		labels, samples := s[0].([]string), s[1].([]float64)
+		for i := 0; i < len(labels); i += 2 {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, labels[i])
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, labels[i+1])
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, label)
+		}
+		for i := 0; i < len(samples); i += 2 {
+			var sample []byte
+			sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+			sample = protowire.AppendFixed64(sample, math.Float64bits(samples[i]))
+			sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+			sample = protowire.AppendVarint(sample, uint64(samples[i+1]))
+			ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, sample)
+		}
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, ts)
+	}
+	return snappy.Encode(nil, req)
+}
+
+func TestPrometheus(t *testing.T) {
+	pp := NewParserPool("prometheus", nil, "", DefaultTSLayout)
+	parser := pp.Get()
+	defer pp.Put(parser)
+
+	bs := encodeWriteRequest(
+		[]interface{}{[]string{"job", "node", "__name__", "up", "instance", "a:9100"}, []float64{1, 1600000000000, 0, 1600000015000}},
+		[]interface{}{[]string{"__name__", "up", "instance", "b:9100", "job", "node"}, []float64{1, 1600000000500}},
+	)
+	metrics, err := ParseAll(parser, bs)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(metrics))
+
+	m := metrics[1]
+	require.Equal(t, "up", m.GetString(PromName, false))
+	require.Equal(t, "a:9100", m.GetString("instance", false))
+	require.Equal(t, float64(0), m.GetFloat(PromValue, false))
+	require.Equal(t, time.Unix(1600000015, 0).UTC(), m.GetDateTime64(PromTimestamp, false))
+	require.Equal(t, int64(1600000015000), m.GetInt(PromTimestamp, false))
+	require.Equal(t, `{"instance":"a:9100","job":"node"}`, m.GetString(PromLabels, false))
+	require.Equal(t, []string{"instance", "job"}, m.GetArray(PromLabelNames, "string"))
+	require.Equal(t, []string{"a:9100", "node"}, m.GetArray(PromLabelValues, "string"))
+	require.Nil(t, m.GetString("absent", true))
+
+	// Samples of a series share the fingerprint, which doesn't depend on the order of labels.
+	require.Equal(t, metrics[0].GetInt(PromFingerprint, false), m.GetInt(PromFingerprint, false))
+	require.NotEqual(t, m.GetInt(PromFingerprint, false), metrics[2].GetInt(PromFingerprint, false))
+	require.Equal(t, time.Unix(1600000000, 5e8).UTC(), metrics[2].GetDateTime64(PromTimestamp, false))
+
+	metric, err := parser.Parse(bs)
+	require.Nil(t, err)
+	require.Equal(t, float64(1), metric.GetFloat(PromValue, false))
+
+	_, err = ParseAll(parser, []byte("not snappy"))
+	require.NotNil(t, err)
+	_, err = ParseAll(parser, snappy.Encode(nil, []byte{0x0a, 0x05, 0x0a}))
+	require.NotNil(t, err)
+
+	require.Nil(t, ValidateWriteRequest(bs))
+	require.NotNil(t, ValidateWriteRequest([]byte("not snappy")))
+	require.NotNil(t, ValidateWriteRequest(snappy.Encode(nil, []byte{0x0a, 0x05, 0x0a})))
+}
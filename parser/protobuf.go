@@ -0,0 +1,332 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package parser
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"github.com/housepower/clickhouse_sinker/model"
+)
+
+const timestampFullName = "google.protobuf.Timestamp"
+
+var _ Parser = (*ProtobufParser)(nil)
+
+// LoadProtoDescriptor finds the message type in a FileDescriptorSet file. .proto files are not parsed directly,
+// they're compiled into the FileDescriptorSet by protoc, along with all files they import:
+//
+//	protoc --include_imports --descriptor_set_out=event.pb -I <import paths> event.proto
+//
+// Without --include_imports, types of imported files(google/protobuf/timestamp.proto etc.) fail to resolve.
+// The message is given by its full name, i.e. the package followed by the type name, like "mycompany.Event".
+func LoadProtoDescriptor(file, message string) (desc protoreflect.MessageDescriptor, err error) {
+	var bs []byte
+	if bs, err = ioutil.ReadFile(file); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	var fdSet descriptorpb.FileDescriptorSet
+	if err = proto.Unmarshal(bs, &fdSet); err != nil {
+		err = errors.Wrapf(err, "failed to parse %s", file)
+		return
+	}
+	files, err := protodesc.NewFiles(&fdSet)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to load %s", file)
+		return
+	}
+	d, err := files.FindDescriptorByName(protoreflect.FullName(message))
+	if err != nil {
+		err = errors.Wrapf(err, "message %s is absent in %s", message, file)
+		return
+	}
+	var ok bool
+	if desc, ok = d.(protoreflect.MessageDescriptor); !ok {
+		err = errors.Errorf("%s of %s is not a message", message, file)
+	}
+	return
+}
+
+// ProtobufParser decodes messages of the type described by desc.
+type ProtobufParser struct {
+	desc     protoreflect.MessageDescriptor
+	tsLayout []string
+}
+
+func (p *ProtobufParser) Parse(bs []byte) (metric model.Metric, err error) {
+	msg := dynamicpb.NewMessage(p.desc)
+	if err = proto.Unmarshal(bs, msg); err != nil {
+		err = errors.Wrapf(err, "")
+		return
+	}
+	metric = &ProtobufMetric{msg: msg, tsLayout: p.tsLayout}
+	return
+}
+
+// ProtobufMetric looks up fields by dot separated paths of field names(or JSON names), like "request.header.host".
+// Intermediate fields must be singular messages. A field without presence(proto3 scalars) is never absent.
+type ProtobufMetric struct {
+	msg      protoreflect.Message
+	tsLayout []string
+}
+
+// field returns the field at key, ok is false if it's absent.
+func (c *ProtobufMetric) field(key string) (v protoreflect.Value, fd protoreflect.FieldDescriptor, ok bool) {
+	msg := c.msg
+	parts := strings.Split(key, ".")
+	for i, part := range parts {
+		fields := msg.Descriptor().Fields()
+		if fd = fields.ByName(protoreflect.Name(part)); fd == nil {
+			if fd = fields.ByJSONName(part); fd == nil {
+				return
+			}
+		}
+		if fd.HasPresence() && !msg.Has(fd) {
+			return
+		}
+		v = msg.Get(fd)
+		if i == len(parts)-1 {
+			ok = true
+			return
+		}
+		if fd.IsList() || fd.IsMap() || fd.Message() == nil {
+			return
+		}
+		msg = v.Message()
+	}
+	return
+}
+
+func (c *ProtobufMetric) Get(key string) interface{} {
+	v, _, ok := c.field(key)
+	if !ok {
+		return nil
+	}
+	return v.Interface()
+}
+
+func (c *ProtobufMetric) GetString(key string, nullable bool) interface{} {
+	v, fd, ok := c.field(key)
+	if !ok {
+		if nullable {
+			return nil
+		}
+		return ""
+	}
+	if fd.IsList() || fd.IsMap() {
+		return ""
+	}
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return v.String()
+	case protoreflect.BytesKind:
+		return string(v.Bytes())
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			return string(ev.Name())
+		}
+		return strconv.Itoa(int(v.Enum()))
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		bs, _ := protojson.Marshal(v.Message().Interface())
+		return string(bs)
+	default:
+		return v.String()
+	}
+}
+
+// scalarFloat converts a numeric, bool or enum value to float64.
+func scalarFloat(v protoreflect.Value, fd protoreflect.FieldDescriptor) float64 {
+	switch fd.Kind() {
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return float64(v.Int())
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return float64(v.Uint())
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return v.Float()
+	case protoreflect.BoolKind:
+		if v.Bool() {
+			return 1
+		}
+		return 0
+	case protoreflect.EnumKind:
+		return float64(v.Enum())
+	default:
+		return 0
+	}
+}
+
+// scalarInt is like scalarFloat, but keeps precision of 64-bit integers.
+func scalarInt(v protoreflect.Value, fd protoreflect.FieldDescriptor) int64 {
+	switch fd.Kind() {
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return v.Int()
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return int64(v.Uint())
+	default:
+		return int64(scalarFloat(v, fd))
+	}
+}
+
+func (c *ProtobufMetric) GetFloat(key string, nullable bool) interface{} {
+	v, fd, ok := c.field(key)
+	if !ok {
+		if nullable {
+			return nil
+		}
+		return float64(0)
+	}
+	if fd.IsList() || fd.IsMap() {
+		return float64(0)
+	}
+	return scalarFloat(v, fd)
+}
+
+func (c *ProtobufMetric) GetInt(key string, nullable bool) interface{} {
+	v, fd, ok := c.field(key)
+	if !ok {
+		if nullable {
+			return nil
+		}
+		return int64(0)
+	}
+	if fd.IsList() || fd.IsMap() {
+		return int64(0)
+	}
+	return scalarInt(v, fd)
+}
+
+// GetArray returns elements of a repeated field as []string, []int64 or []float64.
+func (c *ProtobufMetric) GetArray(key string, t string) interface{} {
+	v, fd, ok := c.field(key)
+	var list protoreflect.List
+	if ok && fd.IsList() {
+		list = v.List()
+	}
+	var n int
+	if list != nil {
+		n = list.Len()
+	}
+	switch t {
+	case "string":
+		results := make([]string, 0, n)
+		for i := 0; i < n; i++ {
+			switch e := list.Get(i); fd.Kind() {
+			case protoreflect.StringKind:
+				results = append(results, e.String())
+			case protoreflect.BytesKind:
+				results = append(results, string(e.Bytes()))
+			case protoreflect.EnumKind:
+				if ev := fd.Enum().Values().ByNumber(e.Enum()); ev != nil {
+					results = append(results, string(ev.Name()))
+				} else {
+					results = append(results, strconv.Itoa(int(e.Enum())))
+				}
+			case protoreflect.MessageKind, protoreflect.GroupKind:
+				bs, _ := protojson.Marshal(e.Message().Interface())
+				results = append(results, string(bs))
+			default:
+				results = append(results, e.String())
+			}
+		}
+		return results
+	case "float":
+		results := make([]float64, 0, n)
+		for i := 0; i < n; i++ {
+			results = append(results, scalarFloat(list.Get(i), fd))
+		}
+		return results
+	case "int":
+		results := make([]int64, 0, n)
+		for i := 0; i < n; i++ {
+			results = append(results, scalarInt(list.Get(i), fd))
+		}
+		return results
+	default:
+		panic("not supported array type " + t)
+	}
+}
+
+// getTime converts a google.protobuf.Timestamp, seconds since epoch, or a string of the layout to time.
+func (c *ProtobufMetric) getTime(key string, nullable bool, layout string) interface{} {
+	v, fd, ok := c.field(key)
+	if !ok {
+		if nullable {
+			return nil
+		}
+		return Epoch
+	}
+	if fd.IsList() || fd.IsMap() {
+		return Epoch
+	}
+	switch fd.Kind() {
+	case protoreflect.MessageKind:
+		if fd.Message().FullName() != timestampFullName {
+			return Epoch
+		}
+		msg := v.Message()
+		fields := fd.Message().Fields()
+		seconds := msg.Get(fields.ByName("seconds")).Int()
+		nanos := msg.Get(fields.ByName("nanos")).Int()
+		return time.Unix(seconds, nanos).UTC()
+	case protoreflect.StringKind:
+		t, _ := time.Parse(layout, v.String())
+		return t
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		f := v.Float()
+		return time.Unix(int64(f), int64(f*1e9)%1e9).UTC()
+	default:
+		return time.Unix(scalarInt(v, fd), 0).UTC()
+	}
+}
+
+func (c *ProtobufMetric) GetDate(key string, nullable bool) interface{} {
+	return c.getTime(key, nullable, c.tsLayout[0])
+}
+
+func (c *ProtobufMetric) GetDateTime(key string, nullable bool) interface{} {
+	return c.getTime(key, nullable, c.tsLayout[1])
+}
+
+func (c *ProtobufMetric) GetDateTime64(key string, nullable bool) interface{} {
+	return c.getTime(key, nullable, c.tsLayout[2])
+}
+
+func (c *ProtobufMetric) GetElasticDateTime(key string, nullable bool) interface{} {
+	t := c.getTime(key, nullable, time.RFC3339)
+	if t == nil {
+		return nil
+	}
+	return t.(time.Time).Unix()
+}
+
+// GetNewKeys is not supported by ProtobufMetric, the schema is fixed by the descriptor.
+func (c *ProtobufMetric) GetNewKeys(knownKeys *sync.Map, newKeys map[string]string) bool {
+	return false
+}
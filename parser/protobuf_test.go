@@ -0,0 +1,139 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package parser
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// writeEventDescriptor writes a FileDescriptorSet of event.proto, which defines enum test.Level,
+// message test.Header and message test.Event with fields of various types.
+func writeEventDescriptor(t *testing.T, file string) {
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type, typeName string, repeated bool) *descriptorpb.FieldDescriptorProto {
+		label := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+		if repeated {
+			label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+		}
+		fd := &descriptorpb.FieldDescriptorProto{Name: proto.String(name), JsonName: proto.String(name), Number: proto.Int32(number), Type: typ.Enum(), Label: label.Enum()}
+		if typeName != "" {
+			fd.TypeName = proto.String(typeName)
+		}
+		return fd
+	}
+	eventFile := &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("event.proto"),
+		Package:    proto.String("test"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"google/protobuf/timestamp.proto"},
+		EnumType: []*descriptorpb.EnumDescriptorProto{{
+			Name: proto.String("Level"),
+			Value: []*descriptorpb.EnumValueDescriptorProto{
+				{Name: proto.String("DEBUG"), Number: proto.Int32(0)},
+				{Name: proto.String("ERROR"), Number: proto.Int32(1)},
+			},
+		}},
+		MessageType: []*descriptorpb.DescriptorProto{
+			{Name: proto.String("Header"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("host", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, "", false),
+			}},
+			{Name: proto.String("Event"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, "", false),
+				field("id", 2, descriptorpb.FieldDescriptorProto_TYPE_INT64, "", false),
+				field("latency", 3, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE, "", false),
+				field("header", 4, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".test.Header", false),
+				field("tags", 5, descriptorpb.FieldDescriptorProto_TYPE_STRING, "", true),
+				field("codes", 6, descriptorpb.FieldDescriptorProto_TYPE_INT32, "", true),
+				field("ts", 7, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".google.protobuf.Timestamp", false),
+				field("level", 8, descriptorpb.FieldDescriptorProto_TYPE_ENUM, ".test.Level", false),
+			}},
+		},
+	}
+	fdSet := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{
+		protodesc.ToFileDescriptorProto(timestamppb.File_google_protobuf_timestamp_proto),
+		eventFile,
+	}}
+	bs, err := proto.Marshal(fdSet)
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(file, bs, 0644))
+}
+
+func TestProtobuf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protobuf")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "event.pb")
+	writeEventDescriptor(t, file)
+
+	_, err = LoadProtoDescriptor(file, "test.Absent")
+	require.NotNil(t, err)
+	pp := NewParserPool("protobuf", nil, "", DefaultTSLayout)
+	require.Nil(t, pp.LoadProtoDescriptor(file, "test.Event"))
+	parser := pp.Get()
+	defer pp.Put(parser)
+
+	desc := parser.(*ProtobufParser).desc
+	fields := desc.Fields()
+	msg := dynamicpb.NewMessage(desc)
+	msg.Set(fields.ByName("name"), protoreflect.ValueOfString("click"))
+	msg.Set(fields.ByName("id"), protoreflect.ValueOfInt64(1<<60))
+	msg.Set(fields.ByName("latency"), protoreflect.ValueOfFloat64(0.5))
+	header := msg.Mutable(fields.ByName("header")).Message()
+	header.Set(header.Descriptor().Fields().ByName("host"), protoreflect.ValueOfString("a"))
+	tags := msg.Mutable(fields.ByName("tags")).List()
+	tags.Append(protoreflect.ValueOfString("t1"))
+	tags.Append(protoreflect.ValueOfString("t2"))
+	msg.Mutable(fields.ByName("codes")).List().Append(protoreflect.ValueOfInt32(404))
+	ts := msg.Mutable(fields.ByName("ts")).Message()
+	ts.Set(ts.Descriptor().Fields().ByName("seconds"), protoreflect.ValueOfInt64(1600000000))
+	ts.Set(ts.Descriptor().Fields().ByName("nanos"), protoreflect.ValueOfInt32(5000))
+	msg.Set(fields.ByName("level"), protoreflect.ValueOfEnum(1))
+	bs, err := proto.Marshal(msg)
+	require.Nil(t, err)
+
+	metric, err := parser.Parse(bs)
+	require.Nil(t, err)
+	require.Equal(t, "click", metric.GetString("name", false))
+	require.Equal(t, int64(1<<60), metric.GetInt("id", false))
+	require.Equal(t, 0.5, metric.GetFloat("latency", false))
+	require.Equal(t, "a", metric.GetString("header.host", true))
+	require.Equal(t, "ERROR", metric.GetString("level", false))
+	require.Equal(t, int64(1), metric.GetInt("level", false))
+	require.Equal(t, []string{"t1", "t2"}, metric.GetArray("tags", "string"))
+	require.Equal(t, []int64{404}, metric.GetArray("codes", "int"))
+	require.Equal(t, []float64{}, metric.GetArray("absent", "float"))
+	require.Equal(t, time.Unix(1600000000, 5000).UTC(), metric.GetDateTime64("ts", false))
+	require.Equal(t, int64(1600000000), metric.GetElasticDateTime("ts", false))
+	require.Nil(t, metric.GetString("absent", true))
+
+	// Absent messages are NULL, while proto3 scalars are never absent.
+	metric, err = parser.Parse(nil)
+	require.Nil(t, err)
+	require.Nil(t, metric.GetString("header.host", true))
+	require.Nil(t, metric.GetDateTime("ts", true))
+	require.Equal(t, "", metric.GetString("name", true))
+	require.Equal(t, int64(0), metric.GetInt("id", true))
+}
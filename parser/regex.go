@@ -0,0 +1,152 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package parser
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/housepower/clickhouse_sinker/model"
+)
+
+var _ Parser = (*RegexParser)(nil)
+
+// RegexParser extracts named capture groups of a regular expression(or an expanded grok expression) from text lines.
+type RegexParser struct {
+	re       *regexp.Regexp
+	tsLayout []string
+}
+
+// Parse matches the line against the expression, a message which doesn't match is an error.
+func (p *RegexParser) Parse(bs []byte) (metric model.Metric, err error) {
+	bs = bytes.TrimRight(bs, "\r\n")
+	loc := p.re.FindSubmatchIndex(bs)
+	if loc == nil {
+		err = errors.Errorf("the message doesn't match the pattern")
+		return
+	}
+	fields := make(map[string]string)
+	for i, name := range p.re.SubexpNames() {
+		if name == "" || loc[2*i] < 0 {
+			continue
+		}
+		// The first group which participates in the match wins if a name is used more than once.
+		if _, ok := fields[name]; !ok {
+			fields[name] = string(bs[loc[2*i]:loc[2*i+1]])
+		}
+	}
+	metric = &RegexMetric{fields, p.tsLayout}
+	return
+}
+
+// RegexMetric converts captured text like CsvMetric does. A group which doesn't participate in the match is absent.
+type RegexMetric struct {
+	fields   map[string]string
+	tsLayout []string
+}
+
+func (c *RegexMetric) Get(key string) interface{} {
+	if v, ok := c.fields[key]; ok {
+		return v
+	}
+	return nil
+}
+
+func (c *RegexMetric) GetString(key string, nullable bool) interface{} {
+	v, ok := c.fields[key]
+	if !ok && nullable {
+		return nil
+	}
+	return v
+}
+
+func (c *RegexMetric) GetFloat(key string, nullable bool) interface{} {
+	v, ok := c.fields[key]
+	if !ok && nullable {
+		return nil
+	}
+	n, _ := strconv.ParseFloat(v, 64)
+	return n
+}
+
+func (c *RegexMetric) GetInt(key string, nullable bool) interface{} {
+	v, ok := c.fields[key]
+	if !ok && nullable {
+		return nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		f, _ := strconv.ParseFloat(v, 64)
+		n = int64(f)
+	}
+	return n
+}
+
+// GetArray is Empty implemented for RegexMetric
+func (c *RegexMetric) GetArray(key string, t string) interface{} {
+	switch t {
+	case "string":
+		return []string{}
+	case "float":
+		return []float64{}
+	case "int":
+		return []int64{}
+	default:
+		panic("not supported array type " + t)
+	}
+}
+
+func (c *RegexMetric) getTime(key string, nullable bool, layout string) interface{} {
+	v, ok := c.fields[key]
+	if !ok {
+		if nullable {
+			return nil
+		}
+		return Epoch
+	}
+	t, _ := time.Parse(layout, v)
+	return t
+}
+
+func (c *RegexMetric) GetDate(key string, nullable bool) interface{} {
+	return c.getTime(key, nullable, c.tsLayout[0])
+}
+
+func (c *RegexMetric) GetDateTime(key string, nullable bool) interface{} {
+	return c.getTime(key, nullable, c.tsLayout[1])
+}
+
+func (c *RegexMetric) GetDateTime64(key string, nullable bool) interface{} {
+	return c.getTime(key, nullable, c.tsLayout[2])
+}
+
+func (c *RegexMetric) GetElasticDateTime(key string, nullable bool) interface{} {
+	t := c.getTime(key, nullable, time.RFC3339)
+	if t == nil {
+		return nil
+	}
+	return t.(time.Time).Unix()
+}
+
+// GetNewKeys is not supported by RegexMetric, fields are fixed by the pattern.
+func (c *RegexMetric) GetNewKeys(knownKeys *sync.Map, newKeys map[string]string) bool {
+	return false
+}
@@ -0,0 +1,101 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package parser
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegex(t *testing.T) {
+	pp := NewParserPool("regex", nil, "", DefaultTSLayout)
+	require.NotNil(t, pp.CompilePattern(`(?P<level`, ""))
+	require.Nil(t, pp.CompilePattern(`^(?P<ts>\S+) (?P<level>[A-Z]+)(?: code=(?P<code>\d+))? (?P<msg>.*)$`, ""))
+	parser := pp.Get()
+	defer pp.Put(parser)
+
+	metric, err := parser.Parse([]byte("2020-09-13T12:26:40Z ERROR code=502 upstream timed out\n"))
+	require.Nil(t, err)
+	require.Equal(t, "ERROR", metric.GetString("level", false))
+	require.Equal(t, int64(502), metric.GetInt("code", true))
+	require.Equal(t, float64(502), metric.GetFloat("code", true))
+	require.Equal(t, "upstream timed out", metric.GetString("msg", false))
+	require.Equal(t, time.Unix(1600000000, 0).UTC(), metric.GetDateTime("ts", false))
+	require.Equal(t, int64(1600000000), metric.GetElasticDateTime("ts", false))
+
+	metric, err = parser.Parse([]byte("2020-09-13T12:26:40Z INFO ok"))
+	require.Nil(t, err)
+	require.Nil(t, metric.GetInt("code", true))
+	require.Equal(t, int64(0), metric.GetInt("code", false))
+	require.Nil(t, metric.GetString("absent", true))
+
+	_, err = parser.Parse([]byte("garbage"))
+	require.NotNil(t, err)
+}
+
+func TestGrok(t *testing.T) {
+	pp := NewParserPool("grok", nil, "", []string{"2006-01-02", "02/Jan/2006:15:04:05 -0700", time.RFC3339Nano})
+	require.Nil(t, pp.CompilePattern(`%{COMBINEDAPACHELOG}`, ""))
+	parser := pp.Get()
+	defer pp.Put(parser)
+
+	line := `127.0.0.1 - frank [13/Sep/2020:20:26:40 +0800] "GET /api/v1?user=42 HTTP/1.1" 200 2326 "-" "curl/7.68.0"`
+	metric, err := parser.Parse([]byte(line))
+	require.Nil(t, err)
+	require.Equal(t, "127.0.0.1", metric.GetString("clientip", false))
+	require.Equal(t, "frank", metric.GetString("auth", false))
+	require.Equal(t, "GET", metric.GetString("verb", false))
+	require.Equal(t, "/api/v1?user=42", metric.GetString("request", false))
+	require.Equal(t, 1.1, metric.GetFloat("httpversion", false))
+	require.Equal(t, int64(200), metric.GetInt("response", false))
+	require.Equal(t, int64(2326), metric.GetInt("bytes", true))
+	require.Equal(t, `"curl/7.68.0"`, metric.GetString("agent", false))
+	require.True(t, time.Unix(1600000000, 0).Equal(metric.GetDateTime("timestamp", false).(time.Time)))
+	require.Nil(t, metric.GetString("rawrequest", true))
+
+	for _, c := range []struct{ expr, text string }{
+		{`%{IP:ip}`, "fe80::1ff:fe23:4567:890a"},
+		{`%{TIMESTAMP_ISO8601:ts} %{LOGLEVEL:level}`, "2020-09-13T12:26:40.123+08:00 WARN"},
+		{`%{SYSLOGLINE}`, "Sep 13 12:26:40 web-01 nginx[1234]: started"},
+		{`%{URI:uri}`, "https://user@example.com:8080/a/b?c=d"},
+	} {
+		re, err := CompileGrok(c.expr, "")
+		require.Nil(t, err, c.expr)
+		require.True(t, re.MatchString(c.text), c.expr)
+	}
+
+	// Extra patterns can refer to bundled ones.
+	dir, err := ioutil.TempDir("", "grok")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "patterns")
+	require.Nil(t, ioutil.WriteFile(file, []byte("# application logs\nAPPLOG %{TIMESTAMP_ISO8601:ts} \\[%{WORD:module}\\] %{GREEDYDATA:msg}\n"), 0644))
+	pp = NewParserPool("grok", nil, "", DefaultTSLayout)
+	require.Nil(t, pp.CompilePattern(`%{APPLOG}`, file))
+	metric, err = pp.Get().Parse([]byte("2020-09-13 12:26:40 [db] slow query"))
+	require.Nil(t, err)
+	require.Equal(t, "db", metric.GetString("module", false))
+
+	_, err = CompileGrok(`%{ABSENT}`, "")
+	require.NotNil(t, err)
+	require.Nil(t, ioutil.WriteFile(file, []byte("LOOP %{LOOP}\n"), 0644))
+	_, err = CompileGrok(`%{LOOP}`, file)
+	require.NotNil(t, err)
+}
@@ -19,12 +19,14 @@ package pool
 // Clickhouse connection pool
 
 import (
+	"crypto/tls"
 	"database/sql"
 	"fmt"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/ClickHouse/clickhouse-go"
 	"github.com/housepower/clickhouse_sinker/health"
 	"github.com/housepower/clickhouse_sinker/util"
 	"github.com/pkg/errors"
@@ -46,10 +48,14 @@ var (
 type Connection struct {
 	*sql.DB
 	dsn string
+
+	mux     sync.Mutex              //protect directs
+	directs []clickhouse.Clickhouse //idle direct connections
 }
 
 type ClusterConnections struct {
 	connections []*Connection
+	httpConns   []*HTTPConnection //used instead of connections if the protocol is http
 	ref         int
 }
 
@@ -63,10 +69,46 @@ func (c *Connection) ReConnect() error {
 	setDBParams(sqlDB)
 	log.Info("reconnect success to ", c.dsn)
 	c.DB = sqlDB
+	c.closeDirects()
 	return nil
 }
 
-func InitConn(name string, hosts [][]string, port int, db, username, password, dsnParams string) (err error) {
+// GetDirect returns an idle direct connection, or opens a new one.
+// A direct connection exposes native blocks of the driver. It serves one insert at a time.
+func (c *Connection) GetDirect() (dc clickhouse.Clickhouse, err error) {
+	c.mux.Lock()
+	if n := len(c.directs); n > 0 {
+		dc = c.directs[n-1]
+		c.directs = c.directs[:n-1]
+		c.mux.Unlock()
+		return
+	}
+	c.mux.Unlock()
+	if dc, err = clickhouse.OpenDirect(c.dsn); err != nil {
+		err = errors.Wrapf(err, "")
+	}
+	return
+}
+
+// PutDirect gives back a direct connection for reuse. The caller shall close it instead if it got an error.
+func (c *Connection) PutDirect(dc clickhouse.Clickhouse) {
+	c.mux.Lock()
+	c.directs = append(c.directs, dc)
+	c.mux.Unlock()
+}
+
+func (c *Connection) closeDirects() {
+	c.mux.Lock()
+	directs := c.directs
+	c.directs = nil
+	c.mux.Unlock()
+	for _, dc := range directs {
+		_ = dc.Close()
+	}
+}
+
+// InitConn creates connections to every shard. Connections are secured with tlsConfig if it's not nil.
+func InitConn(name string, hosts [][]string, port int, db, username, password, dsnParams string, tlsConfig *tls.Config) (err error) {
 	var sqlDB *sql.DB
 	lock.Lock()
 	if poolMaps == nil {
@@ -81,14 +123,24 @@ func InitConn(name string, hosts [][]string, port int, db, username, password, d
 
 	var cc ClusterConnections
 	cc.ref = 1
+	if tlsConfig != nil {
+		// The driver looks up the TLS config by the name given in DSN.
+		if err = clickhouse.RegisterTLSConfig(name, tlsConfig); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+	}
 	// Each shard has a *sql.DB which connects to all replicas inside the shard.
 	// "alt_hosts" tolerates replica single-point-failure.
 	for _, replicas := range hosts {
 		numReplicas := len(replicas)
 		replicaAddrs := make([]string, numReplicas)
 		for i, ip := range replicas {
-			if ips2, err := util.GetIP4Byname(ip); err == nil {
-				ip = ips2[0]
+			// Keep hostnames for TLS, since the server certificate is verified against them.
+			if tlsConfig == nil {
+				if ips2, err := util.GetIP4Byname(ip); err == nil {
+					ip = ips2[0]
+				}
 			}
 			replicaAddrs[i] = fmt.Sprintf("%s:%d", ip, port)
 		}
@@ -97,6 +149,9 @@ func InitConn(name string, hosts [][]string, port int, db, username, password, d
 		if numReplicas > 1 {
 			dsn += "&connection_open_strategy=in_order&alt_hosts=" + strings.Join(replicaAddrs[1:numReplicas], ",")
 		}
+		if tlsConfig != nil {
+			dsn += "&secure=true&tls_config=" + name
+		}
 		if dsnParams != "" {
 			dsn += "&" + dsnParams
 		}
@@ -105,7 +160,7 @@ func InitConn(name string, hosts [][]string, port int, db, username, password, d
 			return
 		}
 		setDBParams(sqlDB)
-		cc.connections = append(cc.connections, &Connection{sqlDB, dsn})
+		cc.connections = append(cc.connections, &Connection{DB: sqlDB, dsn: dsn})
 	}
 
 	lock.Lock()
@@ -142,6 +197,13 @@ func FreeConn(name string) {
 					err = errors.Wrapf(err, conn.dsn)
 					log.Errorf("got error: %+v", err)
 				}
+				conn.closeDirects()
+			}
+			for _, hc := range cc.httpConns {
+				if err := health.Health.RemoveReadinessCheck(hc.urls[0]); err != nil {
+					err = errors.Wrapf(err, hc.urls[0])
+					log.Errorf("got error: %+v", err)
+				}
 			}
 		}
 	}
@@ -151,7 +213,7 @@ func GetTotalConn() (cnt int) {
 	lock.Lock()
 	defer lock.Unlock()
 	for _, cc := range poolMaps {
-		cnt += cc.ref * len(cc.connections)
+		cnt += cc.ref * (len(cc.connections) + len(cc.httpConns))
 	}
 	return
 }
@@ -161,7 +223,7 @@ func GetNumConn(name string) (numConn int) {
 	lock.Lock()
 	defer lock.Unlock()
 	if ps, ok := poolMaps[name]; ok {
-		numConn = len(ps.connections)
+		numConn = len(ps.connections) + len(ps.httpConns)
 	}
 	return
 }
@@ -183,6 +245,7 @@ func GetConn(name string, batchNum int64) (con *Connection) {
 func CloseAll() {
 	for _, cc := range poolMaps {
 		for _, c := range cc.connections {
+			c.closeDirects()
 			_ = c.Close()
 		}
 	}
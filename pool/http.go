@@ -0,0 +1,285 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pool
+
+// Clickhouse HTTP interface connections
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/housepower/clickhouse_sinker/health"
+	"github.com/housepower/clickhouse_sinker/util"
+	"github.com/pkg/errors"
+	"github.com/troian/healthcheck"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	httpTimeout = 300 * time.Second
+)
+
+var (
+	exceptionRegexp = regexp.MustCompile(`Code: (\d+)`)
+)
+
+// HTTPConnection talks to replicas of a shard via the ClickHouse HTTP interface.
+// Replicas are tried in order, the next one is used only if the former is unreachable.
+type HTTPConnection struct {
+	urls     []string //one per replica
+	username string
+	password string
+	params   url.Values //database and query settings
+	gzip     bool
+	client   *http.Client
+}
+
+// HTTPOptions are options of connections to the ClickHouse HTTP interface.
+type HTTPOptions struct {
+	Username    string
+	Password    string
+	Settings    map[string]string
+	Compression string      //gzip or none
+	TLSConfig   *tls.Config //use https if it's not nil
+}
+
+// InitHTTPConn is the same as InitConn except that connections use the HTTP interface.
+func InitHTTPConn(name string, hosts [][]string, port int, db string, opts HTTPOptions) (err error) {
+	lock.Lock()
+	defer lock.Unlock()
+	if poolMaps == nil {
+		poolMaps = make(map[string]*ClusterConnections)
+	}
+	if cc, ok := poolMaps[name]; ok {
+		cc.ref++
+		return
+	}
+
+	var cc ClusterConnections
+	cc.ref = 1
+	params := url.Values{}
+	params.Set("database", db)
+	for k, v := range opts.Settings {
+		params.Set(k, v)
+	}
+	scheme := "http"
+	client := &http.Client{Timeout: httpTimeout}
+	if opts.TLSConfig != nil {
+		scheme = "https"
+		client.Transport = &http.Transport{TLSClientConfig: opts.TLSConfig}
+	}
+	for _, replicas := range hosts {
+		hc := &HTTPConnection{
+			username: opts.Username,
+			password: opts.Password,
+			params:   params,
+			gzip:     opts.Compression != "none",
+			client:   client,
+		}
+		for _, ip := range replicas {
+			// Keep hostnames for TLS, since the server certificate is verified against them.
+			if opts.TLSConfig == nil {
+				if ips2, err := util.GetIP4Byname(ip); err == nil {
+					ip = ips2[0]
+				}
+			}
+			hc.urls = append(hc.urls, fmt.Sprintf("%s://%s:%d/", scheme, ip, port))
+		}
+		cc.httpConns = append(cc.httpConns, hc)
+	}
+	for _, hc := range cc.httpConns {
+		if err = health.Health.AddReadinessCheck(hc.urls[0], healthcheck.Timeout(hc.Ping, 30*time.Second)); err != nil {
+			err = errors.Wrapf(err, "")
+			log.Errorf("got error: %+v", err)
+		}
+	}
+	poolMaps[name] = &cc
+	return nil
+}
+
+// GetHTTPConn select a clickhouse shard from the cluster based on batchNum
+func GetHTTPConn(name string, batchNum int64) (con *HTTPConnection) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	cc, ok := poolMaps[name]
+	if !ok || len(cc.httpConns) == 0 {
+		return
+	}
+	con = cc.httpConns[batchNum%int64(len(cc.httpConns))]
+	return
+}
+
+// Ping checks whether the first replica is alive. It uses the same client as queries, so that TLS settings apply.
+func (hc *HTTPConnection) Ping() (err error) {
+	var resp *http.Response
+	if resp, err = hc.client.Get(hc.urls[0] + "ping"); err != nil {
+		return errors.Wrapf(err, "")
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("ping %s got status %s", hc.urls[0], resp.Status)
+	}
+	return
+}
+
+// Exec executes the statement.
+func (hc *HTTPConnection) Exec(query string) (err error) {
+	_, err = hc.do(nil, []byte(query), false)
+	return
+}
+
+// Query executes the query, and returns all rows with values converted to strings.
+func (hc *HTTPConnection) Query(query string) (rows [][]string, err error) {
+	var body []byte
+	if body, err = hc.do(nil, []byte(query+" FORMAT TabSeparated"), false); err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(body), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		for i, field := range fields {
+			fields[i] = unescapeTSV(field)
+		}
+		rows = append(rows, fields)
+	}
+	return
+}
+
+// Insert executes the INSERT query with data encoded in the format specified by the query.
+func (hc *HTTPConnection) Insert(query string, data []byte) (err error) {
+	params := url.Values{"query": []string{query}}
+	_, err = hc.do(params, data, hc.gzip)
+	return
+}
+
+func (hc *HTTPConnection) do(params url.Values, body []byte, compress bool) (respBody []byte, err error) {
+	query := url.Values{}
+	for k, v := range hc.params {
+		query[k] = v
+	}
+	for k, v := range params {
+		query[k] = v
+	}
+	if compress {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err = zw.Write(body); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		if err = zw.Close(); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		body = buf.Bytes()
+	}
+	for _, u := range hc.urls {
+		var req *http.Request
+		if req, err = http.NewRequest(http.MethodPost, u+"?"+query.Encode(), bytes.NewReader(body)); err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		if hc.username != "" {
+			req.SetBasicAuth(hc.username, hc.password)
+		}
+		if compress {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		var resp *http.Response
+		if resp, err = hc.client.Do(req); err != nil {
+			err = errors.Wrapf(err, "")
+			log.Warnf("failed to send request to %s, %+v", u, err)
+			continue
+		}
+		respBody, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			err = errors.Wrapf(err, "")
+			return
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = errors.Wrapf(parseException(resp, respBody), "")
+		}
+		return
+	}
+	return
+}
+
+// parseException converts an error response into *clickhouse.Exception, so that errors are classified
+// the same as the native protocol. A response without exception code(from a proxy etc.) has code 0,
+// which is considered transient.
+func parseException(resp *http.Response, body []byte) error {
+	msg := strings.TrimSpace(string(body))
+	code := resp.Header.Get("X-ClickHouse-Exception-Code")
+	if code == "" {
+		if m := exceptionRegexp.FindStringSubmatch(msg); m != nil {
+			code = m[1]
+		}
+	}
+	exp := &clickhouse.Exception{Message: msg}
+	if code == "" {
+		exp.Message = fmt.Sprintf("%s: %s", resp.Status, msg)
+	} else if c, err := strconv.Atoi(code); err == nil {
+		exp.Code = int32(c)
+	}
+	return exp
+}
+
+// unescapeTSV reverts escaping of a TabSeparated field.
+func unescapeTSV(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			sb.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 't':
+			sb.WriteByte('\t')
+		case 'n':
+			sb.WriteByte('\n')
+		case 'r':
+			sb.WriteByte('\r')
+		case 'b':
+			sb.WriteByte('\b')
+		case 'f':
+			sb.WriteByte('\f')
+		case '0':
+			sb.WriteByte(0)
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+	return sb.String()
+}
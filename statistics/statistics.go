@@ -52,6 +52,27 @@ var (
 		},
 		[]string{"task"},
 	)
+	FilterMsgsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "filter_msgs_total",
+			Help: "total num of msgs dropped by the filter",
+		},
+		[]string{"task"},
+	)
+	DeadLetterMsgsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "dead_letter_msgs_total",
+			Help: "total num of msgs written to the dead letter sink",
+		},
+		[]string{"task"},
+	)
+	DeadLetterErrorTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "dead_letter_error_total",
+			Help: "total num of failures writing to the dead letter sink",
+		},
+		[]string{"task"},
+	)
 	RingMsgsOffTooSmallErrorTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: prefix + "ring_msgs_offset_too_small_error_total",
@@ -108,6 +129,34 @@ var (
 		},
 		[]string{"task"},
 	)
+	FailedBatchsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "failed_batchs_total",
+			Help: "total num of batches given up writing to ck, handled by the failed batch policy",
+		},
+		[]string{"task", "policy"},
+	)
+	RejectedRowsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "rejected_rows_total",
+			Help: "total num of rows dropped or written to the dead letter sink due to failed to write to ck",
+		},
+		[]string{"task"},
+	)
+	AddColumnsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "add_columns_total",
+			Help: "total num of columns added by dynamic schema",
+		},
+		[]string{"task"},
+	)
+	AddColumnsErrorTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "add_columns_error_total",
+			Help: "total num of times failed to add columns by dynamic schema",
+		},
+		[]string{"task"},
+	)
 	ConsumeOffsets = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: prefix + "consume_offsets",
@@ -156,6 +205,9 @@ func init() {
 	prometheus.MustRegister(ConsumeMsgsTotal)
 	prometheus.MustRegister(ConsumeMsgsErrorTotal)
 	prometheus.MustRegister(ParseMsgsErrorTotal)
+	prometheus.MustRegister(FilterMsgsTotal)
+	prometheus.MustRegister(DeadLetterMsgsTotal)
+	prometheus.MustRegister(DeadLetterErrorTotal)
 	prometheus.MustRegister(RingMsgsOffTooSmallErrorTotal)
 	prometheus.MustRegister(RingMsgsOffTooLargeErrorTotal)
 	prometheus.MustRegister(RingNormalBatchsTotal)
@@ -164,6 +216,10 @@ func init() {
 	prometheus.MustRegister(RingForceBatchAllGapTotal)
 	prometheus.MustRegister(FlushMsgsTotal)
 	prometheus.MustRegister(FlushMsgsErrorTotal)
+	prometheus.MustRegister(FailedBatchsTotal)
+	prometheus.MustRegister(RejectedRowsTotal)
+	prometheus.MustRegister(AddColumnsTotal)
+	prometheus.MustRegister(AddColumnsErrorTotal)
 	prometheus.MustRegister(ConsumeOffsets)
 	prometheus.MustRegister(ClickhouseReconnectTotal)
 	prometheus.MustRegister(RingMsgs)
@@ -240,6 +296,7 @@ func (p *Pusher) reconnect() {
 		Collector(ConsumeMsgsTotal).
 		Collector(ConsumeMsgsErrorTotal).
 		Collector(ParseMsgsErrorTotal).
+		Collector(FilterMsgsTotal).
 		Collector(RingMsgsOffTooSmallErrorTotal).
 		Collector(RingMsgsOffTooLargeErrorTotal).
 		Collector(RingNormalBatchsTotal).
@@ -0,0 +1,83 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package task
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// loadStoredOffset returns the offset stored in the offsets table, messages up to which have been written.
+// It's given to the inputer, which resumes the partition right after the offset.
+// It retries until success, and returns an error if the task has been stopped meanwhile.
+func (service *Service) loadStoredOffset(topic string, partition int) (int64, error) {
+	for {
+		offset, err := service.clickhouse.LoadOffset(topic, partition)
+		if err == nil {
+			if offset >= 0 {
+				log.Infof("%s: resume topic %s partition %d after offset %d according to the offsets table",
+					service.taskCfg.Name, topic, partition, offset)
+			}
+			return offset, nil
+		}
+		log.Errorf("%s: failed to load the offset of topic %s partition %d from the offsets table, got error %+v",
+			service.taskCfg.Name, topic, partition, err)
+		select {
+		case <-service.ctx.Done():
+			return -1, errors.Wrapf(service.ctx.Err(), "")
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+// alignedOffset rounds the offset down to a batch boundary. With ExactlyOnce, batches are cut at boundaries only,
+// so that a batch consumed again after a crash consists of the same messages, and gets the same dedup token.
+func alignedOffset(offset int64, batchSizeShift int) int64 {
+	return offset &^ (1<<batchSizeShift - 1)
+}
+
+// ringDedupToken identifies messages of offsets [firstOff, lastOff] of the partition.
+func ringDedupToken(topic string, partition int, firstOff, lastOff int64) string {
+	return fmt.Sprintf("%s/%d/%d-%d", topic, partition, firstOff, lastOff)
+}
+
+// sharderDedupToken identifies messages of the shard, which come from offsets [begOffs[t][i], endOffs[t][i]] of each topic t and partition i.
+// A partition is absent if its offset is negative.
+func sharderDedupToken(begOffs, endOffs map[string][]int64, shard int) string {
+	topics := make([]string, 0, len(endOffs))
+	for topic := range endOffs {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	var parts []string
+	for _, topic := range topics {
+		var ranges []string
+		for i, endOff := range endOffs[topic] {
+			if endOff >= 0 {
+				ranges = append(ranges, fmt.Sprintf("%d:%d-%d", i, begOffs[topic][i], endOff))
+			}
+		}
+		if ranges != nil {
+			parts = append(parts, topic+"/"+strings.Join(ranges, ","))
+		}
+	}
+	return fmt.Sprintf("%s/shard%d", strings.Join(parts, ";"), shard)
+}
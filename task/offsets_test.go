@@ -0,0 +1,123 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package task
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/output"
+	"github.com/housepower/clickhouse_sinker/util"
+)
+
+func TestDedupTokens(t *testing.T) {
+	require.Equal(t, "topic1/3/100-163", ringDedupToken("topic1", 3, 100, 163))
+	begOffs := map[string][]int64{"b": {-1, 8}, "a": {0}}
+	endOffs := map[string][]int64{"b": {-1, 15}, "a": {7}}
+	require.Equal(t, "a/0:0-7;b/1:8-15/shard2", sharderDedupToken(begOffs, endOffs, 2))
+}
+
+func TestAlignedOffset(t *testing.T) {
+	require.Equal(t, int64(0), alignedOffset(3, 2))
+	require.Equal(t, int64(4), alignedOffset(4, 2))
+	require.Equal(t, int64(8), alignedOffset(11, 2))
+	require.Equal(t, int64(11), alignedOffset(11, 0))
+}
+
+func newExactlyOnceService(t *testing.T, enable bool) *Service {
+	if util.GlobalTimerWheel == nil {
+		util.InitGlobalTimerWheel()
+	}
+	taskCfg := &config.TaskConfig{Name: "test1", Clickhouse: "ch1", TableName: "t1", FlushInterval: 3600, BufferSize: 1 << 20}
+	taskCfg.ExactlyOnce.Enable = enable
+	cfg := &config.Config{
+		Clickhouse: map[string]*config.ClickHouseConfig{"ch1": {DB: "default"}},
+		Tasks:      map[string]*config.TaskConfig{"test1": taskCfg},
+	}
+	service := NewTaskService(nil, output.NewClickHouse(cfg, "test1"), nil, cfg, "test1")
+	var cancel context.CancelFunc
+	service.ctx, cancel = context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	service.batchChan = make(chan *model.Batch, 4)
+	return service
+}
+
+func putOffsets(ring *Ring, begOff, endOff int64) {
+	for i := begOff; i < endOff; i++ {
+		ring.PutElem(model.MsgRow{Msg: &model.InputMessage{Offset: i}, Row: &model.Row{i}})
+	}
+}
+
+func TestRingExactlyOnce(t *testing.T) {
+	for _, enable := range []bool{true, false} {
+		service := newExactlyOnceService(t, enable)
+		// The partition resumes from offset 5, in the middle of batch [4, 8).
+		ring := &Ring{ringBuf: make([]model.MsgRow, 8), ringCap: 8, ringGroundOff: 5, ringCeilingOff: 5, ringFilledOffset: 5,
+			batchSizeShift: 2, topic: "topic1", partition: 0, service: service,
+			batchSys: model.NewBatchSys(service.taskCfg, func(topic string, partition int, offset int64) error { return nil })}
+		putOffsets(ring, 5, 7)
+		ring.ForceBatchOrShard(nil)
+		if !enable {
+			// flushInterval cuts the batch wherever the ring is filled up to.
+			batch := <-service.batchChan
+			require.Equal(t, model.Rows{&model.Row{int64(5)}, &model.Row{int64(6)}}, *batch.Rows)
+			require.Empty(t, batch.DedupToken)
+			ring.tid.Stop()
+			continue
+		}
+		// Batches are cut only at boundaries, no matter when the timer fires.
+		require.Empty(t, service.batchChan)
+		putOffsets(ring, 7, 10)
+		batch := <-service.batchChan
+		require.Equal(t, model.Rows{&model.Row{int64(5)}, &model.Row{int64(6)}, &model.Row{int64(7)}}, *batch.Rows)
+		require.Equal(t, "topic1/0/5-7", batch.DedupToken)
+		ring.ForceBatchOrShard(nil)
+		require.Empty(t, service.batchChan)
+		putOffsets(ring, 10, 12)
+		batch = <-service.batchChan
+		require.Equal(t, "topic1/0/8-11", batch.DedupToken)
+		ring.tid.Stop()
+	}
+}
+
+func TestSharderExactlyOnce(t *testing.T) {
+	service := newExactlyOnceService(t, true)
+	sh := &Sharder{
+		service:  service,
+		policy:   &ShardingPolicy{ckNum: 2, colSeq: 0, stripe: 1},
+		batchSys: model.NewBatchSys(service.taskCfg, func(topic string, partition int, offset int64) error { return nil }),
+		ckNum:    2,
+		msgBuf:   []*model.Rows{model.GetRows(), model.GetRows()},
+		offsets:  make(map[string][]int64),
+		begOffs:  make(map[string][]int64),
+	}
+	defer sh.tid.Stop()
+	ringBuf := make([]model.MsgRow, 8)
+	for i := 4; i < 7; i++ {
+		ringBuf[i] = model.MsgRow{Msg: &model.InputMessage{Offset: int64(i)}, Row: &model.Row{int64(i)}, Shard: i % 2}
+	}
+	// Rows of the ring batch are flushed at once, though bufferSize isn't reached.
+	require.Equal(t, 3, sh.PutElems("topic1", 1, ringBuf, 4, 8, 8))
+	batch0, batch1 := <-service.batchChan, <-service.batchChan
+	require.Equal(t, model.Rows{&model.Row{int64(4)}, &model.Row{int64(6)}}, *batch0.Rows)
+	require.Equal(t, "topic1/1:4-7/shard0", batch0.DedupToken)
+	require.Equal(t, model.Rows{&model.Row{int64(5)}}, *batch1.Rows)
+	require.Equal(t, "topic1/1:4-7/shard1", batch1.DedupToken)
+}
@@ -24,6 +24,8 @@ type Ring struct {
 	tid              goetty.Timeout
 	idleCnt          int
 	isIdle           bool
+	isFreed          bool //the topic is no longer consumed
+	topic            string
 	partition        int
 	batchSys         *model.BatchSys
 
@@ -35,7 +37,7 @@ func (ring *Ring) PutElem(msgRow model.MsgRow) {
 	msgOffset := msgRow.Msg.Offset
 	ring.mux.Lock()
 	defer ring.mux.Unlock()
-	if msgOffset < ring.ringFilledOffset {
+	if ring.isFreed || msgOffset < ring.ringFilledOffset {
 		return
 	}
 	// ring.mux is locked at this point
@@ -43,7 +45,7 @@ func (ring *Ring) PutElem(msgRow model.MsgRow) {
 		ring.idleCnt = 0
 		ring.isIdle = false
 		ring.ringBuf = make([]model.MsgRow, ring.ringCap)
-		log.Infof("%s: topic %s partition %d quit idle", ring.service.taskCfg.Name, ring.service.taskCfg.Topic, ring.partition)
+		log.Infof("%s: topic %s partition %d quit idle", ring.service.taskCfg.Name, ring.topic, ring.partition)
 	}
 	// assert(msgOffset < ring.ringGroundOff + ring.ringCap)
 	if msgOffset >= ring.ringCeilingOff {
@@ -54,6 +56,11 @@ func (ring *Ring) PutElem(msgRow model.MsgRow) {
 		if msgRow.Shard, err = ring.service.sharder.Calc(msgRow.Row); err != nil {
 			log.Fatalf("%s: got error %+v", ring.service.taskCfg.Name, err)
 		}
+		for i := range msgRow.Extra {
+			if msgRow.Extra[i].Shard, err = ring.service.sharder.Calc(msgRow.Extra[i].Row); err != nil {
+				log.Fatalf("%s: got error %+v", ring.service.taskCfg.Name, err)
+			}
+		}
 	}
 	statistics.RingMsgs.WithLabelValues(ring.service.taskCfg.Name).Inc()
 	ring.ringBuf[msgOffset&(ring.ringCap-1)] = msgRow
@@ -70,6 +77,22 @@ func (ring *Ring) PutElem(msgRow model.MsgRow) {
 	}
 }
 
+// free drops messages in the ring, and stops its timer. Offsets of them are never committed.
+func (ring *Ring) free() {
+	ring.mux.Lock()
+	defer ring.mux.Unlock()
+	var msgCnt int
+	for i := range ring.ringBuf {
+		if ring.ringBuf[i].Msg != nil {
+			msgCnt++
+		}
+	}
+	statistics.RingMsgs.WithLabelValues(ring.service.taskCfg.Name).Sub(float64(msgCnt))
+	ring.isFreed = true
+	ring.ringBuf = nil
+	ring.tid.Stop()
+}
+
 type OffsetRange struct {
 	Begin int64 //inclusive
 	End   int64 //exclusive
@@ -86,14 +109,21 @@ func (ring *Ring) ForceBatchOrShard(arg interface{}) {
 
 	ring.mux.Lock()
 	defer ring.mux.Unlock()
+	if ring.isFreed {
+		return
+	}
 	if arg != nil {
 		newMsg = arg.(*model.InputMessage)
-		log.Warnf("%s: Ring.ForceBatchOrShard partition %d message range [%d, %d)", ring.service.taskCfg.Name, newMsg.Partition, ring.ringGroundOff, newMsg.Offset)
+		log.Warnf("%s: Ring.ForceBatchOrShard topic %s partition %d message range [%d, %d)", ring.service.taskCfg.Name, newMsg.Topic, newMsg.Partition, ring.ringGroundOff, newMsg.Offset)
 	}
 	if !ring.isIdle {
 		if newMsg == nil {
-			if ring.ringFilledOffset > ring.ringGroundOff {
-				ring.genBatchOrShard(ring.ringFilledOffset)
+			expNewGroundOff := ring.ringFilledOffset
+			if ring.service.taskCfg.ExactlyOnce.Enable {
+				expNewGroundOff = alignedOffset(expNewGroundOff, ring.batchSizeShift)
+			}
+			if expNewGroundOff > ring.ringGroundOff {
+				ring.genBatchOrShard(expNewGroundOff)
 				ring.idleCnt = 0
 			} else if ring.ringGroundOff == ring.ringCeilingOff {
 				ring.idleCnt++
@@ -101,7 +131,7 @@ func (ring *Ring) ForceBatchOrShard(arg interface{}) {
 					ring.idleCnt = 0
 					ring.isIdle = true
 					ring.ringBuf = nil
-					log.Infof("%s: topic %s partition %d enter idle", ring.service.taskCfg.Name, ring.service.taskCfg.Topic, ring.partition)
+					log.Infof("%s: topic %s partition %d enter idle", ring.service.taskCfg.Name, ring.topic, ring.partition)
 				}
 			}
 		} else {
@@ -135,7 +165,7 @@ func (ring *Ring) genBatchOrShard(expNewGroundOff int64) {
 		return
 	}
 	var gaps []OffsetRange
-	var msgCnt, parseErrs int
+	var msgCnt, parseErrs, filtered int
 	endOff := (ring.ringGroundOff | int64(1<<ring.batchSizeShift-1)) + 1
 	if endOff > expNewGroundOff {
 		endOff = expNewGroundOff
@@ -144,22 +174,42 @@ func (ring *Ring) genBatchOrShard(expNewGroundOff int64) {
 		endOff = ring.ringCeilingOff
 	}
 	if ring.service.sharder != nil {
-		msgCnt = ring.service.sharder.PutElems(ring.partition, ring.ringBuf, ring.ringGroundOff, endOff, ring.ringCap)
+		msgCnt = ring.service.sharder.PutElems(ring.topic, ring.partition, ring.ringBuf, ring.ringGroundOff, endOff, ring.ringCap)
 		statistics.RingMsgs.WithLabelValues(ring.service.taskCfg.Name).Sub(float64(msgCnt))
 	} else {
 		gapBegOff := int64(-1)
-		batch := model.NewBatch()
+		firstOff, lastOff := int64(-1), int64(-1)
+		routes := ring.service.routes
+		batches := make([]*model.Batch, len(routes)) //one per route, nil if no row goes to it
+		var realSize int
 		for i := ring.ringGroundOff; i < endOff; i++ {
 			msgRow := &ring.ringBuf[i&(ring.ringCap-1)]
 			if msgRow.Msg != nil {
 				msgCnt++
+				if firstOff < 0 {
+					firstOff = i
+				}
+				lastOff = i
 				//assert msg.Offset==i
 				if gapBegOff >= 0 {
 					gaps = append(gaps, OffsetRange{Begin: gapBegOff, End: i})
 					gapBegOff = -1
 				}
 				if msgRow.Row != nil {
-					*batch.Rows = append(*batch.Rows, msgRow.Row)
+					if batches[msgRow.Route] == nil {
+						batches[msgRow.Route] = model.NewBatch()
+					}
+					*batches[msgRow.Route].Rows = append(*batches[msgRow.Route].Rows, msgRow.Row)
+					realSize++
+					for _, extra := range msgRow.Extra {
+						if batches[extra.Route] == nil {
+							batches[extra.Route] = model.NewBatch()
+						}
+						*batches[extra.Route].Rows = append(*batches[extra.Route].Rows, extra.Row)
+						realSize++
+					}
+				} else if msgRow.Filtered {
+					filtered++
 				} else {
 					parseErrs++
 				}
@@ -169,27 +219,58 @@ func (ring *Ring) genBatchOrShard(expNewGroundOff int64) {
 			msgRow.Msg = nil
 			msgRow.Row = nil
 			msgRow.Shard = -1
+			msgRow.Route = 0
+			msgRow.Extra = nil
+			msgRow.Filtered = false
 		}
-		batch.RealSize = len(*batch.Rows)
 		if gapBegOff >= 0 {
 			gaps = append(gaps, OffsetRange{Begin: gapBegOff, End: endOff})
 		}
 
-		if batch.RealSize > 0 {
-			log.Debugf("%s: going to flush a batch for topic %v patittion %d, offset %d, messages %d, gaps: %+v, parse errors: %d",
-				ring.service.taskCfg.Name, ring.service.taskCfg.Topic, ring.partition, endOff-1,
-				batch.RealSize, gaps, parseErrs)
+		if realSize > 0 {
+			log.Debugf("%s: going to flush a batch for topic %v patittion %d, offset %d, messages %d, rows %d, gaps: %+v, parse errors: %d, filtered: %d",
+				ring.service.taskCfg.Name, ring.topic, ring.partition, endOff-1,
+				msgCnt, realSize, gaps, parseErrs, filtered)
 
-			batch.BatchIdx = (endOff - 1) >> ring.batchSizeShift
-			ring.batchSys.CreateBatchGroupSingle(batch, ring.partition, endOff-1)
-			ring.service.batchChan <- batch
+			var toSend []*model.Batch
+			for route, batch := range batches {
+				if batch == nil {
+					continue
+				}
+				batch.RealSize = len(*batch.Rows)
+				batch.BatchIdx = (endOff - 1) >> ring.batchSizeShift
+				batch.Dims = routes[route].dims
+				batch.Route = route
+				if ring.service.taskCfg.ExactlyOnce.Enable {
+					batch.DedupToken = ringDedupToken(ring.topic, ring.partition, firstOff, lastOff)
+				}
+				toSend = append(toSend, batch)
+			}
+			if len(toSend) == 1 {
+				ring.batchSys.CreateBatchGroupSingle(toSend[0], ring.topic, ring.partition, endOff-1)
+			} else {
+				// The offset is committed after batches of all routes have been written.
+				offsets := make([]int64, ring.partition+1)
+				for i := range offsets {
+					offsets[i] = -1
+				}
+				offsets[ring.partition] = endOff - 1
+				ring.batchSys.CreateBatchGroupMulti(toSend, map[string][]int64{ring.topic: offsets})
+			}
+			for _, batch := range toSend {
+				select {
+				case ring.service.batchChan <- batch:
+				case <-ring.service.ctx.Done():
+					// The task is stopping or paused, the batch will be consumed again.
+				}
+			}
 			if gaps == nil {
 				statistics.RingNormalBatchsTotal.WithLabelValues(ring.service.taskCfg.Name).Inc()
 			} else {
 				statistics.RingForceBatchAllGapTotal.WithLabelValues(ring.service.taskCfg.Name).Inc()
 			}
 		}
-		statistics.RingMsgs.WithLabelValues(ring.service.taskCfg.Name).Sub(float64(batch.RealSize))
+		statistics.RingMsgs.WithLabelValues(ring.service.taskCfg.Name).Sub(float64(msgCnt))
 	}
 
 	ring.ringGroundOff = endOff
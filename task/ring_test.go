@@ -0,0 +1,44 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package task
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/housepower/clickhouse_sinker/model"
+)
+
+func TestRemoveTopics(t *testing.T) {
+	service := newExactlyOnceService(t, false)
+	newRing := func(topic string, partition int) *Ring {
+		ring := &Ring{ringBuf: make([]model.MsgRow, 8), ringCap: 8, batchSizeShift: 2, topic: topic, partition: partition, service: service,
+			batchSys: model.NewBatchSys(service.taskCfg, func(topic string, partition int, offset int64) error { return nil })}
+		service.rings[model.TopicPartition{Topic: topic, Partition: partition}] = ring
+		return ring
+	}
+	ring1, ring2, ring3 := newRing("topic1", 0), newRing("topic1", 1), newRing("topic2", 0)
+	putOffsets(ring1, 0, 2)
+	service.removeTopics([]string{"topic1"})
+	require.Equal(t, map[model.TopicPartition]*Ring{{Topic: "topic2", Partition: 0}: ring3}, service.rings)
+
+	// Messages parsed after the removal are dropped, and nothing is flushed.
+	putOffsets(ring2, 0, 4)
+	ring1.ForceBatchOrShard(nil)
+	require.Empty(t, service.batchChan)
+	require.Nil(t, ring1.ringBuf)
+}
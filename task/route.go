@@ -0,0 +1,74 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package task
+
+import (
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/output"
+)
+
+// tableRoute is a table which rows are written to. service.routes[0] is the task's table,
+// service.routes[i] is the one of taskCfg.Routes[i-1].
+type tableRoute struct {
+	clickhouse *output.ClickHouse
+	dims       []*model.ColumnWithType //protected by service.schemaMux
+}
+
+func newTableRoutes(clickhouse *output.ClickHouse, routeCnt int) (routes []*tableRoute) {
+	routes = append(routes, &tableRoute{clickhouse: clickhouse})
+	for i := 0; i < routeCnt; i++ {
+		routes = append(routes, &tableRoute{clickhouse: output.NewRouteClickHouse(clickhouse, i)})
+	}
+	return
+}
+
+// initRoutes initializes tables of routes, the task's one shall have been initialized.
+func (service *Service) initRoutes() (err error) {
+	service.routeIdx = make(map[string]int)
+	for i, routeCfg := range service.taskCfg.Routes {
+		route := service.routes[i+1]
+		if err = route.clickhouse.Init(service.pause); err != nil {
+			return
+		}
+		route.dims = route.clickhouse.Dims
+		for _, value := range routeCfg.Values {
+			service.routeIdx[value] = i + 1
+		}
+	}
+	return
+}
+
+// routeOf returns index of the table which the metric goes to.
+func (service *Service) routeOf(metric model.Metric) int {
+	if service.routeIdx == nil {
+		return 0
+	}
+	value, _ := metric.GetString(service.taskCfg.RouteField, false).(string)
+	return service.routeIdx[value]
+}
+
+// hasAutoSchema tells whether any table's schema is fetched from ClickHouse.
+func (service *Service) hasAutoSchema() bool {
+	if service.taskCfg.AutoSchema {
+		return true
+	}
+	for _, routeCfg := range service.taskCfg.Routes {
+		if routeCfg.AutoSchema {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package task
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/output"
+)
+
+func TestRingRoutes(t *testing.T) {
+	taskCfg := &config.TaskConfig{Name: "test1", Clickhouse: "ch1", TableName: "t1", RouteField: "event_type",
+		Routes: []*config.RouteConfig{{Values: []string{"click"}, TableName: "t_click"}}}
+	cfg := &config.Config{
+		Clickhouse: map[string]*config.ClickHouseConfig{"ch1": {DB: "default"}},
+		Tasks:      map[string]*config.TaskConfig{"test1": taskCfg},
+	}
+	service := NewTaskService(nil, output.NewClickHouse(cfg, "test1"), nil, cfg, "test1")
+	require.Equal(t, 2, len(service.routes))
+	service.ctx = context.Background()
+	service.batchChan = make(chan *model.Batch, 4)
+	var committed []int64
+	ring := &Ring{ringBuf: make([]model.MsgRow, 4), ringCap: 4, ringGroundOff: 0, ringCeilingOff: 3, ringFilledOffset: 3,
+		batchSizeShift: 1, topic: "topic1", partition: 0, service: service,
+		batchSys: model.NewBatchSys(taskCfg, func(topic string, partition int, offset int64) error {
+			committed = append(committed, offset)
+			return nil
+		})}
+	for i, route := range []int{1, 0, 1} {
+		ring.ringBuf[i] = model.MsgRow{Msg: &model.InputMessage{Offset: int64(i)}, Row: &model.Row{int64(i)}, Route: route}
+	}
+	// Message 1 is exploded into rows of both tables.
+	ring.ringBuf[1].Extra = []model.MsgRow{{Row: &model.Row{int64(10)}, Route: 1}}
+
+	// Messages [0, 2) go to both tables.
+	ring.genBatchOrShard(3)
+	batch0, batch1 := <-service.batchChan, <-service.batchChan
+	require.Equal(t, 0, batch0.Route)
+	require.Equal(t, model.Rows{&model.Row{int64(1)}}, *batch0.Rows)
+	require.Equal(t, 1, batch1.Route)
+	require.Equal(t, model.Rows{&model.Row{int64(0)}, &model.Row{int64(10)}}, *batch1.Rows)
+	require.Nil(t, ring.ringBuf[1].Extra)
+	require.True(t, batch0.Group == batch1.Group)
+	require.Nil(t, batch1.Commit())
+	require.Empty(t, committed)
+	require.Nil(t, batch0.Commit())
+	require.Equal(t, []int64{1}, committed)
+
+	// Message 2 goes to the route only.
+	ring.genBatchOrShard(3)
+	batch1 = <-service.batchChan
+	require.Equal(t, 1, batch1.Route)
+	require.Equal(t, model.Rows{&model.Row{int64(2)}}, *batch1.Rows)
+	require.Nil(t, batch1.Commit())
+	require.Equal(t, []int64{1, 2}, committed)
+}
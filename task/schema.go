@@ -0,0 +1,199 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package task
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/statistics"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+func (service *Service) initDynamicSchema() (err error) {
+	dynCfg := &service.taskCfg.DynamicSchema
+	interval := time.Duration(dynCfg.NewColumnsInterval) * time.Second
+	service.newColsLimiter = rate.NewLimiter(rate.Every(interval/time.Duration(dynCfg.MaxNewColumns)), dynCfg.MaxNewColumns)
+	service.alterMux.Lock()
+	defer service.alterMux.Unlock()
+	return service.refreshSchema(0)
+}
+
+// addNewColumns adds columns for new fields of the metric, at most MaxNewColumns per NewColumnsInterval.
+// Fields beyond the cap are ignored until a later message carries them again.
+func (service *Service) addNewColumns(metric model.Metric) {
+	newKeys := make(map[string]string)
+	if !metric.GetNewKeys(&service.knownKeys, newKeys) {
+		return
+	}
+	names := make([]string, 0, len(newKeys))
+	for name := range newKeys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	service.alterMux.Lock()
+	defer service.alterMux.Unlock()
+	toAdd := make(map[string]string)
+	for _, name := range names {
+		// Another goroutine may have added it meanwhile.
+		if !model.IsNewKey(name, &service.knownKeys) {
+			continue
+		}
+		if !service.newColsLimiter.Allow() {
+			if service.limiter1.Allow() {
+				log.Warnf("%s: reached the cap of %d new columns per %d seconds, postpone adding column %s",
+					service.taskCfg.Name, service.taskCfg.DynamicSchema.MaxNewColumns, service.taskCfg.DynamicSchema.NewColumnsInterval, name)
+			}
+			break
+		}
+		toAdd[name] = newKeys[name]
+	}
+	if len(toAdd) == 0 {
+		return
+	}
+	err := service.clickhouse.AddColumns(toAdd)
+	// Never try these fields again, otherwise every message carrying them would issue an ALTER.
+	for name := range toAdd {
+		service.knownKeys.Store(name, nil)
+	}
+	if err != nil {
+		statistics.AddColumnsErrorTotal.WithLabelValues(service.taskCfg.Name).Inc()
+		log.Errorf("%s: failed to add columns %+v, they are ignored. Got error %+v", service.taskCfg.Name, toAdd, err)
+		return
+	}
+	statistics.AddColumnsTotal.WithLabelValues(service.taskCfg.Name).Add(float64(len(toAdd)))
+	log.Infof("%s: added columns %+v", service.taskCfg.Name, toAdd)
+	if err = service.refreshSchema(0); err != nil {
+		log.Errorf("%s: failed to refresh schema, got error %+v", service.taskCfg.Name, err)
+	}
+}
+
+// refreshSchemaLoop periodically applies schema changes made by others, i.e. a DBA adds or drops columns.
+func (service *Service) refreshSchemaLoop(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(service.taskCfg.SchemaRefreshInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Infof("%s: Service.refreshSchemaLoop quit due to the context has been canceled", service.taskCfg.Name)
+			return
+		case <-ticker.C:
+			service.alterMux.Lock()
+			for route := range service.routes {
+				if err := service.refreshSchema(route); err != nil {
+					log.Errorf("%s: failed to refresh schema, got error %+v", service.taskCfg.Name, err)
+				}
+			}
+			service.alterMux.Unlock()
+		}
+	}
+}
+
+// refreshSchema fetches schema of the route's table, and applies it if changed.
+// Assumes service.alterMux is locked.
+func (service *Service) refreshSchema(route int) (err error) {
+	var dims []*model.ColumnWithType
+	var allCols []string
+	if dims, allCols, err = service.routes[route].clickhouse.FetchSchema(); err != nil {
+		return
+	}
+	if route == 0 {
+		// Dynamic schema is exclusive with routes, only the task's table matters.
+		for _, name := range allCols {
+			service.knownKeys.Store(name, nil)
+		}
+	}
+	if sameDims(service.routes[route].dims, dims) {
+		return
+	}
+	return service.applyDims(route, dims)
+}
+
+// applyDims switches the route's table to new columns. Rows buffered in rings and the sharder are converted to the new columns,
+// so nothing is lost. Batches generated already keep their columns.
+func (service *Service) applyDims(route int, dims []*model.ColumnWithType) (err error) {
+	var policy *ShardingPolicy
+	if service.sharder != nil {
+		dms := make([]string, 0, len(dims))
+		for _, dim := range dims {
+			dms = append(dms, dim.Name)
+		}
+		if policy, err = NewShardingPolicy(service.taskCfg.ShardingKey, service.taskCfg.ShardingPolicy, dms, service.sharder.ckNum); err != nil {
+			return
+		}
+	}
+	rm := model.NewRowsRemapper(service.routes[route].dims, dims)
+
+	// Block parsing workers, and stop rings and the sharder from generating batches.
+	service.schemaMux.Lock()
+	defer service.schemaMux.Unlock()
+	service.Lock()
+	rings := make([]*Ring, 0, len(service.rings))
+	for _, ring := range service.rings {
+		rings = append(rings, ring)
+	}
+	service.Unlock()
+	for _, ring := range rings {
+		ring.mux.Lock()
+	}
+	for _, ring := range rings {
+		for i := range ring.ringBuf {
+			msgRow := &ring.ringBuf[i]
+			if msgRow.Row != nil && msgRow.Route == route {
+				rm.Remap(msgRow.Row)
+			}
+			for _, extra := range msgRow.Extra {
+				if extra.Route == route {
+					rm.Remap(extra.Row)
+				}
+			}
+		}
+	}
+	if service.sharder != nil {
+		service.sharder.mux.Lock()
+		for _, rows := range service.sharder.msgBuf {
+			for _, row := range *rows {
+				rm.Remap(row)
+			}
+		}
+		service.sharder.policy = policy
+		service.sharder.mux.Unlock()
+	}
+	service.routes[route].dims = dims
+	service.routes[route].clickhouse.SetDims(dims)
+	for _, ring := range rings {
+		ring.mux.Unlock()
+	}
+	log.Infof("%s: switched to %d columns of route %d", service.taskCfg.Name, len(dims), route)
+	return
+}
+
+func sameDims(a, b []*model.ColumnWithType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].Type != b[i].Type || a[i].SourceName != b[i].SourceName ||
+			a[i].Expr.String() != b[i].Expr.String() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,48 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package task
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/housepower/clickhouse_sinker/config"
+	"github.com/housepower/clickhouse_sinker/model"
+	"github.com/housepower/clickhouse_sinker/output"
+)
+
+func TestApplyDims(t *testing.T) {
+	cfg := &config.Config{
+		Clickhouse: map[string]*config.ClickHouseConfig{"ch1": {DB: "default"}},
+		Tasks:      map[string]*config.TaskConfig{"test1": {Name: "test1", Clickhouse: "ch1", TableName: "t1"}},
+	}
+	oldDims := []*model.ColumnWithType{{Name: "a", Type: "Int64"}, {Name: "b", Type: "String"}, {Name: "c", Type: "Float64"}}
+	newDims := []*model.ColumnWithType{{Name: "a", Type: "Int64"}, {Name: "c", Type: "Float64"}, {Name: "d", Type: "Nullable(String)"}, {Name: "e", Type: "Int32"}}
+	ck := output.NewClickHouse(cfg, "test1")
+	ck.SetDims(oldDims)
+	service := NewTaskService(nil, ck, nil, cfg, "test1")
+	service.routes[0].dims = oldDims
+	ring := &Ring{ringBuf: make([]model.MsgRow, 4), ringCap: 4, service: service}
+	ring.ringBuf[1].Row = &model.Row{int64(1), "x", 1.5}
+	service.rings[model.TopicPartition{Topic: "topic1", Partition: 1}] = ring
+
+	require.Nil(t, service.applyDims(0, newDims))
+	require.Equal(t, model.Row{int64(1), 1.5, nil, int64(0)}, *ring.ringBuf[1].Row)
+	require.Nil(t, ring.ringBuf[0].Row)
+	require.Equal(t, []string{"a", "c", "d", "e"}, ck.Dms)
+	require.Equal(t, newDims, service.routes[0].dims)
+}
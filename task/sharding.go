@@ -9,7 +9,6 @@ import (
 	"github.com/cespare/xxhash"
 	"github.com/fagongzi/goetty"
 	"github.com/housepower/clickhouse_sinker/model"
-	"github.com/housepower/clickhouse_sinker/pool"
 	"github.com/housepower/clickhouse_sinker/statistics"
 	"github.com/housepower/clickhouse_sinker/util"
 	"github.com/pkg/errors"
@@ -106,13 +105,14 @@ type Sharder struct {
 	ckNum    int
 	mux      sync.Mutex
 	msgBuf   []*model.Rows
-	offsets  []int64
+	offsets  map[string][]int64 //topic => last offset of each partition since the last flush
+	begOffs  map[string][]int64 //topic => first offset of each partition since the last flush, only for ExactlyOnce
 	tid      goetty.Timeout
 }
 
 func NewSharder(service *Service) (sh *Sharder, err error) {
 	var policy *ShardingPolicy
-	ckNum := pool.GetNumConn(service.taskCfg.Clickhouse)
+	ckNum := service.clickhouse.NumShards()
 	if policy, err = NewShardingPolicy(service.taskCfg.ShardingKey, service.taskCfg.ShardingPolicy, service.clickhouse.Dms, ckNum); err != nil {
 		return
 	}
@@ -122,7 +122,8 @@ func NewSharder(service *Service) (sh *Sharder, err error) {
 		batchSys: model.NewBatchSys(service.taskCfg, service.fnCommit),
 		ckNum:    ckNum,
 		msgBuf:   make([]*model.Rows, ckNum),
-		offsets:  make([]int64, 0),
+		offsets:  make(map[string][]int64),
+		begOffs:  make(map[string][]int64),
 	}
 	for i := 0; i < ckNum; i++ {
 		sh.msgBuf[i] = model.GetRows()
@@ -134,20 +135,30 @@ func (sh *Sharder) Calc(row *model.Row) (int, error) {
 	return sh.policy.Calc(row)
 }
 
-func (sh *Sharder) PutElems(partition int, ringBuf []model.MsgRow, begOff, endOff, ringCap int64) (msgCnt int) {
+func (sh *Sharder) PutElems(topic string, partition int, ringBuf []model.MsgRow, begOff, endOff, ringCap int64) (msgCnt int) {
 	sh.mux.Lock()
 	defer sh.mux.Unlock()
 	var gaps []OffsetRange
-	var parseErrs int
+	var parseErrs, filtered int
 	gapBegOff := int64(-1)
+	firstOff := int64(-1)
 	for i := begOff; i < endOff; i++ {
 		msgRow := &ringBuf[i&(ringCap-1)]
 		if msgRow.Msg != nil {
 			msgCnt++
+			if firstOff < 0 {
+				firstOff = i
+			}
 			//assert msg.Offset==i
 			if msgRow.Row != nil {
 				rows := sh.msgBuf[msgRow.Shard]
 				*rows = append(*rows, msgRow.Row)
+				for _, extra := range msgRow.Extra {
+					rows = sh.msgBuf[extra.Shard]
+					*rows = append(*rows, extra.Row)
+				}
+			} else if msgRow.Filtered {
+				filtered++
 			} else {
 				parseErrs++
 			}
@@ -161,17 +172,25 @@ func (sh *Sharder) PutElems(partition int, ringBuf []model.MsgRow, begOff, endOf
 		msgRow.Msg = nil
 		msgRow.Row = nil
 		msgRow.Shard = -1
+		msgRow.Extra = nil
+		msgRow.Filtered = false
 	}
 	if gapBegOff >= 0 {
 		gaps = append(gaps, OffsetRange{Begin: gapBegOff, End: endOff})
 	}
 
-	gap := partition + 1 - len(sh.offsets)
+	offsets, begOffs := sh.offsets[topic], sh.begOffs[topic]
+	gap := partition + 1 - len(offsets)
 	for i := 0; i < gap; i++ {
-		sh.offsets = append(sh.offsets, -1)
+		offsets = append(offsets, -1)
+		begOffs = append(begOffs, -1)
 	}
+	sh.offsets[topic], sh.begOffs[topic] = offsets, begOffs
 	if msgCnt > 0 {
-		sh.offsets[partition] = endOff - 1
+		if offsets[partition] < 0 {
+			begOffs[partition] = firstOff
+		}
+		offsets[partition] = endOff - 1
 		statistics.ShardMsgs.WithLabelValues(sh.service.taskCfg.Name).Add(float64(msgCnt))
 	}
 	var maxBatchSize int
@@ -181,10 +200,12 @@ func (sh *Sharder) PutElems(partition int, ringBuf []model.MsgRow, begOff, endOf
 			maxBatchSize = batchSize
 		}
 	}
-	log.Debugf("%s: sharded a batch for topic %v patittion %d, offset %d, messages %d, gaps: %+v, parse errors: %d",
-		sh.service.taskCfg.Name, sh.service.taskCfg.Topic, partition, endOff-1,
-		msgCnt, gaps, parseErrs)
-	if maxBatchSize >= sh.service.taskCfg.BufferSize {
+	log.Debugf("%s: sharded a batch for topic %v patittion %d, offset %d, messages %d, gaps: %+v, parse errors: %d, filtered: %d",
+		sh.service.taskCfg.Name, topic, partition, endOff-1,
+		msgCnt, gaps, parseErrs, filtered)
+	// With ExactlyOnce, rows of each ring batch are flushed at once, so that shard batches are cut the same
+	// after being consumed again.
+	if maxBatchSize >= sh.service.taskCfg.BufferSize || sh.service.taskCfg.ExactlyOnce.Enable {
 		sh.doFlush(nil)
 	}
 	return
@@ -207,20 +228,29 @@ func (sh *Sharder) doFlush(_ interface{}) {
 			msgCnt += realSize
 			batch := &model.Batch{
 				Rows:     rows,
+				Dims:     sh.service.routes[0].dims,
 				BatchIdx: int64(i),
 				RealSize: realSize,
 			}
+			if sh.service.taskCfg.ExactlyOnce.Enable {
+				batch.DedupToken = sharderDedupToken(sh.begOffs, sh.offsets, i)
+			}
 			batches = append(batches, batch)
 			sh.msgBuf[i] = model.GetRows()
 		}
 	}
 	if msgCnt > 0 {
-		log.Debugf("%s: going to flush batch group for topic %v, offsets %+v, messages %d", sh.service.taskCfg.Name, sh.service.taskCfg.Name, sh.offsets, msgCnt)
+		log.Debugf("%s: going to flush batch group, offsets %+v, messages %d", sh.service.taskCfg.Name, sh.offsets, msgCnt)
 		sh.batchSys.CreateBatchGroupMulti(batches, sh.offsets)
-		sh.offsets = sh.offsets[:0]
+		sh.offsets = make(map[string][]int64)
+		sh.begOffs = make(map[string][]int64)
 		// ALL batches in a group shall be populated before sending any one to next stage.
 		for _, batch := range batches {
-			sh.service.batchChan <- batch
+			select {
+			case sh.service.batchChan <- batch:
+			case <-sh.service.ctx.Done():
+				// The task is stopping or paused, the batch will be consumed again.
+			}
 		}
 		statistics.ShardMsgs.WithLabelValues(sh.service.taskCfg.Name).Sub(float64(msgCnt))
 	}
@@ -45,14 +45,26 @@ type Service struct {
 	cancel     context.CancelFunc
 	started    bool
 	stopped    chan struct{}
+	paused     chan struct{} //closed once the task pauses itself
+	pauseOnce  sync.Once
+	exited     chan struct{} //closed once the task has been stopped
+	stopOnce   sync.Once
 	inputer    input.Inputer
 	clickhouse *output.ClickHouse
 	pp         *parser.Pool
 	cfg        *config.Config
 	taskCfg    *config.TaskConfig
-	dims       []*model.ColumnWithType
+	routes     []*tableRoute  //routes[0] is the task's table, whose clickhouse is the same as the above
+	routeIdx   map[string]int //RouteField value => index of routes
+	filter     *util.Filter
 
-	rings     []*Ring
+	// Dynamic schema
+	schemaMux      sync.RWMutex //protect dims and rows buffered in rings and the sharder
+	alterMux       sync.Mutex   //serialize schema changes
+	knownKeys      sync.Map     //names of all columns of the table, and fields failed to add as columns
+	newColsLimiter *rate.Limiter
+
+	rings     map[model.TopicPartition]*Ring
 	sharder   *Sharder
 	batchChan chan *model.Batch
 	limiter1  *rate.Limiter
@@ -62,25 +74,58 @@ type Service struct {
 
 // NewTaskService creates an instance of new tasks with kafka, clickhouse and paser instances
 func NewTaskService(inputer input.Inputer, clickhouse *output.ClickHouse, pp *parser.Pool, cfg *config.Config, taskName string) *Service {
+	taskCfg := cfg.Tasks[taskName]
 	return &Service{
 		stopped:    make(chan struct{}),
+		paused:     make(chan struct{}),
+		exited:     make(chan struct{}),
 		inputer:    inputer,
 		clickhouse: clickhouse,
 		started:    false,
 		pp:         pp,
 		cfg:        cfg,
-		taskCfg:    cfg.Tasks[taskName],
+		taskCfg:    taskCfg,
+		routes:     newTableRoutes(clickhouse, len(taskCfg.Routes)),
+		rings:      make(map[model.TopicPartition]*Ring),
 	}
 }
 
 // Init initializes the kafak and clickhouse task associated with this service
 
 func (service *Service) Init() (err error) {
-	if err = service.clickhouse.Init(); err != nil {
+	switch service.taskCfg.Parser {
+	case "protobuf":
+		if err = service.pp.LoadProtoDescriptor(service.taskCfg.ProtoDescriptor, service.taskCfg.ProtoMessage); err != nil {
+			return
+		}
+	case "avro":
+		if err = service.pp.InitAvro(service.taskCfg.SchemaRegistry, service.taskCfg.AvroSchemaFile); err != nil {
+			return
+		}
+	case "regex", "grok":
+		if err = service.pp.CompilePattern(service.taskCfg.Pattern, service.taskCfg.GrokPatterns); err != nil {
+			return
+		}
+	case "influx":
+		if err = service.pp.SetInfluxPrecision(service.taskCfg.InfluxPrecision); err != nil {
+			return
+		}
+	}
+	if err = service.clickhouse.Init(service.pause); err != nil {
 		return
 	}
 
-	service.dims = service.clickhouse.Dims
+	service.routes[0].dims = service.clickhouse.Dims
+	if service.taskCfg.Filter != "" {
+		if service.filter, err = util.NewFilter(service.taskCfg.Filter); err != nil {
+			return
+		}
+	}
+	if len(service.taskCfg.Routes) != 0 {
+		if err = service.initRoutes(); err != nil {
+			return
+		}
+	}
 	service.batchChan = make(chan *model.Batch, 32)
 	service.limiter1 = rate.NewLimiter(rate.Every(10*time.Second), 1)
 	service.limiter2 = rate.NewLimiter(rate.Every(10*time.Second), 1)
@@ -91,8 +136,26 @@ func (service *Service) Init() (err error) {
 			return
 		}
 	}
+	if service.taskCfg.DynamicSchema.Enable {
+		if err = service.initDynamicSchema(); err != nil {
+			return
+		}
+	}
 
-	err = service.inputer.Init(service.cfg, service.taskCfg.Name, service.put)
+	if err = service.inputer.Init(service.cfg, service.taskCfg.Name, service.put); err != nil {
+		return
+	}
+	if service.taskCfg.ExactlyOnce.OffsetsTable != "" {
+		seeker, ok := service.inputer.(input.Seeker)
+		if !ok {
+			err = errors.Errorf("%s: exactlyOnce offsetsTable is unsupported by the inputer", service.taskCfg.Name)
+			return
+		}
+		seeker.SetOffsetLoader(service.loadStoredOffset)
+	}
+	if watcher, ok := service.inputer.(input.TopicsWatcher); ok {
+		watcher.SetTopicsRemovedFn(service.removeTopics)
+	}
 	return
 }
 
@@ -103,6 +166,9 @@ func (service *Service) Run(ctx context.Context) {
 	service.ctx, service.cancel = context.WithCancel(ctx)
 	log.Infof("%s: task started", service.taskCfg.Name)
 	go service.inputer.Run(service.ctx)
+	if service.hasAutoSchema() && service.taskCfg.SchemaRefreshInterval > 0 {
+		go service.refreshSchemaLoop(service.ctx)
+	}
 	if service.sharder != nil {
 		// schedule a delayed ForceFlush
 		if service.sharder.tid, err = util.GlobalTimerWheel.Schedule(time.Duration(service.taskCfg.FlushInterval)*time.Second, service.sharder.ForceFlush, nil); err != nil {
@@ -125,23 +191,25 @@ LOOP:
 	service.stopped <- struct{}{}
 }
 
-func (service *Service) fnCommit(partition int, offset int64) error {
-	msg := model.InputMessage{Topic: service.taskCfg.Topic, Partition: partition, Offset: offset}
+func (service *Service) fnCommit(topic string, partition int, offset int64) error {
+	// Store the offset before committing it to Kafka, partitions resume from the stored one on startup.
+	// A crash before storing it doesn't duplicate rows either, since batches consumed again are cut the same
+	// and deduplicated by their tokens.
+	if service.taskCfg.ExactlyOnce.OffsetsTable != "" {
+		if err := service.clickhouse.SaveOffset(topic, partition, offset); err != nil {
+			return err
+		}
+	}
+	msg := model.InputMessage{Topic: topic, Partition: partition, Offset: offset}
 	return service.inputer.CommitMessages(service.ctx, &msg)
 }
 
 func (service *Service) put(msg model.InputMessage) {
 	statistics.ConsumeMsgsTotal.WithLabelValues(service.taskCfg.Name).Inc()
 	// ensure ring for this message exist
+	tp := model.TopicPartition{Topic: msg.Topic, Partition: msg.Partition}
 	service.Lock()
-	var ring *Ring
-	if msg.Partition < len(service.rings) {
-		ring = service.rings[msg.Partition]
-	} else {
-		for i := len(service.rings); i < msg.Partition+1; i++ {
-			service.rings = append(service.rings, nil)
-		}
-	}
+	ring := service.rings[tp]
 
 	var err error
 	if ring == nil {
@@ -156,6 +224,7 @@ func (service *Service) put(msg model.InputMessage) {
 			batchSizeShift:   batchSizeShift,
 			idleCnt:          0,
 			isIdle:           false,
+			topic:            msg.Topic,
 			partition:        msg.Partition,
 			batchSys:         model.NewBatchSys(service.taskCfg, service.fnCommit),
 			service:          service,
@@ -165,7 +234,7 @@ func (service *Service) put(msg model.InputMessage) {
 			err = errors.Wrap(err, "")
 			log.Fatalf("%s: got error %+v", service.taskCfg.Name, err)
 		}
-		service.rings[msg.Partition] = ring
+		service.rings[tp] = ring
 		service.Unlock()
 	} else {
 		service.Unlock()
@@ -195,47 +264,180 @@ func (service *Service) put(msg model.InputMessage) {
 	// submit message to a goroutine pool
 	statistics.ParsingPoolBacklog.WithLabelValues(service.taskCfg.Name).Inc()
 	_ = util.GlobalParsingPool.Submit(func() {
-		var row *model.Row
+		msgRow := model.MsgRow{Msg: &msg}
 		p := service.pp.Get()
-		metric, err := p.Parse(msg.Value)
+		metrics, err := service.parseWithRetry(p, &msg)
+		if parser.IsRetryable(err) {
+			// The task has been stopped meanwhile, the message will be consumed again.
+			service.pp.Put(p)
+			statistics.ParsingPoolBacklog.WithLabelValues(service.taskCfg.Name).Dec()
+			return
+		}
 		if err != nil {
 			statistics.ParseMsgsErrorTotal.WithLabelValues(service.taskCfg.Name).Inc()
 			if service.limiter1.Allow() {
 				log.Errorf("%s: failed to parse message(topic %v, partition %d, offset %v) %+v, string(value) <<<%+v>>>, got error %+v",
 					service.taskCfg.Name, msg.Topic, msg.Partition, msg.Offset, msg, string(msg.Value), err)
 			}
+			// The message is put into the ring only after it's been persisted to the dead letter sink.
+			// So its offset is never committed before that.
+			if service.clickhouse.DeadLetter != nil && !service.writeDeadLetter(&msg, err) {
+				service.pp.Put(p)
+				statistics.ParsingPoolBacklog.WithLabelValues(service.taskCfg.Name).Dec()
+				return
+			}
 		} else {
-			row = model.MetricToRow(metric, msg, service.dims)
+			kept := metrics[:0]
+			for _, metric := range metrics {
+				if service.filter != nil && !service.filter.Match(metric) {
+					// The message still goes through the ring even if it has no row left, so that its offset is committed.
+					statistics.FilterMsgsTotal.WithLabelValues(service.taskCfg.Name).Inc()
+					continue
+				}
+				if service.taskCfg.DynamicSchema.Enable {
+					service.addNewColumns(metric)
+				}
+				kept = append(kept, metric)
+			}
+			msgRow.Filtered = len(kept) == 0 && len(metrics) != 0
+			metrics = kept
 		}
 
+		// Hold schemaMux until rows are in the ring, so that they're either built with the new schema or converted to it.
+		service.schemaMux.RLock()
+		for i, metric := range metrics {
+			route := service.routeOf(metric)
+			row := model.MetricToRow(metric, msg, service.routes[route].dims)
+			if i == 0 {
+				msgRow.Row, msgRow.Route = row, route
+			} else {
+				msgRow.Extra = append(msgRow.Extra, model.MsgRow{Row: row, Route: route})
+			}
+		}
 		service.pp.Put(p)
 		var ring *Ring
 		service.Lock()
-		ring = service.rings[msg.Partition]
+		ring = service.rings[tp]
 		service.Unlock()
-		ring.PutElem(model.MsgRow{Msg: &msg, Row: row})
+		if ring != nil {
+			// The ring is absent once the topic is no longer consumed.
+			ring.PutElem(msgRow)
+		}
+		service.schemaMux.RUnlock()
 		statistics.ParsingPoolBacklog.WithLabelValues(service.taskCfg.Name).Dec()
 	})
 }
 
+// removeTopics frees rings of topics which are no longer consumed, e.g. deleted ones matching TopicPattern.
+func (service *Service) removeTopics(topics []string) {
+	removed := make(map[string]bool, len(topics))
+	for _, topic := range topics {
+		removed[topic] = true
+	}
+	service.Lock()
+	defer service.Unlock()
+	for tp, ring := range service.rings {
+		if removed[tp.Topic] {
+			ring.free()
+			delete(service.rings, tp)
+		}
+	}
+	log.Infof("%s: freed rings of topics %v which are no longer consumed", service.taskCfg.Name, topics)
+}
+
+// parse returns metrics of the message, which are multiple ones if the message is exploded or carries multiple metrics.
+func (service *Service) parse(p parser.Parser, value []byte) ([]model.Metric, error) {
+	if service.taskCfg.Explode != "" {
+		return parser.Explode(p, value, service.taskCfg.Explode)
+	}
+	return parser.ParseAll(p, value)
+}
+
+// parseWithRetry parses the message again while it fails with a parser.RetryableError, like the Schema Registry is unreachable.
+// It still returns such an error if the task has been stopped meanwhile.
+func (service *Service) parseWithRetry(p parser.Parser, msg *model.InputMessage) (metrics []model.Metric, err error) {
+	backoff := util.NewBackoff(time.Second, 30*time.Second)
+	for {
+		if metrics, err = service.parse(p, msg.Value); err == nil || !parser.IsRetryable(err) {
+			return
+		}
+		if service.limiter1.Allow() {
+			log.Errorf("%s: failed to parse message(topic %v, partition %d, offset %v), will retry, got error %+v",
+				service.taskCfg.Name, msg.Topic, msg.Partition, msg.Offset, err)
+		}
+		if !backoff.Wait(service.ctx) {
+			return
+		}
+	}
+}
+
+// writeDeadLetter retries until success. It returns false if the task has been stopped meanwhile.
+func (service *Service) writeDeadLetter(msg *model.InputMessage, parseErr error) bool {
+	records := []output.DeadLetterRecord{output.NewDeadLetterRecord(msg, parseErr)}
+	for {
+		err := service.clickhouse.DeadLetter.Write(records)
+		if err == nil {
+			statistics.DeadLetterMsgsTotal.WithLabelValues(service.taskCfg.Name).Inc()
+			return true
+		}
+		statistics.DeadLetterErrorTotal.WithLabelValues(service.taskCfg.Name).Inc()
+		log.Errorf("%s: failed to write message(topic %v, partition %d, offset %v) to the dead letter sink, got error %+v",
+			service.taskCfg.Name, msg.Topic, msg.Partition, msg.Offset, err)
+		select {
+		case <-service.ctx.Done():
+			return false
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
 func (service *Service) flush(batch *model.Batch) (err error) {
 	if (len(*batch.Rows)) == 0 {
 		return batch.Commit()
 	}
-	service.clickhouse.Send(batch, func(batch *model.Batch) error {
+	service.routes[batch.Route].clickhouse.Send(service.ctx, batch, func(batch *model.Batch) error {
 		return batch.Commit()
 	})
 	return nil
 }
 
+// pause stops consuming without committing, so that the failed batch will be consumed again after restart.
+// The owner of the task is notified via Paused, and is expected to stop the task and restart it later.
+func (service *Service) pause() {
+	service.pauseOnce.Do(func() {
+		log.Errorf("%s: paused", service.taskCfg.Name)
+		close(service.paused)
+		service.cancel()
+	})
+}
+
+// Paused returns a channel which is closed once the task pauses itself due to a batch failed to write.
+func (service *Service) Paused() <-chan struct{} {
+	return service.paused
+}
+
+// Exited returns a channel which is closed once the task has been stopped.
+func (service *Service) Exited() <-chan struct{} {
+	return service.exited
+}
+
+// Name returns the task name
+func (service *Service) Name() string {
+	return service.taskCfg.Name
+}
+
 // NotifyStop notify task to stop, This is non-blocking.
 func (service *Service) NotifyStop() {
 	log.Infof("%s: notified to stop", service.taskCfg.Name)
 	service.cancel()
 }
 
-// Stop stop kafka and clickhouse client. This is blocking.
+// Stop stop kafka and clickhouse client. This is blocking, and calls other than the first one are no-op.
 func (service *Service) Stop() {
+	service.stopOnce.Do(service.stop)
+}
+
+func (service *Service) stop() {
 	log.Infof("%s: stopping task service...", service.taskCfg.Name)
 	service.cancel()
 	if err := service.inputer.Stop(); err != nil {
@@ -243,22 +445,24 @@ func (service *Service) Stop() {
 	}
 	log.Infof("%s: stopped input", service.taskCfg.Name)
 
-	_ = service.clickhouse.Stop()
+	for i := len(service.routes) - 1; i >= 0; i-- {
+		// The task's table is the last to stop, since others share its dead letter sink.
+		_ = service.routes[i].clickhouse.Stop()
+	}
 	log.Infof("%s: stopped output", service.taskCfg.Name)
 
 	if service.sharder != nil {
 		service.sharder.tid.Stop()
 	}
 	for _, ring := range service.rings {
-		if ring != nil {
-			ring.tid.Stop()
-		}
+		ring.tid.Stop()
 	}
 	log.Infof("%s: stopped internal timers", service.taskCfg.Name)
 
 	if service.started {
 		<-service.stopped
 	}
+	close(service.exited)
 	log.Infof("%s: stopped", service.taskCfg.Name)
 }
 
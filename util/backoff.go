@@ -0,0 +1,69 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Backoff generates exponentially increasing retry intervals with jitter.
+// The n-th interval is a random value inside [d/2, d), where d = min(Initial * 2^n, Max).
+// Jitter avoids many tasks retrying against ClickHouse at the same moment.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+	attempt int
+}
+
+// NewBackoff creates a Backoff
+func NewBackoff(initial, max time.Duration) *Backoff {
+	return &Backoff{Initial: initial, Max: max}
+}
+
+// Next returns the interval to wait before the next retry.
+func (b *Backoff) Next() time.Duration {
+	d := b.Max
+	if b.attempt < 32 {
+		if exp := b.Initial << uint(b.attempt); exp > 0 && exp < b.Max {
+			d = exp
+		}
+	}
+	b.attempt++
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
+
+// Reset starts over from Initial.
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
+
+// Wait sleeps for the next interval. It returns false if ctx is done before that.
+func (b *Backoff) Wait(ctx context.Context) bool {
+	timer := time.NewTimer(b.Next())
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
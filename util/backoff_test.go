@@ -0,0 +1,49 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoff(t *testing.T) {
+	b := NewBackoff(time.Second, 10*time.Second)
+	expCeils := []time.Duration{1, 2, 4, 8, 10, 10, 10}
+	for _, ceil := range expCeils {
+		d := b.Next()
+		require.True(t, d >= ceil*time.Second/2 && d < ceil*time.Second, "interval %v is out of [%v, %v)", d, ceil*time.Second/2, ceil*time.Second)
+	}
+	// Shall not overflow after many attempts.
+	for i := 0; i < 100; i++ {
+		d := b.Next()
+		require.True(t, d >= 5*time.Second && d < 10*time.Second)
+	}
+	b.Reset()
+	require.True(t, b.Next() < time.Second)
+}
+
+func TestBackoffWait(t *testing.T) {
+	b := NewBackoff(10*time.Millisecond, 10*time.Millisecond)
+	require.True(t, b.Wait(context.Background()))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b = NewBackoff(time.Hour, time.Hour)
+	require.False(t, b.Wait(ctx))
+}
@@ -71,3 +71,29 @@ func ExtendFileContent(dir string, content []byte) (string, error) {
 	})
 	return ret, err
 }
+
+// ExtendedFiles returns the absolute path of filePath, and all files referenced by it via `@extend:` recursively.
+func ExtendedFiles(filePath string) (files []string, err error) {
+	var absPath string
+	if absPath, err = filepath.Abs(filePath); err != nil {
+		return
+	}
+	files = append(files, absPath)
+	var b []byte
+	if b, err = ioutil.ReadFile(absPath); err != nil {
+		return
+	}
+	reg := regexp.MustCompile(`"` + extendTag + `.*?"`)
+	for _, match := range reg.FindAllString(string(b), -1) {
+		p := match[len(extendTag)+1 : len(match)-1]
+		if !strings.HasPrefix(p, "/") {
+			p = filepath.Join(filepath.Dir(absPath), p)
+		}
+		var subFiles []string
+		if subFiles, err = ExtendedFiles(p); err != nil {
+			return
+		}
+		files = append(files, subFiles...)
+	}
+	return
+}
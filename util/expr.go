@@ -0,0 +1,488 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ExprFields is where an expression reads fields from. model.Metric implements it.
+// A nullable getter returns nil if the field is absent.
+type ExprFields interface {
+	GetString(key string, nullable bool) interface{}
+	GetInt(key string, nullable bool) interface{}
+	GetFloat(key string, nullable bool) interface{}
+	GetDateTime64(key string, nullable bool) interface{}
+}
+
+// Kinds of expression values.
+const (
+	kindAny = iota
+	kindString
+	kindInt
+	kindFloat
+	kindTime
+)
+
+var kindNames = []string{"any", "String", "Int64", "Float64", "DateTime"}
+
+// Expr computes a column value from message fields, like "concat(lower(host), ':', toString(port))".
+// A field is read as the type which the enclosing function argument(or the column) expects.
+// The result is NULL if any argument is NULL(an absent field), except for coalesce.
+type Expr struct {
+	text string
+	root *exprNode
+}
+
+// CompileExpr compiles the expression for a column of the given ClickHouse type.
+func CompileExpr(text string, colType string) (e *Expr, err error) {
+	var want int
+	if want, err = exprKindOf(colType); err != nil {
+		return
+	}
+	p := &exprParser{text: text}
+	if err = p.lex(); err != nil {
+		return
+	}
+	var ast *exprAST
+	if ast, err = p.parseExpr(); err != nil {
+		return
+	}
+	if tok := p.tokens[p.next]; tok.kind != exprTokEOF {
+		return nil, p.errorf(tok.pos, "unexpected %q", tok.text)
+	}
+	var root *exprNode
+	if root, err = p.compile(ast, want); err != nil {
+		return
+	}
+	return &Expr{text: text, root: root}, nil
+}
+
+// Eval returns a string, int64, float64 or time.Time according to the column type, or nil if the result is NULL.
+func (e *Expr) Eval(fields ExprFields) interface{} {
+	if v, ok := e.root.eval(fields); ok {
+		return v
+	}
+	return nil
+}
+
+func (e *Expr) String() string {
+	if e == nil {
+		return ""
+	}
+	return e.text
+}
+
+func exprKindOf(colType string) (int, error) {
+	typ := strings.TrimSuffix(strings.TrimPrefix(colType, "Nullable("), ")")
+	switch {
+	case typ == "String" || strings.HasPrefix(typ, "FixedString"):
+		return kindString, nil
+	case strings.HasPrefix(typ, "Int") || strings.HasPrefix(typ, "UInt"):
+		return kindInt, nil
+	case strings.HasPrefix(typ, "Float"):
+		return kindFloat, nil
+	case typ == "Date" || strings.HasPrefix(typ, "DateTime") || typ == "ElasticDateTime":
+		return kindTime, nil
+	default:
+		return kindAny, errors.Errorf("expressions are not supported for column type %s", colType)
+	}
+}
+
+type exprNode struct {
+	kind int
+	eval func(fields ExprFields) (v interface{}, ok bool)
+}
+
+// exprFunc is a builtin function. If variadic, the last argument kind repeats.
+// Kind kindAny of ret and args means the kind which the caller expects.
+type exprFunc struct {
+	args     []int
+	variadic bool
+	ret      int
+	call     func(args []interface{}) (interface{}, bool)
+}
+
+var exprFuncs map[string]*exprFunc
+
+func init() {
+	str := func(f func(s string) string) func(args []interface{}) (interface{}, bool) {
+		return func(args []interface{}) (interface{}, bool) { return f(args[0].(string)), true }
+	}
+	exprFuncs = map[string]*exprFunc{
+		"lower": {args: []int{kindString}, ret: kindString, call: str(strings.ToLower)},
+		"upper": {args: []int{kindString}, ret: kindString, call: str(strings.ToUpper)},
+		"trim":  {args: []int{kindString}, ret: kindString, call: str(strings.TrimSpace)},
+		"concat": {args: []int{kindString}, variadic: true, ret: kindString, call: func(args []interface{}) (interface{}, bool) {
+			var sb strings.Builder
+			for _, arg := range args {
+				sb.WriteString(arg.(string))
+			}
+			return sb.String(), true
+		}},
+		"substring": {args: []int{kindString, kindInt, kindInt}, ret: kindString, call: func(args []interface{}) (interface{}, bool) {
+			s, offset, length := args[0].(string), args[1].(int64), args[2].(int64)
+			if offset < 1 || offset > int64(len(s)) || length <= 0 {
+				return "", true
+			}
+			end := offset - 1 + length
+			if end > int64(len(s)) {
+				end = int64(len(s))
+			}
+			return s[offset-1 : end], true
+		}},
+		"replace": {args: []int{kindString, kindString, kindString}, ret: kindString, call: func(args []interface{}) (interface{}, bool) {
+			return strings.ReplaceAll(args[0].(string), args[1].(string), args[2].(string)), true
+		}},
+		"splitPart": {args: []int{kindString, kindString, kindInt}, ret: kindString, call: func(args []interface{}) (interface{}, bool) {
+			parts := strings.Split(args[0].(string), args[1].(string))
+			if idx := args[2].(int64); idx >= 1 && idx <= int64(len(parts)) {
+				return parts[idx-1], true
+			}
+			return "", true
+		}},
+		"domain": {args: []int{kindString}, ret: kindString, call: func(args []interface{}) (interface{}, bool) {
+			u, err := url.Parse(args[0].(string))
+			if err != nil {
+				return "", true
+			}
+			return u.Hostname(), true
+		}},
+		"path": {args: []int{kindString}, ret: kindString, call: func(args []interface{}) (interface{}, bool) {
+			u, err := url.Parse(args[0].(string))
+			if err != nil {
+				return "", true
+			}
+			return u.Path, true
+		}},
+		"extractURLParameter": {args: []int{kindString, kindString}, ret: kindString, call: func(args []interface{}) (interface{}, bool) {
+			u, err := url.Parse(args[0].(string))
+			if err != nil {
+				return "", true
+			}
+			return u.Query().Get(args[1].(string)), true
+		}},
+		"md5": {args: []int{kindString}, ret: kindString, call: func(args []interface{}) (interface{}, bool) {
+			sum := md5.Sum([]byte(args[0].(string)))
+			return hex.EncodeToString(sum[:]), true
+		}},
+		"sha1": {args: []int{kindString}, ret: kindString, call: func(args []interface{}) (interface{}, bool) {
+			sum := sha1.Sum([]byte(args[0].(string)))
+			return hex.EncodeToString(sum[:]), true
+		}},
+		"sha256": {args: []int{kindString}, ret: kindString, call: func(args []interface{}) (interface{}, bool) {
+			sum := sha256.Sum256([]byte(args[0].(string)))
+			return hex.EncodeToString(sum[:]), true
+		}},
+		"fnv64": {args: []int{kindString}, ret: kindInt, call: func(args []interface{}) (interface{}, bool) {
+			h := fnv.New64a()
+			_, _ = h.Write([]byte(args[0].(string)))
+			return int64(h.Sum64()), true
+		}},
+		"length": {args: []int{kindString}, ret: kindInt, call: func(args []interface{}) (interface{}, bool) {
+			return int64(len(args[0].(string))), true
+		}},
+		"toString": {args: []int{kindFloat}, ret: kindString, call: func(args []interface{}) (interface{}, bool) {
+			return strconv.FormatFloat(args[0].(float64), 'f', -1, 64), true
+		}},
+		"toInt": {args: []int{kindString}, ret: kindInt, call: func(args []interface{}) (interface{}, bool) {
+			v, err := strconv.ParseInt(strings.TrimSpace(args[0].(string)), 10, 64)
+			return v, err == nil
+		}},
+		"toFloat": {args: []int{kindString}, ret: kindFloat, call: func(args []interface{}) (interface{}, bool) {
+			v, err := strconv.ParseFloat(strings.TrimSpace(args[0].(string)), 64)
+			return v, err == nil
+		}},
+		"parseDateTime": {args: []int{kindString, kindString}, ret: kindTime, call: func(args []interface{}) (interface{}, bool) {
+			t, err := time.Parse(args[1].(string), args[0].(string))
+			return t, err == nil
+		}},
+		"toDate": {args: []int{kindTime}, ret: kindTime, call: func(args []interface{}) (interface{}, bool) {
+			t := args[0].(time.Time)
+			return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()), true
+		}},
+		"toStartOfHour": {args: []int{kindTime}, ret: kindTime, call: func(args []interface{}) (interface{}, bool) {
+			return args[0].(time.Time).Truncate(time.Hour), true
+		}},
+		"toUnixTimestamp": {args: []int{kindTime}, ret: kindInt, call: func(args []interface{}) (interface{}, bool) {
+			return args[0].(time.Time).Unix(), true
+		}},
+		"now": {ret: kindTime, call: func(args []interface{}) (interface{}, bool) {
+			return time.Now(), true
+		}},
+		// coalesce is evaluated lazily, see compileCall.
+		"coalesce": {args: []int{kindAny}, variadic: true, ret: kindAny},
+	}
+}
+
+const (
+	exprTokEOF = iota
+	exprTokIdent
+	exprTokString
+	exprTokNumber
+	exprTokPunct
+)
+
+type exprToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+// exprAST is a field, a literal or a function call.
+type exprAST struct {
+	tok  exprToken
+	call bool
+	args []*exprAST
+}
+
+type exprParser struct {
+	text   string
+	tokens []exprToken
+	next   int
+}
+
+func (p *exprParser) errorf(pos int, format string, args ...interface{}) error {
+	return errors.Errorf("invalid expression %q at offset %d: %s", p.text, pos, fmt.Sprintf(format, args...))
+}
+
+func (p *exprParser) lex() error {
+	s := p.text
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || s[j] == '.' || (s[j] >= 'a' && s[j] <= 'z') || (s[j] >= 'A' && s[j] <= 'Z') || (s[j] >= '0' && s[j] <= '9')) {
+				j++
+			}
+			p.tokens = append(p.tokens, exprToken{kind: exprTokIdent, text: s[i:j], pos: i})
+			i = j
+		case c == '`':
+			j := strings.IndexByte(s[i+1:], '`')
+			if j < 0 {
+				return p.errorf(i, "unterminated backquoted field")
+			}
+			p.tokens = append(p.tokens, exprToken{kind: exprTokIdent, text: s[i+1 : i+1+j], pos: i})
+			i += j + 2
+		case c == '\'' || c == '"':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(s) && s[j] != c; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				sb.WriteByte(s[j])
+			}
+			if j >= len(s) {
+				return p.errorf(i, "unterminated string")
+			}
+			p.tokens = append(p.tokens, exprToken{kind: exprTokString, text: sb.String(), pos: i})
+			i = j + 1
+		case (c >= '0' && c <= '9') || c == '-' || c == '.':
+			j := i + 1
+			for j < len(s) && ((s[j] >= '0' && s[j] <= '9') || s[j] == '.' || s[j] == 'e' || s[j] == 'E' ||
+				((s[j] == '-' || s[j] == '+') && (s[j-1] == 'e' || s[j-1] == 'E'))) {
+				j++
+			}
+			if _, err := strconv.ParseFloat(s[i:j], 64); err != nil {
+				return p.errorf(i, "invalid number %s", s[i:j])
+			}
+			p.tokens = append(p.tokens, exprToken{kind: exprTokNumber, text: s[i:j], pos: i})
+			i = j
+		case c == '(' || c == ')' || c == ',':
+			p.tokens = append(p.tokens, exprToken{kind: exprTokPunct, text: s[i : i+1], pos: i})
+			i++
+		default:
+			return p.errorf(i, "unexpected character %q", c)
+		}
+	}
+	p.tokens = append(p.tokens, exprToken{kind: exprTokEOF, text: "end of expression", pos: len(s)})
+	return nil
+}
+
+func (p *exprParser) consume() exprToken {
+	tok := p.tokens[p.next]
+	if tok.kind != exprTokEOF {
+		p.next++
+	}
+	return tok
+}
+
+func (p *exprParser) isPunct(punct string) bool {
+	tok := p.tokens[p.next]
+	return tok.kind == exprTokPunct && tok.text == punct
+}
+
+func (p *exprParser) parseExpr() (ast *exprAST, err error) {
+	tok := p.consume()
+	switch tok.kind {
+	case exprTokString, exprTokNumber:
+		return &exprAST{tok: tok}, nil
+	case exprTokIdent:
+	default:
+		return nil, p.errorf(tok.pos, "expect a field, literal or function but got %q", tok.text)
+	}
+	ast = &exprAST{tok: tok}
+	if !p.isPunct("(") {
+		return
+	}
+	p.consume()
+	ast.call = true
+	if p.isPunct(")") {
+		p.consume()
+		return
+	}
+	for {
+		var arg *exprAST
+		if arg, err = p.parseExpr(); err != nil {
+			return
+		}
+		ast.args = append(ast.args, arg)
+		if p.isPunct(",") {
+			p.consume()
+			continue
+		}
+		if tok := p.consume(); tok.kind != exprTokPunct || tok.text != ")" {
+			return nil, p.errorf(tok.pos, "expect \")\" but got %q", tok.text)
+		}
+		return
+	}
+}
+
+// compile builds the node of the AST, which value is of kind want unless want is kindAny.
+func (p *exprParser) compile(ast *exprAST, want int) (node *exprNode, err error) {
+	switch {
+	case ast.call:
+		node, err = p.compileCall(ast, want)
+	case ast.tok.kind == exprTokString:
+		v := ast.tok.text
+		node = &exprNode{kind: kindString, eval: func(ExprFields) (interface{}, bool) { return v, true }}
+	case ast.tok.kind == exprTokNumber:
+		if i, e := strconv.ParseInt(ast.tok.text, 10, 64); e == nil {
+			node = &exprNode{kind: kindInt, eval: func(ExprFields) (interface{}, bool) { return i, true }}
+		} else {
+			f, _ := strconv.ParseFloat(ast.tok.text, 64)
+			node = &exprNode{kind: kindFloat, eval: func(ExprFields) (interface{}, bool) { return f, true }}
+		}
+	default:
+		node = compileField(ast.tok.text, want)
+	}
+	if err != nil || want == kindAny || node.kind == want {
+		return
+	}
+	if node.kind == kindInt && want == kindFloat {
+		inner := node.eval
+		return &exprNode{kind: kindFloat, eval: func(fields ExprFields) (interface{}, bool) {
+			v, ok := inner(fields)
+			if !ok {
+				return nil, false
+			}
+			return float64(v.(int64)), true
+		}}, nil
+	}
+	return nil, p.errorf(ast.tok.pos, "expect %s but got %s", kindNames[want], kindNames[node.kind])
+}
+
+// compileField reads the field as kind want, String if want is kindAny.
+func compileField(name string, want int) *exprNode {
+	switch want {
+	case kindInt:
+		return &exprNode{kind: kindInt, eval: func(fields ExprFields) (interface{}, bool) {
+			v, ok := fields.GetInt(name, true).(int64)
+			return v, ok
+		}}
+	case kindFloat:
+		return &exprNode{kind: kindFloat, eval: func(fields ExprFields) (interface{}, bool) {
+			v, ok := fields.GetFloat(name, true).(float64)
+			return v, ok
+		}}
+	case kindTime:
+		return &exprNode{kind: kindTime, eval: func(fields ExprFields) (interface{}, bool) {
+			v, ok := fields.GetDateTime64(name, true).(time.Time)
+			return v, ok
+		}}
+	default:
+		return &exprNode{kind: kindString, eval: func(fields ExprFields) (interface{}, bool) {
+			v, ok := fields.GetString(name, true).(string)
+			return v, ok
+		}}
+	}
+}
+
+func (p *exprParser) compileCall(ast *exprAST, want int) (node *exprNode, err error) {
+	name := ast.tok.text
+	fn, ok := exprFuncs[name]
+	if !ok {
+		return nil, p.errorf(ast.tok.pos, "unknown function %s", name)
+	}
+	if len(ast.args) < len(fn.args) || (!fn.variadic && len(ast.args) > len(fn.args)) {
+		return nil, p.errorf(ast.tok.pos, "function %s expects %d arguments but got %d", name, len(fn.args), len(ast.args))
+	}
+	ret := fn.ret
+	if ret == kindAny {
+		if ret = want; ret == kindAny {
+			ret = kindString
+		}
+	}
+	args := make([]*exprNode, len(ast.args))
+	for i, argAST := range ast.args {
+		argKind := fn.args[len(fn.args)-1]
+		if i < len(fn.args) {
+			argKind = fn.args[i]
+		}
+		if argKind == kindAny {
+			argKind = ret
+		}
+		if args[i], err = p.compile(argAST, argKind); err != nil {
+			return
+		}
+	}
+	if name == "coalesce" {
+		return &exprNode{kind: ret, eval: func(fields ExprFields) (interface{}, bool) {
+			for _, arg := range args {
+				if v, ok := arg.eval(fields); ok {
+					return v, true
+				}
+			}
+			return nil, false
+		}}, nil
+	}
+	return &exprNode{kind: ret, eval: func(fields ExprFields) (interface{}, bool) {
+		vals := make([]interface{}, len(args))
+		for i, arg := range args {
+			v, ok := arg.eval(fields)
+			if !ok {
+				return nil, false
+			}
+			vals[i] = v
+		}
+		return fn.call(vals)
+	}}, nil
+}
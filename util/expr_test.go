@@ -0,0 +1,122 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type mapFields map[string]interface{}
+
+// absent returns what a getter returns for an absent field.
+func absent(nullable bool, zero interface{}) interface{} {
+	if nullable {
+		return nil
+	}
+	return zero
+}
+
+func (m mapFields) GetString(key string, nullable bool) interface{} {
+	if v, ok := m[key].(string); ok || !nullable {
+		return v
+	}
+	return nil
+}
+
+func (m mapFields) GetInt(key string, nullable bool) interface{} {
+	if v, ok := m[key].(float64); ok {
+		return int64(v)
+	}
+	return absent(nullable, int64(0))
+}
+
+func (m mapFields) GetFloat(key string, nullable bool) interface{} {
+	if v, ok := m[key].(float64); ok {
+		return v
+	}
+	return absent(nullable, float64(0))
+}
+
+func (m mapFields) GetDateTime64(key string, nullable bool) interface{} {
+	if v, ok := m[key].(float64); ok {
+		return time.Unix(int64(v), 0).UTC()
+	}
+	return absent(nullable, time.Time{})
+}
+
+func TestExpr(t *testing.T) {
+	fields := mapFields{
+		"host": "Web-01 ",
+		"port": float64(8080),
+		"ts":   float64(1600000000),
+		"url":  "https://example.com/api/v1?user=42&x=y",
+		"id":   "a,b,c",
+	}
+	cases := []struct {
+		expr     string
+		colType  string
+		expected interface{}
+	}{
+		{`lower(trim(host))`, "String", "web-01"},
+		{`concat(upper(host), ':', toString(port))`, "String", "WEB-01 :8080"},
+		{`coalesce(absent, host)`, "Nullable(String)", "Web-01 "},
+		{`coalesce(absent, 'none')`, "String", "none"},
+		{`concat(absent, host)`, "Nullable(String)", nil},
+		{`domain(url)`, "String", "example.com"},
+		{`path(url)`, "String", "/api/v1"},
+		{`extractURLParameter(url, 'user')`, "String", "42"},
+		{`toInt(extractURLParameter(url, 'user'))`, "UInt64", int64(42)},
+		{`splitPart(id, ',', 2)`, "String", "b"},
+		{`substring(host, 1, 3)`, "FixedString(3)", "Web"},
+		{`replace(id, ',', ';')`, "String", "a;b;c"},
+		{`md5('abc')`, "String", "900150983cd24fb0d6963f7d28e17f72"},
+		{`length(host)`, "Int32", int64(7)},
+		{`port`, "Float64", float64(8080)},
+		{`coalesce(absent, 1)`, "Float32", float64(1)},
+		{`toDate(ts)`, "Date", time.Date(2020, 9, 13, 0, 0, 0, 0, time.UTC)},
+		{`toStartOfHour(ts)`, "DateTime", time.Date(2020, 9, 13, 12, 0, 0, 0, time.UTC)},
+		{`toUnixTimestamp(parseDateTime('2020-09-13 12:26:40', '2006-01-02 15:04:05'))`, "Int64", int64(1600000000)},
+	}
+	for _, c := range cases {
+		e, err := CompileExpr(c.expr, c.colType)
+		require.Nil(t, err, c.expr)
+		require.Equal(t, c.expected, e.Eval(fields), c.expr)
+		require.Equal(t, c.expr, e.String())
+	}
+
+	h1, _ := CompileExpr(`fnv64(host)`, "UInt64")
+	h2, _ := CompileExpr(`fnv64(concat(host))`, "UInt64")
+	require.Equal(t, h1.Eval(fields), h2.Eval(fields))
+
+	for _, c := range []struct{ expr, colType string }{
+		{`lower(host)`, "Int64"},
+		{`toString(port)`, "DateTime"},
+		{`lower(host)`, "Array(String)"},
+		{`unknown(host)`, "String"},
+		{`lower(host, port)`, "String"},
+		{`substring(host, '1', 2)`, "String"},
+		{`concat(host, 1)`, "String"},
+		{`lower(host`, "String"},
+		{`lower(host) x`, "String"},
+		{`'abc`, "String"},
+	} {
+		_, err := CompileExpr(c.expr, c.colType)
+		require.NotNil(t, err, c.expr)
+	}
+}
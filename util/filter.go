@@ -0,0 +1,375 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// FilterFields is implemented by model.Metric
+type FilterFields interface {
+	Get(key string) interface{}
+	GetString(key string, nullable bool) interface{}
+	GetFloat(key string, nullable bool) interface{}
+}
+
+// Filter decides which messages are kept, according to an expression like
+// "level != 'debug' && (status >= 500 || path =~ '^/api/') && !exists(healthcheck) && host in ('a', 'b')".
+// A comparison is numeric if the literal is a number, and a string one otherwise.
+type Filter struct {
+	expr  string
+	match func(fields FilterFields) bool
+}
+
+// NewFilter compiles the filter expression.
+func NewFilter(expr string) (f *Filter, err error) {
+	p := &filterParser{expr: expr}
+	if err = p.lex(); err != nil {
+		return
+	}
+	var match func(fields FilterFields) bool
+	if match, err = p.parseOr(); err != nil {
+		return
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, p.errorf(tok, "unexpected %q", tok.text)
+	}
+	return &Filter{expr: expr, match: match}, nil
+}
+
+// Match tells whether the metric shall be kept.
+func (f *Filter) Match(fields FilterFields) bool {
+	return f.match(fields)
+}
+
+func (f *Filter) String() string {
+	return f.expr
+}
+
+const (
+	tokEOF = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+)
+
+type filterToken struct {
+	kind int
+	text string
+	num  float64
+	pos  int
+}
+
+type filterParser struct {
+	expr   string
+	tokens []filterToken
+	next   int
+}
+
+func (p *filterParser) errorf(tok filterToken, format string, args ...interface{}) error {
+	return errors.Errorf("invalid filter %q at offset %d: %s", p.expr, tok.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *filterParser) lex() error {
+	s := p.expr
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isIdentStart(c):
+			j := i + 1
+			for j < len(s) && (isIdentStart(s[j]) || isDigit(s[j]) || s[j] == '.') {
+				j++
+			}
+			p.tokens = append(p.tokens, filterToken{kind: tokIdent, text: s[i:j], pos: i})
+			i = j
+		case c == '`':
+			j := strings.IndexByte(s[i+1:], '`')
+			if j < 0 {
+				return p.errorf(filterToken{pos: i}, "unterminated backquoted field")
+			}
+			p.tokens = append(p.tokens, filterToken{kind: tokIdent, text: s[i+1 : i+1+j], pos: i})
+			i += j + 2
+		case c == '\'' || c == '"':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(s) && s[j] != c; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				sb.WriteByte(s[j])
+			}
+			if j >= len(s) {
+				return p.errorf(filterToken{pos: i}, "unterminated string")
+			}
+			p.tokens = append(p.tokens, filterToken{kind: tokString, text: sb.String(), pos: i})
+			i = j + 1
+		case isDigit(c) || ((c == '-' || c == '.') && i+1 < len(s) && (isDigit(s[i+1]) || s[i+1] == '.')):
+			j := i + 1
+			for j < len(s) && (isDigit(s[j]) || s[j] == '.' || s[j] == 'e' || s[j] == 'E' ||
+				((s[j] == '-' || s[j] == '+') && (s[j-1] == 'e' || s[j-1] == 'E'))) {
+				j++
+			}
+			num, err := strconv.ParseFloat(s[i:j], 64)
+			if err != nil {
+				return p.errorf(filterToken{pos: i}, "invalid number %s", s[i:j])
+			}
+			p.tokens = append(p.tokens, filterToken{kind: tokNumber, text: s[i:j], num: num, pos: i})
+			i = j
+		default:
+			op := ""
+			for _, candidate := range []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "!~", "<", ">", "!", "(", ")", ","} {
+				if strings.HasPrefix(s[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return p.errorf(filterToken{pos: i}, "unexpected character %q", c)
+			}
+			p.tokens = append(p.tokens, filterToken{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	p.tokens = append(p.tokens, filterToken{kind: tokEOF, text: "end of expression", pos: len(s)})
+	return nil
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.next]
+}
+
+func (p *filterParser) consume() filterToken {
+	tok := p.tokens[p.next]
+	if tok.kind != tokEOF {
+		p.next++
+	}
+	return tok
+}
+
+func (p *filterParser) expectOp(op string) error {
+	if tok := p.consume(); tok.kind != tokOp || tok.text != op {
+		return p.errorf(tok, "expect %q but got %q", op, tok.text)
+	}
+	return nil
+}
+
+func (p *filterParser) isOp(op string) bool {
+	tok := p.peek()
+	return tok.kind == tokOp && tok.text == op
+}
+
+func (p *filterParser) parseOr() (match func(FilterFields) bool, err error) {
+	if match, err = p.parseAnd(); err != nil {
+		return
+	}
+	for p.isOp("||") {
+		p.consume()
+		var right func(FilterFields) bool
+		if right, err = p.parseAnd(); err != nil {
+			return
+		}
+		left := match
+		match = func(m FilterFields) bool { return left(m) || right(m) }
+	}
+	return
+}
+
+func (p *filterParser) parseAnd() (match func(FilterFields) bool, err error) {
+	if match, err = p.parseUnary(); err != nil {
+		return
+	}
+	for p.isOp("&&") {
+		p.consume()
+		var right func(FilterFields) bool
+		if right, err = p.parseUnary(); err != nil {
+			return
+		}
+		left := match
+		match = func(m FilterFields) bool { return left(m) && right(m) }
+	}
+	return
+}
+
+func (p *filterParser) parseUnary() (match func(FilterFields) bool, err error) {
+	if p.isOp("!") {
+		p.consume()
+		var inner func(FilterFields) bool
+		if inner, err = p.parseUnary(); err != nil {
+			return
+		}
+		return func(m FilterFields) bool { return !inner(m) }, nil
+	}
+	if p.isOp("(") {
+		p.consume()
+		if match, err = p.parseOr(); err != nil {
+			return
+		}
+		err = p.expectOp(")")
+		return
+	}
+	tok := p.consume()
+	if tok.kind != tokIdent {
+		return nil, p.errorf(tok, "expect a field but got %q", tok.text)
+	}
+	if tok.text == "exists" && p.isOp("(") {
+		p.consume()
+		field := p.consume()
+		if field.kind != tokIdent {
+			return nil, p.errorf(field, "expect a field but got %q", field.text)
+		}
+		if err = p.expectOp(")"); err != nil {
+			return
+		}
+		// A field whose value is null doesn't exist either.
+		return func(m FilterFields) bool { return m.Get(field.text) != nil }, nil
+	}
+	return p.parseComparison(tok.text)
+}
+
+func (p *filterParser) parseComparison(field string) (match func(FilterFields) bool, err error) {
+	opTok := p.consume()
+	if opTok.kind == tokIdent && opTok.text == "in" {
+		return p.parseIn(field)
+	}
+	if opTok.kind != tokOp {
+		return nil, p.errorf(opTok, "expect an operator but got %q", opTok.text)
+	}
+	lit := p.consume()
+	if lit.kind != tokString && lit.kind != tokNumber {
+		return nil, p.errorf(lit, "expect a literal but got %q", lit.text)
+	}
+	switch opTok.text {
+	case "=~", "!~":
+		if lit.kind != tokString {
+			return nil, p.errorf(lit, "expect a regular expression string but got %q", lit.text)
+		}
+		var re *regexp.Regexp
+		if re, err = regexp.Compile(lit.text); err != nil {
+			return nil, p.errorf(lit, "%s", err.Error())
+		}
+		want := opTok.text == "=~"
+		return func(m FilterFields) bool { return re.MatchString(getFilterString(m, field)) == want }, nil
+	case "==", "!=", "<", "<=", ">", ">=":
+	default:
+		return nil, p.errorf(opTok, "expect an operator but got %q", opTok.text)
+	}
+	op := opTok.text
+	if lit.kind == tokNumber {
+		num := lit.num
+		return func(m FilterFields) bool { return compareFloat(getFilterFloat(m, field), num, op) }, nil
+	}
+	str := lit.text
+	return func(m FilterFields) bool { return compareString(getFilterString(m, field), str, op) }, nil
+}
+
+func (p *filterParser) parseIn(field string) (match func(FilterFields) bool, err error) {
+	if err = p.expectOp("("); err != nil {
+		return
+	}
+	strs := make(map[string]bool)
+	nums := make(map[float64]bool)
+	for {
+		lit := p.consume()
+		switch lit.kind {
+		case tokString:
+			strs[lit.text] = true
+		case tokNumber:
+			nums[lit.num] = true
+		default:
+			return nil, p.errorf(lit, "expect a literal but got %q", lit.text)
+		}
+		if p.isOp(",") {
+			p.consume()
+			continue
+		}
+		if err = p.expectOp(")"); err != nil {
+			return
+		}
+		break
+	}
+	return func(m FilterFields) bool {
+		if len(strs) != 0 && strs[getFilterString(m, field)] {
+			return true
+		}
+		return len(nums) != 0 && nums[getFilterFloat(m, field)]
+	}, nil
+}
+
+func getFilterString(m FilterFields, field string) string {
+	s, _ := m.GetString(field, false).(string)
+	return s
+}
+
+func getFilterFloat(m FilterFields, field string) float64 {
+	switch v := m.GetFloat(field, false).(type) {
+	case float64:
+		return v
+	case float32:
+		return float64(v)
+	default:
+		return 0
+	}
+}
+
+func compareFloat(a, b float64, op string) bool {
+	switch op {
+	case "==":
+		return a == b
+	case "!=":
+		return a != b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	default:
+		return a >= b
+	}
+}
+
+func compareString(a, b string, op string) bool {
+	switch op {
+	case "==":
+		return a == b
+	case "!=":
+		return a != b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	default:
+		return a >= b
+	}
+}
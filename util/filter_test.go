@@ -0,0 +1,57 @@
+/*Copyright [2019] housepower
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func (m mapFields) Get(key string) interface{} {
+	return m[key]
+}
+
+func TestFilter(t *testing.T) {
+	fields := mapFields{"level": "error", "status": float64(503), "path": "/api/v1", "host": "b", "latency": 0.5}
+	cases := []struct {
+		expr  string
+		match bool
+	}{
+		{`level == 'error'`, true},
+		{`level != "error"`, false},
+		{`status >= 500 && status < 600`, true},
+		{`latency > 1 || path =~ '^/api/'`, true},
+		{`path !~ '^/api/'`, false},
+		{`host in ('a', 'b')`, true},
+		{`status in (500, 502)`, false},
+		{`exists(status) && !exists(healthcheck)`, true},
+		// A field is present regardless of its type.
+		{`exists(level) && exists(latency)`, true},
+		{`!(level == 'error' && (status == 503 || host == 'a'))`, false},
+		{`absent == '' && absent == 0`, true},
+	}
+	for _, c := range cases {
+		f, err := NewFilter(c.expr)
+		require.Nil(t, err, c.expr)
+		require.Equal(t, c.match, f.Match(fields), c.expr)
+	}
+
+	for _, expr := range []string{``, `level ==`, `level = 'a'`, `(level == 'a'`, `path =~ 1`, `path =~ '('`, `host in ()`, `level == 'a' status == 1`, `level == 'a`} {
+		_, err := NewFilter(expr)
+		require.NotNil(t, err, expr)
+	}
+}